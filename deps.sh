@@ -48,6 +48,7 @@ git -C ${VGOPATH}/src/github.com/golang/protobuf checkout -b swy1.1.0 v1.1.0
 go install k8s.io/client-go/...
 go get github.com/prometheus/client_golang/prometheus
 go get github.com/go-sql-driver/mysql
+go get github.com/lib/pq
 go get github.com/gorilla/mux
 go get github.com/gorilla/websocket
 go get gopkg.in/yaml.v2
@@ -59,4 +60,5 @@ go get -d gopkg.in/robfig/cron.v2;
 patch -d${VGOPATH}/src/gopkg.in/robfig/cron.v2 -p1 < $(pwd)/contrib/robfig-cron.patch;
 go install gopkg.in/robfig/cron.v2
 go get code.cloudfoundry.org/bytefmt
+go get golang.org/x/crypto/acme
 go get github.com/ceph/go-ceph/rados # this gent is broken in deb, so last
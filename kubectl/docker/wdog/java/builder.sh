@@ -0,0 +1,19 @@
+#!/bin/bash
+set -e
+
+RUNNER="/java/runner/runner.java"
+SOURCES="/java/functions/${SWD_SOURCES}"
+SCRIPT="${SOURCES}/script${SWD_SUFFIX}.java"
+CLASSES="${SOURCES}/classes${SWD_SUFFIX}"
+CP="/java/runner/gson.jar"
+
+# Packages are per-tenant lib/$group/$artifact/$version dirs with jars
+if [ -n "$SWD_PACKAGES" ] && [ -d "${SWD_PACKAGES}/lib" ]; then
+	for j in $(find "${SWD_PACKAGES}/lib" -name '*.jar'); do
+		CP="${CP}:${j}"
+	done
+fi
+
+rm -rf $CLASSES
+mkdir -p $CLASSES
+javac -nowarn -encoding UTF-8 -cp "$CP" -d $CLASSES $RUNNER $SCRIPT
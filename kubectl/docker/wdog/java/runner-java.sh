@@ -0,0 +1,10 @@
+#!/bin/sh
+export RUNNERAPI="1"
+CP="/function/classes${1}:/java/runner/gson.jar"
+if [ -d "/packages/lib" ]; then
+	for j in $(find /packages/lib -name '*.jar'); do
+		CP="${CP}:${j}"
+	done
+fi
+exec "/usr/bin/java" --add-opens java.base/java.io=ALL-UNNAMED \
+	-XX:+UseSerialGC -XX:TieredStopAtLevel=1 -cp "$CP" FR
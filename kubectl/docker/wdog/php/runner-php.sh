@@ -0,0 +1,3 @@
+#!/bin/sh
+export RUNNERAPI="1"
+exec /usr/local/bin/php /home/swifty/runner.php "script"$1
@@ -0,0 +1,35 @@
+#!/bin/bash
+
+set -e
+
+SOURCES="/rust/swycode/${SWD_SOURCES}/script${SWD_SUFFIX}.rs"
+RNRDIR="/rust/runner"
+SCRIPT="${RNRDIR}/src/script.rs"
+
+cd $RNRDIR
+
+rm -f $SCRIPT Cargo.lock
+rm -rf .cargo
+cp Cargo.toml.in Cargo.toml
+ln -s $SOURCES $SCRIPT
+
+#
+# Tenant's crates are listed in deps and vendored by wdog,
+# without them the ones fetched into the image are used
+#
+if [ -n "$SWD_PACKAGES" ] && [ -f "${SWD_PACKAGES}/deps" ]; then
+	cat "${SWD_PACKAGES}/deps" >> Cargo.toml
+	mkdir .cargo
+	cat > .cargo/config <<EOC
+[source.crates-io]
+replace-with = "tenant"
+
+[source.tenant]
+directory = "${SWD_PACKAGES}/vendor"
+EOC
+fi
+
+cargo build --release --offline
+cp target/release/runner "../swycode/${SWD_SOURCES}/runner${SWD_SUFFIX}"
+
+rm -f $SCRIPT
@@ -0,0 +1,3 @@
+#!/bin/sh
+export RUNNERAPI="1"
+exec "/rust/swycode/runner"$1
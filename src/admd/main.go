@@ -920,6 +920,9 @@ func patchMwareLimits(into map[string]*swyapi.MwareLimits, from map[string]*swya
 			if lf.Number != 0 {
 				lt.Number = lf.Number
 			}
+			if lf.SizeMB != 0 {
+				lt.SizeMB = lf.SizeMB
+			}
 		}
 	}
 }
@@ -28,6 +28,8 @@ type WdogFunctionRunResult struct {
 	Stdout		string		`json:"stdout"`
 	Stderr		string		`json:"stderr"`
 	Time		uint		`json:"time"` /* usec */
+	CPU		uint		`json:"cpu,omitempty"` /* usec */
+	MaxRSS		uint		`json:"maxrss,omitempty"` /* KB */
 	Then		json.RawMessage	`json:"then,omitempty"`
 }
 
@@ -48,6 +50,28 @@ type PgRequest struct {
         User    string  `json:"user"`
         Pass    string  `json:"pass,omitempty"`
         DbName  string  `json:"dbname"`
+        Owner   string  `json:"owner,omitempty"`
+        Size    uint64  `json:"size,omitempty"`
+}
+
+/* NOLOGIN role owning the objects in the DB, see pgrest */
+func PgOwnerRole(db string) string {
+	return db + "_own"
+}
+
+type MquotaRequest struct {
+	Token		string		`json:"token"`
+	DbName		string		`json:"dbname"`
+}
+
+type MquotaStatus struct {
+	Type		string		`json:"type,omitempty"`
+	DbName		string		`json:"dbname"`
+	Rows		uint64		`json:"rows"`
+	RowsL		uint64		`json:"rows_limit"`
+	Size		uint64		`json:"size"`
+	SizeL		uint64		`json:"size_limit"`
+	Locked		bool		`json:"locked"`
 }
 
 type FunctionLimits struct {
@@ -68,6 +92,7 @@ type ReposLimits struct {
 
 type MwareLimits struct {
 	Number		uint32	`json:"number" yaml:"number"`
+	SizeMB		uint64	`json:"size_mb,omitempty" yaml:"size_mb,omitempty"`
 }
 
 type S3Limits struct {
@@ -20,6 +20,7 @@ const (
 	GateFsError	uint = 7	// Error accessing file(s)
 	GateNotAvail	uint = 8	// Operation not available on selected object
 	GateLimitHit	uint = 9	// Resource limitation
+	GateConflict	uint = 10	// Object was changed by someone else
 )
 
 type ProjectList struct {
@@ -35,6 +36,8 @@ type FunctionStats struct {
 	Errors		uint64			`json:"errors"`
 	LastCall	string			`json:"lastcall,omitempty"`
 	Time		uint64			`json:"time"`
+	CPUTime		uint64			`json:"cputime"`
+	MaxRSS		uint64			`json:"maxrss,omitempty"`
 	GBS		float64			`json:"gbs"`
 	BytesOut	uint64			`json:"bytesout"`
 	Till		string			`json:"till,omitempty"`
@@ -119,6 +122,7 @@ type FunctionSize struct {
 	Timeout		uint			`json:"timeout"` /* msec */
 	Rate		uint			`json:"rate,omitempty"`
 	Burst		uint			`json:"burst,omitempty"`
+	Concurrency	uint			`json:"concurrency,omitempty"` /* calls one pod runs at once */
 }
 
 type FunctionWait struct {
@@ -140,6 +144,7 @@ type FunctionEventS3 struct {
 type FunctionEventWebsock struct {
 	MwName		string			`json:"name"`
 	MType		*int			`json:"mtype,omitempty"`
+	Events		[]string		`json:"events,omitempty"` /* message (default), connect, disconnect */
 }
 
 type FunctionEvent struct {
@@ -149,15 +154,118 @@ type FunctionEvent struct {
 	Cron		*FunctionEventCron	`json:"cron,omitempty"`
 	S3		*FunctionEventS3	`json:"s3,omitempty"`
 	URL		string			`json:"url,omitempty"`
+	CORS		*CORSPolicy		`json:"cors,omitempty" yaml:"cors,omitempty"` /* url only */
+	Schema		*RequestSchema		`json:"schema,omitempty" yaml:"schema,omitempty"` /* url only */
 	WS		*FunctionEventWebsock	`json:"websocket,omitempty" yaml:"websocket,omitempty"`
 }
 
+/*
+ * Origins are either exact (https://app.example.com), with wildcard
+ * subdomain (https://*.example.com) or just "*". Empty methods and
+ * headers lists mean the gate's defaults, "*" in headers allows any.
+ */
+type CORSPolicy struct {
+	Origins		[]string		`json:"origins"`
+	Methods		[]string		`json:"methods,omitempty"`
+	Headers		[]string		`json:"headers,omitempty"`
+	Expose		[]string		`json:"expose,omitempty"`
+	Credentials	bool			`json:"credentials,omitempty"`
+	MaxAge		uint32			`json:"max_age,omitempty"` /* seconds */
+}
+
 type MwareAdd struct {
 	Name		string			`json:"name"`
 	Project		string			`json:"project,omitempty"`
 	Type		string			`json:"type"`
 	UserData	string			`json:"userdata,omitempty"`
 	AuthCtx		string			`json:"authctx,omitempty"`
+	External	*MwareExternal		`json:"external,omitempty"`
+	JWT		*MwareJWT		`json:"jwt,omitempty"` /* authjwt only */
+}
+
+/*
+ * How authjwt verifies tokens. By default they are HS256 signed with
+ * the platform-generated key, for tokens from external identity
+ * providers the public key or JWKS is given instead.
+ */
+type MwareJWT struct {
+	Alg		string			`json:"alg,omitempty"` /* HS256 (default), RS256, ES256 */
+	PubKey		string			`json:"pubkey,omitempty"` /* PEM */
+	JWKS		string			`json:"jwks,omitempty"` /* document */
+	JWKSURL		string			`json:"jwks_url,omitempty"`
+	Iss		string			`json:"iss,omitempty"`
+	Aud		string			`json:"aud,omitempty"`
+	Claims		[]string		`json:"claims,omitempty"` /* must be present */
+}
+
+/* Bring-your-own mware, the platform only keeps the creds */
+type MwareExternal struct {
+	Addr		string			`json:"addr"`
+	User		string			`json:"user,omitempty"`
+	Pass		string			`json:"pass,omitempty"`
+	DbName		string			`json:"dbname,omitempty"` /* or vhost for rabbit */
+}
+
+type MwareGrant struct {
+	Project		string			`json:"project"`
+	ReadOnly	bool			`json:"readonly,omitempty"`
+}
+
+type MwareRotate struct {
+	Grace		uint32			`json:"grace,omitempty"` /* seconds */
+}
+
+type MwareBackupAdd struct {
+	Note		string			`json:"note,omitempty"`
+}
+
+type MwareBackupInfo struct {
+	Id		string			`json:"id"`
+	Created		string			`json:"created"`
+	State		string			`json:"state"`
+	Note		string			`json:"note,omitempty"`
+	Size		uint64			`json:"size,omitempty"`
+	Auto		bool			`json:"auto,omitempty"`
+	Object		string			`json:"object,omitempty"` /* in the S3 bucket */
+	Bucket		string			`json:"bucket,omitempty"`
+	Restore		*MwareRestoreInfo	`json:"restore,omitempty"`
+}
+
+type MwareRestoreInfo struct {
+	Target		string			`json:"target"`
+	State		string			`json:"state"`
+	Started		string			`json:"started"`
+}
+
+type MwareRestore struct {
+	Name		string			`json:"name,omitempty"` /* empty means the same mware */
+	Project		string			`json:"project,omitempty"`
+}
+
+type AuthKeyAdd struct {
+	Name		string			`json:"name"`
+	Lifetime	uint32			`json:"lifetime,omitempty"` /* seconds, 0 means forever */
+	Scopes		[]string		`json:"scopes,omitempty"`
+	Rate		uint			`json:"rate,omitempty"` /* requests per second */
+	Burst		uint			`json:"burst,omitempty"`
+	Meta		map[string]string	`json:"meta,omitempty"`
+}
+
+type AuthKeyInfo struct {
+	Id		string			`json:"id"`
+	Name		string			`json:"name"`
+	Key		string			`json:"key,omitempty"` /* only reported once, on creation */
+	Created		string			`json:"created"`
+	Expires		string			`json:"expires,omitempty"`
+	Scopes		[]string		`json:"scopes,omitempty"`
+	Rate		uint			`json:"rate,omitempty"`
+	Burst		uint			`json:"burst,omitempty"`
+	Meta		map[string]string	`json:"meta,omitempty"`
+}
+
+type MwareBackupSched struct {
+	Tab		string			`json:"tab"` /* crontab, empty means off */
+	Keep		uint32			`json:"keep,omitempty"` /* 0 means keep all */
 }
 
 type MwareTypeInfo struct {
@@ -173,6 +281,9 @@ type MwareInfo struct {
 	UserData	string			`json:"userdata,omitempty"`
 	DU		*uint64			`json:"disk_usage,omitempty"` /* in ... KB */
 	URL		*string			`json:"url,omitempty"`
+	External	string			`json:"external,omitempty"` /* address */
+	Locked		string			`json:"locked,omitempty"` /* reason */
+	JWT		*MwareJWT		`json:"jwt,omitempty"`
 }
 
 func (i *MwareInfo)SetDU(bytes uint64) {
@@ -222,6 +333,7 @@ type LogEntry struct {
 	Event		string			`json:"event"`
 	Ts		string			`json:"ts"`
 	Text		string			`json:"text"`
+	Cursor		string			`json:"cursor,omitempty"`
 }
 
 type DeployInclude struct {
@@ -327,12 +439,98 @@ type RouterEntry struct {
 	Call		string		`json:"call"`
 	AuthCtx		string		`json:"authctx,omitempty"`
 	Key		string		`json:"key,omitempty"`
+	Cache		*RouterCache	`json:"cache,omitempty"`
+	Transform	*RouterTransform `json:"transform,omitempty"`
+	Limit		*RouterLimit	`json:"limit,omitempty"`
+	Schema		*RequestSchema	`json:"schema,omitempty"`
+}
+
+/*
+ * Rate requests per period seconds (1 by default), so large period
+ * works as a quota. The key is "" for one bucket for all callers,
+ * "ip" for bucket per client address, "claim:name" for bucket per
+ * authctx claim value and "apikey" for bucket per authkey key.
+ */
+type RouterLimit struct {
+	Rate		uint		`json:"rate"`
+	Burst		uint		`json:"burst,omitempty"`
+	Period		uint		`json:"period,omitempty"`
+	Key		string		`json:"key,omitempty"`
+}
+
+type RouterLimitInfo struct {
+	Method		string		`json:"method"`
+	Path		string		`json:"path"`
+	Passed		uint64		`json:"passed"`
+	Limited		uint64		`json:"limited"`
+	Keys		int		`json:"keys"`
+}
+
+/*
+ * Values in templates and args' sources are {header:name}, {query:name},
+ * {param:name} (path template value), {claim:name} (from entry's authctx)
+ * and {path}. Request headers are altered before the authctx check, so
+ * tokens can be moved around, args override the query ones.
+ */
+type RouterTransform struct {
+	Rewrite		string			`json:"rewrite,omitempty"`
+	SetHeaders	map[string]string	`json:"set_headers,omitempty"`
+	DelHeaders	[]string		`json:"del_headers,omitempty"`
+	Args		map[string]string	`json:"args,omitempty"`
+	RespHeaders	map[string]string	`json:"resp_headers,omitempty"`
+	Status		map[string]int		`json:"status,omitempty"` // "404": 200
+}
+
+/*
+ * Only GET-s with 2xx results are cached. The query and headers
+ * lists are the ones the cached response varies by, the rest of
+ * them are ignored when looking up the cache.
+ */
+type RouterCache struct {
+	TTL		uint32		`json:"ttl"` /* seconds */
+	Query		[]string	`json:"query,omitempty"`
+	Headers		[]string	`json:"headers,omitempty"`
+}
+
+type RouterCacheFlush struct {
+	Paths		[]string	`json:"paths,omitempty"`
 }
 
 type RouterAdd struct {
 	Name		string		`json:"name"`
 	Project		string		`json:"project"`
 	Table		[]*RouterEntry	`json:"table"`
+	CORS		*CORSPolicy	`json:"cors,omitempty"`
+	OpenAPI		*OpenAPI	`json:"openapi,omitempty"`	// instead of the table
+}
+
+/*
+ * Entries are identified by method and path. The rev is the revision
+ * the edit is based on, if the table has changed since then, the edit
+ * fails with GateConflict. No rev means apply to whatever is there.
+ */
+type RouterEntryId struct {
+	Method		string		`json:"method"`
+	Path		string		`json:"path"`
+}
+
+type RouterTableEdit struct {
+	Rev		*int		`json:"rev,omitempty"`
+	Add		[]*RouterEntry	`json:"add,omitempty"`
+	Update		[]*RouterEntry	`json:"update,omitempty"`
+	Delete		[]*RouterEntryId `json:"delete,omitempty"`
+}
+
+type RouterRollback struct {
+	To		int		`json:"to"`
+	Rev		*int		`json:"rev,omitempty"`
+}
+
+type RouterTableRev struct {
+	Rev		int		`json:"rev"`
+	Op		string		`json:"op,omitempty"`
+	Created		string		`json:"created,omitempty"`
+	TLen		int		`json:"table_len"`
 }
 
 type RouterInfo struct {
@@ -341,7 +539,54 @@ type RouterInfo struct {
 	Project		string		`json:"project"`
 	Labels		[]string	`json:"labels,omitempty"`
 	TLen		int		`json:"table_len"`
+	TRev		int		`json:"table_rev"`
 	URL		string		`json:"url"`
+	CORS		*CORSPolicy	`json:"cors,omitempty"`
+	Limits		[]*RouterLimitInfo `json:"limits,omitempty"`
+}
+
+/*
+ * Custom domain. Maps are only served after the ownership is verified,
+ * verification is either the TXT record with the token on the _swifty-
+ * challenge.<name> or the token served by the gate itself on the
+ * /.well-known/swifty-challenge/<token> URL (i.e. name points to us).
+ */
+type DomainMap struct {
+	Prefix		string		`json:"prefix"`
+	Router		string		`json:"router,omitempty"`
+	Function	string		`json:"function,omitempty"`
+}
+
+type DomainAdd struct {
+	Name		string		`json:"name"`
+	Project		string		`json:"project"`
+	Verify		string		`json:"verify,omitempty"` // "dns" (default) or "http"
+	Maps		[]*DomainMap	`json:"maps,omitempty"`
+}
+
+type DomainCert struct {
+	Cert		string		`json:"cert,omitempty"` // PEM chain
+	Key		string		`json:"key,omitempty"`  // PEM
+	ACME		bool		`json:"acme,omitempty"`
+}
+
+type DomainCertInfo struct {
+	Source		string		`json:"source"` // "upload" or "acme"
+	State		string		`json:"state"`
+	Expires		string		`json:"expires,omitempty"`
+	Error		string		`json:"error,omitempty"`
+}
+
+type DomainInfo struct {
+	Id		string		`json:"id"`
+	Name		string		`json:"name"`
+	Project		string		`json:"project"`
+	State		string		`json:"state"`
+	Verify		string		`json:"verify"`
+	Token		string		`json:"token,omitempty"`
+	Challenge	string		`json:"challenge,omitempty"`
+	Maps		[]*DomainMap	`json:"maps,omitempty"`
+	Cert		*DomainCertInfo	`json:"cert,omitempty"`
 }
 
 type PkgAdd struct {
@@ -381,6 +626,7 @@ type FunctionRun struct {
 	Claims		map[string]interface{}	`json:"claims,omitempty"` // JWT
 	Method		*string			`json:"method,omitempty"`
 	Path		*string			`json:"path,omitempty"`
+	Params		map[string]string	`json:"params,omitempty"` // Router path template values
 	Key		string			`json:"key,omitempty"`
 	Src		*FunctionSources	`json:"src,omitempty"`
 }
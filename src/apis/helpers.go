@@ -91,6 +91,10 @@ func (cln *Client)Routers() *Collection {
 	return &Collection{cln, "routers"}
 }
 
+func (cln *Client)Domains() *Collection {
+	return &Collection{cln, "domains"}
+}
+
 func (cln *Client)Accounts() *Collection {
 	return &Collection{cln, "accounts"}
 }
@@ -107,6 +111,18 @@ func (cln *Client)Triggers(fid string) *Collection {
 	return cln.Functions().sub(fid, "triggers")
 }
 
+func (cln *Client)MwBackups(mid string) *Collection {
+	return cln.Mwares().sub(mid, "backups")
+}
+
+func (cln *Client)MwKeys(mid string) *Collection {
+	return cln.Mwares().sub(mid, "keys")
+}
+
+func (cln *Client)MwConns(mid string) *Collection {
+	return cln.Mwares().sub(mid, "connections")
+}
+
 func (c *Collection)Resolve(proj, name string) (string, bool) {
 	if strings.HasPrefix(name, ":") {
 		return name[1:], false
@@ -0,0 +1,83 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package swyapi
+
+/*
+ * The subset of OpenAPI 3 document that maps onto router table.
+ * Operations call functions named by the x-swifty-function, security
+ * schemes are auth contexts (the x-swifty-authctx one or the scheme
+ * name itself). The x-swifty-rev is the router table revision the
+ * document was made from. Everything else is ignored on import.
+ */
+
+type OpenAPI struct {
+	OpenAPI		string			`json:"openapi" yaml:"openapi"`
+	Info		OpenAPIInfo		`json:"info" yaml:"info"`
+	Servers		[]*OpenAPIServer	`json:"servers,omitempty" yaml:"servers,omitempty"`
+	Paths		map[string]*OpenAPIPath	`json:"paths" yaml:"paths"`
+	Components	*OpenAPIComponents	`json:"components,omitempty" yaml:"components,omitempty"`
+	Security	[]map[string][]string	`json:"security,omitempty" yaml:"security,omitempty"`
+	Rev		*int			`json:"x-swifty-rev,omitempty" yaml:"x-swifty-rev,omitempty"`
+}
+
+type OpenAPIInfo struct {
+	Title		string			`json:"title" yaml:"title"`
+	Version		string			`json:"version" yaml:"version"`
+	Description	string			`json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+type OpenAPIServer struct {
+	URL		string			`json:"url" yaml:"url"`
+}
+
+type OpenAPIPath struct {
+	Get		*OpenAPIOp		`json:"get,omitempty" yaml:"get,omitempty"`
+	Put		*OpenAPIOp		`json:"put,omitempty" yaml:"put,omitempty"`
+	Post		*OpenAPIOp		`json:"post,omitempty" yaml:"post,omitempty"`
+	Delete		*OpenAPIOp		`json:"delete,omitempty" yaml:"delete,omitempty"`
+	Patch		*OpenAPIOp		`json:"patch,omitempty" yaml:"patch,omitempty"`
+	Head		*OpenAPIOp		`json:"head,omitempty" yaml:"head,omitempty"`
+	Options		*OpenAPIOp		`json:"options,omitempty" yaml:"options,omitempty"`
+	Parameters	[]*OpenAPIParam		`json:"parameters,omitempty" yaml:"parameters,omitempty"`
+}
+
+type OpenAPIOp struct {
+	OperationId	string			`json:"operationId,omitempty" yaml:"operationId,omitempty"`
+	Summary		string			`json:"summary,omitempty" yaml:"summary,omitempty"`
+	Parameters	[]*OpenAPIParam		`json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	Responses	map[string]*OpenAPIResp	`json:"responses" yaml:"responses"`
+	/* nil means document-wide one, empty list -- none */
+	Security	*[]map[string][]string	`json:"security,omitempty" yaml:"security,omitempty"`
+	Function	string			`json:"x-swifty-function" yaml:"x-swifty-function"`
+}
+
+type OpenAPIParam struct {
+	Name		string			`json:"name" yaml:"name"`
+	In		string			`json:"in" yaml:"in"`
+	Required	bool			`json:"required,omitempty" yaml:"required,omitempty"`
+	Schema		*OpenAPISchema		`json:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+type OpenAPISchema struct {
+	Type		string			`json:"type,omitempty" yaml:"type,omitempty"`
+}
+
+type OpenAPIResp struct {
+	Description	string			`json:"description" yaml:"description"`
+}
+
+type OpenAPIComponents struct {
+	SecuritySchemes	map[string]*OpenAPISecScheme `json:"securitySchemes,omitempty" yaml:"securitySchemes,omitempty"`
+}
+
+type OpenAPISecScheme struct {
+	Type		string			`json:"type" yaml:"type"`
+	Scheme		string			`json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	BearerFormat	string			`json:"bearerFormat,omitempty" yaml:"bearerFormat,omitempty"`
+	In		string			`json:"in,omitempty" yaml:"in,omitempty"`
+	Name		string			`json:"name,omitempty" yaml:"name,omitempty"`
+	AuthCtx		string			`json:"x-swifty-authctx,omitempty" yaml:"x-swifty-authctx,omitempty"`
+}
@@ -0,0 +1,86 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package swyapi
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+ * JSON Schema document. It's kept as JSON text, so that mongo doesn't
+ * choke on the $-keys and YAML deploy descriptions can carry it too.
+ */
+type JSONSchema string
+
+func (s JSONSchema)MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return []byte("null"), nil
+	}
+
+	return []byte(s), nil
+}
+
+func (s *JSONSchema)UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = ""
+	} else {
+		*s = JSONSchema(data)
+	}
+
+	return nil
+}
+
+func yamlToJSON(x interface{}) interface{} {
+	switch v := x.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = yamlToJSON(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlToJSON(e)
+		}
+	}
+
+	return x
+}
+
+func (s *JSONSchema)UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var x interface{}
+
+	err := unmarshal(&x)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(yamlToJSON(x))
+	if err != nil {
+		return err
+	}
+
+	*s = JSONSchema(data)
+	return nil
+}
+
+/*
+ * Validation of requests to URL triggers and router entries. Body is
+ * checked for application/json requests with non-empty body, args
+ * (query ones and those set by router transform) are an object with
+ * string values.
+ */
+type RequestSchema struct {
+	Body		JSONSchema		`json:"body,omitempty" yaml:"body,omitempty"`
+	Args		JSONSchema		`json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+/* What the gate replies with 400 when request doesn't match the schema */
+type RequestInvalid struct {
+	Message		string			`json:"message"`
+	Errors		[]string		`json:"errors"`
+}
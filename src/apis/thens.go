@@ -7,6 +7,7 @@ package swyapi
 
 type Then struct {
 	Call		*ThenCall		`json:"call,omitempty"`
+	Invalidate	*ThenInvalidate		`json:"invalidate,omitempty"`
 }
 
 /*
@@ -22,3 +23,13 @@ type ThenCall struct {
 	Args		map[string]string	`json:"args"`
 	Sync		bool			`json:"sync"`
 }
+
+/*
+ * This "then" drops the cached responses of the router (from the
+ * same project as the function). Empty paths list means the whole
+ * router cache.
+ */
+type ThenInvalidate struct {
+	Router		string			`json:"router"`
+	Paths		[]string		`json:"paths,omitempty"`
+}
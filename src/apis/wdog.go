@@ -15,6 +15,26 @@ type WdogFunctionBuild struct {
 	Packages	string		`json:"packages,omitempty"`
 }
 
+/* One line of fn output, Ts is unix nanoseconds */
+type WdogLogLine struct {
+	Ts		int64			`json:"ts"`
+	Stream		string			`json:"stream"`
+	Text		string			`json:"text"`
+}
+
+/*
+ * Run reply is a stream of these, output lines go as they are
+ * printed and the result is the last one
+ */
+type WdogRunFrame struct {
+	Line		*WdogLogLine		`json:"line,omitempty"`
+	Res		*WdogFunctionRunResult	`json:"res,omitempty"`
+}
+
 func (r *WdogFunctionRunResult)FnTime() time.Duration {
 	return time.Duration(r.Time) * time.Microsecond
 }
+
+func (r *WdogFunctionRunResult)FnCPU() time.Duration {
+	return time.Duration(r.CPU) * time.Microsecond
+}
@@ -9,3 +9,10 @@ type WsMwReq struct {
 	MType	int	`json:"msg_type"`
 	Msg	[]byte	`json:"msg_payload"`
 }
+
+type WsConnInfo struct {
+	Cid		string			`json:"cid"`
+	Connected	string			`json:"connected"`
+	Claims		map[string]interface{}	`json:"claims,omitempty"`
+	Channels	[]string		`json:"channels,omitempty"`
+}
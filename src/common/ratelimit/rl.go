@@ -62,6 +62,34 @@ func (rl *RL)Get() bool {
 	return true
 }
 
+/*
+ * Bucket capacity, tokens available right now and the time it
+ * takes to fill the bucket up. Doesn't consume anything.
+ */
+func (rl *RL)Status() (uint, uint, time.Duration) {
+	rl.l.Lock()
+	defer rl.l.Unlock()
+
+	bts := rl.bts
+	if bts == 0 {
+		d := time.Since(rl.t)
+		if d >= rl.base {
+			bts = rl.burst
+		} else {
+			bts = uint(uint64(d) * uint64(rl.eps) / uint64(rl.base))
+			if bts > rl.burst {
+				bts = rl.burst
+			}
+		}
+	}
+
+	if rl.eps == 0 {
+		return rl.burst, bts, 0
+	}
+
+	return rl.burst, bts, time.Duration(rl.burst - bts) * rl.base / time.Duration(rl.eps)
+}
+
 func (rl *RL)Update(burst, eps uint) {
 	rl.l.Lock()
 	rl.burst = burst + 1
@@ -0,0 +1,200 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package xquota
+
+import (
+	"github.com/streadway/amqp"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"errors"
+	"time"
+	"swifty/apis"
+	"swifty/common"
+	"swifty/common/http"
+	"swifty/common/secrets"
+)
+
+/*
+ * Common part of the quota daemons (mquotad, pgquotad). The daemon
+ * periodically asks the DB-specific code which DBs crossed the limit
+ * (either way), locks or unlocks them, tells gate about it via mq
+ * and serves the /status requests from gate.
+ */
+
+const (
+	mquotaQueue	= "mquota"
+	scanDelay	= 10 * time.Second
+)
+
+var NoDB = errors.New("No such DB")
+
+type Ops struct {
+	Overflow	func() ([]*swyapi.MquotaStatus, error)
+	Lock		func(id string) error
+	Unlock		func(id string) error
+	Status		func(id string) (*swyapi.MquotaStatus, error)
+	Scan		func()		/* Optional, called each round */
+}
+
+type Daemon struct {
+	Ops
+	Log		*zap.SugaredLogger
+	Secrets		xsecret.Store
+
+	nChan		*amqp.Channel
+	tokens		[]string
+}
+
+func (d *Daemon)notify(st *swyapi.MquotaStatus) {
+	if d.nChan == nil {
+		return
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+
+	err = d.nChan.Publish("", mquotaQueue, false, false, amqp.Publishing{
+			ContentType: "application/json",
+			Body: data,
+		})
+	if err != nil {
+		d.Log.Errorf("Failed to send notification: %s", err.Error())
+	}
+}
+
+func (d *Daemon)NotifyInit(addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	xc := xh.ParseXCreds(addr)
+	pwd, err := d.Secrets.Get(xc.Pass)
+	if err != nil {
+		return errors.New("No notify queue password")
+	}
+
+	xc.Pass = pwd
+
+	nConn, err := amqp.Dial("amqp://" + xc.URL())
+	if err != nil {
+		return err
+	}
+
+	d.nChan, err = nConn.Channel()
+	if err != nil {
+		nConn.Close()
+		return err
+	}
+
+	_, err = d.nChan.QueueDeclare(mquotaQueue, false, false, false, false, nil)
+	if err != nil {
+		nConn.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (d *Daemon)check() {
+	if d.Scan != nil {
+		d.Scan()
+	}
+
+	sts, err := d.Overflow()
+	if err != nil {
+		d.Log.Debugf("Can't get quota status: %s", err.Error())
+		return
+	}
+
+	for _, st := range sts {
+		if st.Locked {
+			d.Log.Debugf("Unlock DB %s: %d/%d %d/%d", st.DbName, st.Size, st.SizeL, st.Rows, st.RowsL)
+			err = d.Unlock(st.DbName)
+		} else {
+			d.Log.Debugf("Lock DB %s: %d/%d %d/%d", st.DbName, st.Size, st.SizeL, st.Rows, st.RowsL)
+			err = d.Lock(st.DbName)
+		}
+
+		if err != nil {
+			d.Log.Errorf("Can't change %s access: %s", st.DbName, err.Error())
+			continue
+		}
+
+		st.Locked = !st.Locked
+		d.notify(st)
+	}
+}
+
+func (d *Daemon)checkToken(token string) bool {
+	for _, vt := range d.tokens {
+		if token == vt {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Daemon)handleStatus(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var params swyapi.MquotaRequest
+
+	err := xhttp.RReq(r, &params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !d.checkToken(params.Token) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	st, err := d.Status(params.DbName)
+	if err == NoDB {
+		http.Error(w, "No such DB", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		d.Log.Errorf("Can't get %s status: %s", params.DbName, err.Error())
+		http.Error(w, "Error getting status", http.StatusInternalServerError)
+		return
+	}
+
+	xhttp.Respond(w, st)
+}
+
+func (d *Daemon)Listen(addr, token string) error {
+	if addr == "" {
+		return nil
+	}
+
+	toks, err := d.Secrets.Get(token)
+	if err != nil {
+		return err
+	}
+
+	d.tokens = strings.Split(toks, ":")
+
+	http.HandleFunc("/status", d.handleStatus)
+	go func() {
+		d.Log.Fatal(http.ListenAndServe(addr, nil))
+	}()
+
+	return nil
+}
+
+func (d *Daemon)Run() {
+	for {
+		d.Log.Debugf("Next scan in %s", scanDelay.String())
+		time.Sleep(scanDelay)
+		d.check()
+	}
+}
@@ -0,0 +1,613 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package xschema
+
+import (
+	"unicode/utf8"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"errors"
+	"regexp"
+	"math"
+	"fmt"
+)
+
+/*
+ * JSON Schema (draft-07) validator. Supported are the validation
+ * keywords plus local $ref-s (#/...), the "format" and remote refs
+ * are ignored.
+ */
+
+const (
+	depthMax	= 64
+	ErrsMax		= 32
+	/* Recursive $ref-s with anyOf/oneOf go exponential w/o this */
+	StepsMax	= 100000
+)
+
+type Schema struct {
+	root	interface{}
+	res	map[string]*regexp.Regexp
+}
+
+func Parse(data []byte) (*Schema, error) {
+	var root interface{}
+
+	err := json.Unmarshal(data, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Schema{root: root, res: make(map[string]*regexp.Regexp)}
+	err = s.check(root, "#")
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Schema)regexp(p string) (*regexp.Regexp, error) {
+	re, ok := s.res[p]
+	if ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s.res[p] = re
+	return re, nil
+}
+
+/* Patterns met by check are all in res, the rest are compiled each time */
+func (s *Schema)match(p, x string) bool {
+	re, ok := s.res[p]
+	if !ok {
+		var err error
+
+		re, err = regexp.Compile(p)
+		if err != nil {
+			return false
+		}
+	}
+
+	return re.MatchString(x)
+}
+
+var knownTypes = map[string]bool {
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+func (s *Schema)checkList(l interface{}, at string) error {
+	sl, ok := l.([]interface{})
+	if !ok || len(sl) == 0 {
+		return errors.New(at + ": should be non-empty array")
+	}
+
+	for i, x := range sl {
+		err := s.check(x, at + "/" + strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema)checkMap(m interface{}, at string) error {
+	sm, ok := m.(map[string]interface{})
+	if !ok {
+		return errors.New(at + ": should be object")
+	}
+
+	for k, x := range sm {
+		err := s.check(x, at + "/" + k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema)check(n interface{}, at string) error {
+	if _, ok := n.(bool); ok {
+		return nil
+	}
+
+	sm, ok := n.(map[string]interface{})
+	if !ok {
+		return errors.New(at + ": schema should be object or boolean")
+	}
+
+	for k, v := range sm {
+		kat := at + "/" + k
+		var err error
+
+		switch k {
+		case "type":
+			ts, ok := v.([]interface{})
+			if !ok {
+				ts = []interface{}{v}
+			}
+			for _, t := range ts {
+				tn, ok := t.(string)
+				if !ok || !knownTypes[tn] {
+					return fmt.Errorf("%s: bad type %v", kat, t)
+				}
+			}
+
+		case "properties", "definitions", "$defs":
+			err = s.checkMap(v, kat)
+
+		case "patternProperties":
+			err = s.checkMap(v, kat)
+			if err == nil {
+				for p, _ := range v.(map[string]interface{}) {
+					if _, err = s.regexp(p); err != nil {
+						break
+					}
+				}
+			}
+
+		case "items":
+			if _, ok := v.([]interface{}); ok {
+				err = s.checkList(v, kat)
+			} else {
+				err = s.check(v, kat)
+			}
+
+		case "additionalProperties", "additionalItems", "contains", "propertyNames", "not":
+			err = s.check(v, kat)
+
+		case "allOf", "anyOf", "oneOf":
+			err = s.checkList(v, kat)
+
+		case "required":
+			rl, ok := v.([]interface{})
+			if !ok {
+				return errors.New(kat + ": should be array")
+			}
+			for _, r := range rl {
+				if _, ok := r.(string); !ok {
+					return errors.New(kat + ": should be array of strings")
+				}
+			}
+
+		case "enum":
+			if _, ok := v.([]interface{}); !ok {
+				return errors.New(kat + ": should be array")
+			}
+
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				return errors.New(kat + ": should be string")
+			}
+			_, err = s.regexp(p)
+
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf":
+			if _, ok := v.(float64); !ok {
+				return errors.New(kat + ": should be number")
+			}
+
+		case "minLength", "maxLength", "minItems", "maxItems", "minProperties", "maxProperties":
+			if x, ok := v.(float64); !ok || x < 0 || x != math.Trunc(x) {
+				return errors.New(kat + ": should be non-negative integer")
+			}
+
+		case "$ref":
+			ref, ok := v.(string)
+			if !ok || !strings.HasPrefix(ref, "#") {
+				return errors.New(kat + ": only local refs are supported")
+			}
+			if s.resolve(ref) == nil {
+				return errors.New(kat + ": can't resolve " + ref)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* JSON pointer within the schema itself */
+func (s *Schema)resolve(ref string) interface{} {
+	n := s.root
+
+	p := strings.TrimPrefix(ref, "#")
+	if p == "" {
+		return n
+	}
+
+	for _, tok := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		tok = strings.Replace(tok, "~1", "/", -1)
+		tok = strings.Replace(tok, "~0", "~", -1)
+
+		switch x := n.(type) {
+		case map[string]interface{}:
+			n = x[tok]
+		case []interface{}:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil
+			}
+			n = x[i]
+		default:
+			return nil
+		}
+
+		if n == nil {
+			return nil
+		}
+	}
+
+	return n
+}
+
+func typeOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if x == math.Trunc(x) {
+			return "integer"
+		}
+		return "number"
+	}
+
+	return "unknown"
+}
+
+func typeOK(t, vt string) bool {
+	return t == vt || (t == "number" && vt == "integer")
+}
+
+/* Shared by the whole validation including the matches() probes */
+type vbudget struct {
+	steps	int
+	over	bool
+}
+
+type vstate struct {
+	errs	[]string
+	max	int
+	depth	int
+	b	*vbudget
+}
+
+func (st *vstate)fail(at, msg string) {
+	if at == "" {
+		at = "/"
+	}
+
+	if len(st.errs) < st.max {
+		st.errs = append(st.errs, at + ": " + msg)
+	}
+}
+
+/* Nothing more to find out, either errors are enough or budget is out */
+func (st *vstate)done() bool {
+	return len(st.errs) >= st.max || st.b.over
+}
+
+func num(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+/*
+ * Validates the decoded JSON value, returns the list of problems.
+ * The root is the name of the value in the messages, e.g. "body"
+ * would produce "body/foo: should be string".
+ */
+func (s *Schema)Validate(v interface{}, root string) []string {
+	st := &vstate{max: ErrsMax, b: &vbudget{}}
+	s.validate(st, s.root, v, root)
+	if st.b.over {
+		return []string{root + ": too complex to validate"}
+	}
+	return st.errs
+}
+
+/* Returns whether the value matches, stops on the first error */
+func (s *Schema)matches(st *vstate, n, v interface{}, at string) bool {
+	sub := &vstate{depth: st.depth, max: 1, b: st.b}
+	s.validate(sub, n, v, at)
+	return len(sub.errs) == 0
+}
+
+func (s *Schema)validate(st *vstate, n, v interface{}, at string) {
+	if st.done() {
+		return
+	}
+
+	st.b.steps++
+	if st.b.steps > StepsMax {
+		st.b.over = true
+		st.fail(at, "too complex")
+		return
+	}
+
+	if b, ok := n.(bool); ok {
+		if !b {
+			st.fail(at, "not allowed")
+		}
+		return
+	}
+
+	sm, ok := n.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if st.depth >= depthMax {
+		st.fail(at, "too deep")
+		return
+	}
+
+	st.depth++
+	defer func() { st.depth-- }()
+
+	if ref, ok := sm["$ref"].(string); ok {
+		/* In draft-07 $ref overrides the siblings */
+		s.validate(st, s.resolve(ref), v, at)
+		return
+	}
+
+	vt := typeOf(v)
+
+	if t, ok := sm["type"]; ok {
+		ts, ok := t.([]interface{})
+		if !ok {
+			ts = []interface{}{t}
+		}
+
+		tok := false
+		var names []string
+		for _, x := range ts {
+			tn, _ := x.(string)
+			names = append(names, tn)
+			if typeOK(tn, vt) {
+				tok = true
+			}
+		}
+
+		if !tok {
+			st.fail(at, "should be " + strings.Join(names, " or "))
+			return
+		}
+	}
+
+	if e, ok := sm["enum"].([]interface{}); ok {
+		found := false
+		for _, x := range e {
+			if reflect.DeepEqual(x, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			st.fail(at, "not one of the allowed values")
+		}
+	}
+
+	if c, ok := sm["const"]; ok && !reflect.DeepEqual(c, v) {
+		st.fail(at, "should be equal to constant")
+	}
+
+	switch x := v.(type) {
+	case string:
+		s.validateString(st, sm, x, at)
+	case float64:
+		s.validateNumber(st, sm, x, at)
+	case []interface{}:
+		s.validateArray(st, sm, x, at)
+	case map[string]interface{}:
+		s.validateObject(st, sm, x, at)
+	}
+
+	if l, ok := sm["allOf"].([]interface{}); ok {
+		for _, sub := range l {
+			s.validate(st, sub, v, at)
+		}
+	}
+
+	if l, ok := sm["anyOf"].([]interface{}); ok {
+		any := false
+		for _, sub := range l {
+			if s.matches(st, sub, v, at) {
+				any = true
+				break
+			}
+		}
+		if !any {
+			st.fail(at, "should match some schema in anyOf")
+		}
+	}
+
+	if l, ok := sm["oneOf"].([]interface{}); ok {
+		nr := 0
+		for _, sub := range l {
+			if s.matches(st, sub, v, at) {
+				nr++
+			}
+		}
+		if nr != 1 {
+			st.fail(at, "should match exactly one schema in oneOf")
+		}
+	}
+
+	if sub, ok := sm["not"]; ok && s.matches(st, sub, v, at) {
+		st.fail(at, "should not match schema in not")
+	}
+}
+
+func (s *Schema)validateString(st *vstate, sm map[string]interface{}, x string, at string) {
+	l := float64(utf8.RuneCountInString(x))
+
+	if m, ok := num(sm["minLength"]); ok && l < m {
+		st.fail(at, fmt.Sprintf("should be at least %v characters long", m))
+	}
+
+	if m, ok := num(sm["maxLength"]); ok && l > m {
+		st.fail(at, fmt.Sprintf("should be at most %v characters long", m))
+	}
+
+	if p, ok := sm["pattern"].(string); ok {
+		if !s.match(p, x) {
+			st.fail(at, "should match " + p)
+		}
+	}
+}
+
+func (s *Schema)validateNumber(st *vstate, sm map[string]interface{}, x float64, at string) {
+	if m, ok := num(sm["minimum"]); ok && x < m {
+		st.fail(at, fmt.Sprintf("should be >= %v", m))
+	}
+
+	if m, ok := num(sm["maximum"]); ok && x > m {
+		st.fail(at, fmt.Sprintf("should be <= %v", m))
+	}
+
+	if m, ok := num(sm["exclusiveMinimum"]); ok && x <= m {
+		st.fail(at, fmt.Sprintf("should be > %v", m))
+	}
+
+	if m, ok := num(sm["exclusiveMaximum"]); ok && x >= m {
+		st.fail(at, fmt.Sprintf("should be < %v", m))
+	}
+
+	if m, ok := num(sm["multipleOf"]); ok && m > 0 {
+		q := x / m
+		if q != math.Trunc(q) {
+			st.fail(at, fmt.Sprintf("should be multiple of %v", m))
+		}
+	}
+}
+
+func (s *Schema)validateArray(st *vstate, sm map[string]interface{}, x []interface{}, at string) {
+	l := float64(len(x))
+
+	if m, ok := num(sm["minItems"]); ok && l < m {
+		st.fail(at, fmt.Sprintf("should have at least %v items", m))
+	}
+
+	if m, ok := num(sm["maxItems"]); ok && l > m {
+		st.fail(at, fmt.Sprintf("should have at most %v items", m))
+	}
+
+	if u, ok := sm["uniqueItems"].(bool); ok && u {
+	dups:
+		for i := range x {
+			for j := i + 1; j < len(x); j++ {
+				if reflect.DeepEqual(x[i], x[j]) {
+					st.fail(at, "should have unique items")
+					break dups
+				}
+			}
+		}
+	}
+
+	switch items := sm["items"].(type) {
+	case nil:
+	case []interface{}:
+		for i, v := range x {
+			iat := at + "/" + strconv.Itoa(i)
+			if i < len(items) {
+				s.validate(st, items[i], v, iat)
+			} else if ai, ok := sm["additionalItems"]; ok {
+				s.validate(st, ai, v, iat)
+			}
+		}
+	default:
+		for i, v := range x {
+			s.validate(st, items, v, at + "/" + strconv.Itoa(i))
+		}
+	}
+
+	if c, ok := sm["contains"]; ok {
+		found := false
+		for _, v := range x {
+			if s.matches(st, c, v, at) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			st.fail(at, "should contain a matching item")
+		}
+	}
+}
+
+func (s *Schema)validateObject(st *vstate, sm map[string]interface{}, x map[string]interface{}, at string) {
+	l := float64(len(x))
+
+	if m, ok := num(sm["minProperties"]); ok && l < m {
+		st.fail(at, fmt.Sprintf("should have at least %v properties", m))
+	}
+
+	if m, ok := num(sm["maxProperties"]); ok && l > m {
+		st.fail(at, fmt.Sprintf("should have at most %v properties", m))
+	}
+
+	if rl, ok := sm["required"].([]interface{}); ok {
+		for _, r := range rl {
+			rn, _ := r.(string)
+			if _, ok := x[rn]; !ok {
+				st.fail(at, "missing required property " + rn)
+			}
+		}
+	}
+
+	props, _ := sm["properties"].(map[string]interface{})
+	pprops, _ := sm["patternProperties"].(map[string]interface{})
+	addp, hasAddp := sm["additionalProperties"]
+	pnames, hasPnames := sm["propertyNames"]
+
+	for k, v := range x {
+		kat := at + "/" + k
+
+		if hasPnames && !s.matches(st, pnames, k, kat) {
+			st.fail(kat, "bad property name")
+		}
+
+		matched := false
+
+		if ps, ok := props[k]; ok {
+			s.validate(st, ps, v, kat)
+			matched = true
+		}
+
+		for p, ps := range pprops {
+			if s.match(p, k) {
+				s.validate(st, ps, v, kat)
+				matched = true
+			}
+		}
+
+		if !matched && hasAddp {
+			s.validate(st, addp, v, kat)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package xschema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, sch string) *Schema {
+	s, err := Parse([]byte(sch))
+	if err != nil {
+		t.Fatalf("can't parse %s: %s", sch, err.Error())
+	}
+	return s
+}
+
+func value(t *testing.T, v string) interface{} {
+	var x interface{}
+
+	err := json.Unmarshal([]byte(v), &x)
+	if err != nil {
+		t.Fatalf("bad value %s: %s", v, err.Error())
+	}
+	return x
+}
+
+func TestParseBad(t *testing.T) {
+	for _, sch := range []string {
+		`{"type": "float"}`,
+		`{"required": "a"}`,
+		`{"$ref": "http://example.com/x.json"}`,
+		`{"$ref": "#/definitions/none"}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+	} {
+		if _, err := Parse([]byte(sch)); err == nil {
+			t.Errorf("%s is accepted", sch)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := mustParse(t, `{
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"$ref": "#/definitions/tag"}}
+		},
+		"additionalProperties": false,
+		"definitions": {
+			"tag": {"type": "string", "pattern": "^[a-z]+$"}
+		}
+	}`)
+
+	for _, c := range []struct {
+		v	string
+		errs	[]string
+	} {
+		{ `{"name": "x", "age": 3, "tags": ["a", "b"]}`, nil },
+		{ `{"age": 3}`, []string{"body: missing required property name"} },
+		{ `{"name": "x", "age": 1.5}`, []string{"body/age: should be integer"} },
+		{ `{"name": "x", "tags": ["A"]}`, []string{"body/tags/0: should match ^[a-z]+$"} },
+		{ `{"name": "x", "foo": 1}`, []string{"body/foo: not allowed"} },
+	} {
+		errs := s.Validate(value(t, c.v), "body")
+		if strings.Join(errs, ";") != strings.Join(c.errs, ";") {
+			t.Errorf("%s: got %v, want %v", c.v, errs, c.errs)
+		}
+	}
+}
+
+func TestValidateOneOf(t *testing.T) {
+	s := mustParse(t, `{"oneOf": [{"type": "integer"}, {"minimum": 2}]}`)
+
+	if errs := s.Validate(value(t, `1`), "v"); len(errs) != 0 {
+		t.Errorf("1: %v", errs)
+	}
+	if errs := s.Validate(value(t, `3`), "v"); len(errs) != 1 {
+		t.Errorf("3 matches both, got %v", errs)
+	}
+}
+
+func TestValidateErrsCap(t *testing.T) {
+	s := mustParse(t, `{"type": "array", "items": {"type": "string"}}`)
+
+	a := make([]interface{}, 1000)
+	for i := range a {
+		a[i] = float64(i)
+	}
+
+	if errs := s.Validate(a, "v"); len(errs) != ErrsMax {
+		t.Errorf("got %d errors", len(errs))
+	}
+}
+
+/* Each level tries both anyOf branches, 2^depth w/o the budget */
+func TestValidateBudget(t *testing.T) {
+	s := mustParse(t, `{
+		"anyOf": [
+			{"properties": {"x": {"$ref": "#"}}, "required": ["x"]},
+			{"properties": {"x": {"$ref": "#"}}, "required": ["x"], "minProperties": 1}
+		]
+	}`)
+
+	v := `{"c": 1}`
+	for i := 0; i < 40; i++ {
+		v = `{"x": ` + v + `}`
+	}
+
+	start := time.Now()
+	errs := s.Validate(value(t, v), "body")
+	if d := time.Since(start); d > 5 * time.Second {
+		t.Errorf("took %s", d.String())
+	}
+
+	if len(errs) != 1 || !strings.Contains(errs[0], "too complex") {
+		t.Errorf("got %v", errs)
+	}
+}
@@ -19,6 +19,7 @@ type BalancerDat struct {
 	rover		[2]uint32
 	pods		[]*podConn
 	goal		uint32
+	conc		uint32 /* calls each pod runs at once */
 	wakeup		*sync.Cond
 }
 
@@ -95,9 +96,17 @@ func balancerGetConnAny(ctx context.Context, fdm *FnMemData) (*podConn, error) {
 		fdm.lock.Unlock()
 	}
 
-	/* Emulate simple RR balancing -- each next call picks next POD */
+	/*
+	 * Emulate simple RR balancing -- each next call picks next POD.
+	 * Pods run several calls at once, so the goal is the number of
+	 * pods to hold the calls in flight.
+	 */
 	sc := atomic.AddUint32(&fdm.bd.rover[0], 1)
-	scalerSetGoal(ctx, fdm, sc - fdm.bd.rover[1])
+	goal := sc - fdm.bd.rover[1]
+	if conc := fdm.bd.conc; conc > 1 {
+		goal = (goal + conc - 1) / conc
+	}
+	scalerSetGoal(ctx, fdm, goal)
 
 	return aps[sc % uint32(len(aps))], nil
 }
@@ -40,6 +40,15 @@ func setupMwareAddr(conf *YAMLConf) error {
 		if err != nil {
 			return errors.New("mware.maria secret not found")
 		}
+
+		if mc.Maria.Notify != "" {
+			mc.Maria.cn = xh.ParseXCreds(mc.Maria.Notify)
+			mc.Maria.cn.Resolve()
+			mc.Maria.cn.Pass, err = gateSecrets.Get(mc.Maria.cn.Pass)
+			if err != nil {
+				return errors.New("mware.maria notify secret not found")
+			}
+		}
 	}
 
 	if mc.Rabbit != nil {
@@ -67,6 +76,15 @@ func setupMwareAddr(conf *YAMLConf) error {
 		if err != nil  {
 			return errors.New("mware.postgres secret not found")
 		}
+
+		if mc.Postgres.Notify != "" {
+			mc.Postgres.cn = xh.ParseXCreds(mc.Postgres.Notify)
+			mc.Postgres.cn.Resolve()
+			mc.Postgres.cn.Pass, err = gateSecrets.Get(mc.Postgres.cn.Pass)
+			if err != nil {
+				return errors.New("mware.postgres notify secret not found")
+			}
+		}
 	}
 
 	if mc.S3 != nil {
@@ -85,6 +103,15 @@ func setupMwareAddr(conf *YAMLConf) error {
 		}
 	}
 
+	if mc.WS != nil && mc.WS.Fanout != "" {
+		mc.WS.cf = xh.ParseXCreds(mc.WS.Fanout)
+		mc.WS.cf.Resolve()
+		mc.WS.cf.Pass, err = gateSecrets.Get(mc.WS.cf.Pass)
+		if err != nil {
+			return errors.New("mware.websocket.fanout secret not found")
+		}
+	}
+
 	return nil
 }
 
@@ -170,7 +197,10 @@ type YAMLConfRabbit struct {
 type YAMLConfMaria struct {
 	Creds		string			`yaml:"creds"`
 	QDB		string			`yaml:"quotdb"`
+	QuotPort	string			`yaml:"quotport,omitempty"`
+	Notify		string			`yaml:"notify,omitempty"`
 	c		*xh.XCreds
+	cn		*xh.XCreds
 }
 
 type YAMLConfMongo struct {
@@ -181,7 +211,10 @@ type YAMLConfMongo struct {
 type YAMLConfPostgres struct {
 	Creds		string			`yaml:"creds"`
 	AdminPort	string			`yaml:"admport"`
+	QuotPort	string			`yaml:"quotport,omitempty"`
+	Notify		string			`yaml:"notify,omitempty"`
 	c		*xh.XCreds
+	cn		*xh.XCreds
 }
 
 type YAMLConfS3 struct {
@@ -195,6 +228,8 @@ type YAMLConfS3 struct {
 
 type YAMLConfWS struct {
 	API		string			`yaml:"api"`
+	Fanout		string			`yaml:"fanout,omitempty"`
+	cf		*xh.XCreds
 }
 
 type YAMLConfMw struct {
@@ -251,6 +286,7 @@ type YAMLConfRt struct {
 	Timeout		YAMLConfRange		`yaml:"timeout"`
 	Memory		YAMLConfRange		`yaml:"memory"`
 	MaxReplicas	int			`yaml:"max-replicas"`
+	MaxConcurrency	int			`yaml:"max-concurrency"`
 }
 
 func (cr *YAMLConfRt)Validate() error {
@@ -259,6 +295,11 @@ func (cr *YAMLConfRt)Validate() error {
 		fmt.Printf("'runtime.max-replicas' not set, using default 32\n")
 	}
 	sysctl.AddIntSysctl("fn_replicas_limit", &cr.MaxReplicas)
+	if cr.MaxConcurrency == 0 {
+		cr.MaxConcurrency = 8
+		fmt.Printf("'runtime.max-concurrency' not set, using default 8\n")
+	}
+	sysctl.AddIntSysctl("fn_concurrency_max", &cr.MaxConcurrency)
 	if cr.Timeout.Max == 0 {
 		cr.Timeout.Max = 60
 		fmt.Printf("'runtime.timeout.max' not set, using default 1min\n")
@@ -312,6 +353,35 @@ func (dr *YAMLConfDemoRepo)Validate() error {
 	return nil
 }
 
+type YAMLConfACME struct {
+	Directory	string			`yaml:"directory"`
+	Email		string			`yaml:"email,omitempty"`
+	AccountKey	string			`yaml:"account-key,omitempty"`
+	CA		string			`yaml:"ca,omitempty"`
+}
+
+type YAMLConfDomains struct {
+	ACME		*YAMLConfACME		`yaml:"acme,omitempty"`
+	HTTPAddr	string			`yaml:"http-addr,omitempty"`
+}
+
+func (cd *YAMLConfDomains)Validate() error {
+	if cd.ACME == nil {
+		fmt.Printf("'domains.acme' not set, only uploaded certs will work\n")
+		return nil
+	}
+	if cd.ACME.Directory == "" {
+		return errors.New("'domains.acme.directory' not set")
+	}
+	if cd.HTTPAddr == "" {
+		return errors.New("'domains.http-addr' (port 80) is needed for ACME challenges")
+	}
+	if cd.ACME.AccountKey == "" {
+		fmt.Printf("'domains.acme.account-key' not set, will register new account\n")
+	}
+	return nil
+}
+
 type YAMLConf struct {
 	Home		string			`yaml:"home"`
 	DB		string			`yaml:"db"`
@@ -324,6 +394,8 @@ type YAMLConf struct {
 	RepoSyncPeriod	int			`yaml:"repo-sync-period"`
 	RunRate		int			`yaml:"tryrun-rate"`
 	DemoRepo	YAMLConfDemoRepo	`yaml:"demo-repo"`
+	Domains		YAMLConfDomains		`yaml:"domains"`
+	RouterCache	string			`yaml:"router-cache,omitempty"`
 }
 
 func (c *YAMLConf)Validate() error {
@@ -351,6 +423,17 @@ func (c *YAMLConf)Validate() error {
 	if err != nil {
 		return err
 	}
+	err = c.Domains.Validate()
+	if err != nil {
+		return err
+	}
+	if c.RouterCache == "" {
+		fmt.Printf("'router-cache' not set, using gate memory\n")
+	}
+	err = rtCacheInit(c.RouterCache)
+	if err != nil {
+		return err
+	}
 	if c.Home == "" {
 		return errors.New("'home' not set")
 	}
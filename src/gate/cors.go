@@ -0,0 +1,155 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+	"net/url"
+	"swifty/apis"
+)
+
+/*
+ * Per-URL CORS policies. When set, the gate answers the preflight
+ * requests itself, the function is only called for the real ones.
+ * URLs without policy get the call_default_cors behavior.
+ */
+
+func ckCORS(cp *swyapi.CORSPolicy) error {
+	if len(cp.Origins) == 0 {
+		return errors.New("No origins")
+	}
+
+	for _, o := range cp.Origins {
+		if o == "*" {
+			if cp.Credentials {
+				return errors.New("Credentials cannot be used with * origin")
+			}
+			continue
+		}
+
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return errors.New("Bad origin " + o)
+		}
+
+		if strings.Contains(u.Host, "*") && !strings.HasPrefix(u.Host, "*.") {
+			return errors.New("Only *. wildcard is allowed in " + o)
+		}
+	}
+
+	for _, m := range cp.Methods {
+		if methodNr(m) == 31 {
+			return errors.New("Bad method " + m)
+		}
+	}
+
+	return nil
+}
+
+func corsOriginMatch(pat, origin string) bool {
+	pat = strings.TrimSuffix(pat, "/")
+	if strings.EqualFold(pat, origin) {
+		return true
+	}
+
+	/* https://*.example.com matches https://a.b.example.com */
+	ps := strings.SplitN(pat, "://*.", 2)
+	if len(ps) != 2 {
+		return false
+	}
+
+	os := strings.SplitN(origin, "://", 2)
+	if len(os) != 2 || !strings.EqualFold(os[0], ps[0]) {
+		return false
+	}
+
+	return strings.HasSuffix(strings.ToLower(os[1]), "." + strings.ToLower(ps[1]))
+}
+
+func corsOriginOK(cp *swyapi.CORSPolicy, origin string) (bool, bool) {
+	for _, o := range cp.Origins {
+		if o == "*" {
+			return true, true
+		}
+
+		if corsOriginMatch(o, origin) {
+			return true, false
+		}
+	}
+
+	return false, false
+}
+
+/* Returns true if the request is answered (preflight) */
+func handleCORSPolicy(cp *swyapi.CORSPolicy, w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false /* Not a cross-origin request */
+	}
+
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	ok, star := corsOriginOK(cp, origin)
+	if !ok {
+		if preflight {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return true
+		}
+
+		/* No headers -- the browser will drop the response */
+		return false
+	}
+
+	h := w.Header()
+	if star {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+
+	if cp.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(cp.Expose) != 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(cp.Expose, ","))
+		}
+
+		return false
+	}
+
+	methods := cp.Methods
+	if len(methods) == 0 {
+		methods = CORS_Clnt_Methods
+	}
+
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ","))
+
+	headers := cp.Headers
+	if len(headers) == 0 {
+		headers = CORS_Clnt_Headers
+	}
+
+	if len(headers) == 1 && headers[0] == "*" {
+		if rh := r.Header.Get("Access-Control-Request-Headers"); rh != "" {
+			h.Set("Access-Control-Allow-Headers", rh)
+		}
+	} else {
+		h.Set("Access-Control-Allow-Headers", strings.Join(headers, ","))
+	}
+
+	if cp.MaxAge != 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(cp.MaxAge)))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
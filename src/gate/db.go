@@ -9,6 +9,7 @@ import (
 	"time"
 	"fmt"
 	"errors"
+	"strings"
 	"context"
 	"reflect"
 	"net/http"
@@ -96,6 +97,22 @@ func init() {
 	dbColMap[reflect.TypeOf(&RouterDesc{})] = gmgo.DBColRouters
 	dbColMap[reflect.TypeOf([]*RouterDesc{})] = gmgo.DBColRouters
 	dbColMap[reflect.TypeOf(&[]*RouterDesc{})] = gmgo.DBColRouters
+	dbColMap[reflect.TypeOf(MwBackupDesc{})] = gmgo.DBColMwBackups
+	dbColMap[reflect.TypeOf(&MwBackupDesc{})] = gmgo.DBColMwBackups
+	dbColMap[reflect.TypeOf([]*MwBackupDesc{})] = gmgo.DBColMwBackups
+	dbColMap[reflect.TypeOf(&[]*MwBackupDesc{})] = gmgo.DBColMwBackups
+	dbColMap[reflect.TypeOf(WsConnDesc{})] = gmgo.DBColWsConns
+	dbColMap[reflect.TypeOf(&WsConnDesc{})] = gmgo.DBColWsConns
+	dbColMap[reflect.TypeOf([]*WsConnDesc{})] = gmgo.DBColWsConns
+	dbColMap[reflect.TypeOf(&[]*WsConnDesc{})] = gmgo.DBColWsConns
+	dbColMap[reflect.TypeOf(AuthKeyDesc{})] = gmgo.DBColAuthKeys
+	dbColMap[reflect.TypeOf(&AuthKeyDesc{})] = gmgo.DBColAuthKeys
+	dbColMap[reflect.TypeOf([]*AuthKeyDesc{})] = gmgo.DBColAuthKeys
+	dbColMap[reflect.TypeOf(&[]*AuthKeyDesc{})] = gmgo.DBColAuthKeys
+	dbColMap[reflect.TypeOf(DomainDesc{})] = gmgo.DBColDomains
+	dbColMap[reflect.TypeOf(&DomainDesc{})] = gmgo.DBColDomains
+	dbColMap[reflect.TypeOf([]*DomainDesc{})] = gmgo.DBColDomains
+	dbColMap[reflect.TypeOf(&[]*DomainDesc{})] = gmgo.DBColDomains
 }
 
 func dbCol(ctx context.Context, col string) *mgo.Collection {
@@ -127,6 +144,14 @@ func objcni(o interface{}) (string, bson.ObjectId) {
 		return gmgo.DBColEvents, o.ObjID
 	case *RouterDesc:
 		return gmgo.DBColRouters, o.ObjID
+	case *MwBackupDesc:
+		return gmgo.DBColMwBackups, o.ObjID
+	case *WsConnDesc:
+		return gmgo.DBColWsConns, o.ObjID
+	case *AuthKeyDesc:
+		return gmgo.DBColAuthKeys, o.ObjID
+	case *DomainDesc:
+		return gmgo.DBColDomains, o.ObjID
 	default:
 		glog.Fatalf("Unmapped object %s", reflect.TypeOf(o).String())
 		return "", ""
@@ -227,6 +252,7 @@ func idReq(ctx context.Context, id string, q bson.M) bson.M {
 }
 
 type DBLogRec struct {
+	ObjID		bson.ObjectId	`bson:"_id,omitempty"`
 	Cookie		string		`bson:"cookie"`
 	Event		string		`bson:"event"`
 	Time		time.Time	`bson:"ts"`
@@ -355,7 +381,9 @@ func dbFuncCountTen(ctx context.Context) (int, error) {
 }
 
 func dbMwareCountTen(ctx context.Context, mt string) (int, error) {
-	return dbCol(ctx, gmgo.DBColFunc).Find(bson.M{"tenant": gctx(ctx).Tenant, "mwaretype": mt}).Count()
+	/* External ones cost us nothing, so they don't count */
+	return dbCol(ctx, gmgo.DBColMware).Find(bson.M{"tennant": gctx(ctx).Tenant, "mwaretype": mt,
+				"extaddr": bson.M{"$exists": false}}).Count()
 }
 
 func dbFuncUpdate(ctx context.Context, q, ch bson.M) (error) {
@@ -366,6 +394,14 @@ func dbFuncUpdate(ctx context.Context, q, ch bson.M) (error) {
 	return dbCol(ctx, gmgo.DBColFunc).Update(q, ch)
 }
 
+func dbMwareUpdate(ctx context.Context, q, ch bson.M) (error) {
+	if !dbMayUpdate(ctx) {
+		return dbNotAllowed
+	}
+
+	return dbCol(ctx, gmgo.DBColMware).Update(q, ch)
+}
+
 func dbRouterCount(ctx context.Context) (int, error) {
 	return dbCol(ctx, gmgo.DBColRouters).Count()
 }
@@ -498,11 +534,12 @@ func dbFnStatsUpdate(ctx context.Context, cookie string, delta *gmgo.FnStatValue
 				"timeouts":	delta.Timeouts,
 				"errors":	delta.Errors,
 				"rtime":	delta.RunTime,
+				"cputime":	delta.CPUTime,
 				"bytesin":	delta.BytesIn,
 				"bytesout":	delta.BytesOut,
 				"runcost":	delta.RunCost,
 			},
-			"$max": bson.M{"lastcall": lastCall},
+			"$max": bson.M{"lastcall": lastCall, "maxrss": delta.MaxRSS},
 		})
 	return err
 }
@@ -549,6 +586,87 @@ func logSaveResult(ctx context.Context, cookie, event, stdout, stderr string) {
 	}
 }
 
+/*
+ * Lines come while the fn runs, they are saved in the background
+ * not to stall the reply stream on the DB. Whatever piles up by the
+ * time the previous insert is done goes in one batch. If the DB lags
+ * too much the lines are dropped, the log gets the note about it.
+ */
+const (
+	logStreamQueue	= 256
+	logStreamBatch	= 64
+)
+
+type logStream struct {
+	cookie	string
+	event	string
+	lines	chan *swyapi.WdogLogLine
+	dropped	int
+}
+
+func (ls *logStream)put(l *swyapi.WdogLogLine) {
+	if ls.lines == nil {
+		ls.lines = make(chan *swyapi.WdogLogLine, logStreamQueue)
+		go ls.save()
+	}
+
+	select {
+	case ls.lines <- l:
+		;
+	default:
+		ls.dropped++
+		logLinesDropped.Inc()
+	}
+}
+
+func (ls *logStream)rec(l *swyapi.WdogLogLine) interface{} {
+	return &DBLogRec{
+		Cookie:		ls.cookie,
+		Event:		l.Stream + "." + ls.event,
+		Time:		time.Unix(0, l.Ts),
+		Text:		l.Text,
+	}
+}
+
+func (ls *logStream)save() {
+	ctx, done := mkContext("::logsave")
+	defer done(ctx)
+
+	c := dbCol(ctx, gmgo.DBColLogs)
+	for l := range ls.lines {
+		recs := []interface{}{ ls.rec(l) }
+
+	batch:
+		for len(recs) < logStreamBatch {
+			select {
+			case l, ok := <-ls.lines:
+				if !ok {
+					break batch
+				}
+				recs = append(recs, ls.rec(l))
+			default:
+				break batch
+			}
+		}
+
+		err := c.Insert(recs...)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't save %s logs: %s", ls.cookie, err.Error())
+		}
+	}
+
+	/* The channel is closed, put()-s are all done */
+	if ls.dropped != 0 {
+		logSaveEvent(ctx, ls.cookie, fmt.Sprintf("%d output lines dropped", ls.dropped))
+	}
+}
+
+func (ls *logStream)close() {
+	if ls.lines != nil {
+		close(ls.lines)
+	}
+}
+
 func logSaveEvent(ctx context.Context, cookie, text string) {
 	if !dbMayUpdate(ctx) {
 		return
@@ -562,25 +680,211 @@ func logSaveEvent(ctx context.Context, cookie, text string) {
 	})
 }
 
-func logGetFor(ctx context.Context, cookie string, since *time.Time) ([]DBLogRec, error) {
+/*
+ * Lines are saved in the background and their timestamps are the
+ * wdog's ones, so the ts order is not the order records appear in
+ * the DB. Tailing goes by the _id, which is generated by mongo on
+ * insertion and thus grows.
+ */
+func (lr *DBLogRec)cursor() string {
+	return lr.ObjID.Hex()
+}
+
+func parseLogCursor(s string) (bson.ObjectId, error) {
+	/* Old cursors were ts.id ones */
+	if i := strings.LastIndexByte(s, '.'); i >= 0 {
+		s = s[i+1:]
+	}
+
+	if !bson.IsObjectIdHex(s) {
+		return "", errors.New("Bad cursor")
+	}
+
+	return bson.ObjectIdHex(s), nil
+}
+
+func logGetFor(ctx context.Context, cookie string, since *time.Time, after bson.ObjectId) ([]DBLogRec, error) {
 	var logs []DBLogRec
 	q := bson.M{"cookie": cookie}
 	if since != nil {
 		q["ts"] = bson.M{"$gt": since}
 	}
-	err := dbCol(ctx, gmgo.DBColLogs).Find(q).Sort("ts").All(&logs)
+	sort := []string{"ts", "_id"}
+	if after != "" {
+		q["_id"] = bson.M{"$gt": after}
+		sort = []string{"_id"}
+	}
+	err := dbCol(ctx, gmgo.DBColLogs).Find(q).Sort(sort...).All(&logs)
 	return logs, err
 }
 
-func logRemove(ctx context.Context, fn *FunctionDesc) error {
+func logRemove(ctx context.Context, cookie string) error {
+	if !dbMayRemove(ctx) {
+		return dbNotAllowed
+	}
+
+	_, err := dbCol(ctx, gmgo.DBColLogs).RemoveAll(bson.M{"cookie": cookie})
+	return maybe(err)
+}
+
+func dbMwBackupsList(ctx context.Context, mwid string, auto bool) ([]*MwBackupDesc, error) {
+	var bks []*MwBackupDesc
+	q := bson.M{"mwid": mwid}
+	if auto {
+		q["auto"] = true
+	}
+	err := dbCol(ctx, gmgo.DBColMwBackups).Find(q).Sort("-created").All(&bks)
+	return bks, err
+}
+
+func dbMwBackupsRemove(ctx context.Context, mwid string) error {
+	if !dbMayRemove(ctx) {
+		return dbNotAllowed
+	}
+
+	_, err := dbCol(ctx, gmgo.DBColMwBackups).RemoveAll(bson.M{"mwid": mwid})
+	return maybe(err)
+}
+
+/* Running ones not marked alive since then. Older ones have no alive mark at all */
+func dbMwBackupsFailStale(ctx context.Context, before time.Time) error {
+	_, err := dbCol(ctx, gmgo.DBColMwBackups).UpdateAll(bson.M{
+			"state":	DBMwBackupStateRun,
+			"$or":		[]bson.M{
+				{ "alive": bson.M{"$lt": before} },
+				{ "alive": bson.M{"$exists": false}, "created": bson.M{"$lt": before} },
+			},
+		}, bson.M{"$set": bson.M{"state": DBMwBackupStateErr}})
+	if err != nil {
+		return err
+	}
+
+	_, err = dbCol(ctx, gmgo.DBColMwBackups).UpdateAll(bson.M{
+			"restore.state":	DBMwBackupStateRun,
+			"$or":			[]bson.M{
+				{ "restore.alive": bson.M{"$lt": before} },
+				{ "restore.alive": bson.M{"$exists": false}, "restore.started": bson.M{"$lt": before} },
+			},
+		}, bson.M{"$set": bson.M{"restore.state": DBMwBackupStateErr}})
+	return err
+}
+
+func dbWsConnsRemove(ctx context.Context, mwid string) error {
+	if !dbMayRemove(ctx) {
+		return dbNotAllowed
+	}
+
+	_, err := dbCol(ctx, gmgo.DBColWsConns).RemoveAll(bson.M{"mwid": mwid})
+	return maybe(err)
+}
+
+func dbWsConnSetChan(ctx context.Context, mwid, cid, ch string, sub bool) error {
+	op := "$addToSet"
+	if !sub {
+		op = "$pull"
+	}
+
+	return dbCol(ctx, gmgo.DBColWsConns).Update(bson.M{"mwid": mwid, "cid": cid},
+			bson.M{op: bson.M{"channels": ch}})
+}
+
+func dbAuthKeysRemove(ctx context.Context, mwid string) error {
 	if !dbMayRemove(ctx) {
 		return dbNotAllowed
 	}
 
-	_, err := dbCol(ctx, gmgo.DBColLogs).RemoveAll(bson.M{"cookie": fn.Cookie})
+	_, err := dbCol(ctx, gmgo.DBColAuthKeys).RemoveAll(bson.M{"mwid": mwid})
 	return maybe(err)
 }
 
+func dbDomainsDropClaims(ctx context.Context, host string) error {
+	if !dbMayRemove(ctx) {
+		return dbNotAllowed
+	}
+
+	_, err := dbCol(ctx, gmgo.DBColDomains).RemoveAll(bson.M{"host": host, "state": DomainUnverified})
+	return maybe(err)
+}
+
+func dbDomainsVerified(ctx context.Context, host string) (int, error) {
+	return dbCol(ctx, gmgo.DBColDomains).Find(bson.M{"host": host, "state": DomainVerified}).Count()
+}
+
+func dbDomainDropCert(ctx context.Context, dd *DomainDesc) error {
+	if !dbMayUpdate(ctx) {
+		return dbNotAllowed
+	}
+
+	col, q := objq(ctx, dd)
+	return col.Update(q, bson.M{"$unset": bson.M{"cert": ""}})
+}
+
+func dbRtCacheGet(ctx context.Context, key string) (*RtCacheEnt, error) {
+	var ce RtCacheEnt
+
+	err := dbCol(ctx, gmgo.DBColRtCache).Find(bson.M{"_id": key}).One(&ce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ce, nil
+}
+
+func dbRtCachePut(ctx context.Context, ce *RtCacheEnt) error {
+	_, err := dbCol(ctx, gmgo.DBColRtCache).UpsertId(ce.Key, ce)
+	return err
+}
+
+func dbRtCacheDrop(ctx context.Context, rt string, paths []string) error {
+	q := bson.M{"rt": rt}
+	if len(paths) != 0 {
+		q["path"] = bson.M{"$in": paths}
+	}
+
+	_, err := dbCol(ctx, gmgo.DBColRtCache).RemoveAll(q)
+	return maybe(err)
+}
+
+func dbRtTableSave(ctx context.Context, tr *RtTableRev) error {
+	return dbCol(ctx, gmgo.DBColRtTables).Insert(tr)
+}
+
+func dbRtTableGet(ctx context.Context, rt bson.ObjectId, rev int) (*RtTableRev, error) {
+	var tr RtTableRev
+
+	err := dbCol(ctx, gmgo.DBColRtTables).Find(bson.M{"rt": rt, "rev": rev}).One(&tr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tr, nil
+}
+
+func dbRtTableList(ctx context.Context, rt bson.ObjectId) ([]*RtTableRev, error) {
+	var trs []*RtTableRev
+
+	err := dbCol(ctx, gmgo.DBColRtTables).Find(bson.M{"rt": rt}).
+			Select(bson.M{"table": 0}).
+			Sort("-rev").All(&trs)
+	return trs, err
+}
+
+func dbRtTableTrim(ctx context.Context, rt bson.ObjectId, below int) error {
+	_, err := dbCol(ctx, gmgo.DBColRtTables).RemoveAll(bson.M{"rt": rt, "rev": bson.M{"$lt": below}})
+	return err
+}
+
+func dbRtTablesDrop(ctx context.Context, rt bson.ObjectId) error {
+	_, err := dbCol(ctx, gmgo.DBColRtTables).RemoveAll(bson.M{"rt": rt})
+	return maybe(err)
+}
+
+func dbWsConnsRefresh(ctx context.Context, gate string) error {
+	_, err := dbCol(ctx, gmgo.DBColWsConns).UpdateAll(bson.M{"gate": gate},
+			bson.M{"$set": bson.M{"seen": time.Now()}})
+	return err
+}
+
 func dbProjectListAll(ctx context.Context, ten string) (fn []string, mw []string, err error) {
 	err = dbCol(ctx, gmgo.DBColFunc).Find(bson.M{"tennant": ten}).Distinct("project", &fn)
 	if err != nil {
@@ -650,6 +954,12 @@ func dbConnect() error {
 		return fmt.Errorf("No cookie index for ten cache: %s", err.Error())
 	}
 
+	index.Key = []string{"hash"}
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColAuthKeys).EnsureIndex(index)
+	if err != nil {
+		return fmt.Errorf("No hash index for auth keys: %s", err.Error())
+	}
+
 	index.Unique = false
 	index.DropDups = false
 
@@ -671,6 +981,61 @@ func dbConnect() error {
 		return fmt.Errorf("No name index for repos: %s", err.Error())
 	}
 
+	index.Key = []string{"mwid"}
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColMwBackups).EnsureIndex(index)
+	if err != nil {
+		return fmt.Errorf("No mwid index for mware backups: %s", err.Error())
+	}
+
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColWsConns).EnsureIndex(index)
+	if err != nil {
+		return fmt.Errorf("No mwid index for ws conns: %s", err.Error())
+	}
+
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColAuthKeys).EnsureIndex(index)
+	if err != nil {
+		return fmt.Errorf("No mwid index for auth keys: %s", err.Error())
+	}
+
+	index.Key = []string{"host"}
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColDomains).EnsureIndex(index)
+	if err != nil {
+		return fmt.Errorf("No host index for domains: %s", err.Error())
+	}
+
+	/* Conns of dead gates are not refreshed and go away */
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColWsConns).EnsureIndex(mgo.Index{
+			Key: []string{"seen"},
+			ExpireAfter: wsConnStaleTmo,
+		})
+	if err != nil {
+		return fmt.Errorf("No seen index for ws conns: %s", err.Error())
+	}
+
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColRtCache).EnsureIndex(mgo.Index{
+			Key: []string{"rt", "path"},
+		})
+	if err != nil {
+		return fmt.Errorf("No rt index for router cache: %s", err.Error())
+	}
+
+	/* Entries go away (about) when expired */
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColRtCache).EnsureIndex(mgo.Index{
+			Key: []string{"expires"},
+			ExpireAfter: time.Second,
+		})
+	if err != nil {
+		return fmt.Errorf("No expires index for router cache: %s", err.Error())
+	}
+
+	err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColRtTables).EnsureIndex(mgo.Index{
+			Key: []string{"rt", "rev"},
+			Unique: true,
+		})
+	if err != nil {
+		return fmt.Errorf("No rt index for router tables: %s", err.Error())
+	}
+
 	_, err = dbs.DB(gmgo.DBStateDB).C(gmgo.DBColLogs).UpdateAll(bson.M{}, bson.M{"$rename":bson.M{"fnid":"cookie"}})
 	if err != nil {
 		return fmt.Errorf("Cannot update logs field fnid to cookie")
@@ -0,0 +1,46 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"testing"
+	"gopkg.in/mgo.v2/bson"
+	"swifty/apis"
+)
+
+func TestLogCursor(t *testing.T) {
+	id := bson.NewObjectId()
+	lr := &DBLogRec{ObjID: id}
+
+	c, err := parseLogCursor(lr.cursor())
+	if err != nil || c != id {
+		t.Errorf("cursor %s parsed into %s (%v)", lr.cursor(), c.Hex(), err)
+	}
+
+	c, err = parseLogCursor("1540000000000000000." + id.Hex())
+	if err != nil || c != id {
+		t.Errorf("old cursor parsed into %s (%v)", c.Hex(), err)
+	}
+
+	for _, bad := range []string{"", "x", "123.", "123.zz" + id.Hex()[2:]} {
+		if _, err := parseLogCursor(bad); err == nil {
+			t.Errorf("%q is accepted", bad)
+		}
+	}
+}
+
+func TestLogStreamDrop(t *testing.T) {
+	/* No saver behind, so the queue just fills up */
+	ls := &logStream{lines: make(chan *swyapi.WdogLogLine, 2)}
+
+	for i := 0; i < 5; i++ {
+		ls.put(&swyapi.WdogLogLine{Stream: "out", Text: "x"})
+	}
+
+	if len(ls.lines) != 2 || ls.dropped != 3 {
+		t.Errorf("queued %d, dropped %d", len(ls.lines), ls.dropped)
+	}
+}
@@ -0,0 +1,355 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"golang.org/x/crypto/acme"
+	"gopkg.in/mgo.v2/bson"
+	"crypto"
+	"crypto/tls"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"context"
+	"strings"
+	"errors"
+	"sync"
+	"time"
+	"swifty/common/xrest/sysctl"
+)
+
+/*
+ * Certificates from ACME CA. Only the http-01 challenge is supported,
+ * the key authorization is put into DB and any gate answers it, so
+ * the domain just has to point to any of them. CA comes to port 80,
+ * so the gate listens on the domains.http-addr for the challenges.
+ */
+
+const acmeChalPath = "/.well-known/acme-challenge/"
+
+var acmeIssueTmo = 10 * time.Minute
+var acmeRenewBefore = 30 * 24 * time.Hour
+var acmeRenewPeriod = 12 * time.Hour
+
+func init() {
+	sysctl.AddTimeSysctl("acme_issue_tmo", &acmeIssueTmo)
+	sysctl.AddTimeSysctl("acme_renew_before", &acmeRenewBefore)
+	sysctl.AddTimeSysctl("acme_renew_period", &acmeRenewPeriod)
+}
+
+var acmeCl struct {
+	lock	sync.Mutex
+	c	*acme.Client
+}
+
+func acmeEnabled() bool {
+	return conf.Domains.ACME != nil
+}
+
+func acmeAccountKey(path string) (crypto.Signer, error) {
+	if path == "" {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, errors.New("Bad PEM")
+	}
+
+	if k, err := x509.ParseECPrivateKey(blk.Bytes); err == nil {
+		return k, nil
+	}
+
+	if k, err := x509.ParsePKCS1PrivateKey(blk.Bytes); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported key")
+	}
+
+	return s, nil
+}
+
+func acmeClient(ctx context.Context) (*acme.Client, error) {
+	acmeCl.lock.Lock()
+	defer acmeCl.lock.Unlock()
+
+	if acmeCl.c != nil {
+		return acmeCl.c, nil
+	}
+
+	ac := conf.Domains.ACME
+
+	key, err := acmeAccountKey(ac.AccountKey)
+	if err != nil {
+		return nil, errors.New("Can't load account key: " + err.Error())
+	}
+
+	cl := &acme.Client{Key: key, DirectoryURL: ac.Directory}
+
+	if ac.CA != "" {
+		/* Test servers (e.g. pebble) use their own roots */
+		data, err := ioutil.ReadFile(ac.CA)
+		if err != nil {
+			return nil, errors.New("Can't read CA: " + err.Error())
+		}
+
+		cpool := x509.NewCertPool()
+		cpool.AppendCertsFromPEM(data)
+		cl.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: cpool}}}
+	}
+
+	acc := &acme.Account{}
+	if ac.Email != "" {
+		acc.Contact = []string{"mailto:" + ac.Email}
+	}
+
+	_, err = cl.Register(ctx, acc, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, errors.New("Can't register account: " + err.Error())
+	}
+
+	acmeCl.c = cl
+	return cl, nil
+}
+
+func acmeObtain(ctx context.Context, dd *DomainDesc) (*DomainCertDesc, error) {
+	actx, cancel := context.WithTimeout(ctx, acmeIssueTmo)
+	defer cancel()
+
+	cl, err := acmeClient(actx)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := cl.AuthorizeOrder(actx, acme.DomainIDs(dd.Host))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zurl := range o.AuthzURLs {
+		z, err := cl.GetAuthorization(actx, zurl)
+		if err != nil {
+			return nil, err
+		}
+
+		if z.Status == acme.StatusValid {
+			continue
+		}
+
+		var ch *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "http-01" {
+				ch = c
+				break
+			}
+		}
+
+		if ch == nil {
+			return nil, errors.New("No http-01 challenge offered")
+		}
+
+		ka, err := cl.HTTP01ChallengeResponse(ch.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		err = dbUpdatePart(ctx, dd, bson.M{"cert.token": ch.Token, "cert.keyauth": ka})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = cl.Accept(actx, ch)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = cl.WaitAuthorization(actx, z.URI)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	o, err = cl.WaitOrder(actx, o.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest {
+			Subject:	pkix.Name{CommonName: dd.Host},
+			DNSNames:	[]string{dd.Host},
+		}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ders, _, err := cl.CreateOrderCert(actx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var cpem []byte
+	for _, der := range ders {
+		cpem = append(cpem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cd, err := mkDomainCert(dd.Host, cpem, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}))
+	if err != nil {
+		return nil, err
+	}
+
+	cd.ACME = true
+	return cd, nil
+}
+
+func acmeIssue(id bson.ObjectId) {
+	ctx, done := mkContext("::acme")
+	defer done(ctx)
+
+	var dd DomainDesc
+
+	err := dbFind(ctx, bson.M{"_id": id}, &dd)
+	if err != nil {
+		ctxlog(ctx).Errorf("acme: can't find domain %s: %s", id.Hex(), err.Error())
+		return
+	}
+
+	ctxlog(ctx).Debugf("acme: requesting cert for %s", dd.Host)
+
+	cd, err := acmeObtain(ctx, &dd)
+	if err != nil {
+		ctxlog(ctx).Errorf("acme: can't get cert for %s: %s", dd.Host, err.Error())
+		/* The old cert (if any) is kept and served till it expires */
+		err = dbUpdatePart(ctx, &dd, bson.M{"cert.state": DomainCertError, "cert.error": err.Error(),
+					"cert.token": "", "cert.keyauth": ""})
+		if err != nil {
+			ctxlog(ctx).Errorf("acme: can't mark %s failed: %s", dd.Host, err.Error())
+		}
+		return
+	}
+
+	err = dbUpdatePart(ctx, &dd, bson.M{"cert": cd})
+	if err != nil {
+		ctxlog(ctx).Errorf("acme: can't save cert for %s: %s", dd.Host, err.Error())
+		return
+	}
+
+	domainsReload(ctx)
+}
+
+/* Returns false if someone else is already issuing the cert */
+func acmeStart(ctx context.Context, dd *DomainDesc, q bson.M) (bool, error) {
+	err := dbUpdatePart2(ctx, dd, q, bson.M{"cert.acme": true, "cert.state": DomainCertIssuing,
+				"cert.started": time.Now(), "cert.error": ""})
+	if err != nil {
+		if dbNF(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	go acmeIssue(dd.ObjID)
+	return true, nil
+}
+
+func acmeRenew(ctx context.Context) {
+	var dds []*DomainDesc
+
+	err := dbFindAll(ctx, bson.M{"state": DomainVerified, "cert.acme": true,
+				"cert.state": bson.M{"$ne": DomainCertIssuing},
+				"cert.expires": bson.M{"$lt": time.Now().Add(acmeRenewBefore)}}, &dds)
+	if err != nil {
+		ctxlog(ctx).Errorf("acme: can't find certs to renew: %s", err.Error())
+		return
+	}
+
+	for _, dd := range dds {
+		/* Conditional update makes only one gate do the renewal */
+		_, err = acmeStart(ctx, dd, bson.M{"cert.state": dd.Cert.State})
+		if err != nil {
+			ctxlog(ctx).Errorf("acme: can't start renewal for %s: %s", dd.Host, err.Error())
+		}
+	}
+}
+
+func handleACMEChallenge(w http.ResponseWriter, r *http.Request) {
+	ctx, done := mkContext("::acme-chal")
+	defer done(ctx)
+
+	var dd DomainDesc
+
+	tok := strings.TrimPrefix(r.URL.Path, acmeChalPath)
+	err := dbFind(ctx, bson.M{"host": hostOnly(r.Host), "cert.token": tok}, &dd)
+	if err != nil || dd.Cert == nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	w.Write([]byte(dd.Cert.KeyAuth))
+}
+
+/* Plain HTTP listener only answers challenges, the rest is on HTTPS */
+func acmeListen(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(acmeChalPath, handleACMEChallenge)
+
+	srv := &http.Server{
+		Handler:	mux,
+		Addr:		addr,
+		WriteTimeout:	10 * time.Second,
+		ReadTimeout:	10 * time.Second,
+	}
+
+	glog.Fatalf("ACME listener: %s", srv.ListenAndServe().Error())
+}
+
+func acmeInit(ctx context.Context) error {
+	if !acmeEnabled() {
+		return nil
+	}
+
+	go acmeListen(conf.Domains.HTTPAddr)
+
+	go func() {
+		for {
+			time.Sleep(acmeRenewPeriod)
+
+			ctx, done := mkContext("::acme-renew")
+			acmeRenew(ctx)
+			done(ctx)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,769 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"context"
+	"strings"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+	"net"
+	"io"
+	"swifty/apis"
+	"swifty/common"
+	"swifty/common/xrest"
+	"swifty/common/xrest/sysctl"
+)
+
+/*
+ * Custom domains. Tenant registers a hostname, proves the ownership
+ * and then maps path prefixes on it to routers or functions' URLs. The
+ * verified domains with their certs are kept in memory and are
+ * re-read from DB periodically, so changes made via other gates show
+ * up here after domainsRefreshPeriod.
+ */
+
+const (
+	DomainUnverified	= "unverified"
+	DomainVerified		= "verified"
+
+	DomainVerifyDNS		= "dns"
+	DomainVerifyHTTP	= "http"
+
+	DomainCertReady		= "ready"
+	DomainCertIssuing	= "issuing"
+	DomainCertError		= "error"
+
+	domainChalDNS		= "_swifty-challenge."
+	domainChalPath		= "/.well-known/swifty-challenge/"
+	domainHostMax		= 253
+)
+
+var domainsRefreshPeriod = 30 * time.Second
+var domainVerifyTmo = 10 * time.Second
+
+func init() {
+	sysctl.AddTimeSysctl("domains_refresh_period", &domainsRefreshPeriod)
+	sysctl.AddTimeSysctl("domain_verify_tmo", &domainVerifyTmo)
+}
+
+type DomainMapDesc struct {
+	Prefix		string			`bson:"prefix"`
+	Router		string			`bson:"router,omitempty"`
+	Function	string			`bson:"function,omitempty"`
+	URLId		string			`bson:"urlid"`
+}
+
+type DomainCertDesc struct {
+	ACME		bool			`bson:"acme,omitempty"`
+	State		string			`bson:"state"`
+	Error		string			`bson:"error,omitempty"`
+	Cert		string			`bson:"cert,omitempty"`
+	Key		string			`bson:"key,omitempty"`	// encrypted
+	Expires		*time.Time		`bson:"expires,omitempty"`
+	Started		*time.Time		`bson:"started,omitempty"`
+
+	/* ACME http-01 challenge in progress */
+	Token		string			`bson:"token,omitempty"`
+	KeyAuth		string			`bson:"keyauth,omitempty"`
+}
+
+type DomainDesc struct {
+	ObjID		bson.ObjectId		`bson:"_id,omitempty"`
+	SwoId					`bson:",inline"`
+	Cookie		string			`bson:"cookie"`
+	Host		string			`bson:"host"`
+	State		string			`bson:"state"`
+	Verify		string			`bson:"verify"`
+	Token		string			`bson:"token"`
+	Maps		[]*DomainMapDesc	`bson:"maps,omitempty"`
+	Cert		*DomainCertDesc		`bson:"cert,omitempty"`
+}
+
+type Domains struct {}
+
+func domainHostOK(host string) bool {
+	if len(host) > domainHostMax || net.ParseIP(host) != nil {
+		return false
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func hostOnly(hp string) string {
+	h, _, err := net.SplitHostPort(hp)
+	if err != nil {
+		h = hp
+	}
+
+	return strings.ToLower(h)
+}
+
+/* Domains that are the gate itself cannot be claimed */
+func domainIsGate(host string) bool {
+	for _, a := range []string{conf.Daemon.Addr, conf.Daemon.ApiGate, conf.Daemon.CallGate} {
+		if a != "" && hostOnly(a) == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func domainPrefix(p string) (string, error) {
+	p = "/" + strings.Trim(p, "/")
+	if strings.ContainsAny(p, "{}*?#") || strings.Contains(p, "//") {
+		return "", errors.New("Bad prefix " + p)
+	}
+
+	if strings.HasPrefix(p, domainChalPath) || strings.HasPrefix(p, acmeChalPath) {
+		return "", errors.New("Reserved prefix " + p)
+	}
+
+	return p, nil
+}
+
+func domainMapTarget(ctx context.Context, id SwoId, m *swyapi.DomainMap) (string, error) {
+	switch {
+	case m.Router != "" && m.Function == "":
+		var rt RouterDesc
+
+		id.Name = m.Router
+		err := dbFind(ctx, id.dbReq(), &rt)
+		if err != nil {
+			return "", errors.New("Router " + m.Router + " not found")
+		}
+
+		return URLRouter + rt.Cookie, nil
+
+	case m.Function != "" && m.Router == "":
+		var ed FnEventDesc
+
+		id.Name = m.Function
+		cookie := id.Cookie()
+		err := dbFind(ctx, bson.M{"key": urlKey(cookie)}, &ed)
+		if err != nil {
+			return "", errors.New("Function " + m.Function + " has no URL trigger")
+		}
+
+		return URLFunction + cookie, nil
+	}
+
+	return "", errors.New("Either router or function is needed")
+}
+
+func mkDomainMaps(ctx context.Context, id SwoId, ms []*swyapi.DomainMap) ([]*DomainMapDesc, *xrest.ReqErr) {
+	var res []*DomainMapDesc
+	seen := make(map[string]bool)
+
+	for _, m := range ms {
+		pfx, err := domainPrefix(m.Prefix)
+		if err != nil {
+			return nil, GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		if seen[pfx] {
+			return nil, GateErrM(swyapi.GateBadRequest, "Duplicate prefix " + pfx)
+		}
+
+		seen[pfx] = true
+
+		uid, err := domainMapTarget(ctx, id, m)
+		if err != nil {
+			return nil, GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		res = append(res, &DomainMapDesc{Prefix: pfx, Router: m.Router, Function: m.Function, URLId: uid})
+	}
+
+	return res, nil
+}
+
+func (_ Domains)Create(ctx context.Context, p interface{}) (xrest.Obj, *xrest.ReqErr) {
+	params := p.(*swyapi.DomainAdd)
+
+	host := strings.ToLower(strings.TrimSuffix(params.Name, "."))
+	if !domainHostOK(host) || domainIsGate(host) {
+		return nil, GateErrM(swyapi.GateBadRequest, "Bad domain name")
+	}
+
+	switch params.Verify {
+	case "":
+		params.Verify = DomainVerifyDNS
+	case DomainVerifyDNS, DomainVerifyHTTP:
+		;
+	default:
+		return nil, GateErrM(swyapi.GateBadRequest, "Bad verification method")
+	}
+
+	tok, err := xh.GenRandId(32)
+	if err != nil {
+		return nil, GateErrM(swyapi.GateGenErr, "Can't generate token")
+	}
+
+	dd := &DomainDesc {
+		SwoId:	*ctxSwoId(ctx, params.Project, host),
+		Host:	host,
+		State:	DomainUnverified,
+		Verify:	params.Verify,
+		Token:	tok,
+	}
+
+	var cerr *xrest.ReqErr
+
+	dd.Maps, cerr = mkDomainMaps(ctx, dd.SwoId, params.Maps)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	return dd, nil
+}
+
+func (_ Domains)Get(ctx context.Context, r *http.Request) (xrest.Obj, *xrest.ReqErr) {
+	var dd DomainDesc
+
+	cerr := objFindForReq(ctx, r, "did", &dd)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	return &dd, nil
+}
+
+func (_ Domains)Iterate(ctx context.Context, q url.Values, cb func(context.Context, xrest.Obj) *xrest.ReqErr) *xrest.ReqErr {
+	project := q.Get("project")
+	if project == "" {
+		project = DefaultProject
+	}
+
+	var dd DomainDesc
+
+	if name := q.Get("name"); name != "" {
+		err := dbFind(ctx, cookieReq(ctx, project, strings.ToLower(name)), &dd)
+		if err != nil {
+			return GateErrD(err)
+		}
+
+		return cb(ctx, &dd)
+	}
+
+	iter := dbIterAll(ctx, listReq(ctx, project, nil), &dd)
+	defer iter.Close()
+
+	for iter.Next(&dd) {
+		cerr := cb(ctx, &dd)
+		if cerr != nil {
+			return cerr
+		}
+	}
+
+	err := iter.Err()
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	return nil
+}
+
+/* Someone else may keep unverified claim on the same host, that's OK */
+func dbDomainTaken(ctx context.Context, dd *DomainDesc) (bool, error) {
+	var od DomainDesc
+
+	err := dbFind(ctx, bson.M{"host": dd.Host, "$or": []bson.M{
+				{"state": DomainVerified},
+				{"tennant": dd.SwoId.Tennant},
+			}}, &od)
+	if err == nil {
+		return od.ObjID != dd.ObjID, nil
+	}
+
+	if dbNF(err) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (dd *DomainDesc)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	taken, err := dbDomainTaken(ctx, dd)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	if taken {
+		return GateErrC(swyapi.GateDuplicate)
+	}
+
+	dd.ObjID = bson.NewObjectId()
+	dd.Cookie = dd.SwoId.Cookie()
+	err = dbInsert(ctx, dd)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	return nil
+}
+
+func (dd *DomainDesc)Del(ctx context.Context) *xrest.ReqErr {
+	err := dbRemove(ctx, dd)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	domainsReload(ctx)
+	return nil
+}
+
+func (dd *DomainDesc)Upd(ctx context.Context, upd interface{}) *xrest.ReqErr {
+	return GateErrM(swyapi.GateGenErr, "Not updatable")
+}
+
+func (dd *DomainDesc)Info(ctx context.Context, q url.Values, details bool) (interface{}, *xrest.ReqErr) {
+	return dd.toInfo(ctx, details), nil
+}
+
+func (dd *DomainDesc)challenge() string {
+	switch dd.Verify {
+	case DomainVerifyDNS:
+		return "TXT " + domainChalDNS + dd.Host
+	case DomainVerifyHTTP:
+		return "http://" + dd.Host + domainChalPath + dd.Token
+	}
+
+	return ""
+}
+
+func (dd *DomainDesc)toInfo(ctx context.Context, details bool) *swyapi.DomainInfo {
+	di := swyapi.DomainInfo {
+		Id:		dd.ObjID.Hex(),
+		Name:		dd.Host,
+		Project:	dd.SwoId.Project,
+		State:		dd.State,
+		Verify:		dd.Verify,
+	}
+
+	if dd.State == DomainUnverified {
+		di.Token = dd.Token
+		di.Challenge = dd.challenge()
+	}
+
+	if details {
+		for _, m := range dd.Maps {
+			di.Maps = append(di.Maps, &swyapi.DomainMap{Prefix: m.Prefix, Router: m.Router, Function: m.Function})
+		}
+	}
+
+	if dd.Cert != nil {
+		di.Cert = dd.Cert.toInfo()
+	}
+
+	return &di
+}
+
+func (dc *DomainCertDesc)toInfo() *swyapi.DomainCertInfo {
+	ci := &swyapi.DomainCertInfo {
+		Source:	"upload",
+		State:	dc.State,
+		Error:	dc.Error,
+	}
+
+	if dc.ACME {
+		ci.Source = "acme"
+	}
+
+	if dc.Expires != nil {
+		ci.Expires = dc.Expires.Format(time.RFC1123Z)
+	}
+
+	return ci
+}
+
+func domainCheckDNS(dd *DomainDesc) error {
+	txts, err := net.LookupTXT(domainChalDNS + dd.Host)
+	if err != nil {
+		return errors.New("No TXT record")
+	}
+
+	for _, t := range txts {
+		if strings.TrimSpace(t) == dd.Token {
+			return nil
+		}
+	}
+
+	return errors.New("Token not found in TXT record")
+}
+
+/*
+ * The token must come from the site the name points to now. Gate
+ * doesn't serve these, otherwise any name pointing to it could be
+ * claimed by any tenant.
+ */
+func domainCheckHTTP(dd *DomainDesc) error {
+	c := &http.Client {
+		Timeout: domainVerifyTmo,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := c.Get("http://" + dd.Host + domainChalPath + dd.Token)
+	if err != nil {
+		return errors.New("Can't get the token")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Token not served")
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil || strings.TrimSpace(string(data)) != dd.Token {
+		return errors.New("Token mismatch")
+	}
+
+	return nil
+}
+
+func (dd *DomainDesc)verify(ctx context.Context) *xrest.ReqErr {
+	if dd.State == DomainVerified {
+		return nil
+	}
+
+	var err error
+
+	switch dd.Verify {
+	case DomainVerifyDNS:
+		err = domainCheckDNS(dd)
+	case DomainVerifyHTTP:
+		err = domainCheckHTTP(dd)
+	default:
+		err = errors.New("Bad verification method")
+	}
+
+	if err != nil {
+		return GateErrM(swyapi.GateNotAvail, "Verification failed: " + err.Error())
+	}
+
+	var od DomainDesc
+
+	err = dbFind(ctx, bson.M{"host": dd.Host, "state": DomainVerified}, &od)
+	if err == nil {
+		return GateErrC(swyapi.GateDuplicate)
+	}
+	if !dbNF(err) {
+		return GateErrD(err)
+	}
+
+	err = dbUpdatePart2(ctx, dd, bson.M{"state": DomainUnverified}, bson.M{"state": DomainVerified})
+	if err != nil {
+		if dbNF(err) {
+			return GateErrM(swyapi.GateNotAvail, "Domain is being verified")
+		}
+		return GateErrD(err)
+	}
+
+	/* Another tenant could have made it in parallel, both step back then */
+	n, err := dbDomainsVerified(ctx, dd.Host)
+	if err != nil || n > 1 {
+		dbUpdatePart2(ctx, dd, bson.M{"state": DomainVerified}, bson.M{"state": DomainUnverified})
+		if err != nil {
+			return GateErrD(err)
+		}
+		return GateErrC(swyapi.GateDuplicate)
+	}
+
+	dd.State = DomainVerified
+
+	/* Other tenants' claims are now void */
+	err = dbDomainsDropClaims(ctx, dd.Host)
+	if err != nil {
+		ctxlog(ctx).Errorf("domain: can't drop claims for %s: %s", dd.Host, err.Error())
+	}
+
+	domainsReload(ctx)
+	return nil
+}
+
+func (dd *DomainDesc)setMaps(ctx context.Context, ms []*swyapi.DomainMap) *xrest.ReqErr {
+	maps, cerr := mkDomainMaps(ctx, dd.SwoId, ms)
+	if cerr != nil {
+		return cerr
+	}
+
+	err := dbUpdatePart(ctx, dd, bson.M{"maps": maps})
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	dd.Maps = maps
+	domainsReload(ctx)
+	return nil
+}
+
+func (dd *DomainDesc)setCert(ctx context.Context, dc *swyapi.DomainCert) *xrest.ReqErr {
+	if dd.State != DomainVerified {
+		return GateErrM(swyapi.GateNotAvail, "Domain not verified")
+	}
+
+	if dc.ACME {
+		if dc.Cert != "" || dc.Key != "" {
+			return GateErrM(swyapi.GateBadRequest, "Either ACME or cert/key")
+		}
+
+		if !acmeEnabled() {
+			return GateErrM(swyapi.GateNotAvail, "ACME not configured")
+		}
+
+		/* Issuing that got stuck (e.g. gate died) can be restarted */
+		ok, err := acmeStart(ctx, dd, bson.M{"$or": []bson.M{
+					{"cert.state": bson.M{"$ne": DomainCertIssuing}},
+					{"cert.started": bson.M{"$lt": time.Now().Add(-acmeIssueTmo)}},
+				}})
+		if err != nil {
+			return GateErrD(err)
+		}
+
+		if !ok {
+			return GateErrM(swyapi.GateNotAvail, "Certificate is being issued")
+		}
+
+		return nil
+	}
+
+	var err error
+
+	if dc.Cert != "" {
+		var cd *DomainCertDesc
+
+		cd, err = mkDomainCert(dd.Host, []byte(dc.Cert), []byte(dc.Key))
+		if err != nil {
+			return GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		err = dbUpdatePart(ctx, dd, bson.M{"cert": cd})
+	} else if dc.Key != "" {
+		return GateErrM(swyapi.GateBadRequest, "Key without cert")
+	} else {
+		err = dbDomainDropCert(ctx, dd)
+	}
+
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	domainsReload(ctx)
+	return nil
+}
+
+func mkDomainCert(host string, cert, key []byte) (*DomainCertDesc, error) {
+	kp, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, errors.New("Bad cert/key pair: " + err.Error())
+	}
+
+	leaf, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return nil, errors.New("Bad cert: " + err.Error())
+	}
+
+	err = leaf.VerifyHostname(host)
+	if err != nil {
+		return nil, errors.New("Cert is not for " + host)
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		return nil, errors.New("Cert expired")
+	}
+
+	ekey, err := xh.EncryptString(gateSecPas, string(key))
+	if err != nil {
+		return nil, errors.New("Can't encrypt key")
+	}
+
+	return &DomainCertDesc {
+		State:		DomainCertReady,
+		Cert:		string(cert),
+		Key:		ekey,
+		Expires:	&leaf.NotAfter,
+	}, nil
+}
+
+type DomMapsProp struct { }
+
+func (_ *DomMapsProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interface{}, *xrest.ReqErr) {
+	return o.(*DomainDesc).toInfo(ctx, true).Maps, nil
+}
+
+func (_ *DomMapsProp)Upd(ctx context.Context, o xrest.Obj, par interface{}) *xrest.ReqErr {
+	return o.(*DomainDesc).setMaps(ctx, *par.(*[]*swyapi.DomainMap))
+}
+
+type DomCertProp struct { }
+
+func (_ *DomCertProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interface{}, *xrest.ReqErr) {
+	dd := o.(*DomainDesc)
+	if dd.Cert == nil {
+		return &swyapi.DomainCertInfo{}, nil
+	}
+
+	return dd.Cert.toInfo(), nil
+}
+
+func (_ *DomCertProp)Upd(ctx context.Context, o xrest.Obj, par interface{}) *xrest.ReqErr {
+	return o.(*DomainDesc).setCert(ctx, par.(*swyapi.DomainCert))
+}
+
+/*
+ * In-memory part. The whole map is replaced on reload, so readers
+ * don't need any locking.
+ */
+
+type domainMem struct {
+	maps	[]*DomainMapDesc	/* longest prefix first */
+	cert	*tls.Certificate
+}
+
+var domains atomic.Value
+
+func domainGet(host string) *domainMem {
+	dms, _ := domains.Load().(map[string]*domainMem)
+	return dms[host]
+}
+
+func (dm *domainMem)find(path string) (*DomainMapDesc, string) {
+	for _, m := range dm.maps {
+		if m.Prefix == "/" {
+			return m, strings.TrimPrefix(path, "/")
+		}
+
+		if path == m.Prefix {
+			return m, ""
+		}
+
+		if strings.HasPrefix(path, m.Prefix + "/") {
+			return m, path[len(m.Prefix) + 1:]
+		}
+	}
+
+	return nil, ""
+}
+
+func (dc *DomainCertDesc)load() (*tls.Certificate, error) {
+	key, err := xh.DecryptString(gateSecPas, dc.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := tls.X509KeyPair([]byte(dc.Cert), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &kp, nil
+}
+
+func domainsReload(ctx context.Context) {
+	var dds []*DomainDesc
+
+	err := dbFindAll(ctx, bson.M{"state": DomainVerified}, &dds)
+	if err != nil {
+		ctxlog(ctx).Errorf("domain: can't load domains: %s", err.Error())
+		return
+	}
+
+	dms := make(map[string]*domainMem)
+	for _, dd := range dds {
+		dm := &domainMem{maps: dd.Maps}
+		sort.Slice(dm.maps, func(i, j int) bool {
+			return len(dm.maps[i].Prefix) > len(dm.maps[j].Prefix)
+		})
+
+		if dd.Cert != nil && dd.Cert.Cert != "" {
+			dm.cert, err = dd.Cert.load()
+			if err != nil {
+				ctxlog(ctx).Errorf("domain: bad cert for %s: %s", dd.Host, err.Error())
+			}
+		}
+
+		dms[dd.Host] = dm
+	}
+
+	domains.Store(dms)
+}
+
+/* SNI -- nil cert makes tls fall back to the gate's own one */
+func domainCert(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	dm := domainGet(strings.ToLower(hi.ServerName))
+	if dm == nil {
+		return nil, nil
+	}
+
+	return dm.cert, nil
+}
+
+func domainTLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: domainCert}
+}
+
+func domainsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dm := domainGet(hostOnly(r.Host))
+		if dm == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		m, rest := dm.find(r.URL.Path)
+		if m == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		/* Make it look like /call/ request, reqPath() relies on it */
+		r.URL.Path = "/call/" + m.URLId + "/" + rest
+		callURL(w, r, m.URLId)
+	})
+}
+
+func domainsInit(ctx context.Context) error {
+	domainsReload(ctx)
+
+	go func() {
+		for {
+			time.Sleep(domainsRefreshPeriod)
+
+			ctx, done := mkContext("::domains-refresh")
+			domainsReload(ctx)
+			done(ctx)
+		}
+	}()
+
+	return acmeInit(ctx)
+}
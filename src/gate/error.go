@@ -21,6 +21,7 @@ var gateErrMsg = map[uint]string {
 	swyapi.GateFsError:	"Files access failed",
 	swyapi.GateNotAvail:	"Operation not (yet) available",
 	swyapi.GateLimitHit:	"Resource limitation hit",
+	swyapi.GateConflict:	"Changed by someone else",
 }
 
 func GateErrC(code uint) *xrest.ReqErr {
@@ -38,6 +38,8 @@ type FnEventDesc struct {
 	Cron		*FnEventCron	`bson:"cron,omitempty"`
 	S3		*FnEventS3	`bson:"s3,omitempty"`
 	WS		*FnEventWebsock	`bson:"ws,omitempty"`
+	CORS		*swyapi.CORSPolicy	`bson:"cors,omitempty"`
+	Schema		*swyapi.RequestSchema	`bson:"schema,omitempty"`
 }
 
 type Trigger struct {
@@ -143,6 +145,8 @@ func (e *FnEventDesc)toInfo(fn *FunctionDesc) *swyapi.FunctionEvent {
 
 	if e.Source == "url" {
 		ae.URL = fn.getURL()
+		ae.CORS = e.CORS
+		ae.Schema = e.Schema
 	}
 
 	if e.Cron != nil {
@@ -160,6 +164,14 @@ func (e *FnEventDesc)toInfo(fn *FunctionDesc) *swyapi.FunctionEvent {
 		}
 	}
 
+	if e.WS != nil {
+		ae.WS = &swyapi.FunctionEventWebsock {
+			MwName: e.WS.MwName,
+			MType: e.WS.MType,
+			Events: e.WS.Events,
+		}
+	}
+
 	return &ae
 }
 
@@ -0,0 +1,157 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"context"
+	"errors"
+	"time"
+	"net"
+	"sync/atomic"
+	"swifty/common/xrest/sysctl"
+)
+
+/*
+ * Tenants give us addresses to go to on their behalf (JWKS URLs,
+ * external mwares). These must not lead into the cluster, so the
+ * address is checked against the deny list. The check is done on the
+ * IP we actually connect to, i.e. after the name is resolved, so that
+ * a DNS name pointing inside doesn't help. Cluster networks that are
+ * not private (pods' and services' CIDRs) are added via sysctl. The
+ * sysctl replaces the whole list, so dialers see either the old one
+ * or the new one.
+ */
+
+var extAddrCheck = true
+var extNetsDeny atomic.Value /* []*net.IPNet */
+var extAddrDenied = errors.New("Address not allowed")
+
+var extNetsDef = []string {
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+func parseNets(nets []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+
+	for _, n := range nets {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+
+		_, ipn, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, ipn)
+	}
+
+	return ret, nil
+}
+
+func init() {
+	nets, _ := parseNets(extNetsDef)
+	extNetsDeny.Store(nets)
+
+	sysctl.AddBoolSysctl("ext_addr_check", &extAddrCheck)
+	sysctl.AddSysctl("ext_nets_deny",
+		func() string {
+			var ns []string
+			for _, n := range extNetsDenied() {
+				ns = append(ns, n.String())
+			}
+			return strings.Join(ns, ",")
+		},
+		func(nv string) error {
+			nets, err := parseNets(strings.Split(nv, ","))
+			if err == nil {
+				extNetsDeny.Store(nets)
+			}
+			return err
+		})
+}
+
+func extNetsDenied() []*net.IPNet {
+	nets, _ := extNetsDeny.Load().([]*net.IPNet)
+	return nets
+}
+
+func extAddrOK(ip net.IP) bool {
+	if !extAddrCheck {
+		return true
+	}
+
+	if ip.IsUnspecified() || ip.IsLoopback() {
+		return false
+	}
+
+	for _, n := range extNetsDenied() {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func extDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !extAddrOK(ip) {
+		return extAddrDenied
+	}
+
+	return nil
+}
+
+/* Dialer that refuses to connect to denied addresses */
+func extDialer(tmo time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: tmo, Control: extDialControl}
+}
+
+/*
+ * For clients we cannot give our dialer to. This is racy wrt DNS
+ * changes, but still cuts off the obvious attempts.
+ */
+func extHostCheck(ctx context.Context, host string) error {
+	if !extAddrCheck {
+		return nil
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if !extAddrOK(ip.IP) {
+			return extAddrDenied
+		}
+	}
+
+	return nil
+}
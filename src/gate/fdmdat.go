@@ -211,6 +211,7 @@ func fndatGetOrInit(ctx context.Context, cookie string, fn *FunctionDesc, forRem
 	}
 
 	nret.mem = fn.Size.Mem
+	nret.bd.conc = uint32(fn.Size.conc())
 	nret.depname = fn.DepName()
 	nret.fnid = fn.Cookie
 	nret.id = fn.SwoId
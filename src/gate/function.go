@@ -97,6 +97,16 @@ type FnSizeDesc struct {
 	Tmo		uint		`bson:"timeout"`
 	Burst		uint		`bson:"burst"`
 	Rate		uint		`bson:"rate"`
+	Conc		uint		`bson:"conc,omitempty"`
+}
+
+/* Functions made before pods got runner pools have no conc */
+func (sz *FnSizeDesc)conc() uint {
+	if sz.Conc == 0 {
+		return 1
+	}
+
+	return sz.Conc
 }
 
 func (fn *FunctionDesc)k8sId() string {
@@ -312,6 +322,7 @@ func (fn *FunctionDesc)toInfo(ctx context.Context, details bool, periods int) (*
 			Timeout:	fn.Size.Tmo,
 			Rate:		fn.Size.Rate,
 			Burst:		fn.Size.Burst,
+			Concurrency:	fn.Size.conc(),
 		}
 	}
 
@@ -379,6 +390,7 @@ func getFunctionDesc(id *SwoId, p_add *swyapi.FunctionAdd) (*FunctionDesc, *xres
 			Tmo:		p_add.Size.Timeout,
 			Rate:		p_add.Size.Rate,
 			Burst:		p_add.Size.Burst,
+			Conc:		p_add.Size.Concurrency,
 		},
 		Code:		FnCodeDesc {
 			Lang:		p_add.Code.Lang,
@@ -541,6 +553,12 @@ func fnFixSize(sz *swyapi.FunctionSize) error {
 		return errors.New("Too small/big memory size")
 	}
 
+	if sz.Concurrency == 0 {
+		sz.Concurrency = 1
+	} else if sz.Concurrency > uint(conf.Runtime.MaxConcurrency) {
+		return errors.New("Too big concurrency")
+	}
+
 	return nil
 }
 
@@ -593,6 +611,7 @@ func (fn *FunctionDesc)setSize(ctx context.Context, sz *swyapi.FunctionSize) *xr
 	restart := false
 	mfix := false
 	rlfix := false
+	cfix := false
 
 	err := fnFixSize(sz)
 	if err != nil {
@@ -612,6 +631,13 @@ func (fn *FunctionDesc)setSize(ctx context.Context, sz *swyapi.FunctionSize) *xr
 		restart = true
 	}
 
+	if fn.Size.conc() != sz.Concurrency {
+		fn.Size.Conc = sz.Concurrency
+		update["size.conc"] = sz.Concurrency
+		cfix = true
+		restart = true
+	}
+
 	if sz.Rate != fn.Size.Rate || sz.Burst != fn.Size.Burst {
 		fn.Size.Burst = sz.Burst
 		fn.Size.Rate = sz.Rate
@@ -629,7 +655,7 @@ func (fn *FunctionDesc)setSize(ctx context.Context, sz *swyapi.FunctionSize) *xr
 		return GateErrD(err)
 	}
 
-	if rlfix || mfix {
+	if rlfix || mfix || cfix {
 		fdm := memdGetCond(fn.Cookie)
 		if fdm == nil {
 			goto skip
@@ -639,6 +665,10 @@ func (fn *FunctionDesc)setSize(ctx context.Context, sz *swyapi.FunctionSize) *xr
 			fdm.mem = fn.Size.Mem
 		}
 
+		if cfix {
+			fdm.bd.conc = uint32(fn.Size.Conc)
+		}
+
 		if rlfix {
 			if fn.Size.Rate != 0 {
 				if fdm.crl != nil {
@@ -665,8 +695,9 @@ func (fn *FunctionDesc)setSize(ctx context.Context, sz *swyapi.FunctionSize) *xr
 }
 
 func (fn *FunctionDesc)addMware(ctx context.Context, mw *MwareDesc) *xrest.ReqErr {
-	err := dbFuncUpdate(ctx, bson.M{"_id": fn.ObjID, "mware": bson.M{"$ne": mw.SwoId.Name}},
-				bson.M{"$push": bson.M{"mware":mw.SwoId.Name}})
+	ref := mwRef(fn.SwoId.Project, mw)
+	err := dbFuncUpdate(ctx, bson.M{"_id": fn.ObjID, "mware": bson.M{"$ne": ref}},
+				bson.M{"$push": bson.M{"mware":ref}})
 	if err != nil {
 		if dbNF(err) {
 			return GateErrM(swyapi.GateDuplicate, "Mware %s already there")
@@ -675,7 +706,7 @@ func (fn *FunctionDesc)addMware(ctx context.Context, mw *MwareDesc) *xrest.ReqEr
 		}
 	}
 
-	fn.Mware = append(fn.Mware, mw.SwoId.Name)
+	fn.Mware = append(fn.Mware, ref)
 	if fn.State == DBFuncStateRdy {
 		k8sUpdate(ctx, &conf, fn)
 	}
@@ -684,8 +715,9 @@ func (fn *FunctionDesc)addMware(ctx context.Context, mw *MwareDesc) *xrest.ReqEr
 
 func (fn *FunctionDesc)delMware(ctx context.Context, mw *MwareDesc) *xrest.ReqErr {
 	found := -1
+	ref := mwRef(fn.SwoId.Project, mw)
 	for i, mwn := range fn.Mware {
-		if mwn == mw.SwoId.Name {
+		if mwn == ref {
 			found = i
 			break
 		}
@@ -917,7 +949,7 @@ func (fn *FunctionDesc)Del(ctx context.Context) *xrest.ReqErr {
 		goto later
 	}
 
-	err = logRemove(ctx, fn)
+	err = logRemove(ctx, fn.Cookie)
 	if err != nil {
 		ctxlog(ctx).Errorf("logs %s remove error: %s", fn.SwoId.Str(), err.Error())
 		goto later
@@ -1076,6 +1108,7 @@ func (_ *FnSzProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interfac
 		Timeout:	uint(fn.Size.Tmo),
 		Rate:		fn.Size.Rate,
 		Burst:		fn.Size.Burst,
+		Concurrency:	fn.Size.conc(),
 	}, nil
 }
 
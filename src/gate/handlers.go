@@ -36,17 +36,15 @@ func init() {
 }
 
 func handleCall(w http.ResponseWriter, r *http.Request) {
-	if callCORS && xhttp.HandleCORS(w, r, CORS_Clnt_Methods, CORS_Clnt_Headers) {
-		return
-	}
+	callURL(w, r, mux.Vars(r)["urlid"])
+}
 
+func callURL(w http.ResponseWriter, r *http.Request, uid string) {
 	sopq := statsStart()
 
 	ctx, done := mkContext2("::call", swyapi.NobodyRole)
 	defer done(ctx)
 
-	uid := mux.Vars(r)["urlid"]
-
 	url, err := urlFind(ctx, uid)
 	if err != nil {
 		if dbNF(err) {
@@ -57,6 +55,14 @@ func handleCall(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if cp := url.CORS(); cp != nil {
+		if handleCORSPolicy(cp, w, r) {
+			return
+		}
+	} else if callCORS && xhttp.HandleCORS(w, r, CORS_Clnt_Methods, CORS_Clnt_Headers) {
+		return
+	}
+
 	url.Handle(ctx, w, r, sopq)
 }
 
@@ -476,7 +482,144 @@ func handleRouter(ctx context.Context, w http.ResponseWriter, r *http.Request) *
 
 func handleRouterTable(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
 	var tbl []*swyapi.RouterEntry
-	return xrest.HandleProp(ctx, w, r, Routers{}, &RtTblProp{}, &tbl)
+
+	if r.Method == "GET" {
+		return xrest.HandleProp(ctx, w, r, Routers{}, &RtTblProp{}, &tbl)
+	}
+
+	ro, cerr := Routers{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	rd := ro.(*RouterDesc)
+
+	switch r.Method {
+	case "PUT":
+		rev, err := xhttp.ReqAtoi(r.URL.Query(), "rev", -1)
+		if err != nil {
+			return GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		err = xhttp.RReq(r, &tbl)
+		if err != nil {
+			return GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		cerr = rd.setTable(ctx, tbl, rev, "put")
+
+	case "POST":
+		var ed swyapi.RouterTableEdit
+
+		err := xhttp.RReq(r, &ed)
+		if err != nil {
+			return GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		cerr = rd.editTable(ctx, &ed)
+	}
+
+	if cerr != nil {
+		return cerr
+	}
+
+	return xrest.Respond(ctx, w, &swyapi.RouterTableRev{Rev: rd.TRev, TLen: len(rd.Table)})
+}
+
+func handleRouterHistory(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	ro, cerr := Routers{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	hist, cerr := ro.(*RouterDesc).tableHistory(ctx)
+	if cerr != nil {
+		return cerr
+	}
+
+	return xrest.Respond(ctx, w, hist)
+}
+
+func handleRouterRollback(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	var rb swyapi.RouterRollback
+
+	ro, cerr := Routers{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	err := xhttp.RReq(r, &rb)
+	if err != nil {
+		return GateErrE(swyapi.GateBadRequest, err)
+	}
+
+	rd := ro.(*RouterDesc)
+	cerr = rd.rollbackTable(ctx, &rb)
+	if cerr != nil {
+		return cerr
+	}
+
+	return xrest.Respond(ctx, w, &swyapi.RouterTableRev{Rev: rd.TRev, TLen: len(rd.Table)})
+}
+
+func handleRouterCORS(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	var cp swyapi.CORSPolicy
+	return xrest.HandleProp(ctx, w, r, Routers{}, &RtCORSProp{}, &cp)
+}
+
+func handleRouterOpenAPI(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	var doc swyapi.OpenAPI
+	return xrest.HandleProp(ctx, w, r, Routers{}, &RtOpenAPIProp{}, &doc)
+}
+
+func handleRouterCache(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	ro, cerr := Routers{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	cerr = ro.(*RouterDesc).flushCache(ctx, r.URL.Query()["path"])
+	if cerr != nil {
+		return cerr
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+/******************************* DOMAINS **************************************/
+func handleDomains(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	var params swyapi.DomainAdd
+	return xrest.HandleMany(ctx, w, r, Domains{}, &params)
+}
+
+func handleDomain(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	return xrest.HandleOne(ctx, w, r, Domains{}, nil)
+}
+
+func handleDomainVerify(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	do, cerr := Domains{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	dd := do.(*DomainDesc)
+	cerr = dd.verify(ctx)
+	if cerr != nil {
+		return cerr
+	}
+
+	return xrest.Respond(ctx, w, dd.toInfo(ctx, false))
+}
+
+func handleDomainMaps(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	var ms []*swyapi.DomainMap
+	return xrest.HandleProp(ctx, w, r, Domains{}, &DomMapsProp{}, &ms)
+}
+
+func handleDomainCert(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	var dc swyapi.DomainCert
+	return xrest.HandleProp(ctx, w, r, Domains{}, &DomCertProp{}, &dc)
 }
 
 /******************************* ACCOUNTS *************************************/
@@ -590,6 +733,118 @@ func handleMware(ctx context.Context, w http.ResponseWriter, r *http.Request) *x
 	return xrest.HandleOne(ctx, w, r, Mwares{}, nil)
 }
 
+func handleMwareLogs(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	mo, cerr := Mwares{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	return handleLogsFor(ctx, mo.(*MwareDesc).Cookie, w, r.URL.Query())
+}
+
+func handleMwareRotate(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	mo, cerr := Mwares{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	var rq swyapi.MwareRotate
+	err := xhttp.RReq(r, &rq)
+	if err != nil {
+		return GateErrE(swyapi.GateBadRequest, err)
+	}
+
+	cerr = mo.(*MwareDesc).Rotate(ctx, time.Duration(rq.Grace) * time.Second)
+	if cerr != nil {
+		return cerr
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func handleMwareGrants(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	mo, cerr := Mwares{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	var params swyapi.MwareGrant
+	return xrest.HandleMany(ctx, w, r, MwGrants{mo.(*MwareDesc)}, &params)
+}
+
+func handleMwareGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	return xrest.HandleOne(ctx, w, r, MwGrants{}, nil)
+}
+
+func handleMwareBackups(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	mo, cerr := Mwares{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	var params swyapi.MwareBackupAdd
+	return xrest.HandleMany(ctx, w, r, MwBackups{mo.(*MwareDesc)}, &params)
+}
+
+func handleMwareBackup(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	return xrest.HandleOne(ctx, w, r, MwBackups{}, nil)
+}
+
+func handleMwareKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	mw, cerr := authKeyMwFindForReq(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	var params swyapi.AuthKeyAdd
+	return xrest.HandleMany(ctx, w, r, AuthKeys{mw}, &params)
+}
+
+func handleMwareKey(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	return xrest.HandleOne(ctx, w, r, AuthKeys{}, nil)
+}
+
+func handleMwareConns(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	mw, cerr := wsMwFindForReq(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	return xrest.HandleMany(ctx, w, r, WsConns{mw}, nil)
+}
+
+func handleMwareConn(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	return xrest.HandleOne(ctx, w, r, WsConns{}, nil)
+}
+
+func handleMwareBackupSched(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	var bs swyapi.MwareBackupSched
+	return xrest.HandleProp(ctx, w, r, Mwares{}, &MwBackupSchedProp{}, &bs)
+}
+
+func handleMwareBackupRestore(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	bo, cerr := MwBackups{}.Get(ctx, r)
+	if cerr != nil {
+		return cerr
+	}
+
+	var rq swyapi.MwareRestore
+	err := xhttp.RReq(r, &rq)
+	if err != nil {
+		return GateErrE(swyapi.GateBadRequest, err)
+	}
+
+	bd := bo.(*MwBackupDesc)
+	cerr = bd.RestoreTo(ctx, &rq)
+	if cerr != nil {
+		return cerr
+	}
+
+	ifo, _ := bd.Info(ctx, nil, true)
+	return xrest.Respond(ctx, w, ifo)
+}
+
 /******************************* DEPLOYMETS ***********************************/
 func handleDeployments(ctx context.Context, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
 	var ds swyapi.DeployStart
@@ -745,7 +1000,17 @@ func handleLogsFor(ctx context.Context, cookie string, w http.ResponseWriter, q
 		return cerr
 	}
 
-	logs, err := logGetFor(ctx, cookie, since)
+	var after bson.ObjectId
+	if c := q.Get("after"); c != "" {
+		var err error
+
+		after, err = parseLogCursor(c)
+		if err != nil {
+			return GateErrE(swyapi.GateBadRequest, err)
+		}
+	}
+
+	logs, err := logGetFor(ctx, cookie, since, after)
 	if err != nil {
 		return GateErrD(err)
 	}
@@ -759,6 +1024,7 @@ func handleLogsFor(ctx context.Context, cookie string, w http.ResponseWriter, q
 				Event:	loge.Event,
 				Ts:	loge.Time.Format(time.RFC1123Z),
 				Text:	loge.Text,
+				Cursor:	loge.cursor(),
 			})
 		}
 
@@ -898,22 +1164,30 @@ func handleWebSocketClient(w http.ResponseWriter, r *http.Request) {
 	wsClientReq(&wsmw, c, claims)
 }
 
-func handleWebSocketsMw(w http.ResponseWriter, r *http.Request) {
-	ctx, done := mkContext2("::ws", swyapi.UserRole)
-	defer done(ctx)
-
+func wsMwForReq(ctx context.Context, w http.ResponseWriter, r *http.Request) *MwareDesc {
 	var wsmw MwareDesc
 	ws := mux.Vars(r)["ws"]
 
 	err := dbFind(ctx, bson.M{"cookie": ws, "mwaretype": "websocket", "state": DBMwareStateRdy}, &wsmw)
 	if err != nil {
 		http.Error(w, "No such websocket", http.StatusNotFound)
-		return
+		return nil
 	}
 
-	sec := r.Header.Get("X-WS-Token")
-	if sec != wsmw.Secret {
+	if !wsTokenOK(&wsmw, r.Header.Get("X-WS-Token")) {
 		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	return &wsmw
+}
+
+func handleWebSocketsMw(w http.ResponseWriter, r *http.Request) {
+	ctx, done := mkContext2("::ws", swyapi.UserRole)
+	defer done(ctx)
+
+	wsmw := wsMwForReq(ctx, w, r)
+	if wsmw == nil {
 		return
 	}
 
@@ -923,7 +1197,33 @@ func handleWebSocketsMw(w http.ResponseWriter, r *http.Request) {
 		cid = path[4]
 	}
 
-	cerr := wsFunctionReq(ctx, &wsmw, cid, w, r)
+	cerr := wsFunctionReq(ctx, wsmw, cid, w, r)
+	if cerr != nil {
+		http.Error(w, cerr.String(), http.StatusBadRequest)
+	}
+}
+
+func handleWebSocketsChan(w http.ResponseWriter, r *http.Request) {
+	ctx, done := mkContext2("::ws", swyapi.UserRole)
+	defer done(ctx)
+
+	wsmw := wsMwForReq(ctx, w, r)
+	if wsmw == nil {
+		return
+	}
+
+	/* /websockets/{ws}/channels/{chan}[/{cid}] */
+	path := strings.SplitN(r.URL.Path, "/", 6)
+	ch := ""
+	cid := ""
+	if len(path) > 4 {
+		ch = path[4]
+	}
+	if len(path) > 5 {
+		cid = path[5]
+	}
+
+	cerr := wsChannelReq(ctx, wsmw, ch, cid, w, r)
 	if cerr != nil {
 		http.Error(w, cerr.String(), http.StatusBadRequest)
 	}
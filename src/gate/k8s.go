@@ -128,6 +128,9 @@ func k8sGenEnvVar(ctx context.Context, fn *FunctionDesc, wd_port int) []v1.EnvVa
 	s = append(s, v1.EnvVar{
 			Name:	"SWD_FN_TMO",
 			Value:	strconv.Itoa(int(fn.Size.Tmo)), })
+	s = append(s, v1.EnvVar{
+			Name:	"SWD_FN_CONC",
+			Value:	strconv.Itoa(int(fn.Size.conc())), })
 	s = append(s, v1.EnvVar{
 			Name:	"SWD_PORT",
 			Value:	strconv.Itoa(int(wd_port)), })
@@ -266,6 +269,34 @@ func k8sUpdate(ctx context.Context, conf *YAMLConf, fn *FunctionDesc) error {
 	return err
 }
 
+/*
+ * Secrets get into PODs via env refs, so changing them doesn't
+ * change the template. Poke an annotation to re-roll the PODs.
+ */
+func k8sRestart(ctx context.Context, conf *YAMLConf, fn *FunctionDesc) error {
+	depname := fn.DepName()
+
+	deploy := k8sClientSet.Extensions().Deployments(conf.Wdog.Namespace)
+	this, err := deploy.Get(depname, metav1.GetOptions{})
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't get deployment for %s", fn.SwoId.Str())
+		return err
+	}
+
+	if this.Spec.Template.Annotations == nil {
+		this.Spec.Template.Annotations = make(map[string]string)
+	}
+	this.Spec.Template.Annotations["swifty.cloud/restarted"] = time.Now().Format(time.RFC3339)
+
+	_, err = deploy.Update(this)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't restart %s: %s", fn.SwoId.Str(), err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func specSetRes(res *v1.ResourceRequirements, fn *FunctionDesc) {
 	mem_max := fmt.Sprintf("%dMi", fn.Size.Mem)
 	mem_min := fmt.Sprintf("%dMi", fn.Size.Mem / 2)
@@ -438,6 +469,12 @@ func (pod *k8sPod)Service() string {
 		return "nodejs"
 	case "swy-csharp-service":
 		return "csharp"
+	case "swy-java-service":
+		return "java"
+	case "swy-php-service":
+		return "php"
+	case "swy-rust-service":
+		return "rust"
 	}
 
 	return ""
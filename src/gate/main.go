@@ -282,6 +282,18 @@ func getHandlers() http.Handler {
 
 	r.Handle("/v1/middleware",		genReqHandler(handleMwares)).Methods("GET", "POST", "OPTIONS")
 	r.Handle("/v1/middleware/{mid}",	genReqHandler(handleMware)).Methods("GET", "DELETE", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/logs",	genReqHandler(handleMwareLogs)).Methods("GET", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/rotate",	genReqHandler(handleMwareRotate)).Methods("POST", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/grants",	genReqHandler(handleMwareGrants)).Methods("GET", "POST", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/grants/{project}",	genReqHandler(handleMwareGrant)).Methods("GET", "DELETE", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/backups",	genReqHandler(handleMwareBackups)).Methods("GET", "POST", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/backups/schedule",	genReqHandler(handleMwareBackupSched)).Methods("GET", "PUT", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/backups/{bid}",	genReqHandler(handleMwareBackup)).Methods("GET", "DELETE", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/backups/{bid}/restore",	genReqHandler(handleMwareBackupRestore)).Methods("POST", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/keys",	genReqHandler(handleMwareKeys)).Methods("GET", "POST", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/keys/{kid}",	genReqHandler(handleMwareKey)).Methods("GET", "DELETE", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/connections",	genReqHandler(handleMwareConns)).Methods("GET", "OPTIONS")
+	r.Handle("/v1/middleware/{mid}/connections/{cid}",	genReqHandler(handleMwareConn)).Methods("GET", "DELETE", "OPTIONS")
 
 	r.Handle("/v1/repos",			genReqHandler(handleRepos)).Methods("GET", "POST", "OPTIONS")
 	r.Handle("/v1/repos/{rid}",		genReqHandler(handleRepo)).Methods("GET", "PUT", "DELETE", "OPTIONS")
@@ -302,7 +314,18 @@ func getHandlers() http.Handler {
 
 	r.Handle("/v1/routers",			genReqHandler(handleRouters)).Methods("GET", "POST", "OPTIONS")
 	r.Handle("/v1/routers/{rid}",		genReqHandler(handleRouter)).Methods("GET", "DELETE", "OPTIONS")
-	r.Handle("/v1/routers/{rid}/table",	genReqHandler(handleRouterTable)).Methods("GET", "PUT", "OPTIONS")
+	r.Handle("/v1/routers/{rid}/table",	genReqHandler(handleRouterTable)).Methods("GET", "PUT", "POST", "OPTIONS")
+	r.Handle("/v1/routers/{rid}/history",	genReqHandler(handleRouterHistory)).Methods("GET", "OPTIONS")
+	r.Handle("/v1/routers/{rid}/rollback",	genReqHandler(handleRouterRollback)).Methods("POST", "OPTIONS")
+	r.Handle("/v1/routers/{rid}/cors",	genReqHandler(handleRouterCORS)).Methods("GET", "PUT", "OPTIONS")
+	r.Handle("/v1/routers/{rid}/cache",	genReqHandler(handleRouterCache)).Methods("DELETE", "OPTIONS")
+	r.Handle("/v1/routers/{rid}/openapi",	genReqHandler(handleRouterOpenAPI)).Methods("GET", "PUT", "OPTIONS")
+
+	r.Handle("/v1/domains",			genReqHandler(handleDomains)).Methods("GET", "POST", "OPTIONS")
+	r.Handle("/v1/domains/{did}",		genReqHandler(handleDomain)).Methods("GET", "DELETE", "OPTIONS")
+	r.Handle("/v1/domains/{did}/verify",	genReqHandler(handleDomainVerify)).Methods("POST", "OPTIONS")
+	r.Handle("/v1/domains/{did}/maps",	genReqHandler(handleDomainMaps)).Methods("GET", "PUT", "OPTIONS")
+	r.Handle("/v1/domains/{did}/cert",	genReqHandler(handleDomainCert)).Methods("GET", "PUT", "OPTIONS")
 
 	r.Handle("/v1/info/langs",		genReqHandler(handleLanguages)).Methods("GET", "OPTIONS")
 	r.Handle("/v1/info/langs/{lang}",	genReqHandler(handleLanguage)).Methods("GET", "OPTIONS")
@@ -313,6 +336,7 @@ func getHandlers() http.Handler {
 
 	r.HandleFunc("/websockets/{ws}", handleWebSocketClient)
 	r.PathPrefix("/websockets/{ws}/conns").Methods("POST").HandlerFunc(handleWebSocketsMw)
+	r.PathPrefix("/websockets/{ws}/channels").Methods("POST", "PUT", "DELETE").HandlerFunc(handleWebSocketsChan)
 
 	return r
 }
@@ -413,19 +437,30 @@ func main() {
 		glog.Fatalf("Can't start repo syncer: %s", err.Error())
 	}
 
+	err = mwaresInit(ctx)
+	if err != nil {
+		glog.Fatalf("Can't set up mwares: %s", err.Error())
+	}
+
 	err = PrometheusInit(ctx)
 	if err != nil {
 		glog.Fatalf("Can't set up prometheus: %s", err.Error())
 	}
 
+	err = domainsInit(ctx)
+	if err != nil {
+		glog.Fatalf("Can't set up domains: %s", err.Error())
+	}
+
 	MwInit()
 	RtInit()
 	done(ctx)
 
 	err = xhttp.ListenAndServe(
 		&http.Server{
-			Handler:      getHandlers(),
+			Handler:      domainsHandler(getHandlers()),
 			Addr:         conf.Daemon.Addr,
+			TLSConfig:    domainTLSConfig(),
 			WriteTimeout: 60 * time.Second,
 			ReadTimeout:  60 * time.Second,
 		}, conf.Daemon.HTTPS, ModeDevel || isLite(), func(s string) { glog.Debugf(s) })
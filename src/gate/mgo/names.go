@@ -17,4 +17,10 @@ const (
 	DBColAccounts	= "Accounts"
 	DBColRouters	= "Routers"
 	DBColTCache	= "TCache"
+	DBColMwBackups	= "MwareBackups"
+	DBColWsConns	= "WsConns"
+	DBColAuthKeys	= "AuthKeys"
+	DBColDomains	= "Domains"
+	DBColRtCache	= "RouterCache"
+	DBColRtTables	= "RouterTables"
 )
@@ -15,6 +15,8 @@ type FnStatValues struct {
 	Errors		uint64		`bson:"errors"`
 	LastCall	time.Time	`bson:"lastcall"`
 	RunTime		time.Duration	`bson:"rtime"`
+	CPUTime		time.Duration	`bson:"cputime"`
+	MaxRSS		uint64		`bson:"maxrss"` /* KB, peak of all calls */
 	BytesIn		uint64		`bson:"bytesin"`
 	BytesOut	uint64		`bson:"bytesout"`
 
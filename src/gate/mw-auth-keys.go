@@ -0,0 +1,455 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"crypto"
+	"crypto/x509"
+	"crypto/rsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"errors"
+	"time"
+	"io"
+	"swifty/apis"
+	"swifty/common/xrest/sysctl"
+)
+
+/*
+ * Public keys for verifying tokens from external issuers. The key
+ * is either given statically (PEM or JWKS document) or the JWKS is
+ * fetched from the URL and cached. An unknown kid makes us re-fetch
+ * the JWKS (not too often though), this is how issuers rotate keys.
+ * The URL is tenant-provided, so it's https-only and is not allowed
+ * to point inside the cluster (see extaddr.go).
+ */
+
+const (
+	jwksCacheTmo	= time.Hour
+	jwksRefetchTmo	= time.Minute
+	jwksSizeMax	= 1 << 20
+)
+
+var jwksFetchTmo = 10 * time.Second
+
+func init() {
+	sysctl.AddTimeSysctl("jwks_fetch_tmo", &jwksFetchTmo)
+}
+
+type MwJWTConf struct {
+	Alg		string		`bson:"alg"`
+	PubKey		string		`bson:"pubkey,omitempty"`
+	JWKS		string		`bson:"jwks,omitempty"`
+	JWKSURL		string		`bson:"jwks_url,omitempty"`
+	Iss		string		`bson:"iss,omitempty"`
+	Aud		string		`bson:"aud,omitempty"`
+	Claims		[]string	`bson:"claims,omitempty"`
+}
+
+func (jc *MwJWTConf)asymmetric() bool {
+	return jc != nil && jc.Alg != "HS256"
+}
+
+/* Whether both configs take the keys from the same place */
+func (jc *MwJWTConf)sameKeys(o *MwJWTConf) bool {
+	return jc != nil && o != nil && jc.Alg == o.Alg && jc.PubKey == o.PubKey &&
+			jc.JWKS == o.JWKS && jc.JWKSURL == o.JWKSURL
+}
+
+func (jc *MwJWTConf)toInfo() *swyapi.MwareJWT {
+	return &swyapi.MwareJWT {
+		Alg:		jc.Alg,
+		PubKey:		jc.PubKey,
+		JWKS:		jc.JWKS,
+		JWKSURL:	jc.JWKSURL,
+		Iss:		jc.Iss,
+		Aud:		jc.Aud,
+		Claims:		jc.Claims,
+	}
+}
+
+func mkJWTConf(p *swyapi.MwareJWT) *MwJWTConf {
+	jc := &MwJWTConf {
+		Alg:		p.Alg,
+		PubKey:		p.PubKey,
+		JWKS:		p.JWKS,
+		JWKSURL:	p.JWKSURL,
+		Iss:		p.Iss,
+		Aud:		p.Aud,
+		Claims:		p.Claims,
+	}
+
+	if jc.Alg == "" {
+		jc.Alg = "HS256"
+	}
+
+	return jc
+}
+
+func (jc *MwJWTConf)check() error {
+	switch jc.Alg {
+	case "HS256":
+		if jc.PubKey != "" || jc.JWKS != "" || jc.JWKSURL != "" {
+			return errors.New("HS256 uses own key")
+		}
+
+		return nil
+	case "RS256", "ES256":
+		;
+	default:
+		return errors.New("Unsupported alg " + jc.Alg)
+	}
+
+	n := 0
+	for _, x := range []string{jc.PubKey, jc.JWKS, jc.JWKSURL} {
+		if x != "" {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return errors.New("Exactly one of pubkey, jwks or jwks_url is needed")
+	}
+
+	if jc.JWKSURL != "" {
+		u, err := url.Parse(jc.JWKSURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("jwks_url should be https://")
+		}
+	}
+
+	return nil
+}
+
+type jwkKey struct {
+	Kty		string		`json:"kty"`
+	Kid		string		`json:"kid"`
+	Use		string		`json:"use"`
+	Alg		string		`json:"alg"`
+	N		string		`json:"n"`
+	E		string		`json:"e"`
+	Crv		string		`json:"crv"`
+	X		string		`json:"x"`
+	Y		string		`json:"y"`
+}
+
+type jwkSet struct {
+	Keys		[]*jwkKey	`json:"keys"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := decodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwkKey)pubKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("Unsupported curve " + k.Crv)
+		}
+
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("Unsupported key type " + k.Kty)
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set jwkSet
+
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, errors.New("Bad JWKS: " + err.Error())
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pk, err := k.pubKey()
+		if err != nil {
+			continue /* Maybe some other alg we don't care about */
+		}
+
+		keys[k.Kid] = pk
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("No usable keys in JWKS")
+	}
+
+	return keys, nil
+}
+
+func parsePubKey(data string) (interface{}, error) {
+	blk, _ := pem.Decode([]byte(data))
+	if blk == nil {
+		return nil, errors.New("Bad PEM")
+	}
+
+	if blk.Type == "CERTIFICATE" {
+		crt, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return crt.PublicKey, nil
+	}
+
+	return x509.ParsePKIXPublicKey(blk.Bytes)
+}
+
+func fetchJWKS(addr string) ([]byte, error) {
+	tr := &http.Transport {
+		DialContext:		extDialer(jwksFetchTmo).DialContext,
+		TLSHandshakeTimeout:	jwksFetchTmo,
+	}
+
+	cln := &http.Client {
+		Timeout:	jwksFetchTmo,
+		Transport:	tr,
+		CheckRedirect:	func(r *http.Request, via []*http.Request) error {
+			if r.URL.Scheme != "https" || len(via) >= 3 {
+				return errors.New("Bad redirect")
+			}
+			return nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	resp, err := cln.Get(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Bad status " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, jwksSizeMax + 1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > jwksSizeMax {
+		return nil, errors.New("JWKS is too big")
+	}
+
+	return data, nil
+}
+
+/* Returns kid -> key map, the static key sits under "" */
+func (jc *MwJWTConf)loadKeys() (map[string]interface{}, error) {
+	switch {
+	case jc.PubKey != "":
+		pk, err := parsePubKey(jc.PubKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{"": pk}, nil
+
+	case jc.JWKS != "":
+		return parseJWKS([]byte(jc.JWKS))
+
+	case jc.JWKSURL != "":
+		data, err := fetchJWKS(jc.JWKSURL)
+		if err != nil {
+			return nil, errors.New("Can't fetch JWKS: " + err.Error())
+		}
+
+		return parseJWKS(data)
+	}
+
+	return nil, errors.New("No keys")
+}
+
+func asymCheck(alg string, key interface{}, data string, sig []byte) bool {
+	h := sha256.Sum256([]byte(data))
+
+	switch alg {
+	case "RS256":
+		pk, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		return rsa.VerifyPKCS1v15(pk, crypto.SHA256, h[:], sig) == nil
+
+	case "ES256":
+		pk, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pk, h[:], r, s)
+	}
+
+	return false
+}
+
+/* Must be called with ac.lock held (read is enough) */
+func (ac *AuthCtx)keysFresh(force bool) bool {
+	if ac.keysAt.IsZero() {
+		return false
+	}
+
+	if ac.jwt.JWKSURL == "" {
+		return true
+	}
+
+	/*
+	 * Failed fetch and unknown kid both re-fetch no more often than
+	 * once per jwksRefetchTmo, so garbage tokens can't make us hammer
+	 * the issuer (or wait for it).
+	 */
+	since := time.Since(ac.keysAt)
+	if since >= jwksCacheTmo {
+		return false
+	}
+	if (force || ac.keys == nil) && since >= jwksRefetchTmo {
+		return false
+	}
+
+	return true
+}
+
+/*
+ * The fetch happens w/o the ac.lock held, so that a slow issuer doesn't
+ * stall requests that have the keys already. Only one fetch runs at a
+ * time, others wait for it on ac.fetch and then use its result. The
+ * common case of fresh keys only takes the lock for read.
+ */
+func (ac *AuthCtx)refreshKeys(force bool) {
+	ac.lock.RLock()
+	fresh := ac.fetch == nil && ac.keysFresh(force)
+	ac.lock.RUnlock()
+	if fresh {
+		return
+	}
+
+	ac.lock.Lock()
+	for ac.fetch != nil {
+		ch := ac.fetch
+		ac.lock.Unlock()
+		<-ch
+		ac.lock.Lock()
+	}
+
+	if ac.keysFresh(force) {
+		ac.lock.Unlock()
+		return
+	}
+
+	jc := ac.jwt
+	ch := make(chan struct{})
+	ac.fetch = ch
+	ac.lock.Unlock()
+
+	keys, err := jc.loadKeys()
+
+	ac.lock.Lock()
+	if ac.jwt.sameKeys(jc) {
+		ac.keysAt = time.Now()
+		if err == nil {
+			ac.keys = keys
+			ac.keysErr = nil
+		} else if ac.keys == nil {
+			ac.keysErr = err
+		}
+		/* else keep using the old set, maybe the issuer is just down */
+	}
+	ac.fetch = nil
+	close(ch)
+	ac.lock.Unlock()
+}
+
+func (ac *AuthCtx)findPubKey(kid string) (interface{}, bool, error) {
+	ac.lock.RLock()
+	defer ac.lock.RUnlock()
+
+	if ac.keys == nil {
+		if ac.keysErr != nil {
+			return nil, false, ac.keysErr
+		}
+
+		return nil, false, errors.New("No keys")
+	}
+
+	if ac.jwt.PubKey != "" {
+		return ac.keys[""], true, nil
+	}
+
+	if k, ok := ac.keys[kid]; ok {
+		return k, true, nil
+	}
+
+	if kid == "" && len(ac.keys) == 1 {
+		for _, k := range ac.keys {
+			return k, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+func (ac *AuthCtx)pubKey(kid string) (interface{}, error) {
+	ac.refreshKeys(false)
+
+	k, ok, err := ac.findPubKey(kid)
+	if err != nil || ok {
+		return k, err
+	}
+
+	ac.refreshKeys(true)
+
+	k, ok, err = ac.findPubKey(kid)
+	if err != nil || ok {
+		return k, err
+	}
+
+	return nil, errors.New("Unknown JWT key")
+}
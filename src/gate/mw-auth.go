@@ -19,6 +19,9 @@ import (
 	_ "crypto/sha256"
 	"crypto/hmac"
 	"context"
+	"sync"
+	"gopkg.in/mgo.v2/bson"
+	"swifty/common/xrest/sysctl"
 )
 
 const (
@@ -34,7 +37,132 @@ func decodeString(s string) ([]byte, error) {
 }
 
 type AuthCtx struct {
+	lock		sync.RWMutex
 	signKey		string
+	prevKey		string
+	prevTill	time.Time
+
+	jwt		*MwJWTConf
+	keys		map[string]interface{}
+	keysAt		time.Time
+	keysErr		error
+	fetch		chan struct{}		/* JWKS fetch in progress */
+
+	mwid		string			/* authkey mware */
+	kcache		map[string]*authKeyMem
+}
+
+/* Contexts are shared, so that key rotation reaches them all */
+var authCtxs sync.Map
+
+func (ac *AuthCtx)setKeys(mw *MwareDesc) error {
+	if mw.JWT.asymmetric() {
+		ac.lock.Lock()
+		if !ac.jwt.sameKeys(mw.JWT) {
+			ac.keys = nil
+			ac.keysAt = time.Time{}
+			ac.keysErr = nil
+		}
+		ac.jwt = mw.JWT
+		ac.lock.Unlock()
+		return nil
+	}
+
+	key, err := xh.DecryptString(gateSecPas, mw.Secret)
+	if err != nil {
+		return err
+	}
+
+	var pkey string
+	var till time.Time
+
+	if mw.Prev != nil {
+		pkey, err = xh.DecryptString(gateSecPas, mw.Prev.Secret)
+		if err != nil {
+			return err
+		}
+
+		till = mw.Prev.Till
+	}
+
+	ac.lock.Lock()
+	ac.jwt = mw.JWT
+	ac.signKey = key
+	ac.prevKey = pkey
+	ac.prevTill = till
+	ac.lock.Unlock()
+
+	return nil
+}
+
+func authCtxRefresh(ctx context.Context, mw *MwareDesc) {
+	x, ok := authCtxs.Load(mw.Cookie)
+	if ok {
+		err := x.(*AuthCtx).setKeys(mw)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't refresh auth ctx %s: %s", mw.SwoId.Str(), err.Error())
+		}
+	}
+}
+
+/*
+ * Rotation and prev keys revocation happen on one gate, the others
+ * pick the new keys up from DB here
+ */
+var authCtxsRefreshPeriod = 10 * time.Second
+
+func authCtxsReload(ctx context.Context) {
+	var ids []string
+
+	authCtxs.Range(func(k, v interface{}) bool {
+		if v.(*AuthCtx).mwid == "" {
+			ids = append(ids, k.(string))
+		}
+		return true
+	})
+
+	if len(ids) == 0 {
+		return
+	}
+
+	iter := dbIterAll(ctx, bson.M{
+			"cookie":	bson.M{"$in": ids},
+			"mwaretype":	"authjwt",
+			"state":	DBMwareStateRdy,
+		}, &MwareDesc{})
+	defer iter.Close()
+
+	for {
+		/* Fresh one each time, the ctx keeps the JWT conf pointer */
+		var mw MwareDesc
+
+		if !iter.Next(&mw) {
+			break
+		}
+
+		authCtxRefresh(ctx, &mw)
+	}
+
+	err := iter.Err()
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't reload auth ctxs: %s", err.Error())
+	}
+}
+
+func authCtxsInit(ctx context.Context) error {
+	sysctl.AddTimeSysctl("auth_ctx_refresh_period", &authCtxsRefreshPeriod)
+
+	go func() {
+		for {
+			time.Sleep(authCtxsRefreshPeriod)
+
+			ctx, done := mkContext("::authctx-refresh")
+			authCtxsReload(ctx)
+			done(ctx)
+		}
+	}()
+
+	return nil
 }
 
 func authCtxGet(ctx context.Context, id SwoId, ac string) (*AuthCtx, error) {
@@ -50,18 +178,43 @@ func authCtxGet(ctx context.Context, id SwoId, ac string) (*AuthCtx, error) {
 	}
 
 	if item.MwareType == "authjwt" {
-		key, err := xh.DecryptString(gateSecPas, item.Secret)
+		x, ok := authCtxs.Load(item.Cookie)
+		if !ok {
+			x, _ = authCtxs.LoadOrStore(item.Cookie, &AuthCtx{})
+		}
+
+		ac := x.(*AuthCtx)
+		err = ac.setKeys(&item)
 		if err != nil {
 			return nil, err
 		}
 
-		return &AuthCtx{signKey: key}, nil
+		return ac, nil
+	}
+
+	if item.MwareType == "authkey" {
+		x, ok := authCtxs.Load(item.Cookie)
+		if !ok {
+			x, _ = authCtxs.LoadOrStore(item.Cookie, &AuthCtx{mwid: item.Cookie})
+		}
+
+		return x.(*AuthCtx), nil
 	}
 
 	return nil, fmt.Errorf("BUG: Not an auth mware %s", item.MwareType)
 }
 
+func hs256Check(key, data string, sig []byte) bool {
+	hasher := hmac.New(crypto.SHA256.New, []byte(key))
+	hasher.Write([]byte(data))
+	return hmac.Equal(sig, hasher.Sum(nil))
+}
+
 func (ac *AuthCtx)Verify(r *http.Request) (map[string]interface{}, error) {
+	if ac.mwid != "" {
+		return ac.verifyKey(r)
+	}
+
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
 		return nil, errors.New("Authorization header required")
@@ -82,27 +235,54 @@ func (ac *AuthCtx)Verify(r *http.Request) (map[string]interface{}, error) {
 		return nil, errors.New("Bad JWT header")
 	}
 
-	var h map[string]string
+	var h map[string]interface{}
 	err = json.Unmarshal(hb, &h)
 	if err != nil {
 		return nil, errors.New("Bad JWT header")
 	}
 
-	/* Should match the wdog/lib.go */
-	if h["typ"] != "JWT" || h["alg"] != "HS256" {
-		return nil, errors.New("Bad JWT header")
-	}
+	typ, _ := h["typ"].(string)
+	alg, _ := h["alg"].(string)
+	kid, _ := h["kid"].(string)
+
+	ac.lock.RLock()
+	jc := ac.jwt
+	ac.lock.RUnlock()
 
 	sig, err := decodeString(parts[2])
 	if err != nil {
 		return nil, errors.New("Bad JWT signature")
 	}
 
-	hasher := hmac.New(crypto.SHA256.New, []byte(ac.signKey))
-	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	if jc.asymmetric() {
+		/* External issuers may omit the typ */
+		if (typ != "" && !strings.EqualFold(typ, "JWT")) || alg != jc.Alg {
+			return nil, errors.New("Bad JWT header")
+		}
+
+		key, err := ac.pubKey(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if !asymCheck(alg, key, parts[0] + "." + parts[1], sig) {
+			return nil, errors.New("Wrong JWT signature")
+		}
+	} else {
+		/* Should match the wdog/lib.go */
+		if typ != "JWT" || alg != "HS256" {
+			return nil, errors.New("Bad JWT header")
+		}
+
+		ac.lock.RLock()
+		ok := hs256Check(ac.signKey, parts[0] + "." + parts[1], sig) ||
+			(ac.prevKey != "" && time.Now().Before(ac.prevTill) &&
+				hs256Check(ac.prevKey, parts[0] + "." + parts[1], sig))
+		ac.lock.RUnlock()
 
-	if !hmac.Equal(sig, hasher.Sum(nil)) {
-		return nil, errors.New("Wrong JWT signature")
+		if !ok {
+			return nil, errors.New("Wrong JWT signature")
+		}
 	}
 
 	cb, err := decodeString(parts[1])
@@ -116,32 +296,104 @@ func (ac *AuthCtx)Verify(r *http.Request) (map[string]interface{}, error) {
 		return nil, errors.New("Bad JWT claims: " + err.Error())
 	}
 
-	expf, ok := claims["exp"]
-	if ok {
-		now := time.Now().Unix()
-		var exp int64
+	now := time.Now().Unix()
 
-		switch expt := expf.(type) {
-		case float64:
-			exp = int64(expt)
-		case json.Number:
-			exp, _ = expt.Int64()
-		default:
-			now = 0
-			exp = 1 /* XXX valid? why not? */
-		}
+	exp, ok := claimTime(claims, "exp")
+	if ok && exp <= now {
+		return nil, errors.New("Token expired")
+	}
 
-		if exp <= now {
-			return nil, errors.New("Token expired")
+	nbf, ok := claimTime(claims, "nbf")
+	if ok && nbf > now {
+		return nil, errors.New("Token not yet valid")
+	}
+
+	if jc != nil {
+		err = jc.checkClaims(claims)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return claims, nil
 }
 
+func claimTime(claims map[string]interface{}, name string) (int64, bool) {
+	v, ok := claims[name]
+	if !ok {
+		return 0, false
+	}
+
+	switch vt := v.(type) {
+	case float64:
+		return int64(vt), true
+	case json.Number:
+		t, _ := vt.Int64()
+		return t, true
+	}
+
+	return 0, false /* XXX valid? why not? */
+}
+
+func (jc *MwJWTConf)checkClaims(claims map[string]interface{}) error {
+	if jc.Iss != "" {
+		if iss, _ := claims["iss"].(string); iss != jc.Iss {
+			return errors.New("Wrong token issuer")
+		}
+	}
+
+	if jc.Aud != "" {
+		ok := false
+
+		/* Can be a string or an array of them */
+		switch aud := claims["aud"].(type) {
+		case string:
+			ok = (aud == jc.Aud)
+		case []interface{}:
+			for _, a := range aud {
+				if s, _ := a.(string); s == jc.Aud {
+					ok = true
+					break
+				}
+			}
+		}
+
+		if !ok {
+			return errors.New("Wrong token audience")
+		}
+	}
+
+	for _, c := range jc.Claims {
+		if _, ok := claims[c]; !ok {
+			return errors.New("Claim " + c + " missing")
+		}
+	}
+
+	return nil
+}
+
+func SetupAuthJWT(mwd *MwareDesc, p *swyapi.MwareAdd) {
+	if p.JWT != nil {
+		mwd.JWT = mkJWTConf(p.JWT)
+	}
+}
+
 func InitAuthJWT(ctx context.Context, mwd *MwareDesc) (error) {
 	var err error
 
+	if mwd.JWT != nil {
+		err = mwd.JWT.check()
+		if err != nil {
+			return err
+		}
+	}
+
+	if mwd.JWT.asymmetric() {
+		/* Make sure the keys are usable before accepting */
+		_, err = mwd.JWT.loadKeys()
+		return err
+	}
+
 	mwd.Secret, err = xh.GenRandId(32)
 	if err != nil {
 		return err
@@ -150,14 +402,35 @@ func InitAuthJWT(ctx context.Context, mwd *MwareDesc) (error) {
 	return nil
 }
 
+func RotateAuthJWT(ctx context.Context, mwd *MwareDesc) (error) {
+	if mwd.JWT.asymmetric() {
+		return errors.New("Keys are managed by the issuer")
+	}
+
+	return InitAuthJWT(ctx, mwd)
+}
+
 func FiniAuthJWT(ctx context.Context, mwd *MwareDesc) error {
+	authCtxs.Delete(mwd.Cookie)
 	return nil
 }
 
 func GetEnvAuthJWT(ctx context.Context, mwd *MwareDesc) map[string][]byte {
+	if mwd.JWT.asymmetric() {
+		return map[string][]byte{} /* Nothing to sign with */
+	}
+
 	return map[string][]byte{mwd.envName("SIGNKEY"): []byte(mwd.Secret)}
 }
 
+func InfoAuthJWT(ctx context.Context, mwd *MwareDesc, ifo *swyapi.MwareInfo) error {
+	if mwd.JWT != nil {
+		ifo.JWT = mwd.JWT.toInfo()
+	}
+
+	return nil
+}
+
 func TInfoAuthJWT(ctx context.Context) *swyapi.MwareTypeInfo {
 	return &swyapi.MwareTypeInfo {
 		Envs: []string {
@@ -167,9 +440,12 @@ func TInfoAuthJWT(ctx context.Context) *swyapi.MwareTypeInfo {
 }
 
 var MwareAuthJWT = MwareOps {
+	Setup:	SetupAuthJWT,
 	Init:	InitAuthJWT,
 	Fini:	FiniAuthJWT,
 	GetEnv:	GetEnvAuthJWT,
+	Rotate:	RotateAuthJWT,
+	Info:	InfoAuthJWT,
 	TInfo:	TInfoAuthJWT,
 	LiteOK:	true,
 }
@@ -0,0 +1,332 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"encoding/hex"
+	"crypto/sha256"
+	"net/http"
+	"net/url"
+	"context"
+	"errors"
+	"time"
+	"swifty/apis"
+	"swifty/common"
+	"swifty/common/ratelimit"
+	"swifty/common/xrest"
+)
+
+/*
+ * API keys for machine-to-machine clients. The key itself is shown
+ * only once on creation, the DB keeps its hash. Checked keys are
+ * cached on the AuthCtx for a while, so revocations done on other
+ * gates take up to authKeyCacheTmo to propagate.
+ */
+
+const (
+	authKeyHeader	= "X-API-Key"
+	authKeyQuery	= "api_key"
+	authKeyPrefix	= "swk_"
+	authKeyCacheTmo	= 30 * time.Second
+)
+
+var errAuthRatelimited = errors.New("Key ratelimited")
+
+type AuthKeyDesc struct {
+	ObjID		bson.ObjectId		`bson:"_id,omitempty"`
+	Tennant		string			`bson:"tennant"`
+	MwId		string			`bson:"mwid"`		// Mware cookie
+	Name		string			`bson:"name"`
+	Hash		string			`bson:"hash"`
+	Created		time.Time		`bson:"created"`
+	Expires		*time.Time		`bson:"expires,omitempty"`
+	Scopes		[]string		`bson:"scopes,omitempty"`
+	Rate		uint			`bson:"rate,omitempty"`
+	Burst		uint			`bson:"burst,omitempty"`
+	Meta		map[string]string	`bson:"meta,omitempty"`
+
+	key		string			`bson:"-"`
+}
+
+type authKeyMem struct {
+	kd	*AuthKeyDesc
+	rl	*xrl.RL
+	at	time.Time
+}
+
+func authKeyHash(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (ac *AuthCtx)findKey(hash string) (*authKeyMem, error) {
+	ac.lock.RLock()
+	km, ok := ac.kcache[hash]
+	ac.lock.RUnlock()
+
+	if ok && time.Since(km.at) < authKeyCacheTmo {
+		return km, nil
+	}
+
+	ctx, done := mkContext("::authkey")
+	defer done(ctx)
+
+	var kd AuthKeyDesc
+
+	err := dbFind(ctx, bson.M{"mwid": ac.mwid, "hash": hash}, &kd)
+	if err != nil {
+		if dbNF(err) {
+			ac.dropKey(hash)
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	nkm := &authKeyMem{kd: &kd, at: time.Now()}
+	if kd.Rate != 0 {
+		if ok && km.rl != nil {
+			nkm.rl = km.rl /* Don't reset the bucket on refresh */
+		} else {
+			nkm.rl = xrl.MakeRL(kd.Burst, kd.Rate)
+		}
+	}
+
+	ac.lock.Lock()
+	if ac.kcache == nil {
+		ac.kcache = make(map[string]*authKeyMem)
+	}
+	ac.kcache[hash] = nkm
+	ac.lock.Unlock()
+
+	return nkm, nil
+}
+
+func (ac *AuthCtx)dropKey(hash string) {
+	ac.lock.Lock()
+	delete(ac.kcache, hash)
+	ac.lock.Unlock()
+}
+
+func (ac *AuthCtx)verifyKey(r *http.Request) (map[string]interface{}, error) {
+	key := r.Header.Get(authKeyHeader)
+	if key == "" {
+		key = r.URL.Query().Get(authKeyQuery)
+		if key == "" {
+			return nil, errors.New("API key required")
+		}
+	}
+
+	km, err := ac.findKey(authKeyHash(key))
+	if err != nil {
+		return nil, errors.New("Error checking API key")
+	}
+
+	if km == nil {
+		return nil, errors.New("Bad API key")
+	}
+
+	kd := km.kd
+	if kd.Expires != nil && time.Now().After(*kd.Expires) {
+		return nil, errors.New("API key expired")
+	}
+
+	if km.rl != nil && !km.rl.Get() {
+		return nil, errAuthRatelimited
+	}
+
+	claims := map[string]interface{} {
+		"key":	kd.Name,
+		"kid":	kd.ObjID.Hex(),
+	}
+
+	if len(kd.Scopes) != 0 {
+		claims["scopes"] = kd.Scopes
+	}
+
+	if len(kd.Meta) != 0 {
+		claims["meta"] = kd.Meta
+	}
+
+	return claims, nil
+}
+
+func (kd *AuthKeyDesc)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	var okd AuthKeyDesc
+
+	err := dbFind(ctx, bson.M{"mwid": kd.MwId, "name": kd.Name}, &okd)
+	if err == nil {
+		return GateErrC(swyapi.GateDuplicate)
+	}
+	if !dbNF(err) {
+		return GateErrD(err)
+	}
+
+	kd.ObjID = bson.NewObjectId()
+	err = dbInsert(ctx, kd)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	return nil
+}
+
+func (kd *AuthKeyDesc)Info(ctx context.Context, q url.Values, details bool) (interface{}, *xrest.ReqErr) {
+	ifo := &swyapi.AuthKeyInfo {
+		Id:		kd.ObjID.Hex(),
+		Name:		kd.Name,
+		Key:		kd.key,
+		Created:	kd.Created.Format(time.RFC1123Z),
+		Scopes:		kd.Scopes,
+		Rate:		kd.Rate,
+		Burst:		kd.Burst,
+	}
+
+	if kd.Expires != nil {
+		ifo.Expires = kd.Expires.Format(time.RFC1123Z)
+	}
+
+	if details {
+		ifo.Meta = kd.Meta
+	}
+
+	return ifo, nil
+}
+
+func (kd *AuthKeyDesc)Upd(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	return GateErrM(swyapi.GateGenErr, "Not updatable")
+}
+
+func (kd *AuthKeyDesc)Del(ctx context.Context) *xrest.ReqErr {
+	err := dbRemove(ctx, kd)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	if x, ok := authCtxs.Load(kd.MwId); ok {
+		x.(*AuthCtx).dropKey(kd.Hash)
+	}
+
+	return nil
+}
+
+type AuthKeys struct {
+	mw	*MwareDesc
+}
+
+func (ks AuthKeys)Create(ctx context.Context, p interface{}) (xrest.Obj, *xrest.ReqErr) {
+	params := p.(*swyapi.AuthKeyAdd)
+
+	if params.Name == "" {
+		return nil, GateErrM(swyapi.GateBadRequest, "Key name required")
+	}
+
+	if params.Burst != 0 && params.Rate == 0 {
+		return nil, GateErrM(swyapi.GateBadRequest, "Burst without rate")
+	}
+
+	key, err := xh.GenRandId(32)
+	if err != nil {
+		return nil, GateErrM(swyapi.GateGenErr, "Can't generate key")
+	}
+
+	key = authKeyPrefix + key
+
+	kd := &AuthKeyDesc {
+		Tennant:	ks.mw.SwoId.Tennant,
+		MwId:		ks.mw.Cookie,
+		Name:		params.Name,
+		Hash:		authKeyHash(key),
+		Created:	time.Now(),
+		Scopes:		params.Scopes,
+		Rate:		params.Rate,
+		Burst:		params.Burst,
+		Meta:		params.Meta,
+		key:		key,
+	}
+
+	if params.Lifetime != 0 {
+		exp := kd.Created.Add(time.Duration(params.Lifetime) * time.Second)
+		kd.Expires = &exp
+	}
+
+	return kd, nil
+}
+
+func authKeyMwFindForReq(ctx context.Context, r *http.Request) (*MwareDesc, *xrest.ReqErr) {
+	var mw MwareDesc
+
+	cerr := objFindForReq(ctx, r, "mid", &mw)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	if mw.MwareType != "authkey" {
+		return nil, GateErrM(swyapi.GateBadRequest, "Not an authkey")
+	}
+
+	return &mw, nil
+}
+
+func (ks AuthKeys)Get(ctx context.Context, r *http.Request) (xrest.Obj, *xrest.ReqErr) {
+	var kd AuthKeyDesc
+
+	mw, cerr := authKeyMwFindForReq(ctx, r)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	cerr = objFindForReq2(ctx, r, "kid", &kd, bson.M{"mwid": mw.Cookie})
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	return &kd, nil
+}
+
+func (ks AuthKeys)Iterate(ctx context.Context, q url.Values, cb func(context.Context, xrest.Obj) *xrest.ReqErr) *xrest.ReqErr {
+	var kds []*AuthKeyDesc
+
+	err := dbFindAll(ctx, bson.M{"mwid": ks.mw.Cookie}, &kds)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	for _, kd := range kds {
+		cerr := cb(ctx, kd)
+		if cerr != nil {
+			return cerr
+		}
+	}
+
+	return nil
+}
+
+func InitAuthKey(ctx context.Context, mwd *MwareDesc) (error) {
+	return nil /* Keys are added later */
+}
+
+func FiniAuthKey(ctx context.Context, mwd *MwareDesc) error {
+	authCtxs.Delete(mwd.Cookie)
+	return dbAuthKeysRemove(ctx, mwd.Cookie)
+}
+
+func GetEnvAuthKey(ctx context.Context, mwd *MwareDesc) map[string][]byte {
+	return map[string][]byte{}
+}
+
+func TInfoAuthKey(ctx context.Context) *swyapi.MwareTypeInfo {
+	return &swyapi.MwareTypeInfo { }
+}
+
+var MwareAuthKey = MwareOps {
+	Init:	InitAuthKey,
+	Fini:	FiniAuthKey,
+	GetEnv:	GetEnvAuthKey,
+	TInfo:	TInfoAuthKey,
+	LiteOK:	true,
+}
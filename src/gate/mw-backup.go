@@ -0,0 +1,645 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"gopkg.in/robfig/cron.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/url"
+	"context"
+	"errors"
+	"sync"
+	"io"
+	"time"
+
+	"swifty/apis"
+	"swifty/common/xrest"
+)
+
+const (
+	DBMwBackupStateRun	int = 1	// Dumping or restoring
+	DBMwBackupStateRdy	int = 2
+	DBMwBackupStateErr	int = 3
+)
+
+var mwbStates = map[int]string {
+	DBMwBackupStateRun:	"running",
+	DBMwBackupStateRdy:	"ready",
+	DBMwBackupStateErr:	"failed",
+}
+
+/*
+ * All backups live in one bucket in tenant's default S3 namespace,
+ * objects are named project/mware/timestamp.ext
+ */
+const mwBackupBucket = "mwbackups"
+
+var mwBackupExt = map[string]string {
+	"maria":	".sql",
+	"postgres":	".dump",
+	"mongo":	".tar.gz",
+}
+
+type MwBackupSched struct {
+	Tab		string		`bson:"tab"`
+	Keep		uint32		`bson:"keep,omitempty"`
+}
+
+type MwBackupRestore struct {
+	Project		string		`bson:"project"`
+	Target		string		`bson:"target"`		// Mware name
+	State		int		`bson:"state"`
+	Started		time.Time	`bson:"started"`
+	Alive		time.Time	`bson:"alive,omitempty"`
+}
+
+type MwBackupDesc struct {
+	ObjID		bson.ObjectId	`bson:"_id,omitempty"`
+	Tennant		string		`bson:"tennant"`
+	MwId		string		`bson:"mwid"`		// Mware cookie
+	Object		string		`bson:"object"`
+	Size		uint64		`bson:"size"`
+	Created		time.Time	`bson:"created"`
+	State		int		`bson:"state"`
+	Alive		time.Time	`bson:"alive,omitempty"`	// Last seen running, see keepAlive
+	Auto		bool		`bson:"auto,omitempty"`	// Made by schedule
+	Note		string		`bson:"note,omitempty"`
+	Restore		*MwBackupRestore `bson:"restore,omitempty"`
+
+	mw		*MwareDesc	`bson:"-"`
+}
+
+func mwBackupCtx(ten string) (context.Context, func(context.Context)) {
+	return mkContext3("::mwbackup", ten, swyapi.AdminRole)
+}
+
+func (mw *MwareDesc)newBackup(auto bool, note string) (*MwBackupDesc, *xrest.ReqErr) {
+	if conf.Mware.S3 == nil {
+		return nil, GateErrM(swyapi.GateNotAvail, "S3 not configured")
+	}
+
+	handler, _ := mw.ops()
+	if handler.Backup == nil {
+		return nil, GateErrM(swyapi.GateNotAvail, "Backups not supported")
+	}
+
+	if mw.State != DBMwareStateRdy {
+		return nil, GateErrM(swyapi.GateGenErr, "Mware not ready")
+	}
+
+	now := time.Now()
+	return &MwBackupDesc {
+		Tennant:	mw.SwoId.Tennant,
+		MwId:		mw.Cookie,
+		Object:		mw.SwoId.Project + "/" + mw.SwoId.Name + "/" +
+					now.UTC().Format("20060102-150405") + mwBackupExt[mw.MwareType],
+		Created:	now,
+		State:		DBMwBackupStateRun,
+		Alive:		now,
+		Auto:		auto,
+		Note:		note,
+		mw:		mw,
+	}, nil
+}
+
+func (bd *MwBackupDesc)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	bd.ObjID = bson.NewObjectId()
+	err := dbInsert(ctx, bd)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	go func() {
+		bctx, done := mwBackupCtx(bd.Tennant)
+		defer done(bctx)
+
+		bd.run(bctx)
+	}()
+
+	return nil
+}
+
+/*
+ * Running backups and restores are marked alive by the gate doing
+ * them. Those not marked for several periods are failed by any gate,
+ * as the one running them must have died.
+ */
+var mwBackupAlivePeriod = 30 * time.Second
+
+const mwBackupStaleAfter = 3
+
+func (bd *MwBackupDesc)keepAlive(ctx context.Context, field string) func() {
+	stop := make(chan struct{})
+
+	go func() {
+		t := time.NewTicker(mwBackupAlivePeriod)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				err := dbUpdatePart(ctx, bd, bson.M{field: time.Now()})
+				if err != nil {
+					ctxlog(ctx).Errorf("Can't mark backup %s alive: %s", bd.Object, err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+func mwBackupsFailStale(ctx context.Context) {
+	err := dbMwBackupsFailStale(ctx, time.Now().Add(-mwBackupStaleAfter * mwBackupAlivePeriod))
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't fail stale backups: %s", err.Error())
+	}
+}
+
+/*
+ * The dump goes into S3 through a pipe as it's generated. If either
+ * side fails, the pipe is closed with the error, so that the other
+ * one stops too.
+ */
+func (bd *MwBackupDesc)run(ctx context.Context) error {
+	var sc *s3Conn
+	var size uint64
+
+	handler, _ := bd.mw.ops()
+	defer bd.keepAlive(ctx, "alive")()
+
+	ctxlog(ctx).Debugf("Backing up %s into %s", bd.mw.SwoId.Str(), bd.Object)
+
+	sc, err := s3Connect(bd.mw.SwoId.S3Namespace())
+	if err != nil {
+		goto out
+	}
+	defer sc.Close()
+
+	err = sc.MkBucket(mwBackupBucket)
+	if err != nil {
+		goto out
+	}
+
+	size, err = bd.dump(ctx, sc, handler)
+	if err != nil {
+		goto out
+	}
+
+	bd.Size = size
+	bd.State = DBMwBackupStateRdy
+	return dbUpdatePart(ctx, bd, bson.M{"state": bd.State, "size": bd.Size})
+
+out:
+	ctxlog(ctx).Errorf("Backup of %s failed: %s", bd.mw.SwoId.Str(), err.Error())
+	bd.State = DBMwBackupStateErr
+	dbUpdatePart(ctx, bd, bson.M{"state": bd.State})
+	return err
+}
+
+func (bd *MwBackupDesc)dump(ctx context.Context, sc *s3Conn, handler *MwareOps) (uint64, error) {
+	pr, pw := io.Pipe()
+	derr := make(chan error)
+
+	go func() {
+		err := handler.Backup(ctx, bd.mw, pw)
+		pw.CloseWithError(err)
+		derr <- err
+	}()
+
+	size, err := sc.PutStream(mwBackupBucket, bd.Object, pr)
+	pr.CloseWithError(err)
+	if e := <-derr; e != nil {
+		err = e
+	}
+
+	return size, err
+}
+
+func (bd *MwBackupDesc)Info(ctx context.Context, q url.Values, details bool) (interface{}, *xrest.ReqErr) {
+	ifo := &swyapi.MwareBackupInfo {
+		Id:		bd.ObjID.Hex(),
+		Created:	bd.Created.Format(time.RFC1123Z),
+		State:		mwbStates[bd.State],
+		Size:		bd.Size,
+		Auto:		bd.Auto,
+		Note:		bd.Note,
+	}
+
+	if details {
+		ifo.Bucket = mwBackupBucket
+		ifo.Object = bd.Object
+
+		if bd.Restore != nil {
+			ifo.Restore = &swyapi.MwareRestoreInfo {
+				Target:		bd.Restore.Project + "/" + bd.Restore.Target,
+				State:		mwbStates[bd.Restore.State],
+				Started:	bd.Restore.Started.Format(time.RFC1123Z),
+			}
+		}
+	}
+
+	return ifo, nil
+}
+
+func (bd *MwBackupDesc)Upd(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	return GateErrM(swyapi.GateGenErr, "Not updatable")
+}
+
+func (bd *MwBackupDesc)Del(ctx context.Context) *xrest.ReqErr {
+	if bd.State == DBMwBackupStateRun ||
+			(bd.Restore != nil && bd.Restore.State == DBMwBackupStateRun) {
+		return GateErrM(swyapi.GateGenErr, "Backup is busy")
+	}
+
+	err := bd.remove(ctx)
+	if err != nil {
+		return GateErrE(swyapi.GateGenErr, err)
+	}
+
+	return nil
+}
+
+func (bd *MwBackupDesc)remove(ctx context.Context) error {
+	if bd.State == DBMwBackupStateRdy {
+		sc, err := s3Connect(makeSwoId(bd.Tennant, DefaultProject, "").S3Namespace())
+		if err != nil {
+			return err
+		}
+
+		err = sc.Del(mwBackupBucket, bd.Object)
+		sc.Close()
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't remove backup object %s: %s", bd.Object, err.Error())
+			return errors.New("Error removing backup object")
+		}
+	}
+
+	return dbRemove(ctx, bd)
+}
+
+func (bd *MwBackupDesc)restoreTarget(ctx context.Context, rq *swyapi.MwareRestore) (*MwareDesc, *xrest.ReqErr) {
+	if bd.State != DBMwBackupStateRdy {
+		return nil, GateErrM(swyapi.GateGenErr, "Backup not ready")
+	}
+
+	if bd.Restore != nil && bd.Restore.State == DBMwBackupStateRun {
+		return nil, GateErrM(swyapi.GateGenErr, "Restore in progress")
+	}
+
+	tgt := bd.mw
+	if rq.Name != "" {
+		project := rq.Project
+		if project == "" {
+			project = bd.mw.SwoId.Project
+		}
+
+		id := ctxSwoId(ctx, project, rq.Name)
+
+		var mw MwareDesc
+
+		err := dbFind(ctx, id.dbReq(), &mw)
+		if err == nil {
+			if mw.MwareType != bd.mw.MwareType {
+				return nil, GateErrM(swyapi.GateBadRequest, "Mware type mismatch")
+			}
+
+			tgt = &mw
+		} else if dbNF(err) {
+			var cerr *xrest.ReqErr
+
+			tgt, cerr = getMwareDesc(id, &swyapi.MwareAdd{Type: bd.mw.MwareType})
+			if cerr != nil {
+				return nil, cerr
+			}
+
+			cerr = tgt.Add(ctx, nil)
+			if cerr != nil {
+				return nil, cerr
+			}
+		} else {
+			return nil, GateErrD(err)
+		}
+	}
+
+	if tgt.State != DBMwareStateRdy {
+		return nil, GateErrM(swyapi.GateGenErr, "Mware not ready")
+	}
+
+	if h, _ := tgt.ops(); h.Restore == nil {
+		return nil, GateErrM(swyapi.GateNotAvail, "Restore not supported")
+	}
+
+	return tgt, nil
+}
+
+func (bd *MwBackupDesc)RestoreTo(ctx context.Context, rq *swyapi.MwareRestore) *xrest.ReqErr {
+	tgt, cerr := bd.restoreTarget(ctx, rq)
+	if cerr != nil {
+		return cerr
+	}
+
+	now := time.Now()
+	bd.Restore = &MwBackupRestore {
+		Project:	tgt.SwoId.Project,
+		Target:		tgt.SwoId.Name,
+		State:		DBMwBackupStateRun,
+		Started:	now,
+		Alive:		now,
+	}
+
+	err := dbUpdatePart(ctx, bd, bson.M{"restore": bd.Restore})
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	go func() {
+		rctx, done := mwBackupCtx(bd.Tennant)
+		defer done(rctx)
+
+		st := DBMwBackupStateRdy
+		stop := bd.keepAlive(rctx, "restore.alive")
+		err := bd.restoreInto(rctx, tgt)
+		stop()
+		if err != nil {
+			ctxlog(rctx).Errorf("Restore of %s into %s failed: %s",
+					bd.Object, tgt.SwoId.Str(), err.Error())
+			st = DBMwBackupStateErr
+		}
+
+		dbUpdatePart(rctx, bd, bson.M{"restore.state": st})
+	}()
+
+	return nil
+}
+
+func (bd *MwBackupDesc)restoreInto(ctx context.Context, tgt *MwareDesc) error {
+	sc, err := s3Connect(makeSwoId(bd.Tennant, DefaultProject, "").S3Namespace())
+	if err != nil {
+		return err
+	}
+
+	defer sc.Close()
+
+	from, err := sc.GetStream(mwBackupBucket, bd.Object)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	handler, _ := tgt.ops()
+	return handler.Restore(ctx, tgt, from)
+}
+
+type MwBackups struct {
+	mw	*MwareDesc
+}
+
+func (bs MwBackups)Create(ctx context.Context, p interface{}) (xrest.Obj, *xrest.ReqErr) {
+	return bs.mw.newBackup(false, p.(*swyapi.MwareBackupAdd).Note)
+}
+
+func (bs MwBackups)Get(ctx context.Context, r *http.Request) (xrest.Obj, *xrest.ReqErr) {
+	var mw MwareDesc
+	var bd MwBackupDesc
+
+	cerr := objFindForReq(ctx, r, "mid", &mw)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	cerr = objFindForReq2(ctx, r, "bid", &bd, bson.M{"mwid": mw.Cookie})
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	bd.mw = &mw
+	return &bd, nil
+}
+
+func (bs MwBackups)Iterate(ctx context.Context, q url.Values, cb func(context.Context, xrest.Obj) *xrest.ReqErr) *xrest.ReqErr {
+	bks, err := dbMwBackupsList(ctx, bs.mw.Cookie, q.Get("auto") != "")
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	for _, bd := range bks {
+		bd.mw = bs.mw
+		cerr := cb(ctx, bd)
+		if cerr != nil {
+			return cerr
+		}
+	}
+
+	return nil
+}
+
+type MwBackupSchedProp struct { }
+
+func (_ *MwBackupSchedProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interface{}, *xrest.ReqErr) {
+	mw := o.(*MwareDesc)
+	if mw.Backup == nil {
+		return &swyapi.MwareBackupSched{}, nil
+	}
+
+	return &swyapi.MwareBackupSched{Tab: mw.Backup.Tab, Keep: mw.Backup.Keep}, nil
+}
+
+func (_ *MwBackupSchedProp)Upd(ctx context.Context, o xrest.Obj, p interface{}) *xrest.ReqErr {
+	return o.(*MwareDesc).setBackupSched(ctx, p.(*swyapi.MwareBackupSched))
+}
+
+func (mw *MwareDesc)setBackupSched(ctx context.Context, bs *swyapi.MwareBackupSched) *xrest.ReqErr {
+	var sched *MwBackupSched
+
+	if bs.Tab != "" {
+		if h, _ := mw.ops(); h.Backup == nil {
+			return GateErrM(swyapi.GateNotAvail, "Backups not supported")
+		}
+
+		_, err := cron.Parse(bs.Tab)
+		if err != nil {
+			return GateErrM(swyapi.GateBadRequest, "Bad crontab")
+		}
+
+		sched = &MwBackupSched{Tab: bs.Tab, Keep: bs.Keep}
+	}
+
+	err := dbUpdatePart(ctx, mw, bson.M{"backup": sched})
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	mw.Backup = sched
+	if sched == nil {
+		mwBackupUnschedule(mw)
+		return nil
+	}
+
+	err = mwBackupSchedule(mw)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't schedule backups for %s: %s", mw.SwoId.Str(), err.Error())
+		return GateErrM(swyapi.GateGenErr, "Cannot schedule backups")
+	}
+
+	return nil
+}
+
+/*
+ * Every gate has the schedules, so each auto backup fires on all of
+ * them. The first gate to move the mware's backup_run stamp runs it,
+ * the others see the stamp fresh and skip. The lease is shorter than
+ * any sane backup period, but longer than gates' clocks may differ.
+ */
+var mwBackupLease = 30 * time.Second
+
+func (mw *MwareDesc)backupLease(ctx context.Context) (bool, error) {
+	now := time.Now()
+	err := dbUpdatePart2(ctx, mw, bson.M{
+			"$or":	[]bson.M{
+				{ "backup_run": bson.M{"$exists": false} },
+				{ "backup_run": bson.M{"$lt": now.Add(-mwBackupLease)} },
+			},
+		}, bson.M{"backup_run": now})
+	if err != nil {
+		if dbNF(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	mw.BackupRun = now
+	return true, nil
+}
+
+var mwBackupJobs = map[string]cron.EntryID {}
+var mwBackupJobsLock sync.Mutex
+
+func mwBackupSchedule(mw *MwareDesc) error {
+	id := mw.ObjID
+	ten := mw.SwoId.Tennant
+
+	eid, err := cronRunner.AddFunc(mw.Backup.Tab, func() { mwBackupAuto(id, ten) })
+	if err != nil {
+		return err
+	}
+
+	mwBackupJobsLock.Lock()
+	if old, ok := mwBackupJobs[mw.Cookie]; ok {
+		cronRunner.Remove(old)
+	}
+	mwBackupJobs[mw.Cookie] = eid
+	mwBackupJobsLock.Unlock()
+
+	return nil
+}
+
+func mwBackupUnschedule(mw *MwareDesc) {
+	mwBackupJobsLock.Lock()
+	if eid, ok := mwBackupJobs[mw.Cookie]; ok {
+		cronRunner.Remove(eid)
+		delete(mwBackupJobs, mw.Cookie)
+	}
+	mwBackupJobsLock.Unlock()
+}
+
+func mwBackupAuto(id bson.ObjectId, ten string) {
+	ctx, done := mwBackupCtx(ten)
+	defer done(ctx)
+
+	var mw MwareDesc
+
+	err := dbFind(ctx, bson.M{"_id": id}, &mw)
+	if err != nil || mw.Backup == nil {
+		return
+	}
+
+	ok, err := mw.backupLease(ctx)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't lease scheduled backup for %s: %s", mw.SwoId.Str(), err.Error())
+		return
+	}
+	if !ok {
+		return /* Another gate does it */
+	}
+
+	bd, cerr := mw.newBackup(true, "")
+	if cerr != nil {
+		ctxlog(ctx).Errorf("Can't start scheduled backup for %s: %s", mw.SwoId.Str(), cerr.Message)
+		return
+	}
+
+	bd.ObjID = bson.NewObjectId()
+	err = dbInsert(ctx, bd)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't add scheduled backup for %s: %s", mw.SwoId.Str(), err.Error())
+		return
+	}
+
+	err = bd.run(ctx)
+	if err != nil || mw.Backup.Keep == 0 {
+		return
+	}
+
+	bks, err := dbMwBackupsList(ctx, mw.Cookie, true)
+	if err != nil {
+		return
+	}
+
+	kept := uint32(0)
+	for _, b := range bks {
+		if b.State == DBMwBackupStateRun {
+			continue
+		}
+		if b.Restore != nil && b.Restore.State == DBMwBackupStateRun {
+			continue
+		}
+
+		if b.State == DBMwBackupStateRdy && kept < mw.Backup.Keep {
+			kept++
+			continue
+		}
+
+		err = b.remove(ctx)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't drop old backup %s: %s", b.Object, err.Error())
+		}
+	}
+}
+
+func mwBackupsInit(ctx context.Context) error {
+	var err error
+
+	/* Other gates may be running backups, only fail those not alive */
+	mwBackupsFailStale(ctx)
+
+	go func() {
+		for {
+			time.Sleep(mwBackupAlivePeriod)
+
+			ctx, done := mkContext("::mwbackup-stale")
+			mwBackupsFailStale(ctx)
+			done(ctx)
+		}
+	}()
+
+	var mw MwareDesc
+
+	iter := dbIterAll(ctx, bson.M{"backup": bson.M{"$ne": nil}}, &mw)
+	defer iter.Close()
+
+	for iter.Next(&mw) {
+		err = mwBackupSchedule(&mw)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't schedule backups for %s: %s", mw.SwoId.Str(), err.Error())
+		}
+	}
+
+	return iter.Err()
+}
@@ -0,0 +1,232 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"github.com/streadway/amqp"
+	"database/sql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"net/url"
+	"context"
+	"errors"
+	"bufio"
+	"time"
+	"net"
+	"fmt"
+	"swifty/apis"
+)
+
+/*
+ * External mwares live outside of the platform. We only keep the
+ * creds (encrypted as usual) and check the thing is reachable on
+ * creation. Functions get the very same env as for our own mwares.
+ * The check connects via extDialer, so that tenant cannot make gate
+ * probe the cluster insides (see extaddr.go).
+ */
+
+const extDialTmo = 10 * time.Second
+
+func extDial(n, a string) (net.Conn, error) {
+	return extDialer(extDialTmo).Dial(n, a)
+}
+
+/* lib/pq wants both */
+type extPgDialer struct {}
+
+func (_ extPgDialer)Dial(n, a string) (net.Conn, error) {
+	return extDial(n, a)
+}
+
+func (_ extPgDialer)DialTimeout(n, a string, tmo time.Duration) (net.Conn, error) {
+	return extDialer(tmo).Dial(n, a)
+}
+
+func init() {
+	mysql.RegisterDial("swyext", func(a string) (net.Conn, error) {
+		return extDial("tcp", a)
+	})
+}
+
+func SetupExternal(mwd *MwareDesc, p *swyapi.MwareAdd) {
+	/* Will be copied into the desc by Init, so that the DB never sees plain secret */
+	mwd.ext = p.External
+}
+
+func extInit(ctx context.Context, mwd *MwareDesc, check func(*swyapi.MwareExternal) error) error {
+	if mwd.ext == nil {
+		return errors.New("No external creds")
+	}
+
+	err := check(mwd.ext)
+	if err != nil {
+		ctxlog(ctx).Errorf("External %s at %s unreachable: %s", mwd.MwareType, mwd.ExtAddr, err.Error())
+		return fmt.Errorf("Can't connect to %s", mwd.ExtAddr)
+	}
+
+	mwd.Client = mwd.ext.User
+	mwd.Secret = mwd.ext.Pass
+	mwd.Namespace = mwd.ext.DbName
+
+	return nil
+}
+
+func extCheckMongo(x *swyapi.MwareExternal) error {
+	s, err := mgo.DialWithInfo(&mgo.DialInfo {
+		Addrs:		[]string{x.Addr},
+		Database:	x.DbName,
+		Timeout:	extDialTmo,
+		Username:	x.User,
+		Password:	x.Pass,
+		DialServer:	func(a *mgo.ServerAddr) (net.Conn, error) {
+			return extDial("tcp", a.String())
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Close()
+	return nil
+}
+
+func extCheckMaria(x *swyapi.MwareExternal) error {
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@swyext(%s)/%s?timeout=%s",
+				x.User, x.Pass, x.Addr, x.DbName, extDialTmo.String()))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), extDialTmo)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+func extCheckPostgres(x *swyapi.MwareExternal) error {
+	u := url.URL{
+		Scheme:		"postgres",
+		User:		url.UserPassword(x.User, x.Pass),
+		Host:		x.Addr,
+		Path:		"/" + x.DbName,
+		RawQuery:	fmt.Sprintf("connect_timeout=%d", int(extDialTmo.Seconds())),
+	}
+
+	c, err := pq.DialOpen(extPgDialer{}, u.String())
+	if err != nil {
+		return err
+	}
+
+	c.Close()
+	return nil
+}
+
+func extCheckRabbit(x *swyapi.MwareExternal) error {
+	u := url.URL{
+		Scheme:		"amqp",
+		User:		url.UserPassword(x.User, x.Pass),
+		Host:		x.Addr,
+		Path:		"/" + x.DbName,
+	}
+
+	c, err := amqp.DialConfig(u.String(), amqp.Config{Dial: extDial})
+	if err != nil {
+		return err
+	}
+
+	c.Close()
+	return nil
+}
+
+func extRedisCmd(c net.Conn, rd *bufio.Reader, args ...string) error {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+
+	_, err := c.Write([]byte(cmd))
+	if err != nil {
+		return err
+	}
+
+	resp, err := rd.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if resp[0] != '+' {
+		return errors.New(resp)
+	}
+
+	return nil
+}
+
+func extCheckRedis(x *swyapi.MwareExternal) error {
+	c, err := extDial("tcp", x.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(extDialTmo))
+	rd := bufio.NewReader(c)
+
+	if x.Pass != "" {
+		args := []string{"AUTH", x.Pass}
+		if x.User != "" {
+			args = []string{"AUTH", x.User, x.Pass}
+		}
+
+		err = extRedisCmd(c, rd, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if x.DbName != "" {
+		err = extRedisCmd(c, rd, "SELECT", x.DbName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return extRedisCmd(c, rd, "PING")
+}
+
+func FiniExternal(ctx context.Context, mwd *MwareDesc) error {
+	return nil
+}
+
+func extGetEnv(extra string) func(context.Context, *MwareDesc) map[string][]byte {
+	return func(ctx context.Context, mwd *MwareDesc) map[string][]byte {
+		e := mwd.stdEnvs(mwd.ExtAddr)
+		e[mwd.envName(extra)] = []byte(mwd.Namespace)
+		return e
+	}
+}
+
+func mkExtOps(typ, extra string, check func(*swyapi.MwareExternal) error) *MwareOps {
+	return &MwareOps {
+		Setup:	SetupExternal,
+		Init:	func(ctx context.Context, mwd *MwareDesc) error { return extInit(ctx, mwd, check) },
+		Fini:	FiniExternal,
+		GetEnv:	extGetEnv(extra),
+		TInfo:	func(ctx context.Context) *swyapi.MwareTypeInfo {
+			return &swyapi.MwareTypeInfo{ Envs: stdEnvNames(typ, extra) }
+		},
+		LiteOK:	true,
+	}
+}
+
+var mwareExtHandlers = map[string]*MwareOps {
+	"maria":	mkExtOps("maria", "DBNAME", extCheckMaria),
+	"postgres":	mkExtOps("postgres", "DBNAME", extCheckPostgres),
+	"mongo":	mkExtOps("mongo", "DBNAME", extCheckMongo),
+	"rabbit":	mkExtOps("rabbit", "VHOST", extCheckRabbit),
+	"redis":	mkExtOps("redis", "DBNAME", extCheckRedis),
+}
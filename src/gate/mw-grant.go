@@ -0,0 +1,249 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strings"
+	"context"
+	"errors"
+
+	"swifty/apis"
+	"swifty/common"
+	"swifty/common/xrest"
+)
+
+/*
+ * Grant lets functions from another project of the same tenant
+ * attach the mware. Such functions refer to it as project/name.
+ * Read-only grants get their own backend client.
+ */
+type MwGrant struct {
+	Project		string		`bson:"project"`
+	RO		bool		`bson:"ro,omitempty"`
+	Client		string		`bson:"client,omitempty"`
+	Secret		string		`bson:"secret,omitempty"`	// Encrypted
+
+	mw		*MwareDesc	`bson:"-"`
+}
+
+func mwRef(project string, mw *MwareDesc) string {
+	if mw.SwoId.Project == project {
+		return mw.SwoId.Name
+	}
+
+	return mw.SwoId.Project + "/" + mw.SwoId.Name
+}
+
+func mwRefSplit(project, ref string) (string, string) {
+	if i := strings.IndexByte(ref, '/'); i != -1 {
+		return ref[:i], ref[i+1:]
+	}
+
+	return project, ref
+}
+
+func mwProjReq(project string) bson.M {
+	return bson.M{"$or": []bson.M{ {"project": project}, {"grants.project": project} }}
+}
+
+func (mw *MwareDesc)grantFor(project string) *MwGrant {
+	for _, g := range mw.Grants {
+		if g.Project == project {
+			return g
+		}
+	}
+
+	return nil
+}
+
+func (g *MwGrant)genCreds(ctx context.Context, mwd *MwareDesc) error {
+	tmp := MwareDesc{SwoId: mwd.SwoId}
+	err := mwareGenerateUserPassClient(ctx, &tmp)
+	if err != nil {
+		return err
+	}
+
+	g.Client = tmp.Client
+	g.Secret = tmp.Secret
+	return nil
+}
+
+func mwGrantSecId(mw *MwareDesc, g *MwGrant) string {
+	return "mw-" + xh.Cookify(mw.Cookie + "/ro/" + g.Project)
+}
+
+func mwGrantSecEnv(ctx context.Context, h *MwareOps, mw *MwareDesc, g *MwGrant) *secEnvs {
+	ro := *mw
+	ro.Client = g.Client
+	ro.Secret = g.Secret
+
+	return &secEnvs{
+		id: mwGrantSecId(mw, g),
+		envs: h.GetEnv(ctx, &ro),
+	}
+}
+
+func (mw *MwareDesc)addGrant(ctx context.Context, g *MwGrant) *xrest.ReqErr {
+	var err, erc error
+
+	if g.Project == "" || g.Project == mw.SwoId.Project {
+		return GateErrM(swyapi.GateBadRequest, "Bad project")
+	}
+
+	if mw.State != DBMwareStateRdy {
+		return GateErrM(swyapi.GateGenErr, "Mware not ready")
+	}
+
+	if mw.grantFor(g.Project) != nil {
+		return GateErrM(swyapi.GateDuplicate, "Already granted")
+	}
+
+	handler, _ := mw.ops()
+	if g.RO {
+		if handler.GrantRO == nil {
+			return GateErrM(swyapi.GateNotAvail, "Read-only access not supported")
+		}
+
+		err = handler.GrantRO(ctx, mw, g)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't add RO client for %s: %s", mw.SwoId.Str(), err.Error())
+			return GateErrM(swyapi.GateGenErr, "Cannot create read-only client")
+		}
+
+		err = k8sSecretAdd(ctx, mwGrantSecEnv(ctx, handler, mw, g))
+		if err != nil {
+			goto outh
+		}
+
+		g.Secret, err = xh.EncryptString(gateSecPas, g.Secret)
+		if err != nil {
+			ctxlog(ctx).Errorf("Mw secret encrypt error: %s", err.Error())
+			err = errors.New("Encrypt error")
+			goto outs
+		}
+	}
+
+	err = dbMwareUpdate(ctx, bson.M{"_id": mw.ObjID, "grants.project": bson.M{"$ne": g.Project}},
+				bson.M{"$push": bson.M{"grants": g}})
+	if err != nil {
+		if dbNF(err) {
+			err = errors.New("Already granted")
+		}
+		goto outs
+	}
+
+	mw.Grants = append(mw.Grants, g)
+	return nil
+
+outs:
+	if g.RO {
+		erc = k8sSecretRemove(ctx, mwGrantSecId(mw, g))
+		if erc != nil {
+			ctxlog(ctx).Errorf("Can't remove RO secret for %s: %s", mw.SwoId.Str(), erc.Error())
+		}
+	}
+outh:
+	if g.RO {
+		erc = handler.RevokeRO(ctx, mw, g)
+		if erc != nil {
+			ctxlog(ctx).Errorf("Can't drop RO client for %s: %s", mw.SwoId.Str(), erc.Error())
+		}
+	}
+
+	return GateErrE(swyapi.GateGenErr, err)
+}
+
+func (mw *MwareDesc)revokeGrant(ctx context.Context, g *MwGrant) error {
+	if g.RO {
+		handler, _ := mw.ops()
+		err := handler.RevokeRO(ctx, mw, g)
+		if err != nil {
+			return err
+		}
+
+		err = k8sSecretRemove(ctx, mwGrantSecId(mw, g))
+		if err != nil {
+			return err
+		}
+	}
+
+	return dbMwareUpdate(ctx, bson.M{"_id": mw.ObjID}, bson.M{"$pull": bson.M{"grants": bson.M{"project": g.Project}}})
+}
+
+func (g *MwGrant)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	return g.mw.addGrant(ctx, g)
+}
+
+func (g *MwGrant)Del(ctx context.Context) *xrest.ReqErr {
+	var fn FunctionDesc
+
+	err := dbFind(ctx, bson.M{"tennant": g.mw.SwoId.Tennant, "project": g.Project,
+				"mware": mwRef(g.Project, g.mw)}, &fn)
+	if err == nil {
+		return GateErrM(swyapi.GateGenErr, "Mware is used by " + fn.SwoId.Str())
+	}
+	if !dbNF(err) {
+		return GateErrD(err)
+	}
+
+	err = g.mw.revokeGrant(ctx, g)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't revoke %s grant on %s: %s", g.Project, g.mw.SwoId.Str(), err.Error())
+		return GateErrM(swyapi.GateGenErr, "Cannot revoke grant")
+	}
+
+	return nil
+}
+
+func (g *MwGrant)Upd(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	return GateErrM(swyapi.GateGenErr, "Not updatable")
+}
+
+func (g *MwGrant)Info(ctx context.Context, q url.Values, details bool) (interface{}, *xrest.ReqErr) {
+	return &swyapi.MwareGrant{Project: g.Project, ReadOnly: g.RO}, nil
+}
+
+type MwGrants struct {
+	mw	*MwareDesc
+}
+
+func (gs MwGrants)Create(ctx context.Context, p interface{}) (xrest.Obj, *xrest.ReqErr) {
+	params := p.(*swyapi.MwareGrant)
+	return &MwGrant{Project: params.Project, RO: params.ReadOnly, mw: gs.mw}, nil
+}
+
+func (gs MwGrants)Get(ctx context.Context, r *http.Request) (xrest.Obj, *xrest.ReqErr) {
+	var mw MwareDesc
+
+	cerr := objFindForReq(ctx, r, "mid", &mw)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	g := mw.grantFor(mux.Vars(r)["project"])
+	if g == nil {
+		return nil, GateErrM(swyapi.GateNotFound, "No such grant")
+	}
+
+	g.mw = &mw
+	return g, nil
+}
+
+func (gs MwGrants)Iterate(ctx context.Context, q url.Values, cb func(context.Context, xrest.Obj) *xrest.ReqErr) *xrest.ReqErr {
+	for _, g := range gs.mw.Grants {
+		g.mw = gs.mw
+		cerr := cb(ctx, g)
+		if cerr != nil {
+			return cerr
+		}
+	}
+
+	return nil
+}
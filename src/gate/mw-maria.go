@@ -7,8 +7,13 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"io"
+	"bytes"
 	"errors"
 	"context"
+	"os/exec"
+	"strings"
 	"swifty/apis"
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
@@ -125,6 +130,178 @@ func FiniMariaDB(ctx context.Context, mwd *MwareDesc) error {
 	return nil
 }
 
+func RotateMariaDB(ctx context.Context, mwd *MwareDesc) error {
+	prev := mwd.Client
+
+	err := mwareGenerateUserPassClient(ctx, mwd)
+	if err != nil {
+		return err
+	}
+
+	db, err := mariaConn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = mariaReq(db, "CREATE USER '" + mwd.Client + "'@'%' IDENTIFIED BY '" + mwd.Secret + "';")
+	if err != nil {
+		return err
+	}
+
+	err = mariaCopyGrants(db, prev, mwd.Client)
+	if err != nil {
+		mariaDropUser(ctx, db, mwd)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * The new user gets exactly what the old one has, e.g. if mquotad
+ * has the db locked, the rotated creds must stay locked too.
+ */
+func mariaCopyGrants(db *sql.DB, from, to string) error {
+	rows, err := db.Query("SHOW GRANTS FOR '" + from + "'@'%';")
+	if err != nil {
+		return err
+	}
+
+	var grants []string
+	for rows.Next() {
+		var g string
+
+		err = rows.Scan(&g)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		grants = append(grants, g)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	ofrom := " TO '" + from + "'@'%'"
+	oto := " TO '" + to + "'@'%'"
+
+	for _, g := range grants {
+		if strings.HasPrefix(g, "GRANT USAGE ON *.*") {
+			continue
+		}
+
+		i := strings.Index(g, ofrom)
+		if i == -1 {
+			return errors.New("Unexpected grant " + g)
+		}
+
+		/* Drop the IDENTIFIED BY PASSWORD tail, if any */
+		err = mariaReq(db, g[:i] + oto + ";")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RevokeMariaDB(ctx context.Context, mwd *MwareDesc, prev *MwarePrevCreds) error {
+	db, err := mariaConn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return mariaReq(db, "DROP USER IF EXISTS '" + prev.Client + "'@'%';")
+}
+
+func GrantROMariaDB(ctx context.Context, mwd *MwareDesc, g *MwGrant) error {
+	err := g.genCreds(ctx, mwd)
+	if err != nil {
+		return err
+	}
+
+	db, err := mariaConn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = mariaReq(db, "CREATE USER '" + g.Client + "'@'%' IDENTIFIED BY '" + g.Secret + "';")
+	if err != nil {
+		return err
+	}
+
+	err = mariaReq(db, "GRANT SELECT, SHOW VIEW ON " + mwd.Namespace + ".* TO '" + g.Client + "'@'%';")
+	if err != nil {
+		mariaReq(db, "DROP USER IF EXISTS '" + g.Client + "'@'%';")
+		return err
+	}
+
+	return nil
+}
+
+func RevokeROMariaDB(ctx context.Context, mwd *MwareDesc, g *MwGrant) error {
+	db, err := mariaConn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return mariaReq(db, "DROP USER IF EXISTS '" + g.Client + "'@'%';")
+}
+
+func mariaCmd(tool string, args ...string) *exec.Cmd {
+	c := conf.Mware.Maria.c
+	cmd := exec.Command(tool, append([]string{"-h", c.Host, "-P", c.Port, "-u", c.User}, args...)...)
+	/* Don't show the password in ps */
+	cmd.Env = append(os.Environ(), "MYSQL_PWD=" + c.Pass)
+	return cmd
+}
+
+func BackupMariaDB(ctx context.Context, mwd *MwareDesc, to io.Writer) error {
+	var errb bytes.Buffer
+
+	if conf.Mware.Maria == nil {
+		return errors.New("Not configured")
+	}
+
+	cmd := mariaCmd("mysqldump", "--single-transaction", "--routines", "--triggers", mwd.Namespace)
+	cmd.Stdout = to
+	cmd.Stderr = &errb
+	err := cmd.Run()
+	if err != nil {
+		ctxlog(ctx).Errorf("maria: can't dump %s: %s (%s)", mwd.Namespace, err.Error(), errb.String())
+		return errors.New("Dump error")
+	}
+
+	return nil
+}
+
+func RestoreMariaDB(ctx context.Context, mwd *MwareDesc, from io.Reader) error {
+	var errb bytes.Buffer
+
+	if conf.Mware.Maria == nil {
+		return errors.New("Not configured")
+	}
+
+	cmd := mariaCmd("mysql", mwd.Namespace)
+	cmd.Stdin = from
+	cmd.Stderr = &errb
+	err := cmd.Run()
+	if err != nil {
+		ctxlog(ctx).Errorf("maria: can't restore %s: %s (%s)", mwd.Namespace, err.Error(), errb.String())
+		return errors.New("Restore error")
+	}
+
+	return nil
+}
+
 func GetEnvMariaDB(ctx context.Context, mwd *MwareDesc) map[string][]byte {
 	e := mwd.stdEnvs(conf.Mware.Maria.c.Addr())
 	e[mwd.envName("DBNAME")] = []byte(mwd.Namespace)
@@ -162,6 +339,16 @@ func InfoMariaDB(ctx context.Context, mwd *MwareDesc, ifo *swyapi.MwareInfo) err
 	}
 
 	ifo.SetDU(size)
+
+	if conf.Mware.Maria.QuotPort != "" {
+		st, err := mwQuotaStatus(conf.Mware.Maria.c, conf.Mware.Maria.QuotPort, mwd)
+		if err != nil {
+			ctxlog(ctx).Errorf("Error getting maria quota status: %s", err.Error())
+		} else if st.Locked {
+			ifo.Locked = "over quota"
+		}
+	}
+
 	return nil
 }
 
@@ -175,6 +362,12 @@ var MwareMariaDB = MwareOps {
 	Init:	InitMariaDB,
 	Fini:	FiniMariaDB,
 	GetEnv:	GetEnvMariaDB,
+	Rotate:	RotateMariaDB,
+	Revoke:	RevokeMariaDB,
+	Backup:	BackupMariaDB,
+	Restore:RestoreMariaDB,
+	GrantRO:GrantROMariaDB,
+	RevokeRO:RevokeROMariaDB,
 	Info:	InfoMariaDB,
 	TInfo:	TInfoMaria,
 }
@@ -7,9 +7,18 @@ package main
 
 import (
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"context"
 	"errors"
+	"strings"
 	"time"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"archive/tar"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
 	"swifty/apis"
 )
 
@@ -73,6 +82,315 @@ func FiniMongo(ctx context.Context, mwd *MwareDesc) error {
 	return nil
 }
 
+func RotateMongo(ctx context.Context, mwd *MwareDesc) error {
+	err := mwareGenerateUserPassClient(ctx, mwd)
+	if err != nil {
+		return err
+	}
+
+	sess, err := mgoDial(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	return sess.DB(mwd.Namespace).UpsertUser(&mgo.User{
+		Username: mwd.Client,
+		Password: mwd.Secret,
+		Roles: []mgo.Role{ "dbOwner" },
+	})
+}
+
+func RevokeMongo(ctx context.Context, mwd *MwareDesc, prev *MwarePrevCreds) error {
+	sess, err := mgoDial(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	err = sess.DB(mwd.Namespace).RemoveUser(prev.Client)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+
+	return err
+}
+
+func GrantROMongo(ctx context.Context, mwd *MwareDesc, g *MwGrant) error {
+	err := g.genCreds(ctx, mwd)
+	if err != nil {
+		return err
+	}
+
+	sess, err := mgoDial(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	return sess.DB(mwd.Namespace).UpsertUser(&mgo.User{
+		Username: g.Client,
+		Password: g.Secret,
+		Roles: []mgo.Role{ mgo.RoleRead },
+	})
+}
+
+func RevokeROMongo(ctx context.Context, mwd *MwareDesc, g *MwGrant) error {
+	return RevokeMongo(ctx, mwd, &MwarePrevCreds{Client: g.Client})
+}
+
+/*
+ * The dump is a tar.gz with <coll>.bson and <coll>.indexes.json
+ * files, the former being the plain sequence of documents just
+ * like mongodump generates them. Tar needs the size of the file
+ * in advance, so big collections go as several <coll>.bson ones
+ * of about mgoDumpChunk bytes each, to be loaded one after another.
+ */
+const mgoDumpChunk = 4 << 20
+
+func mgoTarAdd(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:		name,
+		Mode:		0600,
+		Size:		int64(len(data)),
+		ModTime:	time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(data)
+	return err
+}
+
+func mgoDumpColl(tw *tar.Writer, col *mgo.Collection) error {
+	var docs bytes.Buffer
+	var doc bson.Raw
+
+	chunks := 0
+	iter := col.Find(nil).Iter()
+	for iter.Next(&doc) {
+		docs.Write(doc.Data)
+		if docs.Len() < mgoDumpChunk {
+			continue
+		}
+
+		err := mgoTarAdd(tw, col.Name + ".bson", docs.Bytes())
+		if err != nil {
+			iter.Close()
+			return err
+		}
+
+		docs.Reset()
+		chunks++
+	}
+
+	err := iter.Close()
+	if err != nil {
+		return err
+	}
+
+	if docs.Len() > 0 || chunks == 0 {
+		err = mgoTarAdd(tw, col.Name + ".bson", docs.Bytes())
+	}
+
+	return err
+}
+
+func BackupMongo(ctx context.Context, mwd *MwareDesc, to io.Writer) error {
+	sess, err := mgoDial(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	db := sess.DB(mwd.Namespace)
+	colls, err := db.CollectionNames()
+	if err != nil {
+		ctxlog(ctx).Errorf("mongo: can't list collections in %s: %s", mwd.Namespace, err.Error())
+		return errors.New("Dump error")
+	}
+
+	gz := gzip.NewWriter(to)
+	tw := tar.NewWriter(gz)
+
+	for _, cn := range colls {
+		if strings.HasPrefix(cn, "system.") {
+			continue
+		}
+
+		err = mgoDumpColl(tw, db.C(cn))
+		if err != nil {
+			ctxlog(ctx).Errorf("mongo: can't dump %s.%s: %s", mwd.Namespace, cn, err.Error())
+			return errors.New("Dump error")
+		}
+
+		idxs, err := db.C(cn).Indexes()
+		if err != nil {
+			ctxlog(ctx).Errorf("mongo: can't get %s.%s indexes: %s", mwd.Namespace, cn, err.Error())
+			return errors.New("Dump error")
+		}
+
+		ij, _ := json.Marshal(idxs)
+
+		err = mgoTarAdd(tw, cn + ".indexes.json", ij)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+
+	return err
+}
+
+const mgoRestoreBatch = 1024
+
+func mgoRestoreDocs(col *mgo.Collection, from io.Reader) error {
+	var docs []interface{}
+	var hdr [4]byte
+
+	for {
+		_, err := io.ReadFull(from, hdr[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New("Corrupted dump")
+		}
+
+		l := int(binary.LittleEndian.Uint32(hdr[:]))
+		if l < 5 || l > 16 << 20 {
+			return errors.New("Corrupted dump")
+		}
+
+		data := make([]byte, l)
+		copy(data, hdr[:])
+		_, err = io.ReadFull(from, data[4:])
+		if err != nil {
+			return errors.New("Corrupted dump")
+		}
+
+		docs = append(docs, bson.Raw{Kind: 0x03, Data: data})
+
+		if len(docs) == mgoRestoreBatch {
+			err := col.Insert(docs...)
+			if err != nil {
+				return err
+			}
+			docs = docs[:0]
+		}
+	}
+
+	if len(docs) > 0 {
+		return col.Insert(docs...)
+	}
+
+	return nil
+}
+
+func mgoRestoreIndexes(col *mgo.Collection, data []byte) error {
+	var idxs []mgo.Index
+
+	err := json.Unmarshal(data, &idxs)
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range idxs {
+		if idx.Name == "_id_" {
+			continue
+		}
+
+		err = col.EnsureIndex(idx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Restore replaces the whole contents, so collections that are not
+ * in the dump should go away too.
+ */
+func mgoDropAll(db *mgo.Database) error {
+	colls, err := db.CollectionNames()
+	if err != nil {
+		return err
+	}
+
+	for _, cn := range colls {
+		if strings.HasPrefix(cn, "system.") {
+			continue
+		}
+
+		err = db.C(cn).DropCollection()
+		if err != nil && !strings.Contains(err.Error(), "ns not found") {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RestoreMongo(ctx context.Context, mwd *MwareDesc, from io.Reader) error {
+	sess, err := mgoDial(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	gz, err := gzip.NewReader(from)
+	if err != nil {
+		return errors.New("Corrupted dump")
+	}
+
+	db := sess.DB(mwd.Namespace)
+	err = mgoDropAll(db)
+	if err != nil {
+		ctxlog(ctx).Errorf("mongo: can't clean %s: %s", mwd.Namespace, err.Error())
+		return errors.New("Restore error")
+	}
+
+	tr := tar.NewReader(gz)
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New("Corrupted dump")
+		}
+
+		switch {
+		case strings.HasSuffix(h.Name, ".indexes.json"):
+			var fd []byte
+
+			fd, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return errors.New("Corrupted dump")
+			}
+
+			err = mgoRestoreIndexes(db.C(strings.TrimSuffix(h.Name, ".indexes.json")), fd)
+		case strings.HasSuffix(h.Name, ".bson"):
+			err = mgoRestoreDocs(db.C(strings.TrimSuffix(h.Name, ".bson")), tr)
+		}
+
+		if err != nil {
+			ctxlog(ctx).Errorf("mongo: can't restore %s/%s: %s", mwd.Namespace, h.Name, err.Error())
+			return errors.New("Restore error")
+		}
+	}
+
+	return nil
+}
+
 func GetEnvMongo(ctx context.Context, mwd *MwareDesc) map[string][]byte {
 	e := mwd.stdEnvs(conf.Mware.Mongo.c.Addr())
 	e[mwd.envName("DBNAME")] = []byte(mwd.Namespace)
@@ -113,6 +431,12 @@ var MwareMongo = MwareOps {
 	Init:	InitMongo,
 	Fini:	FiniMongo,
 	GetEnv:	GetEnvMongo,
+	Rotate:	RotateMongo,
+	Revoke:	RevokeMongo,
+	Backup:	BackupMongo,
+	Restore:RestoreMongo,
+	GrantRO:GrantROMongo,
+	RevokeRO:RevokeROMongo,
 	Info:	InfoMongo,
 	TInfo:	TInfoMongo,
 	LiteOK:	true,
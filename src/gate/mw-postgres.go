@@ -7,18 +7,45 @@ package main
 
 import (
 	"errors"
+	"bytes"
+	"io"
+	"io/ioutil"
 	"strings"
 	"context"
+	"net/http"
+	"encoding/json"
 	"swifty/common/http"
 	"swifty/apis"
 )
 
+const (
+	pgDefSizeMB = 256
+)
+
+func pgSizeLimit(ctx context.Context) (uint64, error) {
+	tmd, err := tendatGet(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if lim, ok := tmd.mwl["postgres"]; ok && lim.SizeMB != 0 {
+		return lim.SizeMB << 20, nil
+	}
+
+	return pgDefSizeMB << 20, nil
+}
+
 func InitPostgres(ctx context.Context, mwd *MwareDesc) (error) {
 	if conf.Mware.Postgres == nil {
 		return errors.New("Not configured")
 	}
 
-	err := mwareGenerateUserPassClient(ctx, mwd)
+	size, err := pgSizeLimit(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = mwareGenerateUserPassClient(ctx, mwd)
 	if err != nil {
 		return err
 	}
@@ -37,6 +64,7 @@ func InitPostgres(ctx context.Context, mwd *MwareDesc) (error) {
 			&swyapi.PgRequest{
 				Token: conf.Mware.Postgres.c.Pass,
 				User: mwd.Client, Pass: mwd.Secret, DbName: mwd.Namespace,
+				Size: size,
 			})
 	return err
 }
@@ -56,15 +84,151 @@ func FiniPostgres(ctx context.Context, mwd *MwareDesc) error {
 	return err
 }
 
+func pgReq(req string, rq *swyapi.PgRequest) error {
+	if conf.Mware.Postgres == nil {
+		return errors.New("Not configured")
+	}
+
+	rq.Token = conf.Mware.Postgres.c.Pass
+
+	addr := conf.Mware.Postgres.c.AddrP(conf.Mware.Postgres.AdminPort)
+	_, err := xhttp.Req(
+			&xhttp.RestReq{
+				Address: "http://" + addr + "/" + req,
+				Timeout: 120,
+			}, rq)
+
+	return err
+}
+
+func RotatePostgres(ctx context.Context, mwd *MwareDesc) error {
+	owner := mwd.Client
+
+	err := mwareGenerateUserPassClient(ctx, mwd)
+	if err != nil {
+		return err
+	}
+
+	mwd.Client = "p" + strings.ToLower(mwd.Client[:30])
+
+	return pgReq("rotate", &swyapi.PgRequest{
+			User: mwd.Client, Pass: mwd.Secret,
+			DbName: mwd.Namespace, Owner: owner,
+		})
+}
+
+func RevokePostgres(ctx context.Context, mwd *MwareDesc, prev *MwarePrevCreds) error {
+	return pgReq("revoke", &swyapi.PgRequest{
+			User: prev.Client, DbName: mwd.Namespace, Owner: mwd.Client,
+		})
+}
+
+func GrantROPostgres(ctx context.Context, mwd *MwareDesc, g *MwGrant) error {
+	err := g.genCreds(ctx, mwd)
+	if err != nil {
+		return err
+	}
+
+	g.Client = "p" + strings.ToLower(g.Client[:30])
+
+	return pgReq("grantro", &swyapi.PgRequest{
+			User: g.Client, Pass: g.Secret,
+			DbName: mwd.Namespace, Owner: mwd.Client,
+		})
+}
+
+func RevokeROPostgres(ctx context.Context, mwd *MwareDesc, g *MwGrant) error {
+	return pgReq("revokero", &swyapi.PgRequest{
+			User: g.Client, DbName: mwd.Namespace,
+		})
+}
+
+func BackupPostgres(ctx context.Context, mwd *MwareDesc, to io.Writer) error {
+	if conf.Mware.Postgres == nil {
+		return errors.New("Not configured")
+	}
+
+	addr := conf.Mware.Postgres.c.AddrP(conf.Mware.Postgres.AdminPort)
+	resp, err := xhttp.Req(
+			&xhttp.RestReq{
+				Address: "http://" + addr + "/dump",
+				Timeout: 600,
+			},
+			&swyapi.PgRequest{
+				Token: conf.Mware.Postgres.c.Pass,
+				DbName: mwd.Namespace,
+			})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	_, err = io.Copy(to, resp.Body)
+	return err
+}
+
+/* The pgrest reads the request and then the dump from the same body */
+func RestorePostgres(ctx context.Context, mwd *MwareDesc, from io.Reader) error {
+	if conf.Mware.Postgres == nil {
+		return errors.New("Not configured")
+	}
+
+	rq, _ := json.Marshal(&swyapi.PgRequest{
+			Token: conf.Mware.Postgres.c.Pass,
+			User: mwd.Client, DbName: mwd.Namespace,
+		})
+
+	addr := conf.Mware.Postgres.c.AddrP(conf.Mware.Postgres.AdminPort)
+	resp, err := http.Post("http://" + addr + "/restore", "application/octet-stream",
+			io.MultiReader(bytes.NewReader(rq), from))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("Restore error: " + strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
 func GetEnvPostgres(ctx context.Context, mwd *MwareDesc) map[string][]byte {
 	e := mwd.stdEnvs(conf.Mware.Postgres.c.Addr())
 	e[mwd.envName("DBNAME")] = []byte(mwd.Namespace)
 	return e
 }
 
+func InfoPostgres(ctx context.Context, mwd *MwareDesc, ifo *swyapi.MwareInfo) error {
+	if conf.Mware.Postgres.QuotPort == "" {
+		return nil
+	}
+
+	st, err := mwQuotaStatus(conf.Mware.Postgres.c, conf.Mware.Postgres.QuotPort, mwd)
+	if err != nil {
+		ctxlog(ctx).Errorf("Error getting postgres quota status: %s", err.Error())
+		return errors.New("Error getting DB size")
+	}
+
+	ifo.SetDU(st.Size)
+	if st.Locked {
+		ifo.Locked = "over quota"
+	}
+
+	return nil
+}
+
 var MwarePostgres = MwareOps {
 	Init:	InitPostgres,
 	Fini:	FiniPostgres,
 	GetEnv:	GetEnvPostgres,
+	Rotate:	RotatePostgres,
+	Revoke:	RevokePostgres,
+	Backup:	BackupPostgres,
+	Restore:RestorePostgres,
+	GrantRO:GrantROPostgres,
+	RevokeRO:RevokeROPostgres,
+	Info:	InfoPostgres,
 	Disabled:  true,
 }
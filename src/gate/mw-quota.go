@@ -0,0 +1,104 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"fmt"
+	"context"
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"swifty/apis"
+	"swifty/common"
+	"swifty/common/http"
+)
+
+/*
+ * Quota daemons (mquotad for maria, pgquotad for postgres) lock
+ * the DBs that grow too big. They tell us about it via the mq
+ * and report the current state via their status endpoints.
+ */
+
+const mquotaQueue = "mquota"
+
+func mwQuotaStatus(c *xh.XCreds, port string, mwd *MwareDesc) (*swyapi.MquotaStatus, error) {
+	var st swyapi.MquotaStatus
+
+	resp, err := xhttp.Req(
+			&xhttp.RestReq{
+				Address: "http://" + c.AddrP(port) + "/status",
+				Timeout: 5,
+			}, &swyapi.MquotaRequest{
+				Token: c.Pass,
+				DbName: mwd.Namespace,
+			})
+	if err != nil {
+		return nil, err
+	}
+
+	err = xhttp.RResp(resp, &st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+func handleMquotaEvent(ctx context.Context, user string, data []byte) {
+	var st swyapi.MquotaStatus
+	var mw MwareDesc
+
+	err := json.Unmarshal(data, &st)
+	if err != nil {
+		ctxlog(ctx).Errorf("Invalid event from quota daemon")
+		return
+	}
+
+	if st.Type == "" {
+		st.Type = "maria"
+	}
+
+	err = dbFind(ctx, bson.M{"mwaretype": st.Type, "namespace": st.DbName}, &mw)
+	if err != nil {
+		ctxlog(ctx).Errorf("mq: No %s mware for %s quota event", st.Type, st.DbName)
+		return
+	}
+
+	if st.Locked {
+		why := fmt.Sprintf("%d/%d bytes", st.Size, st.SizeL)
+		if st.RowsL != 0 {
+			why += fmt.Sprintf(", %d/%d rows", st.Rows, st.RowsL)
+		}
+		logSaveEvent(ctx, mw.Cookie, "locked: over quota (" + why + ")")
+	} else {
+		logSaveEvent(ctx, mw.Cookie, "unlocked")
+	}
+}
+
+func mwQuotaListen(cn *xh.XCreds) error {
+	if cn == nil {
+		return nil
+	}
+
+	return mqStartListener(cn.User, cn.Pass, cn.Addr() + "/" + cn.Domn, mquotaQueue, handleMquotaEvent)
+}
+
+func mwQuotaInit(ctx context.Context) error {
+	if conf.Mware.Maria != nil {
+		err := mwQuotaListen(conf.Mware.Maria.cn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.Mware.Postgres != nil {
+		err := mwQuotaListen(conf.Mware.Postgres.cn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -94,6 +94,46 @@ func FiniRabbitMQ(ctx context.Context, mwd *MwareDesc) error {
 	return nil
 }
 
+func RotateRabbitMQ(ctx context.Context, mwd *MwareDesc) error {
+	err := mwareGenerateUserPassClient(ctx, mwd)
+	if err != nil {
+		return err
+	}
+
+	rmqc, err := rabbitConn()
+	if err != nil {
+		return err
+	}
+
+	err = rabbitErr(rmqc.PutUser(mwd.Client, rabbithole.UserSettings{Password: mwd.Secret}))
+	if err != nil {
+		return fmt.Errorf("Can't create user %s: %s", mwd.Client, err.Error())
+	}
+
+	err = rabbitErr(rmqc.UpdatePermissionsIn(mwd.Namespace, mwd.Client,
+			rabbithole.Permissions{Configure: ".*", Write: ".*", Read: ".*"}))
+	if err != nil {
+		rmqc.DeleteUser(mwd.Client)
+		return fmt.Errorf("Can't set permissions %s: %s", mwd.Client, err.Error())
+	}
+
+	return nil
+}
+
+func RevokeRabbitMQ(ctx context.Context, mwd *MwareDesc, prev *MwarePrevCreds) error {
+	rmqc, err := rabbitConn()
+	if err != nil {
+		return err
+	}
+
+	err = rabbitErr(rmqc.DeleteUser(prev.Client))
+	if err != nil {
+		return fmt.Errorf("Can't delete user %s: %s", prev.Client, err.Error())
+	}
+
+	return nil
+}
+
 func mqEvent(ctx context.Context, mwid, queue, userid, data string) {
 	var mware MwareDesc
 	err := dbFind(ctx, bson.M{"mwaretype": "rabbit", "client": userid}, &mware)
@@ -121,6 +161,8 @@ var MwareRabbitMQ = MwareOps {
 	Init:	InitRabbitMQ,
 	Fini:	FiniRabbitMQ,
 	GetEnv:	GetEnvRabbitMQ,
+	Rotate:	RotateRabbitMQ,
+	Revoke:	RevokeRabbitMQ,
 	Disabled:	true,
 }
 
@@ -0,0 +1,163 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"net/http"
+	"context"
+	"errors"
+	"strings"
+	"swifty/apis"
+	"swifty/common/http"
+	"swifty/common/xrest"
+)
+
+/*
+ * Channels (rooms) are named groups of connections. Membership lives
+ * on the connection itself on the gate holding it, so it goes away
+ * together with the connection. The DB copy is only for listing.
+ */
+
+const wsChanNameMax = 64
+
+func wsChanNameOK(ch string) bool {
+	return ch != "" && len(ch) <= wsChanNameMax && !strings.ContainsAny(ch, "/ ")
+}
+
+func wsSubLocal(lid, cid, ch string, sub bool) bool {
+	aux, ok := wsConns.Load(lid)
+	if !ok {
+		return false
+	}
+
+	wcs := aux.(*wsConnMap)
+
+	wcs.lock.Lock()
+	defer wcs.lock.Unlock()
+
+	wc, ok := wcs.cons[cid]
+	if !ok {
+		return false
+	}
+
+	if sub {
+		if wc.chans == nil {
+			wc.chans = make(map[string]bool)
+		}
+		wc.chans[ch] = true
+	} else {
+		delete(wc.chans, ch)
+	}
+
+	return true
+}
+
+func wsSendChanLocal(lid, ch string, mtype int, msg []byte) {
+	aux, ok := wsConns.Load(lid)
+	if !ok {
+		return
+	}
+
+	wcs := aux.(*wsConnMap)
+
+	wcs.lock.RLock()
+	defer wcs.lock.RUnlock()
+
+	for _, wc := range wcs.cons {
+		if wc.chans[ch] {
+			wc.send(mtype, msg)
+		}
+	}
+}
+
+func wsChanSubConn(mwd *MwareDesc, ch, cid string, sub bool) error {
+	if wsConnGate(cid) != wsGateId {
+		return wsFanPublish("", wsFanQueue(wsConnGate(cid)),
+				&wsFanMsg{Mw: mwd.Cookie, Cid: cid, Chan: ch, Sub: sub, Unsub: !sub})
+	}
+
+	if !wsSubLocal(mwd.Cookie, cid, ch, sub) {
+		return errors.New("No connection")
+	}
+
+	return nil
+}
+
+/*
+ * The connection is (un)subscribed first, so that the DB doesn't list
+ * what has failed. If the DB update fails (e.g. the conn is gone from
+ * there) the subscription is reverted.
+ */
+func wsChanSub(ctx context.Context, mwd *MwareDesc, ch, cid string, sub bool) *xrest.ReqErr {
+	err := wsChanSubConn(mwd, ch, cid, sub)
+	if err != nil {
+		ctxlog(ctx).Errorf("ws: can't (un)subscribe %s to %s: %s", cid, ch, err.Error())
+		return GateErrM(swyapi.GateNotFound, "Target not found")
+	}
+
+	err = dbWsConnSetChan(ctx, mwd.Cookie, cid, ch, sub)
+	if err != nil {
+		rerr := wsChanSubConn(mwd, ch, cid, !sub)
+		if rerr != nil {
+			ctxlog(ctx).Errorf("ws: can't revert %s (un)subscription to %s: %s", cid, ch, rerr.Error())
+		}
+		return GateErrD(err)
+	}
+
+	return nil
+}
+
+func wsChanPublish(ctx context.Context, mwd *MwareDesc, ch string, rq *swyapi.WsMwReq) {
+	wsSendChanLocal(mwd.Cookie, ch, rq.MType, rq.Msg)
+
+	if !wsFanOn() {
+		return
+	}
+
+	err := wsFanPublish(wsFanExchange, "", &wsFanMsg{Mw: mwd.Cookie, Chan: ch, MType: rq.MType, Msg: rq.Msg})
+	if err != nil {
+		ctxlog(ctx).Errorf("ws: can't publish to other gates: %s", err.Error())
+	}
+}
+
+/*
+ * POST   .../channels/{chan}        -- publish the message
+ * PUT    .../channels/{chan}/{cid}  -- subscribe connection
+ * DELETE .../channels/{chan}/{cid}  -- unsubscribe one
+ */
+func wsChannelReq(ctx context.Context, mwd *MwareDesc, ch, cid string, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
+	if !wsChanNameOK(ch) {
+		return GateErrM(swyapi.GateBadRequest, "Bad channel name")
+	}
+
+	switch r.Method {
+	case "POST":
+		var rq swyapi.WsMwReq
+
+		err := xhttp.RReq(r, &rq)
+		if err != nil {
+			return GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		wsChanPublish(ctx, mwd, ch, &rq)
+
+	case "PUT", "DELETE":
+		if cid == "" {
+			return GateErrM(swyapi.GateBadRequest, "Connection ID missing")
+		}
+
+		cerr := wsChanSub(ctx, mwd, ch, cid, r.Method == "PUT")
+		if cerr != nil {
+			return cerr
+		}
+
+	default:
+		return GateErrM(swyapi.GateBadRequest, "Bad method")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"github.com/gorilla/mux"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"context"
+	"time"
+	"swifty/apis"
+	"swifty/common/xrest"
+)
+
+/*
+ * Connected clients are registered in the DB so that any gate can
+ * list them. Each gate periodically marks its conns as alive, the
+ * rest expire by the TTL index. Claims are stored as JSON, since
+ * their keys may have dots and dollars mongo doesn't accept.
+ */
+
+const (
+	wsConnRefreshPeriod	= time.Minute
+	wsConnStaleTmo		= 3 * wsConnRefreshPeriod
+)
+
+type WsConnDesc struct {
+	ObjID		bson.ObjectId		`bson:"_id,omitempty"`
+	Cid		string			`bson:"cid"`
+	MwId		string			`bson:"mwid"`
+	Gate		string			`bson:"gate"`
+	Connected	time.Time		`bson:"connected"`
+	Seen		time.Time		`bson:"seen"`
+	Claims		string			`bson:"claimsj,omitempty"`
+	Channels	[]string		`bson:"channels,omitempty"`
+
+	mw		*MwareDesc		`bson:"-"`
+}
+
+func wsConnRegister(ctx context.Context, mwd *MwareDesc, cid string, claims map[string]interface{}) *WsConnDesc {
+	now := time.Now()
+	wc := &WsConnDesc{
+		ObjID:		bson.NewObjectId(),
+		Cid:		cid,
+		MwId:		mwd.Cookie,
+		Gate:		wsGateId,
+		Connected:	now,
+		Seen:		now,
+	}
+
+	if claims != nil {
+		cj, err := json.Marshal(claims)
+		if err != nil {
+			ctxlog(ctx).Errorf("ws: can't encode conn %s claims: %s", cid, err.Error())
+			return nil
+		}
+
+		wc.Claims = string(cj)
+	}
+
+	err := dbInsert(ctx, wc)
+	if err != nil {
+		ctxlog(ctx).Errorf("ws: can't register conn %s: %s", cid, err.Error())
+		return nil
+	}
+
+	return wc
+}
+
+func (wc *WsConnDesc)unregister(ctx context.Context) {
+	err := dbRemove(ctx, wc)
+	if err != nil {
+		ctxlog(ctx).Errorf("ws: can't unregister conn %s: %s", wc.Cid, err.Error())
+	}
+}
+
+func (wc *WsConnDesc)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	return GateErrM(swyapi.GateNotAvail, "Clients connect themselves")
+}
+
+func (wc *WsConnDesc)Upd(ctx context.Context, _ interface{}) *xrest.ReqErr {
+	return GateErrM(swyapi.GateGenErr, "Not updatable")
+}
+
+func (wc *WsConnDesc)Del(ctx context.Context) *xrest.ReqErr {
+	err := wsCloseConn(wc.MwId, wc.Cid)
+	if err != nil {
+		ctxlog(ctx).Errorf("ws: can't close conn %s: %s", wc.Cid, err.Error())
+		return GateErrM(swyapi.GateGenErr, "Cannot close connection")
+	}
+
+	return nil
+}
+
+func (wc *WsConnDesc)Info(ctx context.Context, q url.Values, details bool) (interface{}, *xrest.ReqErr) {
+	var claims map[string]interface{}
+
+	if wc.Claims != "" {
+		err := json.Unmarshal([]byte(wc.Claims), &claims)
+		if err != nil {
+			ctxlog(ctx).Errorf("ws: bad conn %s claims: %s", wc.Cid, err.Error())
+		}
+	}
+
+	return &swyapi.WsConnInfo{
+		Cid:		wc.Cid,
+		Connected:	wc.Connected.Format(time.RFC1123Z),
+		Claims:		claims,
+		Channels:	wc.Channels,
+	}, nil
+}
+
+type WsConns struct {
+	mw	*MwareDesc
+}
+
+func (wcs WsConns)Create(ctx context.Context, p interface{}) (xrest.Obj, *xrest.ReqErr) {
+	return nil, GateErrM(swyapi.GateNotAvail, "Clients connect themselves")
+}
+
+func wsMwFindForReq(ctx context.Context, r *http.Request) (*MwareDesc, *xrest.ReqErr) {
+	var mw MwareDesc
+
+	cerr := objFindForReq(ctx, r, "mid", &mw)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	if mw.MwareType != "websocket" {
+		return nil, GateErrM(swyapi.GateBadRequest, "Not a websocket")
+	}
+
+	return &mw, nil
+}
+
+func (wcs WsConns)Get(ctx context.Context, r *http.Request) (xrest.Obj, *xrest.ReqErr) {
+	var wc WsConnDesc
+
+	mw, cerr := wsMwFindForReq(ctx, r)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	err := dbFind(ctx, bson.M{"mwid": mw.Cookie, "cid": mux.Vars(r)["cid"]}, &wc)
+	if err != nil {
+		return nil, GateErrD(err)
+	}
+
+	wc.mw = mw
+	return &wc, nil
+}
+
+func (wcs WsConns)Iterate(ctx context.Context, q url.Values, cb func(context.Context, xrest.Obj) *xrest.ReqErr) *xrest.ReqErr {
+	var wconns []*WsConnDesc
+
+	err := dbFindAll(ctx, bson.M{"mwid": wcs.mw.Cookie}, &wconns)
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	for _, wc := range wconns {
+		wc.mw = wcs.mw
+		cerr := cb(ctx, wc)
+		if cerr != nil {
+			return cerr
+		}
+	}
+
+	return nil
+}
+
+func wsConnsInit(ctx context.Context) error {
+	go func() {
+		for {
+			time.Sleep(wsConnRefreshPeriod)
+
+			ctx, done := mkContext("::ws-refresh")
+			err := dbWsConnsRefresh(ctx, wsGateId)
+			if err != nil {
+				ctxlog(ctx).Errorf("ws: can't refresh conns: %s", err.Error())
+			}
+			done(ctx)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,248 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"github.com/streadway/amqp"
+	"encoding/json"
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"swifty/apis"
+	"swifty/common"
+	"swifty/common/xrest/sysctl"
+)
+
+/*
+ * Websocket clients may be connected to any gate, while functions
+ * POST to whichever gate the balancer picks. So gates exchange the
+ * messages via rabbit. Each gate has its own queue for unicasts
+ * and all the queues are bound to one fanout exchange for broadcasts
+ * and closes. When the rabbit connection breaks the gate keeps
+ * reconnecting, messages sent meanwhile are lost.
+ */
+
+const wsFanExchange = "swy.websockets"
+
+var wsGateId string
+var wsFanReconnectTmo = 5 * time.Second
+
+type wsFanMsg struct {
+	Gate		string		`json:"gate"`
+	Mw		string		`json:"mw"`
+	Cid		string		`json:"cid,omitempty"`
+	MType		int		`json:"mtype,omitempty"`
+	Msg		[]byte		`json:"msg,omitempty"`
+	Close		bool		`json:"close,omitempty"`
+	Chan		string		`json:"chan,omitempty"`
+	Sub		bool		`json:"sub,omitempty"`
+	Unsub		bool		`json:"unsub,omitempty"`
+}
+
+var wsFan struct {
+	lock	sync.Mutex
+	on	bool		/* configured, otherwise it's single gate setup */
+	ch	*amqp.Channel	/* nil while reconnecting */
+}
+
+func wsFanOn() bool {
+	wsFan.lock.Lock()
+	defer wsFan.lock.Unlock()
+
+	return wsFan.on
+}
+
+func wsFanQueue(gid string) string {
+	return "swy.ws." + gid
+}
+
+func wsFanPublish(exch, key string, m *wsFanMsg) error {
+	wsFan.lock.Lock()
+	defer wsFan.lock.Unlock()
+
+	if wsFan.ch == nil {
+		if wsFan.on {
+			return errors.New("Fanout is reconnecting")
+		}
+		return errors.New("No fanout")
+	}
+
+	m.Gate = wsGateId
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return wsFan.ch.Publish(exch, key, false, false, amqp.Publishing{
+			ContentType: "application/json",
+			Body: data,
+		})
+}
+
+/*
+ * Unicasts go to the owning gate's queue. If the client has gone
+ * already, the message is silently dropped there.
+ */
+func wsFanSend(lid, cid string, rq *swyapi.WsMwReq) error {
+	m := &wsFanMsg{Mw: lid, Cid: cid, MType: rq.MType, Msg: rq.Msg}
+
+	if cid != "" {
+		return wsFanPublish("", wsFanQueue(wsConnGate(cid)), m)
+	}
+
+	if !wsFanOn() {
+		return nil /* Single gate setup */
+	}
+
+	return wsFanPublish(wsFanExchange, "", m)
+}
+
+func wsFanClose(lid string) {
+	if !wsFanOn() {
+		return
+	}
+
+	err := wsFanPublish(wsFanExchange, "", &wsFanMsg{Mw: lid, Close: true})
+	if err != nil {
+		glog.Errorf("ws: can't send close for %s: %s", lid, err.Error())
+	}
+}
+
+func wsFanDeliver(data []byte) {
+	var m wsFanMsg
+
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		glog.Errorf("ws: bad fanout message: %s", err.Error())
+		return
+	}
+
+	if m.Gate == wsGateId {
+		return /* Our own broadcast */
+	}
+
+	switch {
+	case m.Sub || m.Unsub:
+		wsSubLocal(m.Mw, m.Cid, m.Chan, m.Sub)
+	case m.Chan != "":
+		wsSendChanLocal(m.Mw, m.Chan, m.MType, m.Msg)
+	case m.Close:
+		if m.Cid != "" {
+			wsCloseLocalConn(m.Mw, m.Cid)
+		} else {
+			wsCloseLocal(m.Mw)
+		}
+	default:
+		wsSendLocal(m.Mw, m.Cid, m.MType, m.Msg)
+	}
+}
+
+func wsFanConnect(cf *xh.XCreds) (*amqp.Connection, *amqp.Channel, <-chan amqp.Delivery, error) {
+	var msgs <-chan amqp.Delivery
+
+	conn, err := amqp.Dial("amqp://" + cf.URL())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		goto outc
+	}
+
+	err = ch.ExchangeDeclare(wsFanExchange, "fanout", false, false, false, false, nil)
+	if err != nil {
+		goto outc
+	}
+
+	_, err = ch.QueueDeclare(wsFanQueue(wsGateId), false, true, true, false, nil)
+	if err != nil {
+		goto outc
+	}
+
+	err = ch.QueueBind(wsFanQueue(wsGateId), "", wsFanExchange, false, nil)
+	if err != nil {
+		goto outc
+	}
+
+	msgs, err = ch.Consume(wsFanQueue(wsGateId), "", true, true, false, false, nil)
+	if err != nil {
+		goto outc
+	}
+
+	return conn, ch, msgs, nil
+
+outc:
+	conn.Close()
+	return nil, nil, nil, err
+}
+
+/* The deliveries channel gets closed when the connection or channel dies */
+func wsFanRun(cf *xh.XCreds, conn *amqp.Connection, msgs <-chan amqp.Delivery) {
+	for {
+		for d := range msgs {
+			wsFanDeliver(d.Body)
+		}
+
+		glog.Errorf("ws: fanout stopped, reconnecting")
+		wsFan.lock.Lock()
+		wsFan.ch = nil
+		wsFan.lock.Unlock()
+		conn.Close()
+
+		for {
+			var ch *amqp.Channel
+			var err error
+
+			time.Sleep(wsFanReconnectTmo)
+			conn, ch, msgs, err = wsFanConnect(cf)
+			if err == nil {
+				wsFan.lock.Lock()
+				wsFan.ch = ch
+				wsFan.lock.Unlock()
+				break
+			}
+
+			glog.Errorf("ws: can't reconnect fanout: %s", err.Error())
+		}
+
+		glog.Debugf("ws: fanout reconnected")
+	}
+}
+
+func wsFanInit(ctx context.Context) error {
+	if conf.Mware.WS == nil || conf.Mware.WS.cf == nil {
+		return nil
+	}
+
+	cf := conf.Mware.WS.cf
+	conn, ch, msgs, err := wsFanConnect(cf)
+	if err != nil {
+		return err
+	}
+
+	wsFan.lock.Lock()
+	wsFan.on = true
+	wsFan.ch = ch
+	wsFan.lock.Unlock()
+
+	go wsFanRun(cf, conn, msgs)
+
+	ctxlog(ctx).Debugf("ws: fanout started, gate %s", wsGateId)
+	return nil
+}
+
+func init() {
+	var err error
+
+	sysctl.AddTimeSysctl("ws_fan_reconnect_tmo", &wsFanReconnectTmo)
+
+	wsGateId, err = xh.GenRandId(8)
+	if err != nil {
+		panic("Can't generate gate id: " + err.Error())
+	}
+}
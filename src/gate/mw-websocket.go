@@ -12,8 +12,10 @@ import (
 	"context"
 	"net/http"
 	"strconv"
+	"strings"
 	"errors"
 	"sync"
+	"time"
 	"swifty/apis"
 	"swifty/common"
 	"swifty/common/http"
@@ -43,9 +45,33 @@ func InitWebSocket(ctx context.Context, mwd *MwareDesc) (error) {
 	return nil
 }
 
+func RotateWebSocket(ctx context.Context, mwd *MwareDesc) (error) {
+	var err error
+
+	mwd.Secret, err = xh.GenRandId(32)
+	return err
+}
+
+/* The prev token is accepted till the rotation grace ends */
+func wsTokenOK(mwd *MwareDesc, tok string) bool {
+	sec, err := xh.DecryptString(gateSecPas, mwd.Secret)
+	if err == nil && tok == sec {
+		return true
+	}
+
+	if mwd.Prev != nil && time.Now().Before(mwd.Prev.Till) {
+		sec, err = xh.DecryptString(gateSecPas, mwd.Prev.Secret)
+		if err == nil && tok == sec {
+			return true
+		}
+	}
+
+	return false
+}
+
 func FiniWebSocket(ctx context.Context, mwd *MwareDesc) error {
 	wsCloseConns(mwd.Cookie)
-	return nil
+	return dbWsConnsRemove(ctx, mwd.Cookie)
 }
 
 func GetEnvWebSocket(ctx context.Context, mwd *MwareDesc) map[string][]byte {
@@ -83,31 +109,53 @@ var MwareWebSocket = MwareOps {
 	Init:	InitWebSocket,
 	Fini:	FiniWebSocket,
 	GetEnv:	GetEnvWebSocket,
+	Rotate:	RotateWebSocket,
 	Info:	InfoWebSocket,
 	TInfo:	TInfoWebSocket,
 	Disabled:	true,
 }
 
+type wsConn struct {
+	c	*websocket.Conn
+	wlock	sync.Mutex
+	chans	map[string]bool /* under wsConnMap lock */
+}
+
+/* Gorilla allows for one writer at a time */
+func (wc *wsConn)send(mtype int, msg []byte) error {
+	wc.wlock.Lock()
+	defer wc.wlock.Unlock()
+	return wc.c.WriteMessage(mtype, msg)
+}
+
 type wsConnMap struct {
 	lock	sync.RWMutex
-	cons	map[string]*websocket.Conn
+	cons	map[string]*wsConn
 	rover	int64
 }
 
 var wsConns sync.Map
 
+/*
+ * Connection IDs carry the ID of the gate holding the connection,
+ * so that the requests for it can be routed there.
+ */
+func wsConnGate(cid string) string {
+	return strings.SplitN(cid, "-", 2)[0]
+}
+
 func wsAddConn(lid string, c *websocket.Conn) string {
 	aux, ok := wsConns.Load(lid)
 	if !ok {
-		aux, _ = wsConns.LoadOrStore(lid, &wsConnMap{cons: make(map[string]*websocket.Conn)})
+		aux, _ = wsConns.LoadOrStore(lid, &wsConnMap{cons: make(map[string]*wsConn)})
 	}
 
 	wcs := aux.(*wsConnMap)
 
 	wcs.lock.Lock()
 	wcs.rover += 1
-	cid := strconv.FormatInt(wcs.rover, 16)
-	wcs.cons[cid] = c
+	cid := wsGateId + "-" + strconv.FormatInt(wcs.rover, 16)
+	wcs.cons[cid] = &wsConn{c: c}
 	wcs.lock.Unlock()
 
 	return cid
@@ -127,7 +175,7 @@ func wsDelConn(lid string, cid string) {
 	wcs.lock.Unlock()
 }
 
-func wsCloseConns(lid string) {
+func wsCloseLocal(lid string) {
 	aux, ok := wsConns.Load(lid)
 	if !ok {
 		return
@@ -138,40 +186,86 @@ func wsCloseConns(lid string) {
 	wcs := aux.(*wsConnMap)
 
 	wcs.lock.Lock()
-	for _, c := range wcs.cons {
-		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
-		c.Close()
+	for _, wc := range wcs.cons {
+		wc.send(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		wc.c.Close()
 	}
 	wcs.lock.Unlock()
 }
 
-func wsUnicastMessage(ctx context.Context, cid string, wcs *wsConnMap, rq *swyapi.WsMwReq) *xrest.ReqErr {
-
-	c, ok := wcs.cons[cid]
-	if ok {
-		err := c.WriteMessage(rq.MType, rq.Msg)
-		if err != nil {
-			; /* XXX What? */
-		}
+func wsCloseLocalConn(lid, cid string) bool {
+	aux, ok := wsConns.Load(lid)
+	if !ok {
+		return false
 	}
 
+	wcs := aux.(*wsConnMap)
+
+	wcs.lock.RLock()
+	wc, ok := wcs.cons[cid]
+	wcs.lock.RUnlock()
+
 	if !ok {
-		return GateErrM(swyapi.GateNotFound, "Target not found")
+		return false
+	}
+
+	/* Reader will notice this and clean the conn up */
+	wc.send(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+	wc.c.Close()
+	return true
+}
+
+func wsCloseConn(lid, cid string) error {
+	if wsConnGate(cid) != wsGateId {
+		return wsFanPublish("", wsFanQueue(wsConnGate(cid)), &wsFanMsg{Mw: lid, Cid: cid, Close: true})
+	}
+
+	if !wsCloseLocalConn(lid, cid) {
+		return errors.New("No connection")
 	}
 
 	return nil
 }
 
-func wsBroadcastMessage(ctx context.Context, wcs *wsConnMap, rq *swyapi.WsMwReq) *xrest.ReqErr {
+func wsCloseConns(lid string) {
+	wsCloseLocal(lid)
+	wsFanClose(lid)
+}
+
+/* Sends to connections on this gate, cid == "" means all of them */
+func wsSendLocal(lid, cid string, mtype int, msg []byte) bool {
+	aux, ok := wsConns.Load(lid)
+	if !ok {
+		return false
+	}
+
+	wcs := aux.(*wsConnMap)
 
-	for _, c := range wcs.cons {
-		err := c.WriteMessage(rq.MType, rq.Msg)
+	wcs.lock.RLock()
+	defer wcs.lock.RUnlock()
+
+	if cid != "" {
+		wc, ok := wcs.cons[cid]
+		if !ok {
+			return false
+		}
+
+		err := wc.send(mtype, msg)
 		if err != nil {
 			; /* XXX What? */
 		}
+
+		return true
 	}
 
-	return nil
+	for _, wc := range wcs.cons {
+		err := wc.send(mtype, msg)
+		if err != nil {
+			; /* XXX What? */
+		}
+	}
+
+	return true
 }
 
 func wsFunctionReq(ctx context.Context, mwd *MwareDesc, cid string, w http.ResponseWriter, r *http.Request) *xrest.ReqErr {
@@ -182,41 +276,69 @@ func wsFunctionReq(ctx context.Context, mwd *MwareDesc, cid string, w http.Respo
 		return GateErrE(swyapi.GateBadRequest, err)
 	}
 
-	aux, ok := wsConns.Load(mwd.Cookie)
-	if !ok {
-		return GateErrM(swyapi.GateNotFound, "Target not found")
+	if cid != "" {
+		if wsConnGate(cid) != wsGateId {
+			err = wsFanSend(mwd.Cookie, cid, &rq)
+		} else if !wsSendLocal(mwd.Cookie, cid, rq.MType, rq.Msg) {
+			err = errors.New("No connection")
+		}
+
+		if err != nil {
+			return GateErrM(swyapi.GateNotFound, "Target not found")
+		}
+	} else {
+		wsSendLocal(mwd.Cookie, "", rq.MType, rq.Msg)
+		err = wsFanSend(mwd.Cookie, "", &rq)
+		if err != nil {
+			ctxlog(ctx).Errorf("ws: can't broadcast to other gates: %s", err.Error())
+		}
 	}
 
-	wcs := aux.(*wsConnMap)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
 
-	var cerr *xrest.ReqErr
+type FnEventWebsock struct {
+	MwName	string		`bson:"mware"`
+	MType	*int		`bson:"mtype,omitempty"`
+	Events	[]string	`bson:"events,omitempty"`
+}
 
-	wcs.lock.RLock()
-	defer wcs.lock.RUnlock()
+const (
+	wsEvMessage	= "message"
+	wsEvConnect	= "connect"
+	wsEvDisconnect	= "disconnect"
+)
 
-	if cid != "" {
-		cerr = wsUnicastMessage(ctx, cid, wcs, &rq)
+func (we *FnEventWebsock)wants(event string, mtype int) bool {
+	if len(we.Events) == 0 {
+		if event != wsEvMessage {
+			return false
+		}
 	} else {
-		cerr = wsBroadcastMessage(ctx, wcs, &rq)
+		found := false
+		for _, e := range we.Events {
+			if e == event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
 	}
 
-	if cerr != nil {
-		return cerr
+	if event == wsEvMessage && we.MType != nil && *we.MType != mtype {
+		return false
 	}
 
-	w.WriteHeader(http.StatusOK)
-	return nil
-}
-
-type FnEventWebsock struct {
-	MwName	string	`bson:"mware"`
-	MType	*int	`bson:"mtype,omitempty"`
+	return true
 }
 
 func wsKey(mwid string) string { return "ws:" + mwid }
 
-func wsTrigger(mwd *MwareDesc, cid string, mtype int, message []byte, claims map[string]interface{}) {
-	ctx, done := mkContext("::ws-message")
+func wsTrigger(mwd *MwareDesc, cid, event string, mtype int, message []byte, claims map[string]interface{}) {
+	ctx, done := mkContext("::ws-" + event)
 	defer done(ctx)
 
 	var evs []*FnEventDesc
@@ -240,14 +362,18 @@ func wsTrigger(mwd *MwareDesc, cid string, mtype int, message []byte, claims map
 		Args: map[string]string {
 			"mwid":	 mwd.SwoId.Name,
 			"cid":	 cid,
-			"mtype": strconv.Itoa(mtype),
+			"event": event,
 		},
 		Body: body,
 		Claims: claims,
 	}
 
+	if event == wsEvMessage {
+		args.Args["mtype"] = strconv.Itoa(mtype)
+	}
+
 	for _, ed := range evs {
-		if ed.WS.MType != nil && *ed.WS.MType != mtype {
+		if !ed.WS.wants(event, mtype) {
 			continue
 		}
 
@@ -269,6 +395,12 @@ func wsClientReq(mwd *MwareDesc, c *websocket.Conn, claims map[string]interface{
 	cid := wsAddConn(mwd.Cookie, c)
 	defer wsDelConn(mwd.Cookie, cid)
 
+	ctx, done := mkContext("::ws-conn")
+	wc := wsConnRegister(ctx, mwd, cid, claims)
+	done(ctx)
+
+	wsTrigger(mwd, cid, wsEvConnect, 0, nil, claims)
+
 	for {
 		mtype, message, err := c.ReadMessage()
 		if err != nil {
@@ -276,7 +408,15 @@ func wsClientReq(mwd *MwareDesc, c *websocket.Conn, claims map[string]interface{
 			break
 		}
 
-		wsTrigger(mwd, cid, mtype, message, claims)
+		wsTrigger(mwd, cid, wsEvMessage, mtype, message, claims)
+	}
+
+	wsTrigger(mwd, cid, wsEvDisconnect, 0, nil, claims)
+
+	if wc != nil {
+		ctx, done = mkContext("::ws-conn")
+		wc.unregister(ctx)
+		done(ctx)
 	}
 }
 
@@ -300,9 +440,16 @@ var wsEOps = EventOps {
 			return errors.New("Field \"websocket\" missing")
 		}
 
+		for _, e := range evt.WS.Events {
+			if e != wsEvMessage && e != wsEvConnect && e != wsEvDisconnect {
+				return errors.New("Bad websocket event " + e)
+			}
+		}
+
 		ed.WS = &FnEventWebsock{
 			MwName: evt.WS.MwName,
 			MType: evt.WS.MType,
+			Events: evt.WS.Events,
 		}
 
 		return nil
@@ -11,8 +11,10 @@ import (
 	"net/url"
 	"net/http"
 	"fmt"
+	"io"
 	"context"
 	"errors"
+	"time"
 
 	"swifty/apis"
 	"swifty/common"
@@ -44,6 +46,21 @@ type MwareDesc struct {
 	State		int		`bson:"state"`		// Mware state
 	UserData	string		`bson:"userdata,omitempty"`
 	HDat		map[string]string	`bson:"hdat",omitempty"`
+	Prev		*MwarePrevCreds	`bson:"prev,omitempty"`	// Rotated out creds, valid till grace ends
+	Rotating	time.Time	`bson:"rotating,omitempty"`	// Rotation in progress since
+	Backup		*MwBackupSched	`bson:"backup,omitempty"`	// Scheduled backups
+	BackupRun	time.Time	`bson:"backup_run,omitempty"`	// Last scheduled backup started at
+	ExtAddr		string		`bson:"extaddr,omitempty"`	// Address of external mware
+	Grants		[]*MwGrant	`bson:"grants,omitempty"`	// Other projects allowed to use it
+	JWT		*MwJWTConf	`bson:"jwt,omitempty"`	// Authjwt verification setup
+
+	ext		*swyapi.MwareExternal	`bson:"-"`
+}
+
+type MwarePrevCreds struct {
+	Client		string		`bson:"client,omitempty"`
+	Secret		string		`bson:"secret"`
+	Till		time.Time	`bson:"till"`
 }
 
 var mwStates = map[int]string {
@@ -75,6 +92,26 @@ type MwareOps struct {
 	GetEnv	func(ctx context.Context, mwd *MwareDesc) (map[string][]byte)
 	Info	func(ctx context.Context, mwd *MwareDesc, ifo *swyapi.MwareInfo) (error)
 	TInfo	func(ctx context.Context) *swyapi.MwareTypeInfo
+	/*
+	 * Rotate generates new Client/Secret pair and makes it work
+	 * on the backend keeping the old one alive. Revoke kills the
+	 * prev one. Both operate on plain (not encrypted) secrets.
+	 */
+	Rotate	func(ctx context.Context, mwd *MwareDesc) (error)
+	Revoke	func(ctx context.Context, mwd *MwareDesc, prev *MwarePrevCreds) (error)
+	/*
+	 * Backup writes the logical dump of the mware contents, Restore
+	 * loads one back, replacing whatever is there. Dumps can be big,
+	 * so both stream and don't keep the whole thing in memory.
+	 */
+	Backup	func(ctx context.Context, mwd *MwareDesc, to io.Writer) (error)
+	Restore	func(ctx context.Context, mwd *MwareDesc, from io.Reader) (error)
+	/*
+	 * GrantRO creates read-only client (plain secret in the grant),
+	 * RevokeRO removes one.
+	 */
+	GrantRO	func(ctx context.Context, mwd *MwareDesc, g *MwGrant) (error)
+	RevokeRO func(ctx context.Context, mwd *MwareDesc, g *MwGrant) (error)
 	Disabled bool
 	LiteOK	bool
 }
@@ -116,10 +153,11 @@ func mwSecEnv(ctx context.Context, h *MwareOps, mw *MwareDesc) *secEnvs {
 	}
 }
 
-func mwareGetEnvData(ctx context.Context, id SwoId, name string) (*secEnvs, error) {
+func mwareGetEnvData(ctx context.Context, id SwoId, ref string) (*secEnvs, error) {
 	var mw MwareDesc
 
-	id.Name = name
+	fnproj := id.Project
+	id.Project, id.Name = mwRefSplit(fnproj, ref)
 	err := dbFind(ctx, id.dbReq(), &mw)
 	if err != nil {
 		return nil, fmt.Errorf("No such mware: %s", id.Str())
@@ -128,8 +166,21 @@ func mwareGetEnvData(ctx context.Context, id SwoId, name string) (*secEnvs, erro
 		return nil, errors.New("Mware not ready")
 	}
 
-	handler := mwareHandlers[mw.MwareType]
-	return mwSecEnv(ctx, handler, &mw), nil
+	handler, _ := mw.ops()
+	if id.Project == fnproj {
+		return mwSecEnv(ctx, handler, &mw), nil
+	}
+
+	g := mw.grantFor(fnproj)
+	if g == nil {
+		return nil, fmt.Errorf("Mware %s not granted to %s", id.Str(), fnproj)
+	}
+
+	if !g.RO {
+		return mwSecEnv(ctx, handler, &mw), nil
+	}
+
+	return mwGrantSecEnv(ctx, handler, &mw, g), nil
 }
 
 func mwareGenerateUserPassClient(ctx context.Context, mwd *MwareDesc) (error) {
@@ -156,9 +207,20 @@ var mwareHandlers = map[string]*MwareOps {
 	"rabbit":	&MwareRabbitMQ,
 	"mongo":	&MwareMongo,
 	"authjwt":	&MwareAuthJWT,
+	"authkey":	&MwareAuthKey,
 	"websocket":	&MwareWebSocket,
 }
 
+func (mw *MwareDesc)ops() (*MwareOps, bool) {
+	if mw.ExtAddr != "" {
+		h, ok := mwareExtHandlers[mw.MwareType]
+		return h, ok
+	}
+
+	h, ok := mwareHandlers[mw.MwareType]
+	return h, ok
+}
+
 func mwareRemoveId(ctx context.Context, id *SwoId) *xrest.ReqErr {
 	var item MwareDesc
 
@@ -171,7 +233,7 @@ func mwareRemoveId(ctx context.Context, id *SwoId) *xrest.ReqErr {
 }
 
 func (item *MwareDesc)Del(ctx context.Context) *xrest.ReqErr {
-	handler, ok := mwareHandlers[item.MwareType]
+	handler, ok := item.ops()
 	if !ok {
 		return GateErrC(swyapi.GateGenErr) /* Shouldn't happen */
 	}
@@ -182,12 +244,45 @@ func (item *MwareDesc)Del(ctx context.Context) *xrest.ReqErr {
 		return GateErrM(swyapi.GateGenErr, "Cannot terminate mware")
 	}
 
+	if item.Prev != nil {
+		err = item.revokePrev(ctx)
+		if err != nil {
+			ctxlog(ctx).Errorf("Failed prev creds cleanup for mware %s: %s", item.SwoId.Str(), err.Error())
+			goto stalled
+		}
+	}
+
+	if item.Backup != nil {
+		mwBackupUnschedule(item)
+	}
+
+	for _, g := range item.Grants {
+		err = item.revokeGrant(ctx, g)
+		if err != nil {
+			ctxlog(ctx).Errorf("Failed grant cleanup for mware %s: %s", item.SwoId.Str(), err.Error())
+			goto stalled
+		}
+	}
+
 	err = handler.Fini(ctx, item)
 	if err != nil {
 		ctxlog(ctx).Errorf("Failed cleanup for mware %s: %s", item.SwoId.Str(), err.Error())
 		goto stalled
 	}
 
+	/* Objects in S3 are left for user to decide what to do with them */
+	err = dbMwBackupsRemove(ctx, item.Cookie)
+	if err != nil {
+		ctxlog(ctx).Errorf("Failed backups cleanup for mware %s: %s", item.SwoId.Str(), err.Error())
+		goto stalled
+	}
+
+	err = logRemove(ctx, item.Cookie)
+	if err != nil {
+		ctxlog(ctx).Errorf("Failed logs cleanup for mware %s: %s", item.SwoId.Str(), err.Error())
+		goto stalled
+	}
+
 	err = k8sSecretRemove(ctx, "mw-" + item.Cookie)
 	if err != nil {
 		ctxlog(ctx).Errorf("Failed secret cleanup for mware %s: %s", item.SwoId.Str(), err.Error())
@@ -286,7 +381,7 @@ type FnMwares struct {
 func (fm FnMwares)Get(ctx context.Context, r *http.Request) (xrest.Obj, *xrest.ReqErr) {
 	var mw MwareDesc
 
-	cerr := objFindForReq2(ctx, r, "mid", &mw, bson.M{"project": fm.Fn.SwoId.Project})
+	cerr := objFindForReq2(ctx, r, "mid", &mw, mwProjReq(fm.Fn.SwoId.Project))
 	if cerr != nil {
 		return nil, cerr
 	}
@@ -297,7 +392,7 @@ func (fm FnMwares)Get(ctx context.Context, r *http.Request) (xrest.Obj, *xrest.R
 func (fm FnMwares)Create(ctx context.Context, p interface{}) (xrest.Obj, *xrest.ReqErr) {
 	var mw MwareDesc
 
-	cerr := objFindId(ctx, *p.(*string), &mw, bson.M{"project": fm.Fn.SwoId.Project})
+	cerr := objFindId(ctx, *p.(*string), &mw, mwProjReq(fm.Fn.SwoId.Project))
 	if cerr != nil {
 		return nil, cerr
 	}
@@ -308,7 +403,7 @@ func (fm FnMwares)Create(ctx context.Context, p interface{}) (xrest.Obj, *xrest.
 func (fm FnMwares)Iterate(ctx context.Context, q url.Values, cb func(context.Context, xrest.Obj) *xrest.ReqErr) *xrest.ReqErr {
 	for _, mwn := range fm.Fn.Mware {
 		id := fm.Fn.SwoId
-		id.Name = mwn
+		id.Project, id.Name = mwRefSplit(id.Project, mwn)
 
 		var mw MwareDesc
 
@@ -371,12 +466,13 @@ func (item *MwareDesc)toInfo(ctx context.Context, details bool) (*swyapi.MwareIn
 		Project:	item.SwoId.Project,
 		Type:		item.MwareType,
 		Labels:		item.Labels,
+		External:	item.ExtAddr,
 	}
 
 	if details {
 		resp.UserData = item.UserData
 
-		handler, ok := mwareHandlers[item.MwareType]
+		handler, ok := item.ops()
 		if !ok {
 			return nil, GateErrC(swyapi.GateGenErr) /* Shouldn't happen */
 		}
@@ -410,7 +506,7 @@ func getMwareStats(ctx context.Context) (map[string]*swyapi.TenantStatsMware, *x
 
 		st.Count++
 
-		h := mwareHandlers[mw.MwareType]
+		h, _ := mw.ops()
 		if h.Info != nil {
 			var ifo swyapi.MwareInfo
 
@@ -449,7 +545,18 @@ func getMwareDesc(id *SwoId, params *swyapi.MwareAdd) (*MwareDesc, *xrest.ReqErr
 		UserData:	params.UserData,
 	}
 
-	handler, ok := mwareHandlers[params.Type]
+	handlers := mwareHandlers
+	if params.External != nil {
+		if params.External.Addr == "" {
+			return nil, GateErrM(swyapi.GateBadRequest, "No external address")
+		}
+
+		ret.ExtAddr = params.External.Addr
+		ret.ext = params.External
+		handlers = mwareExtHandlers
+	}
+
+	handler, ok := handlers[params.Type]
 	if !ok {
 		return nil, GateErrM(swyapi.GateBadRequest, "Not such type")
 	}
@@ -490,7 +597,7 @@ func (mwd *MwareDesc)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
 	var handler *MwareOps
 	var err, erc error
 
-	if checkMwCount(ctx, mwd.MwareType) != nil {
+	if mwd.ExtAddr == "" && checkMwCount(ctx, mwd.MwareType) != nil {
 		return GateErrC(swyapi.GateLimitHit)
 	}
 
@@ -503,7 +610,7 @@ func (mwd *MwareDesc)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
 
 	gateMwares.WithLabelValues(mwd.MwareType).Inc()
 
-	handler, _ = mwareHandlers[mwd.MwareType]
+	handler, _ = mwd.ops()
 
 	if handler.Disabled {
 		err = fmt.Errorf("Bad mware type %s", mwd.MwareType)
@@ -572,10 +679,323 @@ stalled:
 	goto out
 }
 
+func (mw *MwareDesc)Rotate(ctx context.Context, grace time.Duration) *xrest.ReqErr {
+	var prev *MwarePrevCreds
+	var old MwareDesc
+	var err, erc error
+	var encsec string
+
+	handler, ok := mw.ops()
+	if !ok {
+		return GateErrC(swyapi.GateGenErr) /* Shouldn't happen */
+	}
+
+	if handler.Rotate == nil {
+		return GateErrM(swyapi.GateNotAvail, "Rotation not supported")
+	}
+
+	if mw.State != DBMwareStateRdy {
+		return GateErrM(swyapi.GateGenErr, "Mware not ready")
+	}
+
+	cerr := mw.rotateLock(ctx)
+	if cerr != nil {
+		return cerr
+	}
+	defer mw.rotateUnlock(ctx)
+
+	if mw.Prev != nil {
+		/* Previous rotation is still in grace -- finish it */
+		err = mw.revokePrev(ctx)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't revoke prev creds for %s: %s", mw.SwoId.Str(), err.Error())
+			return GateErrM(swyapi.GateGenErr, "Cannot revoke old credentials")
+		}
+	}
+
+	encsec = mw.Secret
+	old = *mw
+	old.Secret, err = xh.DecryptString(gateSecPas, mw.Secret)
+	if err != nil {
+		ctxlog(ctx).Errorf("Mw secret decrypt error: %s", err.Error())
+		return GateErrM(swyapi.GateGenErr, "Decrypt error")
+	}
+
+	err = handler.Rotate(ctx, mw)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't rotate mware %s: %s", mw.SwoId.Str(), err.Error())
+		return GateErrM(swyapi.GateGenErr, "Cannot rotate credentials")
+	}
+
+	err = k8sSecretMod(ctx, mwSecEnv(ctx, handler, mw))
+	if err != nil {
+		goto outh
+	}
+
+	mw.Secret, err = xh.EncryptString(gateSecPas, mw.Secret)
+	if err != nil {
+		ctxlog(ctx).Errorf("Mw secret encrypt error: %s", err.Error())
+		err = errors.New("Encrypt error")
+		goto outs
+	}
+
+	prev = &MwarePrevCreds{
+		Client:	old.Client,
+		Secret:	encsec,
+		Till:	time.Now().Add(grace),
+	}
+
+	err = dbUpdatePart(ctx, mw, bson.M {
+				"client":	mw.Client,
+				"secret":	mw.Secret,
+				"prev":		prev })
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't update rotated %s: %s", mw.SwoId.Str(), err.Error())
+		err = errors.New("DB error")
+		goto outs
+	}
+
+	mw.Prev = prev
+	authCtxRefresh(ctx, mw)
+	mwareRestartFns(ctx, mw)
+
+	if grace == 0 {
+		err = mw.revokePrev(ctx)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't revoke prev creds for %s: %s", mw.SwoId.Str(), err.Error())
+		}
+	} else {
+		mwareRevokeAt(mw.ObjID, prev.Till)
+	}
+
+	return nil
+
+outs:
+	erc = k8sSecretMod(ctx, mwSecEnv(ctx, handler, &old))
+	if erc != nil {
+		ctxlog(ctx).Errorf("Can't restore secret for %s: %s", mw.SwoId.Str(), erc.Error())
+	}
+outh:
+	if handler.Revoke != nil {
+		erc = handler.Revoke(ctx, &old, &MwarePrevCreds{Client: mw.Client})
+		if erc != nil {
+			ctxlog(ctx).Errorf("Can't drop new creds for %s: %s", mw.SwoId.Str(), erc.Error())
+		}
+	}
+
+	ctxlog(ctx).Errorf("mwareRotate: %s", err.Error())
+	return GateErrE(swyapi.GateGenErr, err)
+}
+
+/*
+ * Two rotations running in parallel (on one gate or on two) would
+ * each revoke what the other has just set up, so they are serialized
+ * with the "rotating" mark in DB. The mark of a gate that died in the
+ * middle goes stale after mwRotateTmo.
+ */
+var mwRotateTmo = 5 * time.Minute
+
+func (mw *MwareDesc)rotateLock(ctx context.Context) *xrest.ReqErr {
+	var cur MwareDesc
+
+	now := time.Now()
+	err := dbUpdatePart2(ctx, mw, bson.M{
+			"state":	DBMwareStateRdy,
+			"$or":		[]bson.M{
+				{ "rotating": bson.M{"$exists": false} },
+				{ "rotating": bson.M{"$lt": now.Add(-mwRotateTmo)} },
+			},
+		}, bson.M{"rotating": now})
+	if err != nil {
+		if dbNF(err) {
+			return GateErrM(swyapi.GateNotAvail, "Rotation in progress")
+		}
+
+		return GateErrD(err)
+	}
+
+	/* The creds might have been changed by whoever held the mark */
+	err = dbFind(ctx, bson.M{"_id": mw.ObjID}, &cur)
+	if err != nil {
+		mw.rotateUnlock(ctx)
+		return GateErrD(err)
+	}
+
+	cur.ext = mw.ext
+	*mw = cur
+	return nil
+}
+
+func (mw *MwareDesc)rotateUnlock(ctx context.Context) {
+	err := dbUpdatePart(ctx, mw, bson.M{"rotating": time.Time{}})
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't unmark rotating %s: %s", mw.SwoId.Str(), err.Error())
+	}
+}
+
+func (mw *MwareDesc)revokePrev(ctx context.Context) error {
+	handler, _ := mw.ops()
+	if handler.Revoke != nil {
+		err := handler.Revoke(ctx, mw, mw.Prev)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Only clear what's been revoked, not the next rotation's creds */
+	err := dbUpdatePart2(ctx, mw, bson.M{"prev.client": mw.Prev.Client}, bson.M{"prev": nil})
+	if err != nil && !dbNF(err) {
+		return err
+	}
+
+	mw.Prev = nil
+	return nil
+}
+
+func mwareRevokeAt(id bson.ObjectId, till time.Time) {
+	time.AfterFunc(time.Until(till), func() {
+		ctx, done := mkContext("::mwrevoke")
+		defer done(ctx)
+
+		mwareRevokeExpired(ctx, id)
+	})
+}
+
+/*
+ * Prev creds are revoked by the timer on the gate that rotated them,
+ * and by the periodic sweep on all gates in case that one has died.
+ * Both work under the rotation lease, so that the creds are checked
+ * and revoked while no other rotation can change them.
+ */
+var mwPrevSweepPeriod = time.Minute
+
+func mwareRevokeExpired(ctx context.Context, id bson.ObjectId) {
+	var mw MwareDesc
+
+	err := dbFind(ctx, bson.M{"_id": id, "state": DBMwareStateRdy}, &mw)
+	if err != nil {
+		return
+	}
+
+	/* Re-rotated, the next timer will take care of it */
+	if mw.Prev == nil || mw.Prev.Till.After(time.Now()) {
+		return
+	}
+
+	/* Rotation in progress revokes the prev creds itself */
+	cerr := mw.rotateLock(ctx)
+	if cerr != nil {
+		return
+	}
+	defer mw.rotateUnlock(ctx)
+
+	if mw.Prev == nil || mw.Prev.Till.After(time.Now()) {
+		return
+	}
+
+	err = mw.revokePrev(ctx)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't revoke prev creds for %s: %s", mw.SwoId.Str(), err.Error())
+	}
+}
+
+func mwareSweepPrev(ctx context.Context) {
+	var mw MwareDesc
+	var ids []bson.ObjectId
+
+	iter := dbIterAll(ctx, bson.M{"prev.till": bson.M{"$lt": time.Now()}}, &mw)
+	for iter.Next(&mw) {
+		ids = append(ids, mw.ObjID)
+	}
+
+	err := iter.Close()
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't find expired prev creds: %s", err.Error())
+		return
+	}
+
+	for _, id := range ids {
+		mwareRevokeExpired(ctx, id)
+	}
+}
+
+func mwareRestartFns(ctx context.Context, mw *MwareDesc) {
+	var fn FunctionDesc
+
+	iter := dbIterAll(ctx, bson.M{
+			"tennant":	mw.SwoId.Tennant,
+			"$or":		[]bson.M{
+				{ "project": mw.SwoId.Project, "mware": mw.SwoId.Name },
+				{ "mware": mw.SwoId.Project + "/" + mw.SwoId.Name },
+			},
+			"state":	DBFuncStateRdy,
+		}, &fn)
+	defer iter.Close()
+
+	for iter.Next(&fn) {
+		err := k8sRestart(ctx, &conf, &fn)
+		if err != nil {
+			ctxlog(ctx).Errorf("Can't restart %s after %s rotation", fn.SwoId.Str(), mw.SwoId.Str())
+		}
+	}
+}
+
+func mwaresInit(ctx context.Context) error {
+	var mw MwareDesc
+
+	iter := dbIterAll(ctx, bson.M{"prev": bson.M{"$ne": nil}}, &mw)
+	defer iter.Close()
+
+	for iter.Next(&mw) {
+		ctxlog(ctx).Debugf("Will revoke %s prev creds at %s", mw.SwoId.Str(), mw.Prev.Till.String())
+		mwareRevokeAt(mw.ObjID, mw.Prev.Till)
+	}
+
+	err := iter.Err()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(mwPrevSweepPeriod)
+
+			ctx, done := mkContext("::mwrevoke")
+			mwareSweepPrev(ctx)
+			done(ctx)
+		}
+	}()
+
+	err = mwBackupsInit(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = mwQuotaInit(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = wsFanInit(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = wsConnsInit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return authCtxsInit(ctx)
+}
+
 func mwareGetInfo(ctx context.Context, mtyp string) (*swyapi.MwareTypeInfo, *xrest.ReqErr) {
 	handler, ok := mwareHandlers[mtyp]
 	if !ok {
-		return nil, GateErrM(swyapi.GateBadRequest, "Not such type")
+		handler, ok = mwareExtHandlers[mtyp]
+		if !ok {
+			return nil, GateErrM(swyapi.GateBadRequest, "Not such type")
+		}
 	}
 
 	if handler.TInfo == nil {
@@ -592,4 +1012,13 @@ func MwInit() {
 		}
 		sysctl.AddBoolSysctl("mw_" + mw + "_disable", &mh.Disabled)
 	}
+
+	for mw, mh := range mwareExtHandlers {
+		sysctl.AddBoolSysctl("mw_ext_" + mw + "_disable", &mh.Disabled)
+	}
+
+	sysctl.AddTimeSysctl("mw_rotate_tmo", &mwRotateTmo)
+	sysctl.AddTimeSysctl("mw_prev_sweep_period", &mwPrevSweepPeriod)
+	sysctl.AddTimeSysctl("mw_backup_lease", &mwBackupLease)
+	sysctl.AddTimeSysctl("mw_backup_alive_period", &mwBackupAlivePeriod)
 }
@@ -105,6 +105,14 @@ var (
 		[]string { "reason" },
 	)
 
+	gateRtCache = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "swifty_gate_router_cache",
+			Help: "Number of router cache lookups",
+		},
+		[]string { "result" },
+	)
+
 	gateBuilds = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "swifty_gate_builds",
@@ -179,6 +187,20 @@ var (
 		},
 	)
 
+	logLinesDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "swifty_gate_log_lines_dropped",
+			Help: "Function output lines not saved because DB lagged behind",
+		},
+	)
+
+	memWarnings = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "swifty_gate_mem_warnings",
+			Help: "How many times functions got close to their memory limit",
+		},
+	)
+
 	scaleOverruns = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "swifty_gate_scale_overruns",
@@ -297,6 +319,7 @@ func PrometheusInit(ctx context.Context) error {
 	/* XXX: We can pick up the call-counts from the database, but ... */
 	prometheus.MustRegister(gateCalls)
 	prometheus.MustRegister(gateCallErrs)
+	prometheus.MustRegister(gateRtCache)
 	prometheus.MustRegister(gateBuilds)
 	prometheus.MustRegister(gateCalLat)
 	prometheus.MustRegister(wdogWaitLat)
@@ -309,8 +332,10 @@ func PrometheusInit(ctx context.Context) error {
 	prometheus.MustRegister(limitPullErrs)
 	prometheus.MustRegister(statWrites)
 	prometheus.MustRegister(scaleOverruns)
+	prometheus.MustRegister(memWarnings)
 	prometheus.MustRegister(dbAccViolations)
 	prometheus.MustRegister(statWriteFails)
+	prometheus.MustRegister(logLinesDropped)
 	prometheus.MustRegister(scalers)
 	prometheus.MustRegister(portWaiters)
 	prometheus.MustRegister(srcGCs)
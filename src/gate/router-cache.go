@@ -0,0 +1,295 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"context"
+	"errors"
+	"strings"
+	"bytes"
+	"sync"
+	"time"
+	"swifty/apis"
+	"swifty/common/xrest/sysctl"
+)
+
+/*
+ * Cache of router entries' responses. By default it lives in gate
+ * memory (LRU, limited in size), thus flushes only affect the gate
+ * that got them and other gates keep their copies till TTL. When
+ * there are several gates, the mongo backend should be used.
+ */
+
+const (
+	RtCacheMemory	= "memory"
+	RtCacheMongo	= "mongo"
+)
+
+var rtCacheMemMaxKb = 64 * 1024
+var rtCacheEntMaxKb = 512
+
+func init() {
+	sysctl.AddIntSysctl("rt_cache_mem_max_kb", &rtCacheMemMaxKb)
+	sysctl.AddIntSysctl("rt_cache_entry_max_kb", &rtCacheEntMaxKb)
+}
+
+type RtCacheEnt struct {
+	Key		string			`bson:"_id"`
+	Rt		string			`bson:"rt"`	// router cookie
+	Path		string			`bson:"path"`
+	Code		int			`bson:"code"`
+	Body		[]byte			`bson:"body"`
+	Expires		time.Time		`bson:"expires"`
+}
+
+type rtCacheBackend interface {
+	get(context.Context, string) *RtCacheEnt
+	put(context.Context, *RtCacheEnt)
+	drop(context.Context, string, []string)
+}
+
+var rtCache rtCacheBackend
+
+func ckRtCache(c *swyapi.RouterCache, method string) error {
+	if c.TTL == 0 {
+		return errors.New("Zero cache TTL")
+	}
+
+	if method != "GET" && method != "*" {
+		return errors.New("Only GET-s are cached")
+	}
+
+	return nil
+}
+
+/*
+ * Entries behind auth keep separate copies for each set of claims,
+ * otherwise one user's reply would go to another one
+ */
+func rtCacheKey(rt, path string, c *swyapi.RouterCache, r *http.Request, claims map[string]interface{}) string {
+	k := rt + "\x00" + path + "\x00"
+
+	if len(c.Query) != 0 {
+		q := r.URL.Query()
+		for _, n := range c.Query {
+			k += n + "=" + q.Get(n) + "&"
+		}
+	}
+
+	k += "\x00"
+	for _, n := range c.Headers {
+		k += n + ":" + r.Header.Get(n) + "\n"
+	}
+
+	if claims != nil {
+		/* Map keys are sorted by json, so the same claims give the same key */
+		cl, _ := json.Marshal(claims)
+		h := sha256.Sum256(cl)
+		k += "\x00" + hex.EncodeToString(h[:])
+	}
+
+	return k
+}
+
+func rtCacheReply(w http.ResponseWriter, ce *RtCacheEnt) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(ce.Code)
+	w.Write(ce.Body)
+}
+
+type rtCacheWriter struct {
+	http.ResponseWriter
+	code	int
+	body	bytes.Buffer
+	over	bool
+}
+
+func (cw *rtCacheWriter)WriteHeader(code int) {
+	cw.code = code
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *rtCacheWriter)Write(b []byte) (int, error) {
+	if cw.code == 0 {
+		cw.code = http.StatusOK
+	}
+
+	if !cw.over {
+		if cw.body.Len() + len(b) > rtCacheEntMaxKb << 10 {
+			cw.over = true
+			cw.body.Reset()
+		} else {
+			cw.body.Write(b)
+		}
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *rtCacheWriter)entry(key, rt, path string, ttl uint32) *RtCacheEnt {
+	if cw.over || cw.code < 200 || cw.code >= 300 {
+		return nil
+	}
+
+	return &RtCacheEnt {
+		Key:		key,
+		Rt:		rt,
+		Path:		path,
+		Code:		cw.code,
+		Body:		cw.body.Bytes(),
+		Expires:	time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+/*
+ * In-memory LRU
+ */
+
+type rtCacheMem struct {
+	lock	sync.Mutex
+	ents	map[string]*list.Element
+	lru	*list.List
+	size	int
+}
+
+func (cm *rtCacheMem)remove(el *list.Element) {
+	ce := cm.lru.Remove(el).(*RtCacheEnt)
+	delete(cm.ents, ce.Key)
+	cm.size -= len(ce.Body)
+}
+
+func (cm *rtCacheMem)get(ctx context.Context, key string) *RtCacheEnt {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	el, ok := cm.ents[key]
+	if !ok {
+		return nil
+	}
+
+	ce := el.Value.(*RtCacheEnt)
+	if time.Now().After(ce.Expires) {
+		cm.remove(el)
+		return nil
+	}
+
+	cm.lru.MoveToFront(el)
+	return ce
+}
+
+func (cm *rtCacheMem)put(ctx context.Context, ce *RtCacheEnt) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if el, ok := cm.ents[ce.Key]; ok {
+		cm.remove(el)
+	}
+
+	cm.ents[ce.Key] = cm.lru.PushFront(ce)
+	cm.size += len(ce.Body)
+
+	for cm.size > rtCacheMemMaxKb << 10 {
+		cm.remove(cm.lru.Back())
+	}
+}
+
+func (cm *rtCacheMem)drop(ctx context.Context, rt string, paths []string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	var nxt *list.Element
+	for el := cm.lru.Front(); el != nil; el = nxt {
+		nxt = el.Next()
+
+		ce := el.Value.(*RtCacheEnt)
+		if ce.Rt != rt {
+			continue
+		}
+
+		if len(paths) == 0 {
+			cm.remove(el)
+			continue
+		}
+
+		for _, p := range paths {
+			if ce.Path == p {
+				cm.remove(el)
+				break
+			}
+		}
+	}
+}
+
+/*
+ * Mongo-backed, shared between gates. Writes are done from the
+ * calls' contexts, so it doesn't go through the dbMayModify checks,
+ * the collection contains nothing but the cached stuff.
+ */
+
+type rtCacheDB struct { }
+
+func (_ rtCacheDB)get(ctx context.Context, key string) *RtCacheEnt {
+	ce, err := dbRtCacheGet(ctx, key)
+	if err != nil {
+		if !dbNF(err) {
+			ctxlog(ctx).Errorf("rtcache: can't get entry: %s", err.Error())
+		}
+		return nil
+	}
+
+	/* Mongo TTL monitor runs once a minute */
+	if time.Now().After(ce.Expires) {
+		return nil
+	}
+
+	return ce
+}
+
+func (_ rtCacheDB)put(ctx context.Context, ce *RtCacheEnt) {
+	err := dbRtCachePut(ctx, ce)
+	if err != nil {
+		ctxlog(ctx).Errorf("rtcache: can't put entry: %s", err.Error())
+	}
+}
+
+func (_ rtCacheDB)drop(ctx context.Context, rt string, paths []string) {
+	err := dbRtCacheDrop(ctx, rt, paths)
+	if err != nil {
+		ctxlog(ctx).Errorf("rtcache: can't drop entries: %s", err.Error())
+	}
+}
+
+func rtCacheFlush(ctx context.Context, rt string, paths []string) {
+	for i, p := range paths {
+		paths[i] = rtCachePath(p)
+	}
+
+	rtCache.drop(ctx, rt, paths)
+}
+
+/* Flushing and lookups should agree on how the path looks like */
+func rtCachePath(p string) string {
+	return "/" + strings.Trim(p, "/")
+}
+
+func rtCacheInit(c string) error {
+	switch c {
+	case "", RtCacheMemory:
+		rtCache = &rtCacheMem{ents: make(map[string]*list.Element), lru: list.New()}
+	case RtCacheMongo:
+		rtCache = rtCacheDB{}
+	default:
+		return errors.New("Unknown router cache backend " + c)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"swifty/apis"
+)
+
+func TestRtCacheKeyParams(t *testing.T) {
+	c := &swyapi.RouterCache{TTL: 10, Query: []string{"q"}, Headers: []string{"X-Lang"}}
+
+	r1 := httptest.NewRequest("GET", "/x?q=1&z=2", nil)
+	r2 := httptest.NewRequest("GET", "/x?q=1&z=3", nil)
+	if rtCacheKey("rt", "/x", c, r1, nil) != rtCacheKey("rt", "/x", c, r2, nil) {
+		t.Errorf("unlisted query param changes the key")
+	}
+
+	r3 := httptest.NewRequest("GET", "/x?q=2", nil)
+	if rtCacheKey("rt", "/x", c, r1, nil) == rtCacheKey("rt", "/x", c, r3, nil) {
+		t.Errorf("listed query param doesn't change the key")
+	}
+
+	r4 := httptest.NewRequest("GET", "/x?q=1", nil)
+	r4.Header.Set("X-Lang", "en")
+	if rtCacheKey("rt", "/x", c, r1, nil) == rtCacheKey("rt", "/x", c, r4, nil) {
+		t.Errorf("listed header doesn't change the key")
+	}
+
+	if rtCacheKey("rt", "/x", c, r1, nil) == rtCacheKey("rt2", "/x", c, r1, nil) {
+		t.Errorf("router doesn't change the key")
+	}
+}
+
+func TestRtCacheKeyClaims(t *testing.T) {
+	c := &swyapi.RouterCache{TTL: 10}
+	r := httptest.NewRequest("GET", "/x", nil)
+
+	alice := map[string]interface{}{"sub": "alice", "role": "user"}
+	alice2 := map[string]interface{}{"role": "user", "sub": "alice"}
+	bob := map[string]interface{}{"sub": "bob", "role": "user"}
+
+	if rtCacheKey("rt", "/x", c, r, alice) == rtCacheKey("rt", "/x", c, r, bob) {
+		t.Errorf("different users share the key")
+	}
+
+	if rtCacheKey("rt", "/x", c, r, alice) != rtCacheKey("rt", "/x", c, r, alice2) {
+		t.Errorf("same claims give different keys")
+	}
+
+	if rtCacheKey("rt", "/x", c, r, alice) == rtCacheKey("rt", "/x", c, r, nil) {
+		t.Errorf("authenticated key matches the anonymous one")
+	}
+}
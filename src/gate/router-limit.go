@@ -0,0 +1,210 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"container/list"
+	"time"
+	"fmt"
+	"swifty/apis"
+	"swifty/common/ratelimit"
+	"swifty/common/xrest/sysctl"
+)
+
+/*
+ * Per-entry rate limits. Buckets live in gate memory, so with several
+ * gates each one lets the configured rate through. Keyed buckets are
+ * kept in LRU order, when there are too many the idle ones go away.
+ *
+ * The "ip" key is the peer address. When gate sits behind a balancer
+ * it's the balancer's one, so rt_limit_ip_header can name the header
+ * the balancer puts the client address into. The last value is taken,
+ * the ones before it come from the client and can be anything.
+ */
+
+const (
+	RtLimitGlobal	= ""
+	RtLimitIP	= "ip"
+	RtLimitAPIKey	= "apikey"
+	rtLimitClaim	= "claim:"
+)
+
+var rtLimitKeysMax = 16384
+var rtLimitIPHeader string
+
+func init() {
+	sysctl.AddIntSysctl("rt_limit_keys_max", &rtLimitKeysMax)
+	sysctl.AddStringSysctl("rt_limit_ip_header", &rtLimitIPHeader)
+}
+
+func ckRtLimit(l *swyapi.RouterLimit, ac string) error {
+	if l.Rate == 0 {
+		return errors.New("Zero rate")
+	}
+
+	switch {
+	case l.Key == RtLimitGlobal || l.Key == RtLimitIP:
+		return nil
+	case l.Key == RtLimitAPIKey:
+	case strings.HasPrefix(l.Key, rtLimitClaim) && len(l.Key) > len(rtLimitClaim):
+	default:
+		return errors.New("Bad limit key " + l.Key)
+	}
+
+	if ac == "" {
+		return errors.New("Limit key needs authctx")
+	}
+
+	return nil
+}
+
+type rtLimiter struct {
+	method	string
+	path	string
+	conf	*swyapi.RouterLimit
+	lock	sync.Mutex
+	rl	*xrl.RL
+	keyed	map[string]*list.Element
+	lru	*list.List
+	passed	uint64
+	limited	uint64
+}
+
+func mkRtLimiter(e *swyapi.RouterEntry) *rtLimiter {
+	rlm := &rtLimiter{method: e.Method, path: e.Path, conf: e.Limit}
+	if e.Limit.Key == RtLimitGlobal {
+		rlm.rl = rlm.mkRL()
+	} else {
+		rlm.keyed = make(map[string]*list.Element)
+		rlm.lru = list.New()
+	}
+
+	return rlm
+}
+
+type rtBucket struct {
+	key	string
+	rl	*xrl.RL
+}
+
+func (rlm *rtLimiter)mkRL() *xrl.RL {
+	per := rlm.conf.Period
+	if per == 0 {
+		per = 1
+	}
+
+	return xrl.MakeRLBase(rlm.conf.Burst, rlm.conf.Rate, time.Duration(per) * time.Second)
+}
+
+/* IP and global limits don't need claims, so they go before authctx */
+func (rlm *rtLimiter)early() bool {
+	return rlm.conf.Key == RtLimitGlobal || rlm.conf.Key == RtLimitIP
+}
+
+func (rlm *rtLimiter)key(r *http.Request, claims map[string]interface{}) string {
+	var c interface{}
+
+	switch {
+	case rlm.conf.Key == RtLimitIP:
+		return clientIP(r)
+	case rlm.conf.Key == RtLimitAPIKey:
+		c = claims["kid"]
+	default:
+		c = claims[rlm.conf.Key[len(rtLimitClaim):]]
+	}
+
+	/* Callers w/o the claim share one bucket */
+	if c == nil {
+		return ""
+	}
+
+	if s, ok := c.(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(c)
+}
+
+func clientIP(r *http.Request) string {
+	if rtLimitIPHeader != "" {
+		if v := r.Header.Get(rtLimitIPHeader); v != "" {
+			vs := strings.Split(v, ",")
+			return strings.TrimSpace(vs[len(vs)-1])
+		}
+	}
+
+	return hostOnly(r.RemoteAddr)
+}
+
+func (rlm *rtLimiter)bucket(key string) *xrl.RL {
+	if rlm.rl != nil {
+		return rlm.rl
+	}
+
+	rlm.lock.Lock()
+	defer rlm.lock.Unlock()
+
+	if el, ok := rlm.keyed[key]; ok {
+		rlm.lru.MoveToFront(el)
+		return el.Value.(*rtBucket).rl
+	}
+
+	for len(rlm.keyed) >= rtLimitKeysMax && rlm.lru.Len() > 0 {
+		el := rlm.lru.Back()
+		rlm.lru.Remove(el)
+		delete(rlm.keyed, el.Value.(*rtBucket).key)
+	}
+
+	b := &rtBucket{key: key, rl: rlm.mkRL()}
+	rlm.keyed[key] = rlm.lru.PushFront(b)
+	return b.rl
+}
+
+func secsUp(d time.Duration) string {
+	return strconv.FormatInt(int64((d + time.Second - 1) / time.Second), 10)
+}
+
+/* Returns false if the request is rejected, the reply is sent then */
+func (rlm *rtLimiter)check(w http.ResponseWriter, r *http.Request, claims map[string]interface{}) bool {
+	rl := rlm.bucket(rlm.key(r, claims))
+	ok := rl.Get()
+	lim, left, reset := rl.Status()
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.FormatUint(uint64(lim), 10))
+	h.Set("RateLimit-Remaining", strconv.FormatUint(uint64(left), 10))
+	h.Set("RateLimit-Reset", secsUp(reset))
+
+	if !ok {
+		atomic.AddUint64(&rlm.limited, 1)
+		h.Set("Retry-After", secsUp(reset / time.Duration(lim - left)))
+		http.Error(w, "", http.StatusTooManyRequests)
+		return false
+	}
+
+	atomic.AddUint64(&rlm.passed, 1)
+	return true
+}
+
+func (rlm *rtLimiter)info() *swyapi.RouterLimitInfo {
+	rlm.lock.Lock()
+	keys := len(rlm.keyed)
+	rlm.lock.Unlock()
+
+	return &swyapi.RouterLimitInfo {
+		Method:		rlm.method,
+		Path:		rlm.path,
+		Passed:		atomic.LoadUint64(&rlm.passed),
+		Limited:	atomic.LoadUint64(&rlm.limited),
+		Keys:		keys,
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"swifty/apis"
+)
+
+func mkTestLimiter(key string) *rtLimiter {
+	return mkRtLimiter(&swyapi.RouterEntry{Method: "GET", Path: "/x",
+			Limit: &swyapi.RouterLimit{Rate: 1, Period: 3600, Key: key}})
+}
+
+func TestRtLimitCheck(t *testing.T) {
+	rlm := mkTestLimiter(RtLimitIP)
+
+	call := func(addr string) int {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		rlm.check(w, r, nil)
+		return w.Code
+	}
+
+	if c := call("1.1.1.1:100"); c != http.StatusOK {
+		t.Errorf("first call got %d", c)
+	}
+	if c := call("1.1.1.1:200"); c != http.StatusTooManyRequests {
+		t.Errorf("second call got %d", c)
+	}
+	if c := call("2.2.2.2:100"); c != http.StatusOK {
+		t.Errorf("other IP got %d", c)
+	}
+}
+
+func TestRtLimitLRU(t *testing.T) {
+	old := rtLimitKeysMax
+	rtLimitKeysMax = 2
+	defer func() { rtLimitKeysMax = old }()
+
+	rlm := mkTestLimiter("claim:sub")
+
+	a := rlm.bucket("a")
+	b := rlm.bucket("b")
+	rlm.bucket("a")
+	rlm.bucket("c")
+
+	if len(rlm.keyed) != 2 {
+		t.Fatalf("%d buckets", len(rlm.keyed))
+	}
+	if rlm.bucket("a") != a {
+		t.Errorf("recently used bucket is evicted")
+	}
+	if rlm.bucket("b") == b {
+		t.Errorf("idle bucket is kept")
+	}
+}
+
+func TestRtLimitIPHeader(t *testing.T) {
+	old := rtLimitIPHeader
+	defer func() { rtLimitIPHeader = old }()
+
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+
+	rtLimitIPHeader = ""
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("peer address is %s", ip)
+	}
+
+	rtLimitIPHeader = "X-Forwarded-For"
+	if ip := clientIP(r); ip != "1.2.3.4" {
+		t.Errorf("forwarded address is %s", ip)
+	}
+}
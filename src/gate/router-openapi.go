@@ -0,0 +1,292 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"net/url"
+	"context"
+	"strings"
+	"errors"
+	"sort"
+	"fmt"
+	"swifty/apis"
+	"swifty/common/xrest"
+)
+
+/*
+ * Router table <-> OpenAPI 3 document. Operations on one path calling
+ * the same function with the same security make one table entry. The
+ * gate-only bits (key, cache, transform, limit, schema) aren't in the
+ * document and are kept for entries that survive the update. The table
+ * revision goes as x-swifty-rev, so that the document exported, edited
+ * and put back doesn't overwrite the changes made in between.
+ */
+
+func oapiOp(pi *swyapi.OpenAPIPath, m string) **swyapi.OpenAPIOp {
+	switch m {
+	case "GET":
+		return &pi.Get
+	case "PUT":
+		return &pi.Put
+	case "POST":
+		return &pi.Post
+	case "DELETE":
+		return &pi.Delete
+	case "PATCH":
+		return &pi.Patch
+	case "HEAD":
+		return &pi.Head
+	case "OPTIONS":
+		return &pi.Options
+	}
+
+	return nil
+}
+
+func oapiOpId(m, path string) string {
+	id := strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, path)
+
+	id = strings.Trim(id, "_")
+	if id == "" {
+		id = "root"
+	}
+
+	return strings.ToLower(m) + "_" + id
+}
+
+func oapiAuthCtx(doc *swyapi.OpenAPI, sec []map[string][]string) (string, error) {
+	if len(sec) == 0 || len(sec[0]) == 0 {
+		return "", nil
+	}
+
+	if len(sec) > 1 || len(sec[0]) > 1 {
+		return "", errors.New("Only one security scheme per operation is supported")
+	}
+
+	for n, _ := range sec[0] {
+		if doc.Components != nil {
+			ss, ok := doc.Components.SecuritySchemes[n]
+			if ok && ss.AuthCtx != "" {
+				return ss.AuthCtx, nil
+			}
+		}
+
+		return n, nil
+	}
+
+	return "", nil
+}
+
+/*
+ * The old entry to take gate-only bits from. Methods may have moved
+ * between entries on the path, so the one with the same function is
+ * the next best match.
+ */
+func oapiKeep(old []*swyapi.RouterEntry, re *swyapi.RouterEntry) *swyapi.RouterEntry {
+	if i := findEntry(old, re.Method, re.Path); i >= 0 {
+		return old[i]
+	}
+
+	var ret *swyapi.RouterEntry
+	for _, e := range old {
+		if e.Path != re.Path {
+			continue
+		}
+		if e.Call == re.Call {
+			return e
+		}
+		if ret == nil {
+			ret = e
+		}
+	}
+
+	return ret
+}
+
+func tableFromOpenAPI(doc *swyapi.OpenAPI, old []*swyapi.RouterEntry) ([]*swyapi.RouterEntry, error) {
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, errors.New("Only OpenAPI 3 is supported")
+	}
+
+
+	var paths []string
+	for p, _ := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	tbl := []*swyapi.RouterEntry{}
+	for _, p := range paths {
+		var res []*swyapi.RouterEntry
+		var ms [][]string
+
+		pi := doc.Paths[p]
+		if pi == nil {
+			continue
+		}
+
+		for _, m := range clientMethods {
+			op := *oapiOp(pi, m)
+			if op == nil {
+				continue
+			}
+
+			if op.Function == "" {
+				return nil, fmt.Errorf("No x-swifty-function for %s %s", m, p)
+			}
+
+			sec := doc.Security
+			if op.Security != nil {
+				sec = *op.Security
+			}
+
+			ac, err := oapiAuthCtx(doc, sec)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %s", m, p, err.Error())
+			}
+
+			i := 0
+			for ; i < len(res); i++ {
+				if res[i].Call == op.Function && res[i].AuthCtx == ac {
+					break
+				}
+			}
+
+			if i == len(res) {
+				res = append(res, &swyapi.RouterEntry{Path: strings.TrimPrefix(p, "/"), Call: op.Function, AuthCtx: ac})
+				ms = append(ms, nil)
+			}
+
+			ms[i] = append(ms[i], m)
+		}
+
+		for i, re := range res {
+			if len(ms[i]) == len(clientMethods) {
+				re.Method = "*"
+			} else {
+				re.Method = strings.Join(ms[i], " ")
+			}
+
+			if o := oapiKeep(old, re); o != nil {
+				re.Key = o.Key
+				re.Transform = o.Transform
+				re.Limit = o.Limit
+				re.Schema = o.Schema
+				if o.Cache != nil && ckRtCache(o.Cache, re.Method) == nil {
+					re.Cache = o.Cache
+				}
+			}
+
+			tbl = append(tbl, re)
+		}
+	}
+
+	return tbl, nil
+}
+
+func (rd *RouterDesc)oapiScheme(ctx context.Context, ac string) *swyapi.OpenAPISecScheme {
+	var item MwareDesc
+
+	id := rd.SwoId
+	id.Name = ac
+	err := dbFind(ctx, id.dbReq(), &item)
+	if err == nil && item.MwareType == "authkey" {
+		return &swyapi.OpenAPISecScheme{Type: "apiKey", In: "header", Name: authKeyHeader}
+	}
+
+	return &swyapi.OpenAPISecScheme{Type: "http", Scheme: "bearer", BearerFormat: "JWT"}
+}
+
+func (rd *RouterDesc)toOpenAPI(ctx context.Context) *swyapi.OpenAPI {
+	rev := rd.TRev
+	doc := &swyapi.OpenAPI {
+		OpenAPI:	"3.0.3",
+		Info:		swyapi.OpenAPIInfo{Title: rd.SwoId.Name, Version: "1"},
+		Servers:	[]*swyapi.OpenAPIServer{&swyapi.OpenAPIServer{URL: rd.getURL()}},
+		Paths:		make(map[string]*swyapi.OpenAPIPath),
+		Rev:		&rev,
+	}
+
+	acs := make(map[string]bool)
+
+	for _, e := range rd.Table {
+		/* Entries for other methods on this path may be there already */
+		pi, ok := doc.Paths["/" + e.Path]
+		if !ok {
+			pi = &swyapi.OpenAPIPath{}
+			for _, s := range rtSegs(e.Path) {
+				if rtIsParam(s) {
+					pi.Parameters = append(pi.Parameters, &swyapi.OpenAPIParam {
+						Name:		s[1:len(s)-1],
+						In:		"path",
+						Required:	true,
+						Schema:		&swyapi.OpenAPISchema{Type: "string"},
+					})
+				}
+			}
+			doc.Paths["/" + e.Path] = pi
+		}
+
+		ms := clientMethods
+		if e.Method != "*" {
+			ms = strings.Fields(e.Method)
+		}
+
+		for _, m := range ms {
+			opp := oapiOp(pi, m)
+			if opp == nil {
+				continue
+			}
+
+			op := &swyapi.OpenAPIOp {
+				OperationId:	oapiOpId(m, e.Path),
+				Function:	e.Call,
+				Responses:	map[string]*swyapi.OpenAPIResp {
+					"200": &swyapi.OpenAPIResp{Description: "Function response"},
+				},
+			}
+
+			if e.AuthCtx != "" {
+				op.Security = &[]map[string][]string{ {e.AuthCtx: []string{}} }
+				acs[e.AuthCtx] = true
+			}
+
+			*opp = op
+		}
+	}
+
+	if len(acs) != 0 {
+		doc.Components = &swyapi.OpenAPIComponents{SecuritySchemes: make(map[string]*swyapi.OpenAPISecScheme)}
+		for ac, _ := range acs {
+			doc.Components.SecuritySchemes[ac] = rd.oapiScheme(ctx, ac)
+		}
+	}
+
+	return doc
+}
+
+type RtOpenAPIProp struct { }
+
+func (_ *RtOpenAPIProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interface{}, *xrest.ReqErr) {
+	return o.(*RouterDesc).toOpenAPI(ctx), nil
+}
+
+func (_ *RtOpenAPIProp)Upd(ctx context.Context, o xrest.Obj, par interface{}) *xrest.ReqErr {
+	rd := o.(*RouterDesc)
+
+	doc := par.(*swyapi.OpenAPI)
+	tbl, err := tableFromOpenAPI(doc, rd.Table)
+	if err != nil {
+		return GateErrE(swyapi.GateBadRequest, err)
+	}
+
+	return rd.setTable(ctx, tbl, optRev(doc.Rev), "openapi")
+}
@@ -0,0 +1,49 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"testing"
+	"swifty/apis"
+)
+
+func TestRtOpenAPISplit(t *testing.T) {
+	doc := &swyapi.OpenAPI {
+		OpenAPI: "3.0.3",
+		Paths: map[string]*swyapi.OpenAPIPath {
+			"/x": &swyapi.OpenAPIPath {
+				Get:	&swyapi.OpenAPIOp{Function: "fa"},
+				Head:	&swyapi.OpenAPIOp{Function: "fa"},
+				Post:	&swyapi.OpenAPIOp{Function: "fb"},
+			},
+		},
+	}
+
+	old := []*swyapi.RouterEntry {
+		{ Method: "POST", Path: "x", Call: "fb", Key: "post-x" },
+		{ Method: "GET", Path: "x", Call: "fa", Key: "get-x" },
+	}
+
+	tbl, err := tableFromOpenAPI(doc, old)
+	if err != nil {
+		t.Fatalf("split path rejected: %s", err.Error())
+	}
+
+	if len(tbl) != 2 {
+		t.Fatalf("got %d entries", len(tbl))
+	}
+
+	if tbl[0].Method != "GET HEAD" || tbl[0].Call != "fa" || tbl[0].Key != "get-x" {
+		t.Errorf("bad first entry %v", tbl[0])
+	}
+	if tbl[1].Method != "POST" || tbl[1].Call != "fb" || tbl[1].Key != "post-x" {
+		t.Errorf("bad second entry %v", tbl[1])
+	}
+
+	if cerr := ckTable(tbl); cerr != nil {
+		t.Errorf("table from document is bad: %s", cerr.Message)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+	"swifty/apis"
+	"swifty/common/xrest"
+	"swifty/common/xrest/sysctl"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Router table revisions. Each change bumps the trev on the router
+ * and puts the new table into history, the last rt_table_history
+ * of them are kept for rollbacks.
+ */
+
+var rtTableHistory = 32
+
+func init() {
+	sysctl.AddIntSysctl("rt_table_history", &rtTableHistory)
+}
+
+type RtTableRev struct {
+	ObjID		bson.ObjectId		`bson:"_id,omitempty"`
+	Rt		bson.ObjectId		`bson:"rt"`
+	Rev		int			`bson:"rev"`
+	Op		string			`bson:"op"`
+	Created		time.Time		`bson:"created"`
+	TLen		int			`bson:"tlen"`
+	Table		[]*swyapi.RouterEntry	`bson:"table"`
+}
+
+/* Routers made before revisions were introduced have no trev at all */
+func rtRevQ(rev int) bson.M {
+	if rev == 0 {
+		return bson.M{"trev": bson.M{"$in": []interface{}{0, nil}}}
+	}
+
+	return bson.M{"trev": rev}
+}
+
+func (tr *RtTableRev)toInfo() *swyapi.RouterTableRev {
+	return &swyapi.RouterTableRev {
+		Rev:		tr.Rev,
+		Op:		tr.Op,
+		Created:	tr.Created.Format(time.RFC1123Z),
+		TLen:		tr.TLen,
+	}
+}
+
+/* History is best effort, the table itself is already in place */
+func (rd *RouterDesc)saveTable(ctx context.Context, op string) {
+	err := dbRtTableSave(ctx, &RtTableRev {
+		ObjID:		bson.NewObjectId(),
+		Rt:		rd.ObjID,
+		Rev:		rd.TRev,
+		Op:		op,
+		Created:	time.Now(),
+		TLen:		len(rd.Table),
+		Table:		rd.Table,
+	})
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't save %s table rev %d: %s", rd.SwoId.Str(), rd.TRev, err.Error())
+		return
+	}
+
+	err = dbRtTableTrim(ctx, rd.ObjID, rd.TRev - rtTableHistory + 1)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't trim %s table history: %s", rd.SwoId.Str(), err.Error())
+	}
+}
+
+func optRev(rev *int) int {
+	if rev == nil {
+		return -1
+	}
+
+	return *rev
+}
+
+/*
+ * Entries are told apart by the methods and the path shape, the same
+ * way ckTable does, so e.g. GET /a/{x} and GET /a/{y} is the same
+ * entry, while POST /a/{x} is another one.
+ */
+func rtEntryKey(method, path string) string {
+	shape, _, err := rtParsePath(path)
+	if err != nil {
+		shape = path
+	}
+
+	return strconv.FormatUint(uint64(rtMethods(method)), 16) + " " + shape
+}
+
+func findEntry(tbl []*swyapi.RouterEntry, method, path string) int {
+	k := rtEntryKey(method, path)
+	for i, e := range tbl {
+		if rtEntryKey(e.Method, e.Path) == k {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (rd *RouterDesc)editTable(ctx context.Context, ed *swyapi.RouterTableEdit) *xrest.ReqErr {
+	tbl := make([]*swyapi.RouterEntry, len(rd.Table))
+	copy(tbl, rd.Table)
+
+	for _, id := range ed.Delete {
+		i := findEntry(tbl, id.Method, id.Path)
+		if i < 0 {
+			return GateErrM(swyapi.GateNotFound, "No entry " + id.Method + " " + id.Path)
+		}
+
+		tbl = append(tbl[:i], tbl[i+1:]...)
+	}
+
+	for _, e := range ed.Update {
+		i := findEntry(tbl, e.Method, e.Path)
+		if i < 0 {
+			return GateErrM(swyapi.GateNotFound, "No entry " + e.Method + " " + e.Path)
+		}
+
+		tbl[i] = e
+	}
+
+	for _, e := range ed.Add {
+		if findEntry(tbl, e.Method, e.Path) >= 0 {
+			return GateErrM(swyapi.GateDuplicate, "Entry " + e.Method + " " + e.Path + " exists")
+		}
+
+		tbl = append(tbl, e)
+	}
+
+	return rd.setTable(ctx, tbl, optRev(ed.Rev), "edit")
+}
+
+func (rd *RouterDesc)rollbackTable(ctx context.Context, rb *swyapi.RouterRollback) *xrest.ReqErr {
+	tr, err := dbRtTableGet(ctx, rd.ObjID, rb.To)
+	if err != nil {
+		if dbNF(err) {
+			return GateErrM(swyapi.GateNotFound, "No revision " + strconv.Itoa(rb.To))
+		}
+		return GateErrD(err)
+	}
+
+	/* Rollback is a new revision too, so it can be rolled back itself */
+	return rd.setTable(ctx, tr.Table, optRev(rb.Rev), "rollback:" + strconv.Itoa(rb.To))
+}
+
+func (rd *RouterDesc)tableHistory(ctx context.Context) ([]*swyapi.RouterTableRev, *xrest.ReqErr) {
+	trs, err := dbRtTableList(ctx, rd.ObjID)
+	if err != nil {
+		return nil, GateErrD(err)
+	}
+
+	ret := []*swyapi.RouterTableRev{}
+	for _, tr := range trs {
+		ret = append(ret, tr.toInfo())
+	}
+
+	return ret, nil
+}
+
+func (rd *RouterDesc)tableAt(ctx context.Context, rev int) ([]*swyapi.RouterEntry, *xrest.ReqErr) {
+	if rev == rd.TRev {
+		return rd.Table, nil
+	}
+
+	tr, err := dbRtTableGet(ctx, rd.ObjID, rev)
+	if err != nil {
+		if dbNF(err) {
+			return nil, GateErrM(swyapi.GateNotFound, "No revision " + strconv.Itoa(rev))
+		}
+		return nil, GateErrD(err)
+	}
+
+	return tr.Table, nil
+}
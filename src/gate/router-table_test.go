@@ -0,0 +1,86 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"testing"
+	"swifty/apis"
+)
+
+func TestRtTableMethods(t *testing.T) {
+	tbl := []*swyapi.RouterEntry {
+		{ Method: "GET", Path: "/x", Call: "fa" },
+		{ Method: "POST PUT", Path: "/x", Call: "fb" },
+		{ Method: "GET", Path: "/a/{id}", Call: "fc" },
+	}
+
+	if cerr := ckTable(tbl); cerr != nil {
+		t.Fatalf("methods split between entries: %s", cerr.Message)
+	}
+
+	bad := append(tbl, &swyapi.RouterEntry{ Method: "PUT", Path: "/x", Call: "fd" })
+	if ckTable(bad) == nil {
+		t.Errorf("overlapping methods accepted")
+	}
+
+	bad = append(tbl, &swyapi.RouterEntry{ Method: "*", Path: "/a/{name}", Call: "fd" })
+	if ckTable(bad) == nil {
+		t.Errorf("overlapping shape accepted")
+	}
+
+	if i := findEntry(tbl, "PUT POST", "/x"); i != 1 {
+		t.Errorf("found %d for POST PUT /x", i)
+	}
+	if i := findEntry(tbl, "GET", "/a/{other}"); i != 2 {
+		t.Errorf("found %d for GET /a/{other}", i)
+	}
+	if i := findEntry(tbl, "POST", "/a/{id}"); i != -1 {
+		t.Errorf("found %d for POST /a/{id}", i)
+	}
+}
+
+func TestRtFindMethod(t *testing.T) {
+	rt := &RouterURL{table: make(map[string][]*RouterEntry)}
+
+	for _, e := range []*swyapi.RouterEntry {
+			{ Method: "GET", Path: "/x", Key: "get-x" },
+			{ Method: "POST", Path: "/x", Key: "post-x" },
+			{ Method: "GET", Path: "/a/{id}", Key: "get-a" },
+			{ Method: "DELETE", Path: "/a/{name}", Key: "del-a" },
+			{ Method: "*", Path: "/{any}/b", Key: "any-b" },
+		} {
+		shape, segs, err := rtParsePath(e.Path)
+		if err != nil {
+			t.Fatalf("bad path %s: %s", e.Path, err.Error())
+		}
+
+		re := &RouterEntry{key: e.Key, shape: shape, segs: segs, methods: rtMethods(e.Method)}
+		if segs == nil {
+			rt.table[e.Path] = append(rt.table[e.Path], re)
+		} else {
+			rt.tmpls = append(rt.tmpls, re)
+		}
+	}
+
+	check := func(m, path, key string, found bool) {
+		e, _, f := rt.find(path, methodNr(m))
+		k := ""
+		if e != nil {
+			k = e.key
+		}
+		if k != key || f != found {
+			t.Errorf("%s %s: got %q/%v", m, path, k, f)
+		}
+	}
+
+	check("GET", "/x", "get-x", true)
+	check("POST", "/x", "post-x", true)
+	check("PUT", "/x", "", true)
+	check("DELETE", "/a/1", "del-a", true)
+	check("PUT", "/a/1", "", true)
+	check("PUT", "/c/b", "any-b", true)
+	check("GET", "/nope", "", false)
+}
@@ -0,0 +1,257 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"net/http"
+	"bytes"
+	"strconv"
+	"strings"
+	"errors"
+	"fmt"
+	"swifty/apis"
+)
+
+/*
+ * Declarative transformations of requests and responses for router
+ * entries. Values are taken from {source:name} placeholders, the list
+ * of sources is in rtXformSrcOK.
+ */
+
+type rtXformCtx struct {
+	r	*http.Request
+	path	string
+	params	map[string]string
+	claims	map[string]interface{}
+}
+
+func rtXformSrcOK(src string) bool {
+	if src == "path" {
+		return true
+	}
+
+	kv := strings.SplitN(src, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return false
+	}
+
+	switch kv[0] {
+	case "header", "query", "param", "claim":
+		return true
+	}
+
+	return false
+}
+
+func rtXformTmplOK(tmpl string, claims bool) error {
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			break
+		}
+
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return errors.New("Unterminated {")
+		}
+
+		src := tmpl[i+1:i+j]
+		if !rtXformSrcOK(src) {
+			return errors.New("Bad value source " + src)
+		}
+
+		if !claims && strings.HasPrefix(src, "claim:") {
+			return errors.New("Claims are not known yet for " + src)
+		}
+
+		tmpl = tmpl[i+j+1:]
+	}
+
+	return nil
+}
+
+func ckRtXform(xf *swyapi.RouterTransform) error {
+	if xf.Rewrite != "" {
+		if xf.Rewrite[0] != '/' {
+			return errors.New("Rewrite should start with /")
+		}
+
+		err := rtXformTmplOK(xf.Rewrite, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Request headers are set before the token is verified */
+	for h, v := range xf.SetHeaders {
+		if h == "" {
+			return errors.New("Empty header name")
+		}
+
+		err := rtXformTmplOK(v, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	for h, v := range xf.RespHeaders {
+		if h == "" {
+			return errors.New("Empty header name")
+		}
+
+		err := rtXformTmplOK(v, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for a, src := range xf.Args {
+		if a == "" {
+			return errors.New("Empty arg name")
+		}
+
+		if !rtXformSrcOK(src) {
+			return errors.New("Bad value source " + src)
+		}
+	}
+
+	for c, nc := range xf.Status {
+		oc, err := strconv.Atoi(c)
+		if err != nil || oc < 100 || oc > 599 {
+			return errors.New("Bad status " + c)
+		}
+
+		if nc < 100 || nc > 599 {
+			return fmt.Errorf("Bad status %d", nc)
+		}
+	}
+
+	return nil
+}
+
+func (xc *rtXformCtx)value(src string) string {
+	if src == "path" {
+		return xc.path
+	}
+
+	kv := strings.SplitN(src, ":", 2)
+	switch kv[0] {
+	case "header":
+		return xc.r.Header.Get(kv[1])
+	case "query":
+		return xc.r.URL.Query().Get(kv[1])
+	case "param":
+		return xc.params[kv[1]]
+	case "claim":
+		v, ok := xc.claims[kv[1]]
+		if !ok {
+			return ""
+		}
+		if s, ok := v.(string); ok {
+			return s
+		}
+		return fmt.Sprint(v)
+	}
+
+	return ""
+}
+
+func (xc *rtXformCtx)expand(tmpl string) string {
+	var res bytes.Buffer
+
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			break
+		}
+
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			break
+		}
+
+		res.WriteString(tmpl[:i])
+		res.WriteString(xc.value(tmpl[i+1:i+j]))
+		tmpl = tmpl[i+j+1:]
+	}
+
+	res.WriteString(tmpl)
+	return res.String()
+}
+
+/* Goes before the authctx check, so that tokens can be moved around */
+func rtXformRequest(xf *swyapi.RouterTransform, xc *rtXformCtx) {
+	if len(xf.SetHeaders) != 0 {
+		/* All values are evaluated against the original headers */
+		vals := make(map[string]string, len(xf.SetHeaders))
+		for h, v := range xf.SetHeaders {
+			vals[h] = xc.expand(v)
+		}
+		for h, v := range vals {
+			xc.r.Header.Set(h, v)
+		}
+	}
+
+	for _, h := range xf.DelHeaders {
+		xc.r.Header.Del(h)
+	}
+}
+
+func rtXformArgs(xf *swyapi.RouterTransform, xc *rtXformCtx, args *swyapi.FunctionRun) {
+	if xf.Rewrite != "" {
+		p := xc.expand(xf.Rewrite)
+		args.Path = &p
+	}
+
+	if len(xf.Args) != 0 {
+		args.Args = make(map[string]string, len(xf.Args))
+		for a, src := range xf.Args {
+			args.Args[a] = xc.value(src)
+		}
+	}
+}
+
+type rtXformWriter struct {
+	http.ResponseWriter
+	xf	*swyapi.RouterTransform
+	xc	*rtXformCtx
+	hdr	bool
+}
+
+func (xw *rtXformWriter)WriteHeader(code int) {
+	if xw.hdr {
+		return
+	}
+
+	xw.hdr = true
+
+	if nc, ok := xw.xf.Status[strconv.Itoa(code)]; ok {
+		code = nc
+	}
+
+	h := xw.Header()
+	for n, v := range xw.xf.RespHeaders {
+		h.Set(n, xw.xc.expand(v))
+	}
+
+	xw.ResponseWriter.WriteHeader(code)
+}
+
+func (xw *rtXformWriter)Write(b []byte) (int, error) {
+	if !xw.hdr {
+		xw.WriteHeader(http.StatusOK)
+	}
+
+	return xw.ResponseWriter.Write(b)
+}
+
+func rtXformResponse(xf *swyapi.RouterTransform, xc *rtXformCtx, w http.ResponseWriter) http.ResponseWriter {
+	if len(xf.RespHeaders) == 0 && len(xf.Status) == 0 {
+		return w
+	}
+
+	return &rtXformWriter{ResponseWriter: w, xf: xf, xc: xc}
+}
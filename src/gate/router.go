@@ -9,6 +9,9 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"strconv"
+	"errors"
+	"sort"
 	"context"
 	"swifty/apis"
 	"swifty/common"
@@ -26,6 +29,8 @@ type RouterDesc struct {
 	Cookie		string			`bson:"cookie"`
 	Labels		[]string		`bson:"labels,omitempty"`
 	Table		[]*swyapi.RouterEntry	`bson:"table"`
+	TRev		int			`bson:"trev,omitempty"`
+	CORS		*swyapi.CORSPolicy	`bson:"cors,omitempty"`
 }
 
 type Routers struct {}
@@ -36,11 +41,158 @@ func init() {
 	sysctl.AddIntSysctl("router_table_key_len_max", &TableKeyLenMax)
 }
 
+/*
+ * Paths may have {name} segments, that match any single non-empty
+ * segment, and the trailing * one, that matches the rest of the
+ * path. Captured values go to FunctionRun.Params, the rest of the
+ * path sits under the "*" key. Exact paths are checked first, then
+ * the templated ones segment by segment, literal segments win over
+ * {name}-s and those win over *.
+ */
+const rtWildcard = "*"
+
+func rtIsParam(s string) bool {
+	return len(s) > 2 && s[0] == '{' && s[len(s)-1] == '}'
+}
+
+func rtSegs(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func rtParamNameOK(n string) bool {
+	for _, c := range n {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Returns the path with params' names dropped, nil segs for exact paths */
+func rtParsePath(path string) (string, []string, error) {
+	segs := rtSegs(path)
+	names := make(map[string]bool)
+	tmpl := false
+
+	for i, s := range segs {
+		switch {
+		case s == rtWildcard:
+			if i != len(segs) - 1 {
+				return "", nil, errors.New("* is only allowed at the end")
+			}
+			tmpl = true
+		case rtIsParam(s):
+			n := s[1:len(s)-1]
+			if !rtParamNameOK(n) {
+				return "", nil, errors.New("Bad parameter name " + n)
+			}
+			if names[n] {
+				return "", nil, errors.New("Duplicate parameter " + n)
+			}
+			names[n] = true
+			segs[i] = "{}"
+			tmpl = true
+		case strings.ContainsAny(s, "{}*"):
+			return "", nil, errors.New("Bad path segment " + s)
+		}
+	}
+
+	if !tmpl {
+		return path, nil, nil
+	}
+
+	return strings.Join(segs, "/"), rtSegs(path), nil
+}
+
+func rtSegRank(s string) int {
+	switch {
+	case s == rtWildcard:
+		return 2
+	case rtIsParam(s):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func rtLess(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ra, rb := rtSegRank(a[i]), rtSegRank(b[i])
+		if ra != rb {
+			return ra < rb
+		}
+		if ra == 0 && a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+
+	/* The "a" vs "a/*" case, the former is more specific */
+	return len(a) < len(b)
+}
+
+func rtMethods(m string) xh.Bitmask {
+	var ms xh.Bitmask
+
+	if m == "*" {
+		ms.Fill()
+	} else {
+		for _, m := range strings.Fields(m) {
+			ms.Set(methodNr(m))
+		}
+	}
+
+	return ms
+}
+
 func ckTable(tbl []*swyapi.RouterEntry) *xrest.ReqErr {
+	shapes := make(map[string]xh.Bitmask)
+
 	for _, t := range tbl {
 		if len(t.Key) > TableKeyLenMax {
 			return GateErrM(swyapi.GateBadRequest, "Too long key")
 		}
+
+		shape, _, err := rtParsePath(t.Path)
+		if err != nil {
+			return GateErrM(swyapi.GateBadRequest, "Bad path " + t.Path + ": " + err.Error())
+		}
+
+		/* Entries of the same shape should serve different methods */
+		ms := rtMethods(t.Method)
+		if shapes[shape] & ms != 0 {
+			return GateErrM(swyapi.GateBadRequest, "Ambiguous path " + t.Method + " " + t.Path)
+		}
+
+		shapes[shape] |= ms
+
+		if t.Cache != nil {
+			err = ckRtCache(t.Cache, t.Method)
+			if err != nil {
+				return GateErrM(swyapi.GateBadRequest, "Bad cache for " + t.Path + ": " + err.Error())
+			}
+		}
+
+		if t.Transform != nil {
+			err = ckRtXform(t.Transform)
+			if err != nil {
+				return GateErrM(swyapi.GateBadRequest, "Bad transform for " + t.Path + ": " + err.Error())
+			}
+		}
+
+		if t.Limit != nil {
+			err = ckRtLimit(t.Limit, t.AuthCtx)
+			if err != nil {
+				return GateErrM(swyapi.GateBadRequest, "Bad limit for " + t.Path + ": " + err.Error())
+			}
+		}
+
+		if t.Schema != nil {
+			err = ckReqSchema(t.Schema)
+			if err != nil {
+				return GateErrM(swyapi.GateBadRequest, "Bad schema for " + t.Path + ": " + err.Error())
+			}
+		}
 	}
 
 	return nil
@@ -51,14 +203,35 @@ func getRouterDesc(id *SwoId, params *swyapi.RouterAdd) (*RouterDesc, *xrest.Req
 		return nil, GateErrM(swyapi.GateBadRequest, "Bad function name")
 	}
 
+	if params.OpenAPI != nil {
+		if len(params.Table) != 0 {
+			return nil, GateErrM(swyapi.GateBadRequest, "Either table or openapi is allowed")
+		}
+
+		tbl, err := tableFromOpenAPI(params.OpenAPI, nil)
+		if err != nil {
+			return nil, GateErrE(swyapi.GateBadRequest, err)
+		}
+
+		params.Table = tbl
+	}
+
 	cerr := ckTable(params.Table)
 	if cerr != nil {
 		return nil, cerr
 	}
 
+	if params.CORS != nil {
+		err := ckCORS(params.CORS)
+		if err != nil {
+			return nil, GateErrE(swyapi.GateBadRequest, err)
+		}
+	}
+
 	rd := RouterDesc {
 		SwoId:	*id,
 		Table:	params.Table,
+		CORS:	params.CORS,
 	}
 
 	return &rd, nil
@@ -77,20 +250,25 @@ func makeRouterURL(ctx context.Context, urlid string) (*RouterURL, error) {
 	}
 
 	rurl := RouterURL{}
-	rurl.table = make(map[string]*RouterEntry)
+	rurl.table = make(map[string][]*RouterEntry)
+	rurl.cors = rt.CORS
+	rurl.cookie = rt.Cookie
 	id := rt.SwoId
 	for _, e := range rt.Table {
 		id.Name = e.Call
 		re := RouterEntry{}
 		re.cookie = id.Cookie()
 		re.key = e.Key
-		if e.Method == "*" {
-			re.methods.Fill()
-		} else {
-			for _, m := range strings.Fields(e.Method) {
-				re.methods.Set(methodNr(m))
-			}
+		re.cache = e.Cache
+		re.xform = e.Transform
+		if e.Limit != nil {
+			re.lim = mkRtLimiter(e)
+		}
+		re.sch, err = mkReqSchema(e.Schema)
+		if err != nil {
+			return nil, err
 		}
+		re.methods = rtMethods(e.Method)
 		if e.AuthCtx != "" {
 			ac, err := authCtxGet(ctx, id, e.AuthCtx)
 			if err != nil {
@@ -100,9 +278,24 @@ func makeRouterURL(ctx context.Context, urlid string) (*RouterURL, error) {
 			re.ac = ac
 		}
 
-		rurl.table[e.Path] = &re
+		shape, segs, err := rtParsePath(e.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		re.shape = shape
+		if segs == nil {
+			rurl.table[e.Path] = append(rurl.table[e.Path], &re)
+		} else {
+			re.segs = segs
+			rurl.tmpls = append(rurl.tmpls, &re)
+		}
 	}
 
+	sort.Slice(rurl.tmpls, func(i, j int) bool {
+		return rtLess(rurl.tmpls[i].segs, rurl.tmpls[j].segs)
+	})
+
 	return &rurl, nil
 }
 
@@ -175,21 +368,32 @@ func (rt *RouterDesc)toInfo(ctx context.Context, details bool) *swyapi.RouterInf
 		Project:	rt.SwoId.Project,
 		Labels:		rt.Labels,
 		TLen:		len(rt.Table),
+		TRev:		rt.TRev,
+		CORS:		rt.CORS,
 	}
 
 	ri.URL = rt.getURL()
 
+	if details {
+		/* Counters are per-gate and live till the table changes */
+		if u, ok := urls.Load(URLRouter + rt.Cookie); ok {
+			ri.Limits = u.(*RouterURL).limits()
+		}
+	}
+
 	return &ri
 }
 
 func (rd *RouterDesc)Add(ctx context.Context, _ interface{}) *xrest.ReqErr {
 	rd.ObjID = bson.NewObjectId()
 	rd.Cookie = rd.SwoId.Cookie()
+	rd.TRev = 1
 	err := dbInsert(ctx, rd)
 	if err != nil {
 		return GateErrD(err)
 	}
 
+	rd.saveTable(ctx, "create")
 	gateRouters.Inc()
 	return nil
 }
@@ -211,22 +415,40 @@ func (rd *RouterDesc)Del(ctx context.Context) *xrest.ReqErr {
 		return GateErrD(err)
 	}
 
+	err = dbRtTablesDrop(ctx, rd.ObjID)
+	if err != nil {
+		ctxlog(ctx).Errorf("Can't drop %s table history: %s", rd.SwoId.Str(), err.Error())
+	}
+
 	gateRouters.Dec()
 	urlClean(ctx, URLRouter, rd.Cookie)
 	return nil
 }
 
-func (rd *RouterDesc)setTable(ctx context.Context, tbl []*swyapi.RouterEntry) *xrest.ReqErr {
+/* The rev is the one the change is based on, -1 means any */
+func (rd *RouterDesc)setTable(ctx context.Context, tbl []*swyapi.RouterEntry, rev int, op string) *xrest.ReqErr {
+	if rev >= 0 && rev != rd.TRev {
+		return GateErrM(swyapi.GateConflict, "Table is at revision " + strconv.Itoa(rd.TRev))
+	}
+
 	cerr := ckTable(tbl)
 	if cerr != nil {
 		return cerr
 	}
 
-	err := dbUpdatePart(ctx, rd, bson.M{"table": tbl})
+	/* Whoever comes second fails on the revision check */
+	err := dbUpdatePart2(ctx, rd, rtRevQ(rd.TRev), bson.M{"table": tbl, "trev": rd.TRev + 1})
 	if err != nil {
+		if dbNF(err) {
+			return GateErrC(swyapi.GateConflict)
+		}
 		return GateErrD(err)
 	}
 
+	rd.Table = tbl
+	rd.TRev++
+	rd.saveTable(ctx, op)
+
 	/*
 	 * XXX: Maybe it's worth fixing the table on RouterURL, but
 	 * flushing the cache and making urlFind repopulate one from
@@ -241,30 +463,141 @@ type RouterEntry struct {
 	ac	*AuthCtx
 	methods	xh.Bitmask
 	key	string
+	shape	string
+	segs	[]string
+	cache	*swyapi.RouterCache
+	xform	*swyapi.RouterTransform
+	lim	*rtLimiter
+	sch	*reqSchema
+}
+
+func (e *RouterEntry)match(segs []string) (map[string]string, bool) {
+	params := make(map[string]string)
+
+	for i, s := range e.segs {
+		if s == rtWildcard {
+			params[rtWildcard] = strings.Join(segs[i:], "/")
+			return params, true
+		}
+
+		if i >= len(segs) {
+			return nil, false
+		}
+
+		if rtIsParam(s) {
+			if segs[i] == "" {
+				return nil, false
+			}
+
+			params[s[1:len(s)-1]] = segs[i]
+		} else if s != segs[i] {
+			return nil, false
+		}
+	}
+
+	return params, len(segs) == len(e.segs)
 }
 
 type RouterURL struct {
 	URL
-	table	map[string]*RouterEntry
+	table	map[string][]*RouterEntry	/* entries for different methods */
+	tmpls	[]*RouterEntry		/* sorted by precedence */
+	cors	*swyapi.CORSPolicy
+	cookie	string
+}
+
+func (rt *RouterURL)CORS() *swyapi.CORSPolicy { return rt.cors }
+
+func (rt *RouterURL)limits() []*swyapi.RouterLimitInfo {
+	var ret []*swyapi.RouterLimitInfo
+
+	for _, es := range rt.table {
+		for _, e := range es {
+			if e.lim != nil {
+				ret = append(ret, e.lim.info())
+			}
+		}
+	}
+
+	for _, e := range rt.tmpls {
+		if e.lim != nil {
+			ret = append(ret, e.lim.info())
+		}
+	}
+
+	return ret
+}
+
+/*
+ * The most specific shape matching the path is taken, then the entry
+ * of this shape serving the method. The last return value tells
+ * whether the path itself was found, i.e. it's the method not allowed.
+ */
+func (rt *RouterURL)find(path string, mnr uint) (*RouterEntry, map[string]string, bool) {
+	es, ok := rt.table[path]
+	if ok {
+		for _, e := range es {
+			if e.methods.Test(mnr) {
+				return e, nil, true
+			}
+		}
+
+		return nil, nil, true
+	}
+
+	if len(rt.tmpls) == 0 {
+		return nil, nil, false
+	}
+
+	shape := ""
+	segs := rtSegs(path)
+	for _, e := range rt.tmpls {
+		if shape != "" && e.shape != shape {
+			break
+		}
+
+		params, ok := e.match(segs)
+		if !ok {
+			continue
+		}
+
+		if e.methods.Test(mnr) {
+			return e, params, true
+		}
+
+		/* Same-shape entries go together after sorting */
+		shape = e.shape
+	}
+
+	return nil, nil, shape != ""
 }
 
 func (rt *RouterURL)Handle(ctx context.Context, w http.ResponseWriter, r *http.Request, sopq *statsOpaque) {
 	path := reqPath(r)
-	e, ok := rt.table[path]
-	if !ok {
-		http.Error(w, "", http.StatusNotFound)
+	e, params, found := rt.find(path, methodNr(r.Method))
+	if e == nil {
+		if found {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		} else {
+			http.Error(w, "", http.StatusNotFound)
+		}
 		return
 	}
 
-	mnr := methodNr(r.Method)
-	if !e.methods.Test(mnr) {
-		http.Error(w, "", http.StatusMethodNotAllowed)
+	if e.lim != nil && e.lim.early() && !e.lim.check(w, r, nil) {
 		return
 	}
 
+	var xc *rtXformCtx
+	if e.xform != nil {
+		xc = &rtXformCtx{r: r, path: path, params: params}
+		rtXformRequest(e.xform, xc)
+	}
+
 	args := &swyapi.FunctionRun{
 		Path:	&path,
 		Key:	e.key,
+		Params:	params,
 	}
 
 	if e.ac != nil {
@@ -272,11 +605,25 @@ func (rt *RouterURL)Handle(ctx context.Context, w http.ResponseWriter, r *http.R
 
 		args.Claims, err = e.ac.Verify(r)
 		if err != nil {
-			http.Error(w, "", http.StatusUnauthorized)
+			code := http.StatusUnauthorized
+			if err == errAuthRatelimited {
+				code = http.StatusTooManyRequests
+			}
+			http.Error(w, "", code)
 			return
 		}
 	}
 
+	if e.lim != nil && !e.lim.early() && !e.lim.check(w, r, args.Claims) {
+		return
+	}
+
+	if xc != nil {
+		xc.claims = args.Claims
+		rtXformArgs(e.xform, xc, args)
+		w = rtXformResponse(e.xform, xc, w)
+	}
+
 	/* FIXME -- cache guy on e */
 	fmd, err := memdGet(ctx, e.cookie)
 	if err != nil {
@@ -289,7 +636,27 @@ func (rt *RouterURL)Handle(ctx context.Context, w http.ResponseWriter, r *http.R
 		return
 	}
 
-	fmd.Handle(ctx, w, r, sopq, args)
+	/* Function's own authctx is checked by the call, don't bypass it */
+	if e.cache == nil || r.Method != "GET" || (fmd.ac != nil && e.ac == nil) {
+		fmd.Handle(ctx, w, r, sopq, args, e.sch)
+		return
+	}
+
+	cpath := rtCachePath(path)
+	ck := rtCacheKey(rt.cookie, cpath, e.cache, r, args.Claims)
+	if ce := rtCache.get(ctx, ck); ce != nil {
+		gateRtCache.WithLabelValues("hit").Inc()
+		rtCacheReply(w, ce)
+		return
+	}
+
+	gateRtCache.WithLabelValues("miss").Inc()
+	cw := &rtCacheWriter{ResponseWriter: w}
+	fmd.Handle(ctx, cw, r, sopq, args, e.sch)
+
+	if ce := cw.entry(ck, rt.cookie, cpath, e.cache.TTL); ce != nil {
+		rtCache.put(ctx, ce)
+	}
 }
 
 type RtTblProp struct { }
@@ -299,6 +666,20 @@ func (_ *RtTblProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interfa
 	f := 0
 	t := len(rt.Table)
 
+	if q != nil && q.Get("rev") != "" {
+		rev, err := strconv.Atoi(q.Get("rev"))
+		if err != nil {
+			return nil, GateErrM(swyapi.GateBadRequest, "Invalid revision")
+		}
+
+		tbl, cerr := rt.tableAt(ctx, rev)
+		if cerr != nil {
+			return nil, cerr
+		}
+
+		return tbl, nil
+	}
+
 	if q != nil {
 		f, e := xhttp.ReqAtoi(q, "from", f)
 		if f < 0 || e != nil {
@@ -313,6 +694,48 @@ func (_ *RtTblProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interfa
 	return rt.Table[f:t], nil
 }
 
+/* PUT goes via handleRouterTable, it knows the revision */
 func (_ *RtTblProp)Upd(ctx context.Context, o xrest.Obj, par interface{}) *xrest.ReqErr {
-	return o.(*RouterDesc).setTable(ctx, *par.(*[]*swyapi.RouterEntry))
+	return GateErrC(swyapi.GateNotAvail)
+}
+
+func (rd *RouterDesc)flushCache(ctx context.Context, paths []string) *xrest.ReqErr {
+	rtCacheFlush(ctx, rd.Cookie, paths)
+	return nil
+}
+
+type RtCORSProp struct { }
+
+func (_ *RtCORSProp)Info(ctx context.Context, o xrest.Obj, q url.Values) (interface{}, *xrest.ReqErr) {
+	rt := o.(*RouterDesc)
+	if rt.CORS == nil {
+		return &swyapi.CORSPolicy{}, nil
+	}
+
+	return rt.CORS, nil
+}
+
+func (_ *RtCORSProp)Upd(ctx context.Context, o xrest.Obj, par interface{}) *xrest.ReqErr {
+	return o.(*RouterDesc).setCORS(ctx, par.(*swyapi.CORSPolicy))
+}
+
+/* Empty origins list turns the policy off */
+func (rd *RouterDesc)setCORS(ctx context.Context, cp *swyapi.CORSPolicy) *xrest.ReqErr {
+	if len(cp.Origins) == 0 {
+		cp = nil
+	} else {
+		err := ckCORS(cp)
+		if err != nil {
+			return GateErrE(swyapi.GateBadRequest, err)
+		}
+	}
+
+	err := dbUpdatePart(ctx, rd, bson.M{"cors": cp})
+	if err != nil {
+		return GateErrD(err)
+	}
+
+	rd.CORS = cp
+	urlClean(ctx, URLRouter, rd.Cookie)
+	return nil
 }
@@ -11,6 +11,8 @@ import (
 	"time"
 	"context"
 	"strings"
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 
 	"swifty/apis"
@@ -37,13 +39,20 @@ func init() {
 func makeArgs(args *swyapi.FunctionRun, sopq *statsOpaque, r *http.Request) {
 	defer r.Body.Close()
 
-	args.Args = make(map[string]string)
+	/* Router may have put some args, these win over the query */
+	if args.Args == nil {
+		args.Args = make(map[string]string)
+	}
 
 	for k, v := range r.URL.Query() {
 		if len(v) < 1 {
 			continue
 		}
 
+		if _, ok := args.Args[k]; ok {
+			continue
+		}
+
 		args.Args[k] = v[0]
 		sopq.argsSz += len(k) + len(v[0])
 	}
@@ -84,9 +93,13 @@ type podConn struct {
 	PTok	string
 }
 
-func talkHTTP(addr, port, url string, args *swyapi.FunctionRun) (*swyapi.WdogFunctionRunResult, error) {
+/*
+ * Wdog streams output lines while the fn runs, each goes to the lines
+ * callback right away and is also collected into the result
+ */
+func talkHTTP(addr, port, url string, args *swyapi.FunctionRun, lines func(*swyapi.WdogLogLine)) (*swyapi.WdogFunctionRunResult, error) {
 	var resp *http.Response
-	var res swyapi.WdogFunctionRunResult
+	var stdout, stderr bytes.Buffer
 	var err error
 
 	resp, err = xhttp.Req(
@@ -103,12 +116,35 @@ func talkHTTP(addr, port, url string, args *swyapi.FunctionRun) (*swyapi.WdogFun
 		return nil, err
 	}
 
-	err = xhttp.RResp(resp, &res)
-	if err != nil {
-		return nil, err
-	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var f swyapi.WdogRunFrame
+
+		err = dec.Decode(&f)
+		if err != nil {
+			return nil, err
+		}
 
-	return &res, nil
+		if f.Line != nil {
+			out := &stdout
+			if f.Line.Stream == "stderr" {
+				out = &stderr
+			}
+			out.WriteString(f.Line.Text + "\n")
+
+			if lines != nil {
+				lines(f.Line)
+			}
+		}
+
+		if f.Res != nil {
+			f.Res.Stdout = stdout.String()
+			f.Res.Stderr = stderr.String()
+			return f.Res, nil
+		}
+	}
 }
 
 func traceTime(sopq *statsOpaque, w string, wt *uint) {
@@ -129,31 +165,27 @@ func (conn *podConn)Run(ctx context.Context, sopq *statsOpaque, suff, event stri
 
 	traceTime(sopq, "wdog.req", nil)
 
+	ls := &logStream{cookie: conn.FnId, event: event}
+
 	if proxy {
 		res, err = talkHTTP(conn.Host, conf.Wdog.p_port,
-				conn.PTok + "/" + strings.Replace(conn.Addr, ".", "_", -1), args)
+				conn.PTok + "/" + strings.Replace(conn.Addr, ".", "_", -1), args, ls.put)
 	} else {
 		url := conn.PTok
 		if suff != "" {
 			url += "/" + suff
 		}
-		res, err = talkHTTP(conn.Addr, conn.Port, url, args)
+		res, err = talkHTTP(conn.Addr, conn.Port, url, args, ls.put)
 	}
 
+	ls.close()
+
 	if err != nil {
 		return nil, fmt.Errorf("RUN error %s", err.Error())
 	}
 
 	traceTime(sopq, "wdog.resp", &res.Time)
 
-	if res.Stdout != "" || res.Stderr != "" {
-		go func() {
-			sctx, done := mkContext("::logsave")
-			defer done(sctx)
-			logSaveResult(sctx, conn.FnId, event, res.Stdout, res.Stderr)
-		}()
-	}
-
 	return res, nil
 }
 
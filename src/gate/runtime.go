@@ -36,6 +36,9 @@ var rt_handlers = map[string]*langInfo {
 	"nodejs":	&nodejs_info,
 	"ruby":		&ruby_info,
 	"csharp":	&csharp_info,
+	"java":		&java_info,
+	"php":		&php_info,
+	"rust":		&rust_info,
 }
 
 var golang_info = langInfo {
@@ -88,6 +91,48 @@ var csharp_info = langInfo {
 	Build:		true,
 }
 
+var java_info = langInfo {
+	Ext:		"java",
+	CodePath:	"/function",
+	Build:		true,
+	BuildPkgPath:	javaPkgPath,
+	/*
+	 * Java's runner-java.sh puts jars from /packages/lib on classpath
+	 */
+	RunPackages:	"/packages",
+}
+
+var php_info = langInfo {
+	Ext:		"php",
+	CodePath:	"/function",
+	/*
+	 * PHP runner includes /packages/vendor/autoload.php if present
+	 */
+	RunPackages:	"/packages",
+}
+
+var rust_info = langInfo {
+	Ext:		"rs",
+	CodePath:	"/rust/swycode",
+	Build:		true,
+	BuildPkgPath:	rustPkgPath,
+}
+
+func rustPkgPath(id SwoId) string {
+	/*
+	 * Build dep mounts volume's packages subdir to /rust-pkg,
+	 * builder takes the vendored crates from there
+	 */
+	return "/rust-pkg/" + id.Tennant + "/rust"
+}
+
+func javaPkgPath(id SwoId) string {
+	/*
+	 * Build dep mounts volume's packages subdir to /java-pkg
+	 */
+	return "/java-pkg/" + id.Tennant + "/java"
+}
+
 var extmap map[string]string
 
 func init() {
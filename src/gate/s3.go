@@ -8,6 +8,12 @@ package main
 import (
 	"strings"
 	"path/filepath"
+	"bytes"
+	"time"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"encoding/xml"
 	"fmt"
 	"errors"
 	"context"
@@ -113,6 +119,188 @@ func s3KeyDel(conf *YAMLConfS3, key string) error {
 		}, nil)
 }
 
+/*
+ * Gate-side access to objects in tenant's namespace. We go to the
+ * data API with admin token and short-living key, as the gate has
+ * no permanent creds in the users' namespaces.
+ */
+type s3Conn struct {
+	key	*swys3api.KeyGenResult
+	cln	*http.Client
+}
+
+const s3ConnKeyLifetime = 3600
+
+func s3Connect(ns string) (*s3Conn, error) {
+	if conf.Mware.S3 == nil {
+		return nil, errors.New("Not configured")
+	}
+
+	k, err := s3KeyGen(ns, "", s3ConnKeyLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Conn{key: k, cln: &http.Client{Timeout: s3ConnKeyLifetime * time.Second}}, nil
+}
+
+func (sc *s3Conn)Close() {
+	s3KeyDel(conf.Mware.S3, sc.key.AccessKeyID)
+}
+
+func (sc *s3Conn)req(method, path string, data []byte) (*http.Response, error) {
+	return sc.reqBody(method, path, bytes.NewReader(data))
+}
+
+func (sc *s3Conn)reqBody(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s3Endpoint(conf.Mware.S3, false) + "/" + path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(swys3api.SwyS3_AdminToken, conf.Mware.S3.c.Pass)
+	req.Header.Set(swys3api.SwyS3_AccessKey, sc.key.AccessKeyID)
+
+	return sc.cln.Do(req)
+}
+
+func (sc *s3Conn)open(method, path string, data []byte) (*http.Response, error) {
+	resp, err := sc.req(method, path, data)
+	if err != nil {
+		return nil, fmt.Errorf("Error talking to S3: %s", err.Error())
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s responded %d", method, path, resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+func (sc *s3Conn)do(method, path string, data []byte) ([]byte, error) {
+	resp, err := sc.open(method, path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if method != "GET" && method != "POST" {
+		return nil, nil
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (sc *s3Conn)MkBucket(bucket string) error {
+	resp, err := sc.req("HEAD", bucket, nil)
+	if err != nil {
+		return fmt.Errorf("Error talking to S3: %s", err.Error())
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	_, err = sc.do("PUT", bucket, nil)
+	return err
+}
+
+func (sc *s3Conn)Put(bucket, oname string, data []byte) error {
+	_, err := sc.do("PUT", bucket + "/" + oname, data)
+	return err
+}
+
+func (sc *s3Conn)Get(bucket, oname string) ([]byte, error) {
+	return sc.do("GET", bucket + "/" + oname, nil)
+}
+
+/*
+ * Objects that may not fit into memory (mware backups) go through
+ * these two. Put uploads the stream in parts, so that only one part
+ * is in memory at a time, Get gives the body as it comes.
+ */
+var s3PartSize = 16 << 20
+
+func (sc *s3Conn)PutStream(bucket, oname string, r io.Reader) (uint64, error) {
+	var ini swys3api.S3MpuInit
+	var fin swys3api.S3MpuFiniParts
+	var size uint64
+	var fx []byte
+
+	path := bucket + "/" + oname
+	data, err := sc.do("POST", path + "?uploads", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	err = xml.Unmarshal(data, &ini)
+	if err != nil {
+		return 0, fmt.Errorf("Bad S3 upload init response: %s", err.Error())
+	}
+
+	upl := "?uploadId=" + ini.UploadId
+	buf := make([]byte, s3PartSize)
+
+	for pn := 1; ; pn++ {
+		var resp *http.Response
+		var l int
+
+		l, err = io.ReadFull(r, buf)
+		if err == io.EOF && pn > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			goto abort
+		}
+
+		resp, err = sc.open("PUT", path + upl + "&partNumber=" + strconv.Itoa(pn), buf[:l])
+		if err != nil {
+			goto abort
+		}
+
+		resp.Body.Close()
+		fin.Part = append(fin.Part, swys3api.S3MpuFiniPart{PartNumber: pn, ETag: resp.Header.Get("ETag")})
+		size += uint64(l)
+
+		if l < len(buf) {
+			break
+		}
+	}
+
+	fx, err = xml.Marshal(&fin)
+	if err != nil {
+		goto abort
+	}
+
+	_, err = sc.do("POST", path + upl, fx)
+	if err != nil {
+		goto abort
+	}
+
+	return size, nil
+
+abort:
+	sc.do("DELETE", path + upl, nil)
+	return 0, err
+}
+
+func (sc *s3Conn)GetStream(bucket, oname string) (io.ReadCloser, error) {
+	resp, err := sc.open("GET", bucket + "/" + oname, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (sc *s3Conn)Del(bucket, oname string) error {
+	_, err := sc.do("DELETE", bucket + "/" + oname, nil)
+	return err
+}
+
 const (
 	gates3queue = "events"
 )
@@ -0,0 +1,108 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"strconv"
+	"testing"
+	"errors"
+	"bytes"
+	"io"
+	"swifty/apis/s3"
+	"swifty/common"
+)
+
+type fakeMpu struct {
+	parts	map[string][]byte
+	fin	[]swys3api.S3MpuFiniPart
+	aborted	bool
+}
+
+func (f *fakeMpu)ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "POST" && q.Get("uploadId") == "":
+		xml.NewEncoder(w).Encode(&swys3api.S3MpuInit{UploadId: "upl"})
+	case r.Method == "PUT":
+		pn := q.Get("partNumber")
+		f.parts[pn] = data
+		w.Header().Set("ETag", "e" + pn)
+	case r.Method == "POST":
+		var fin swys3api.S3MpuFiniParts
+		xml.Unmarshal(data, &fin)
+		f.fin = fin.Part
+	case r.Method == "DELETE":
+		f.aborted = true
+	}
+}
+
+func fakeS3(t *testing.T) (*fakeMpu, *s3Conn, func()) {
+	f := &fakeMpu{parts: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+
+	oc, ops := conf.Mware.S3, s3PartSize
+	conf.Mware.S3 = &YAMLConfS3{API: srv.URL, c: &xh.XCreds{}}
+	s3PartSize = 10
+
+	return f, &s3Conn{key: &swys3api.KeyGenResult{}, cln: srv.Client()}, func() {
+		srv.Close()
+		conf.Mware.S3, s3PartSize = oc, ops
+	}
+}
+
+func TestS3PutStream(t *testing.T) {
+	f, sc, done := fakeS3(t)
+	defer done()
+
+	data := strings.Repeat("0123456789", 2) + "abcde"
+	size, err := sc.PutStream("b", "o", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("put failed: %s", err.Error())
+	}
+
+	if size != uint64(len(data)) || len(f.parts) != 3 || len(f.fin) != 3 {
+		t.Fatalf("put %d bytes in %d parts, %d finished", size, len(f.parts), len(f.fin))
+	}
+
+	var got bytes.Buffer
+	for i, p := range f.fin {
+		if p.PartNumber != i + 1 || p.ETag != "e" + strconv.Itoa(i + 1) {
+			t.Errorf("bad part %d: %v", i, p)
+		}
+		got.Write(f.parts[strconv.Itoa(i + 1)])
+	}
+
+	if got.String() != data || f.aborted {
+		t.Errorf("uploaded %q, aborted %v", got.String(), f.aborted)
+	}
+}
+
+func TestS3PutStreamAbort(t *testing.T) {
+	f, sc, done := fakeS3(t)
+	defer done()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte(strings.Repeat("x", 15)))
+		pw.CloseWithError(errors.New("dump broke"))
+	}()
+
+	_, err := sc.PutStream("b", "o", pr)
+	if err == nil || err.Error() != "dump broke" {
+		t.Fatalf("put returned %v", err)
+	}
+
+	if !f.aborted || f.fin != nil {
+		t.Errorf("upload not aborted")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"errors"
+	"swifty/apis"
+	"swifty/common/xschema"
+)
+
+/*
+ * Requests validation. Bad requests are answered by gate, the function
+ * is not called and the call doesn't get into stats.
+ */
+
+type reqSchema struct {
+	body	*xschema.Schema
+	args	*xschema.Schema
+}
+
+func mkReqSchema(rs *swyapi.RequestSchema) (*reqSchema, error) {
+	var err error
+
+	if rs == nil || (rs.Body == "" && rs.Args == "") {
+		return nil, nil
+	}
+
+	sch := &reqSchema{}
+
+	if rs.Body != "" {
+		sch.body, err = xschema.Parse([]byte(rs.Body))
+		if err != nil {
+			return nil, errors.New("body schema: " + err.Error())
+		}
+	}
+
+	if rs.Args != "" {
+		sch.args, err = xschema.Parse([]byte(rs.Args))
+		if err != nil {
+			return nil, errors.New("args schema: " + err.Error())
+		}
+	}
+
+	return sch, nil
+}
+
+func ckReqSchema(rs *swyapi.RequestSchema) error {
+	_, err := mkReqSchema(rs)
+	return err
+}
+
+func (sch *reqSchema)check(args *swyapi.FunctionRun) []string {
+	var errs []string
+
+	if sch.args != nil {
+		av := make(map[string]interface{}, len(args.Args))
+		for k, v := range args.Args {
+			av[k] = v
+		}
+
+		errs = append(errs, sch.args.Validate(av, "args")...)
+	}
+
+	if sch.body != nil && args.Body != "" {
+		if args.ContentType != "application/json" {
+			return append(errs, "body: should be application/json")
+		}
+
+		var bv interface{}
+
+		err := json.Unmarshal([]byte(args.Body), &bv)
+		if err != nil {
+			return append(errs, "body: bad JSON")
+		}
+
+		errs = append(errs, sch.body.Validate(bv, "body")...)
+	}
+
+	return errs
+}
+
+func reqInvalid(w http.ResponseWriter, errs []string) {
+	data, _ := json.Marshal(&swyapi.RequestInvalid{Message: "Request doesn't match schema", Errors: errs})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(data)
+}
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 	"context"
 	"swifty/gate/mgo"
@@ -16,9 +17,11 @@ import (
 )
 
 var statsFlushPeriod = 8 * time.Second
+var memWarnPct = 90
 
 func init() {
 	sysctl.AddTimeSysctl("stats_fush_period", &statsFlushPeriod)
+	sysctl.AddIntSysctl("fn_memory_warn_pct", &memWarnPct)
 }
 
 type statsWriter interface {
@@ -83,6 +86,10 @@ func (fs *FnStats)RunTimeUsec() uint64 {
 	return uint64(fs.RunTime/time.Microsecond)
 }
 
+func (fs *FnStats)CPUTimeUsec() uint64 {
+	return uint64(fs.CPUTime/time.Microsecond)
+}
+
 func getCallStats(ctx context.Context, periods int) ([]swyapi.TenantStatsFn, *xrest.ReqErr) {
 	var cs []swyapi.TenantStatsFn
 
@@ -157,6 +164,7 @@ func (fn *FunctionDesc)getStats(ctx context.Context, periods int) ([]swyapi.Func
 				Errors:		prev.Errors - cur.Errors,
 				LastCall:	prev.LastCallS(),
 				Time:		prev.RunTimeUsec() - cur.RunTimeUsec(),
+				CPUTime:	prev.CPUTimeUsec() - cur.CPUTimeUsec(),
 				GBS:		GBS(prev.RunCost - cur.RunCost),
 				BytesOut:	prev.BytesOut - cur.BytesOut,
 				Till:		prev.TillS(),
@@ -172,6 +180,8 @@ func (fn *FunctionDesc)getStats(ctx context.Context, periods int) ([]swyapi.Func
 		Errors:		prev.Errors,
 		LastCall:	prev.LastCallS(),
 		Time:		prev.RunTimeUsec(),
+		CPUTime:	prev.CPUTimeUsec(),
+		MaxRSS:		prev.MaxRSS,	/* all-time peak, archives don't have per-period ones */
 		GBS:		GBS(prev.RunCost),
 		BytesOut:	prev.BytesOut,
 		Till:		prev.TillS(),
@@ -228,6 +238,12 @@ func statsUpdate(fmd *FnMemData, op *statsOpaque, res *swyapi.WdogFunctionRunRes
 	fmd.stats.LastCall = op.ts
 
 	fmd.stats.RunTime += rt
+	fmd.stats.CPUTime += res.FnCPU()
+
+	peak := uint64(res.MaxRSS) > fmd.stats.MaxRSS
+	if peak {
+		fmd.stats.MaxRSS = uint64(res.MaxRSS)
+	}
 
 	rc := uint64(rt) * uint64(fmd.mem)
 	fmd.stats.RunCost += rc
@@ -237,6 +253,10 @@ func statsUpdate(fmd *FnMemData, op *statsOpaque, res *swyapi.WdogFunctionRunRes
 
 	fmd.stats.Dirty()
 
+	if peak {
+		statsCheckMem(fmd, res.MaxRSS)
+	}
+
 	td := fmd.td
 	td.lock.Lock()
 	td.stats.RunCost += rc
@@ -248,6 +268,30 @@ func statsUpdate(fmd *FnMemData, op *statsOpaque, res *swyapi.WdogFunctionRunRes
 	td.stats.Dirty()
 }
 
+/*
+ * Runners of one pod share its memory, so each one is in trouble
+ * when it gets close to its share. Only new peaks are checked not
+ * to flood the logs with the same warning.
+ */
+func statsCheckMem(fmd *FnMemData, rss uint) {
+	conc := uint64(fmd.bd.conc)
+	if conc == 0 {
+		conc = 1
+	}
+
+	lim := uint64(fmd.mem) * 1024 / conc
+	if lim == 0 || uint64(rss) * 100 < lim * uint64(memWarnPct) {
+		return
+	}
+
+	memWarnings.Inc()
+	go func() {
+		ctx, done := mkContext("::memwarn")
+		defer done(ctx)
+		logSaveEvent(ctx, fmd.fnid, fmt.Sprintf("memory: peak %dKB of %dKB limit", rss, lim))
+	}()
+}
+
 var statsFlushReqs chan *statsFlush
 
 func statsInit() error {
@@ -301,6 +345,8 @@ func (st *FnStats)Write(ctx context.Context) error {
 		Timeouts: now.Timeouts - st.onDisk.Timeouts,
 		Errors: now.Errors - st.onDisk.Errors,
 		RunTime: now.RunTime - st.onDisk.RunTime,
+		CPUTime: now.CPUTime - st.onDisk.CPUTime,
+		MaxRSS: now.MaxRSS, /* goes with $max, not $inc */
 		BytesIn: now.BytesIn - st.onDisk.BytesIn,
 		BytesOut: now.BytesOut - st.onDisk.BytesOut,
 		RunCost: now.RunCost - st.onDisk.RunCost,
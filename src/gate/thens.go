@@ -40,6 +40,13 @@ func doThenCall(ctx context.Context, fmd *FnMemData, tc *swyapi.ThenCall) {
 	}()
 }
 
+func doThenInvalidate(ctx context.Context, fmd *FnMemData, ti *swyapi.ThenInvalidate) {
+	id := fmd.id
+	id.Name = ti.Router
+
+	rtCacheFlush(ctx, id.Cookie(), ti.Paths)
+}
+
 func noteThens(ctx context.Context, fmd *FnMemData, then_msg json.RawMessage) {
 	var then swyapi.Then
 
@@ -53,4 +60,8 @@ func noteThens(ctx context.Context, fmd *FnMemData, then_msg json.RawMessage) {
 	case then.Call != nil:
 		doThenCall(ctx, fmd, then.Call)
 	}
+
+	if then.Invalidate != nil {
+		doThenInvalidate(ctx, fmd, then.Invalidate)
+	}
 }
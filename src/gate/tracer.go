@@ -123,6 +123,8 @@ func traceCall(fmd *FnMemData, args *swyapi.FunctionRun, res *swyapi.WdogFunctio
 			"method": args.Method,
 			"path":	args.Path,
 			"code":  res.Code,
+			"cpu":   res.CPU,
+			"maxrss": res.MaxRSS,
 		},
 	}
 
@@ -21,6 +21,7 @@ import (
 
 type URL interface {
 	Handle(context.Context, http.ResponseWriter, *http.Request, *statsOpaque)
+	CORS() *swyapi.CORSPolicy
 }
 
 var urls sync.Map
@@ -28,6 +29,8 @@ var urls sync.Map
 type FnURL struct {
 	URL
 	fd	*FnMemData
+	cors	*swyapi.CORSPolicy
+	sch	*reqSchema
 }
 
 const (
@@ -67,7 +70,12 @@ func makeFnURL(ctx context.Context, urlid string) (*FnURL, error) {
 		return nil, err
 	}
 
-	return &FnURL{fd: fdm}, nil
+	sch, err := mkReqSchema(ed.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FnURL{fd: fdm, cors: ed.CORS, sch: sch}, nil
 }
 
 func urlCreate(ctx context.Context, urlid string) (URL, error) {
@@ -116,16 +124,36 @@ var urlEOps = EventOps {
 			return errors.New("Invalid \"url\" parameter")
 		}
 
+		if evt.CORS != nil {
+			err := ckCORS(evt.CORS)
+			if err != nil {
+				return err
+			}
+
+			ed.CORS = evt.CORS
+		}
+
+		if evt.Schema != nil {
+			err := ckReqSchema(evt.Schema)
+			if err != nil {
+				return err
+			}
+
+			ed.Schema = evt.Schema
+		}
+
 		return nil
 	},
 	start:	urlEventStart,
 	stop:	urlEventStop,
 }
 
+func (furl *FnURL)CORS() *swyapi.CORSPolicy { return furl.cors }
+
 func (furl *FnURL)Handle(ctx context.Context, w http.ResponseWriter, r *http.Request, sopq *statsOpaque) {
 	path := reqPath(r)
 	args := &swyapi.FunctionRun{Path: &path}
-	furl.fd.Handle(ctx, w, r, sopq, args)
+	furl.fd.Handle(ctx, w, r, sopq, args, furl.sch)
 }
 
 var wrl *xrl.RL
@@ -159,7 +187,7 @@ func init() {
 }
 
 func (fmd *FnMemData)Handle(ctx context.Context, w http.ResponseWriter, r *http.Request, sopq *statsOpaque,
-		args *swyapi.FunctionRun) {
+		args *swyapi.FunctionRun, sch *reqSchema) {
 	var res *swyapi.WdogFunctionRunResult
 	var err error
 	var code int
@@ -177,24 +205,35 @@ func (fmd *FnMemData)Handle(ctx context.Context, w http.ResponseWriter, r *http.
 		goto out
 	}
 
-	conn, err = balancerGetConnAny(ctx, fmd)
-	if err != nil {
-		code = http.StatusInternalServerError
-		err = errors.New("DB error")
-		goto out
-	}
-
-	defer balancerPutConn(fmd)
-
 	if args.Claims == nil && fmd.ac != nil {
 		args.Claims, err = fmd.ac.Verify(r)
 		if err != nil {
 			code = http.StatusUnauthorized
+			if err == errAuthRatelimited {
+				code = http.StatusTooManyRequests
+			}
 			goto out
 		}
 	}
 
+	/* Bad requests shouldn't occupy pods and push the scaler */
 	makeArgs(args, sopq, r)
+	if sch != nil {
+		if errs := sch.check(args); len(errs) != 0 {
+			reqInvalid(w, errs)
+			return
+		}
+	}
+
+	conn, err = balancerGetConnAny(ctx, fmd)
+	if err != nil {
+		code = http.StatusInternalServerError
+		err = errors.New("DB error")
+		goto out
+	}
+
+	defer balancerPutConn(fmd)
+
 	res, err = conn.Run(ctx, sopq, "", "call", args)
 	if err != nil {
 		code = http.StatusInternalServerError
@@ -9,11 +9,13 @@ import (
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
 	"go.uber.org/zap"
+	"strconv"
 	"flag"
-	"time"
 	"os"
+	"swifty/apis"
 	"swifty/common"
 	"swifty/common/secrets"
+	"swifty/common/xquota"
 )
 
 var zcfg zap.Config = zap.Config {
@@ -33,6 +35,9 @@ type YAMLConf struct {
 	Addr		string		`yaml:"address"`
 	User		string		`yaml:"user"`
 	Pass		string		`yaml:"password"`
+	Listen		string		`yaml:"listen,omitempty"`
+	Token		string		`yaml:"token,omitempty"`
+	Notify		string		`yaml:"notify,omitempty"`
 }
 
 var conf YAMLConf
@@ -56,44 +61,174 @@ WHERE
 	((ifo.rows < ifo.rowsl AND ifo.size < ifo.sizel) AND locked=true)
 `
 
-func lockAccess(qdb *sql.DB, id string) {
-	/* FIXME -- revoke ins and upd privs for db id from user id (swifty makes them match) */
+const quotaStatusReq = `
+SELECT
+	quotas.rows,
+	IFNULL(SUM(information_schema.tables.table_rows), 0),
+	quotas.size,
+	IFNULL(SUM(information_schema.tables.data_length + information_schema.tables.index_length), 0),
+	quotas.locked
+FROM quotas
+LEFT JOIN information_schema.tables ON information_schema.tables.table_schema=quotas.id
+WHERE quotas.id=?
+GROUP BY quotas.id
+`
+
+/*
+ * Gate creates the DB owner with ALL privileges and read-only grants
+ * with SELECT only, but after creds rotation the user names no longer
+ * match the DB name, so work on whoever has access to the DB.
+ */
+type dbUser struct {
+	name	string
+	host	string
 }
 
-func unlockAccess(qdb *sql.DB, id string) {
-	/* FIXME -- grant all privs back */
+func (u *dbUser)String() string {
+	return "'" + u.name + "'@'" + u.host + "'"
 }
 
-func checkQuotas(qdb *sql.DB, delay *uint) {
+func dbUsers(qdb *sql.DB, id, priv string) ([]*dbUser, error) {
+	rows, err := qdb.Query("SELECT User, Host FROM mysql.db WHERE Db=? AND " + priv + "='Y'", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*dbUser
+	for rows.Next() {
+		var u dbUser
+
+		err = rows.Scan(&u.name, &u.host)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &u)
+	}
+
+	return users, rows.Err()
+}
+
+func setLocked(qdb *sql.DB, id string, locked bool) error {
+	_, err := qdb.Exec("UPDATE quotas SET locked=? WHERE id=?", locked, id)
+	return err
+}
+
+/*
+ * DB-level privileges are checked when the connection selects the
+ * DB, so the already connected sessions keep writing after REVOKE.
+ * Kick them, they'll reconnect with the new privileges.
+ */
+func killSessions(qdb *sql.DB, u *dbUser) error {
+	rows, err := qdb.Query("SELECT ID FROM information_schema.processlist WHERE USER=?", u.name)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err = qdb.Exec("KILL CONNECTION " + strconv.FormatInt(id, 10))
+		if err != nil {
+			/* Might have gone by itself */
+			log.Debugf("Can't kill %s session %d: %s", u.String(), id, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func lockAccess(qdb *sql.DB, id string) error {
+	users, err := dbUsers(qdb, id, "Insert_priv")
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		_, err = qdb.Exec("REVOKE INSERT, UPDATE, CREATE ON `" + id + "`.* FROM " + u.String())
+		if err != nil {
+			return err
+		}
+
+		err = killSessions(qdb, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return setLocked(qdb, id, true)
+}
+
+func unlockAccess(qdb *sql.DB, id string) error {
+	/* Read-only users don't have DELETE, so they stay such */
+	users, err := dbUsers(qdb, id, "Delete_priv")
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		_, err = qdb.Exec("GRANT INSERT, UPDATE, CREATE ON `" + id + "`.* TO " + u.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return setLocked(qdb, id, false)
+}
+
+func overflow(qdb *sql.DB) ([]*swyapi.MquotaStatus, error) {
 	rows, err := qdb.Query(quotaOverflowReq)
 	if err != nil {
-		log.Debugf("Can't get quota status: %s", err.Error())
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
+	var sts []*swyapi.MquotaStatus
+
 	for rows.Next() {
-		var swid string
-		var tqsize uint
-		var tqrows uint
-		var tsize uint
-		var trows uint
-		var locked bool
-
-		err = rows.Scan(&swid, &tqsize, &tsize, &tqrows, &trows, &locked)
+		var st swyapi.MquotaStatus
+
+		err = rows.Scan(&st.DbName, &st.RowsL, &st.Rows, &st.SizeL, &st.Size, &st.Locked)
 		if err != nil {
 			log.Debugf("Can't scan row: %s", err.Error())
 			continue
 		}
 
-		if locked {
-			log.Debugf("Unlock DB %s: %d/%d %d/%d", swid, tsize, tqsize, trows, tqrows)
-			unlockAccess(qdb, swid)
-		} else {
-			log.Debugf("Lock DB %s: %d/%d %d/%d", swid, tsize, tqsize, trows, tqrows)
-			lockAccess(qdb, swid)
-		}
+		sts = append(sts, &st)
+	}
+
+	return sts, nil
+}
+
+func status(qdb *sql.DB, id string) (*swyapi.MquotaStatus, error) {
+	st := swyapi.MquotaStatus{DbName: id}
+	err := qdb.QueryRow(quotaStatusReq, id).Scan(&st.RowsL, &st.Rows, &st.SizeL, &st.Size, &st.Locked)
+	if err == sql.ErrNoRows {
+		return nil, xquota.NoDB
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	return &st, nil
 }
 
 func main() {
@@ -136,10 +271,28 @@ func main() {
 		return
 	}
 
-	delay := uint(10)
-	for {
-		log.Debugf("Next scan in %d seconds", delay)
-		time.Sleep(time.Duration(delay) * time.Second)
-		checkQuotas(qdb, &delay)
+	qd := &xquota.Daemon {
+		Log:		log,
+		Secrets:	qdSecrets,
+		Ops:		xquota.Ops {
+			Overflow:	func() ([]*swyapi.MquotaStatus, error) { return overflow(qdb) },
+			Lock:		func(id string) error { return lockAccess(qdb, id) },
+			Unlock:		func(id string) error { return unlockAccess(qdb, id) },
+			Status:		func(id string) (*swyapi.MquotaStatus, error) { return status(qdb, id) },
+		},
+	}
+
+	err = qd.NotifyInit(conf.Notify)
+	if err != nil {
+		log.Errorf("Can't setup notifications: %s", err.Error())
+		return
+	}
+
+	err = qd.Listen(conf.Listen, conf.Token)
+	if err != nil {
+		log.Errorf("Can't find tokens secret: %s", err.Error())
+		return
 	}
+
+	qd.Run()
 }
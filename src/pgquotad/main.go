@@ -0,0 +1,403 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	"go.uber.org/zap"
+	"net/url"
+	"strings"
+	"flag"
+	"fmt"
+	"os"
+	"swifty/apis"
+	"swifty/common"
+	"swifty/common/secrets"
+	"swifty/common/xquota"
+)
+
+var zcfg zap.Config = zap.Config {
+	Level:            zap.NewAtomicLevelAt(zap.DebugLevel),
+	Development:      true,
+	DisableStacktrace:true,
+	Encoding:         "console",
+	EncoderConfig:    zap.NewDevelopmentEncoderConfig(),
+	OutputPaths:      []string{"stderr"},
+	ErrorOutputPaths: []string{"stderr"},
+}
+var logger, _ = zcfg.Build()
+var log = logger.Sugar()
+
+type YAMLConf struct {
+	DB		string		`yaml:"db"`
+	Addr		string		`yaml:"address"`
+	User		string		`yaml:"user"`
+	Pass		string		`yaml:"password"`
+	Listen		string		`yaml:"listen,omitempty"`
+	Token		string		`yaml:"token,omitempty"`
+	Notify		string		`yaml:"notify,omitempty"`
+}
+
+var conf YAMLConf
+var qdSecrets xsecret.Store
+
+/*
+ * Quotas table is filled by pgrest, the owners column is ours, we
+ * keep there who the locked DB's objects belonged to.
+ */
+const quotaTableReq = `
+CREATE TABLE IF NOT EXISTS quotas (
+	id varchar(64) PRIMARY KEY,
+	size bigint,
+	locked bool,
+	owners text
+)
+`
+
+const quotaUsageReq = `
+SELECT quotas.id, quotas.size, pg_database_size(pg_database.datname), quotas.locked
+FROM quotas
+JOIN pg_database ON pg_database.datname=quotas.id
+`
+
+const quotaOverflowReq = `
+SELECT * FROM (` + quotaUsageReq + `) ifo (id, sizel, size, locked)
+WHERE
+	(ifo.size > ifo.sizel AND NOT ifo.locked)
+	OR
+	(ifo.size < ifo.sizel AND ifo.locked)
+`
+
+/* Who can create things in the DB, i.e. the mware owner(s) */
+const writersReq = `
+SELECT rolname FROM pg_roles
+WHERE NOT rolsuper AND rolname <> $2 AND has_database_privilege(oid, $1, 'CREATE')
+`
+
+/*
+ * Postgres has no per-DB write privileges and the owner of an object
+ * can do whatever it wants with it, so the DB owner cannot be locked
+ * with REVOKE. Instead its objects are handed over to the lockRole
+ * and the owner gets only SELECT on them. Creating new things is
+ * revoked too. Unlock gives the objects back to the newest of the
+ * owners (there can be two while creds rotation is in grace).
+ */
+const lockRole = "swy_quota_lock"
+
+var pgURL url.URL
+
+func dbConn(id string) (*sql.DB, error) {
+	u := pgURL
+	u.Path = "/" + id
+	return sql.Open("postgres", u.String())
+}
+
+func dbExec(db *sql.DB, reqs ...string) error {
+	for _, req := range reqs {
+		_, err := db.Exec(req)
+		if err != nil {
+			return fmt.Errorf("%s: %s", req, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func dbRoles(qdb *sql.DB, req string, args ...interface{}) ([]string, error) {
+	rows, err := qdb.Query(req, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []string
+	for rows.Next() {
+		var r string
+
+		err = rows.Scan(&r)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, r)
+	}
+
+	return ret, rows.Err()
+}
+
+func pgId(n string) string {
+	return "\"" + strings.Replace(n, "\"", "\"\"", -1) + "\""
+}
+
+func lockRoleInit(qdb *sql.DB) error {
+	var n int
+
+	err := qdb.QueryRow("SELECT count(*) FROM pg_roles WHERE rolname=$1", lockRole).Scan(&n)
+	if err != nil || n != 0 {
+		return err
+	}
+
+	return dbExec(qdb, "CREATE ROLE " + pgId(lockRole) + " NOLOGIN")
+}
+
+func lockAccess(qdb *sql.DB, id string) error {
+	var owners sql.NullString
+
+	ws, err := dbRoles(qdb, writersReq, id, lockRole)
+	if err != nil {
+		return err
+	}
+
+	err = qdb.QueryRow("SELECT owners FROM quotas WHERE id=$1", id).Scan(&owners)
+	if err != nil {
+		return err
+	}
+
+	db, err := dbConn(id)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, w := range ws {
+		err = dbExec(qdb, "REVOKE CREATE, TEMPORARY ON DATABASE " + pgId(id) + " FROM " + pgId(w))
+		if err != nil {
+			return err
+		}
+
+		err = dbExec(db, "REASSIGN OWNED BY " + pgId(w) + " TO " + pgId(lockRole))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dbExec(db, "REVOKE CREATE ON SCHEMA public FROM PUBLIC")
+	if err != nil {
+		return err
+	}
+
+	schemas, err := dbRoles(db, "SELECT nspname FROM pg_namespace WHERE nspname='public' OR nspowner=$1::regrole",
+				lockRole)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range ws {
+		for _, sc := range schemas {
+			err = dbExec(db,
+				"REVOKE CREATE ON SCHEMA " + pgId(sc) + " FROM " + pgId(w),
+				"GRANT USAGE ON SCHEMA " + pgId(sc) + " TO " + pgId(w),
+				"GRANT SELECT ON ALL TABLES IN SCHEMA " + pgId(sc) + " TO " + pgId(w),
+				"GRANT SELECT ON ALL SEQUENCES IN SCHEMA " + pgId(sc) + " TO " + pgId(w))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if owners.String != "" {
+		ws = append(ws, strings.Split(owners.String, ",")...)
+	}
+
+	_, err = qdb.Exec("UPDATE quotas SET locked=true, owners=$1 WHERE id=$2", strings.Join(ws, ","), id)
+	return err
+}
+
+func unlockAccess(qdb *sql.DB, id string) error {
+	var owners sql.NullString
+
+	err := qdb.QueryRow("SELECT owners FROM quotas WHERE id=$1", id).Scan(&owners)
+	if err != nil {
+		return err
+	}
+
+	/* Dropped ones (rotated out) don't show up here, the owner role goes first */
+	ws, err := dbRoles(qdb, "SELECT rolname FROM pg_roles WHERE rolname = ANY(string_to_array($1, ',')) " +
+				"ORDER BY rolname = $2 DESC, oid DESC", owners.String, swyapi.PgOwnerRole(id))
+	if err != nil {
+		return err
+	}
+
+	db, err := dbConn(id)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(ws) > 0 {
+		err = dbExec(db, "REASSIGN OWNED BY " + pgId(lockRole) + " TO " + pgId(ws[0]))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, w := range ws {
+		err = dbExec(qdb, "GRANT ALL PRIVILEGES ON DATABASE " + pgId(id) + " TO " + pgId(w))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dbExec(db, "GRANT CREATE ON SCHEMA public TO PUBLIC")
+	if err != nil {
+		return err
+	}
+
+	/* Older pgquotad locked DBs this way */
+	err = dbExec(qdb, "ALTER DATABASE " + pgId(id) + " RESET default_transaction_read_only")
+	if err != nil {
+		return err
+	}
+
+	_, err = qdb.Exec("UPDATE quotas SET locked=false, owners=NULL WHERE id=$1", id)
+	return err
+}
+
+/* Creds rotated while locked, the new owner should be locked too */
+func relock(qdb *sql.DB) {
+	ids, err := dbRoles(qdb, "SELECT quotas.id FROM quotas JOIN pg_database ON pg_database.datname=quotas.id " +
+				"WHERE quotas.locked")
+	if err != nil {
+		log.Debugf("Can't get locked DBs: %s", err.Error())
+		return
+	}
+
+	for _, id := range ids {
+		ws, err := dbRoles(qdb, writersReq, id, lockRole)
+		if err != nil || len(ws) == 0 {
+			continue
+		}
+
+		log.Debugf("Re-lock DB %s for %v", id, ws)
+		err = lockAccess(qdb, id)
+		if err != nil {
+			log.Errorf("Can't re-lock %s: %s", id, err.Error())
+		}
+	}
+}
+
+func overflow(qdb *sql.DB) ([]*swyapi.MquotaStatus, error) {
+	rows, err := qdb.Query(quotaOverflowReq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sts []*swyapi.MquotaStatus
+
+	for rows.Next() {
+		st := swyapi.MquotaStatus{Type: "postgres"}
+
+		err = rows.Scan(&st.DbName, &st.SizeL, &st.Size, &st.Locked)
+		if err != nil {
+			log.Debugf("Can't scan row: %s", err.Error())
+			continue
+		}
+
+		sts = append(sts, &st)
+	}
+
+	return sts, nil
+}
+
+func status(qdb *sql.DB, id string) (*swyapi.MquotaStatus, error) {
+	st := swyapi.MquotaStatus{Type: "postgres"}
+	err := qdb.QueryRow(quotaUsageReq + " WHERE quotas.id=$1", id).
+			Scan(&st.DbName, &st.SizeL, &st.Size, &st.Locked)
+	if err == sql.ErrNoRows {
+		return nil, xquota.NoDB
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+func main() {
+	var conf_path string
+	var err error
+
+	flag.StringVar(&conf_path,
+			"conf",
+				"/etc/swifty/conf/pgquotad.yaml",
+				"path to the configuration file")
+	flag.Parse()
+	if _, err := os.Stat(conf_path); err == nil {
+		err = xh.ReadYamlConfig(conf_path, &conf)
+	}
+	if err != nil {
+		log.Errorf("Can't read config: %s", err.Error())
+		return
+	}
+
+	log.Debugf("Config: %v", conf)
+
+	qdSecrets, err = xsecret.Init("pgqd")
+	if err != nil {
+		log.Errorf("Can't read secrets: %s", err.Error())
+		return
+	}
+
+	pwd, err := qdSecrets.Get(conf.Pass)
+	if err != nil {
+		log.Errorf("No password found: %s", err.Error())
+		return
+	}
+
+	pgURL = url.URL{
+		Scheme:		"postgres",
+		User:		url.UserPassword(conf.User, pwd),
+		Host:		conf.Addr,
+		Path:		"/" + conf.DB,
+		RawQuery:	"sslmode=disable",
+	}
+
+	qdb, err := sql.Open("postgres", pgURL.String())
+	if err == nil {
+		err = qdb.Ping()
+	}
+	if err != nil {
+		log.Errorf("Can't connect to postgres (%s)", err.Error())
+		return
+	}
+
+	err = dbExec(qdb, quotaTableReq, "ALTER TABLE quotas ADD COLUMN IF NOT EXISTS owners text")
+	if err == nil {
+		err = lockRoleInit(qdb)
+	}
+	if err != nil {
+		log.Errorf("Can't setup quotas: %s", err.Error())
+		return
+	}
+
+	qd := &xquota.Daemon {
+		Log:		log,
+		Secrets:	qdSecrets,
+		Ops:		xquota.Ops {
+			Overflow:	func() ([]*swyapi.MquotaStatus, error) { return overflow(qdb) },
+			Lock:		func(id string) error { return lockAccess(qdb, id) },
+			Unlock:		func(id string) error { return unlockAccess(qdb, id) },
+			Status:		func(id string) (*swyapi.MquotaStatus, error) { return status(qdb, id) },
+			Scan:		func() { relock(qdb) },
+		},
+	}
+
+	err = qd.NotifyInit(conf.Notify)
+	if err != nil {
+		log.Errorf("Can't setup notifications: %s", err.Error())
+		return
+	}
+
+	err = qd.Listen(conf.Listen, conf.Token)
+	if err != nil {
+		log.Errorf("Can't find tokens secret: %s", err.Error())
+		return
+	}
+
+	qd.Run()
+}
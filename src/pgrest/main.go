@@ -11,8 +11,11 @@ import (
 	"errors"
 	"strings"
 	"bytes"
+	"io"
+	"encoding/json"
 	"os/exec"
 	"flag"
+	"strconv"
 	"syscall"
 	"os"
 	"swifty/apis"
@@ -28,6 +31,7 @@ type YAMLConf struct {
 	Token	string		`yaml:"token"`
 	Uid	uint32		`yaml:"user"`
 	Gid	uint32		`yaml:"group"`
+	QDB	string		`yaml:"quotdb,omitempty"`
 }
 
 var zcfg zap.Config = zap.Config {
@@ -64,6 +68,92 @@ func pgRun(cmd *exec.Cmd) error {
 	return err
 }
 
+func pgRunOut(cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: conf.Uid, Gid: conf.Gid}
+	err := cmd.Run()
+	if err != nil {
+		log.Errorf("Error running cmd: %s", stderr.String())
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+/* Stream the tool's input and output w/o keeping them in memory */
+func pgRunIO(cmd *exec.Cmd, in io.Reader, out io.Writer) error {
+	var stderr bytes.Buffer
+
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: conf.Uid, Gid: conf.Gid}
+	err := cmd.Run()
+	if err != nil {
+		log.Errorf("Error running cmd: %s", stderr.String())
+	}
+
+	return err
+}
+
+func pgQuery(q string) (string, error) {
+	out, err := pgRunOut(exec.Command("psql", "-tA", "-c", q))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func pgRoleEnsure(role string) error {
+	return pgRun(exec.Command("psql", "-c", "DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname='" + role +
+				"') THEN CREATE ROLE " + role + " NOLOGIN; END IF; END $$;"))
+}
+
+/*
+ * Objects in the DB are owned by the NOLOGIN owner role. Clients are
+ * its members and switch to it on login, so the objects they create
+ * belong to it too. Thus rotating the client doesn't change objects'
+ * owner and the default privileges set for it (see pgGrantRO) stay.
+ * DBs created before are converted when seen next time.
+ */
+func pgSetOwner(db, user string) error {
+	own := swyapi.PgOwnerRole(db)
+
+	err := pgRoleEnsure(own)
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "GRANT ALL PRIVILEGES ON DATABASE \"" + db + "\" TO " + own + ";"))
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "GRANT " + own + " TO " + user + ";"))
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "ALTER ROLE " + user + " IN DATABASE \"" + db + "\" SET role = " + own + ";"))
+	if err != nil {
+		return err
+	}
+
+	return pgRun(exec.Command("psql", "-d", db, "-c", "REASSIGN OWNED BY " + user + " TO " + own + ";"))
+}
+
+/* Read-only clients are members of this role, it has the privileges */
+func pgReadRole(db string) string {
+	return db + "_ro"
+}
+
 func pgCreate(inf *swyapi.PgRequest) error {
 	var err error
 
@@ -90,6 +180,20 @@ func pgCreate(inf *swyapi.PgRequest) error {
 		goto out
 	}
 
+	err = pgSetOwner(inf.DbName, inf.User)
+	if err != nil {
+		goto out
+	}
+
+	/* The pgquotad watches the DBs listed in quotas table */
+	if conf.QDB != "" && inf.Size != 0 {
+		err = pgRun(exec.Command("psql", "-d", conf.QDB, "-c", "INSERT INTO quotas VALUES ('" + inf.DbName + "', " +
+					strconv.FormatUint(inf.Size, 10) + ", false);"))
+		if err != nil {
+			goto out
+		}
+	}
+
 	log.Debugf("`- added OK")
 	return nil
 
@@ -117,6 +221,13 @@ func pgDrop(inf *swyapi.PgRequest) error {
 		log.Errorf("Cannot drop database %s: %s", inf.DbName, err.Error())
 	}
 
+	if conf.QDB != "" {
+		errq := pgRun(exec.Command("psql", "-d", conf.QDB, "-c", "DELETE FROM quotas WHERE id='" + inf.DbName + "';"))
+		if errq != nil {
+			log.Errorf("Cannot drop %s quota: %s", inf.DbName, errq.Error())
+		}
+	}
+
 	erru := pgRun(exec.Command("psql", "-c", "DROP USER " + inf.User + ";"))
 	if erru != nil {
 		log.Errorf("Cannot drop user %s: %s", inf.User, erru.Error())
@@ -125,12 +236,281 @@ func pgDrop(inf *swyapi.PgRequest) error {
 		}
 	}
 
+	for _, role := range []string{ swyapi.PgOwnerRole(inf.DbName), pgReadRole(inf.DbName) } {
+		errr := pgRun(exec.Command("psql", "-c", "DROP ROLE IF EXISTS " + role + ";"))
+		if errr != nil {
+			log.Errorf("Cannot drop role %s: %s", role, errr.Error())
+		}
+	}
+
 	if err == nil {
 		log.Debugf("`- dropped OK")
 	}
 	return err
 }
 
+/*
+ * Rotation adds new user as a member of the owner role, so that it
+ * can access all the objects created so far. The old one is then
+ * dropped by pgRevoke, whatever it still owns goes to the role.
+ */
+func pgRotate(inf *swyapi.PgRequest) error {
+	var err error
+
+	if !pgCheckString(inf.User) ||
+			! pgCheckString(inf.Owner) ||
+			! pgCheckString(inf.DbName) ||
+			! pgCheckString(inf.Pass) {
+		return errors.New("Bad string value")
+	}
+
+	log.Debugf("Rotate u: %s -> %s, db: %s", inf.Owner, inf.User, inf.DbName)
+
+	err = pgSetOwner(inf.DbName, inf.Owner)
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "CREATE USER " + inf.User + " WITH PASSWORD '" + inf.Pass + "';"))
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "GRANT ALL PRIVILEGES ON DATABASE \"" + inf.DbName + "\" to " + inf.User + ";"))
+	if err != nil {
+		goto out
+	}
+
+	err = pgSetOwner(inf.DbName, inf.User)
+	if err != nil {
+		goto out
+	}
+
+	log.Debugf("`- rotated OK")
+	return nil
+
+out:
+	pgRun(exec.Command("psql", "-d", inf.DbName, "-c", "DROP OWNED BY " + inf.User + ";"))
+	pgRun(exec.Command("psql", "-c", "DROP USER " + inf.User + ";"))
+	return err
+}
+
+func pgRevoke(inf *swyapi.PgRequest) error {
+	var err error
+
+	if !pgCheckString(inf.User) ||
+			! pgCheckString(inf.Owner) ||
+			! pgCheckString(inf.DbName) {
+		return errors.New("Bad string value")
+	}
+
+	if inf.User == "postgres" || inf.DbName == "postgres" {
+		return errors.New("System revoke impossible")
+	}
+
+	log.Debugf("Revoke u: %s (-> %s), db: %s", inf.User, inf.Owner, inf.DbName)
+
+	/* In case it was rotated before the owner role appeared */
+	err = pgSetOwner(inf.DbName, inf.Owner)
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-d", inf.DbName, "-c", "REASSIGN OWNED BY " + inf.User + " TO " +
+				swyapi.PgOwnerRole(inf.DbName) + ";"))
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-d", inf.DbName, "-c", "DROP OWNED BY " + inf.User + ";"))
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "DROP USER " + inf.User + ";"))
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("`- revoked OK")
+	return nil
+}
+
+func pgDump(inf *swyapi.PgRequest, out io.Writer) error {
+	if !pgCheckString(inf.DbName) {
+		return errors.New("Bad string value")
+	}
+
+	if inf.DbName == "postgres" {
+		return errors.New("System dump impossible")
+	}
+
+	log.Debugf("Dump db: %s", inf.DbName)
+
+	return pgRunIO(exec.Command("pg_dump", "-Fc", "--no-owner", "--no-acl", inf.DbName), nil, out)
+}
+
+/*
+ * Restored objects are created on behalf of the owner role, so that
+ * the mware client can keep working with them as usual.
+ */
+func pgRestore(inf *swyapi.PgRequest, in io.Reader) error {
+	if !pgCheckString(inf.User) ||
+			! pgCheckString(inf.DbName) {
+		return errors.New("Bad string value")
+	}
+
+	if inf.User == "postgres" || inf.DbName == "postgres" {
+		return errors.New("System restore impossible")
+	}
+
+	log.Debugf("Restore db: %s (as %s)", inf.DbName, inf.User)
+
+	err := pgSetOwner(inf.DbName, inf.User)
+	if err != nil {
+		return err
+	}
+
+	err = pgRunIO(exec.Command("pg_restore", "--clean", "--if-exists", "--no-owner", "--no-acl",
+			"--role=" + swyapi.PgOwnerRole(inf.DbName), "-d", inf.DbName), in, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("`- restored OK")
+	return nil
+}
+
+/*
+ * Read-only user for granting access to other projects. It can only
+ * SELECT from what's there and what the owner role creates later. The
+ * privileges are on the read role shared by all such users, so that
+ * revoking one doesn't take them from the others.
+ */
+func pgGrantRO(inf *swyapi.PgRequest) error {
+	var err error
+
+	if !pgCheckString(inf.User) ||
+			! pgCheckString(inf.Owner) ||
+			! pgCheckString(inf.DbName) ||
+			! pgCheckString(inf.Pass) {
+		return errors.New("Bad string value")
+	}
+
+	log.Debugf("Add RO u: %s, db: %s", inf.User, inf.DbName)
+
+	ro := pgReadRole(inf.DbName)
+
+	err = pgSetOwner(inf.DbName, inf.Owner)
+	if err != nil {
+		return err
+	}
+
+	err = pgRoleEnsure(ro)
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "GRANT CONNECT ON DATABASE \"" + inf.DbName + "\" TO " + ro + ";"))
+	if err != nil {
+		goto outr
+	}
+
+	err = pgRun(exec.Command("psql", "-d", inf.DbName, "-c", "GRANT USAGE ON SCHEMA public TO " + ro + ";"))
+	if err != nil {
+		goto outr
+	}
+
+	err = pgRun(exec.Command("psql", "-d", inf.DbName, "-c", "GRANT SELECT ON ALL TABLES IN SCHEMA public TO " + ro + ";"))
+	if err != nil {
+		goto outr
+	}
+
+	err = pgRun(exec.Command("psql", "-d", inf.DbName, "-c", "ALTER DEFAULT PRIVILEGES FOR ROLE " + swyapi.PgOwnerRole(inf.DbName) +
+				" IN SCHEMA public GRANT SELECT ON TABLES TO " + ro + ";"))
+	if err != nil {
+		goto outr
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "CREATE USER " + inf.User + " WITH PASSWORD '" + inf.Pass + "' IN ROLE " + ro + ";"))
+	if err != nil {
+		goto outr
+	}
+
+	log.Debugf("`- added OK")
+	return nil
+
+outr:
+	pgReadRoleGC(inf.DbName)
+	return err
+}
+
+/* The read role is only dropped when the last RO user is gone */
+func pgReadRoleGC(db string) error {
+	ro := pgReadRole(db)
+
+	n, err := pgQuery("SELECT count(*) FROM pg_auth_members JOIN pg_roles ON roleid = pg_roles.oid WHERE rolname = '" + ro + "';")
+	if err != nil {
+		return err
+	}
+
+	if n != "0" {
+		return nil
+	}
+
+	ex, err := pgQuery("SELECT count(*) FROM pg_roles WHERE rolname = '" + ro + "';")
+	if err != nil {
+		return err
+	}
+
+	if ex == "0" {
+		return nil
+	}
+
+	log.Debugf("Drop read role %s", ro)
+
+	err = pgRun(exec.Command("psql", "-d", db, "-c", "DROP OWNED BY " + ro + ";"))
+	if err != nil {
+		return err
+	}
+
+	return pgRun(exec.Command("psql", "-c", "DROP ROLE " + ro + ";"))
+}
+
+func pgRevokeRO(inf *swyapi.PgRequest) error {
+	var err error
+
+	if !pgCheckString(inf.User) ||
+			! pgCheckString(inf.DbName) {
+		return errors.New("Bad string value")
+	}
+
+	if inf.User == "postgres" || inf.DbName == "postgres" {
+		return errors.New("System revoke impossible")
+	}
+
+	log.Debugf("Revoke RO u: %s, db: %s", inf.User, inf.DbName)
+
+	/* Users granted before the read role have own privileges */
+	err = pgRun(exec.Command("psql", "-d", inf.DbName, "-c", "DROP OWNED BY " + inf.User + ";"))
+	if err != nil {
+		return err
+	}
+
+	err = pgRun(exec.Command("psql", "-c", "DROP USER " + inf.User + ";"))
+	if err != nil {
+		return err
+	}
+
+	err = pgReadRoleGC(inf.DbName)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("`- revoked OK")
+	return nil
+}
+
 func checkToken(token string) bool {
 	for _, vt := range pgrTokens {
 		if token == vt {
@@ -174,8 +554,111 @@ out:
 	http.Error(w, err.Error(), code)
 }
 
+/*
+ * The status goes out with the first byte of the dump. If the dump
+ * fails after that, the connection is broken, so that the client
+ * sees the data is truncated.
+ */
+type dumpWriter struct {
+	w	http.ResponseWriter
+	started	bool
+}
+
+func (dw *dumpWriter)Write(p []byte) (int, error) {
+	if !dw.started {
+		dw.w.Header().Set("Content-Type", "application/octet-stream")
+		dw.w.WriteHeader(http.StatusOK)
+		dw.started = true
+	}
+
+	return dw.w.Write(p)
+}
+
+func handleDump(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var code int
+	var params swyapi.PgRequest
+	var dw *dumpWriter
+
+	code = http.StatusBadRequest
+	err := xhttp.RReq(r, &params)
+	if err != nil {
+		goto out
+	}
+
+	code = http.StatusUnauthorized
+	if !checkToken(params.Token) {
+		err = errors.New("Not authorized")
+		goto out
+	}
+
+	code = http.StatusInternalServerError
+	dw = &dumpWriter{w: w}
+	err = pgDump(&params, dw)
+	if err != nil {
+		if dw.started {
+			log.Errorf("Dump of %s broke: %s", params.DbName, err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		goto out
+	}
+
+	if !dw.started {
+		dw.Write(nil)
+	}
+
+	return
+
+out:
+	http.Error(w, err.Error(), code)
+}
+
+/*
+ * The request is followed by the dump itself in the same body, so the
+ * latter is fed to pg_restore as it arrives.
+ */
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var code int
+	var params swyapi.PgRequest
+
+	dec := json.NewDecoder(r.Body)
+
+	code = http.StatusBadRequest
+	err := dec.Decode(&params)
+	if err != nil {
+		goto out
+	}
+
+	code = http.StatusUnauthorized
+	if !checkToken(params.Token) {
+		err = errors.New("Not authorized")
+		goto out
+	}
+
+	code = http.StatusInternalServerError
+	err = pgRestore(&params, io.MultiReader(dec.Buffered(), r.Body))
+	if err != nil {
+		goto out
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	return
+
+out:
+	http.Error(w, err.Error(), code)
+}
+
 func handleCreate(w http.ResponseWriter, r *http.Request) { handleRequest(w, r, pgCreate) }
 func handleDrop(w http.ResponseWriter, r *http.Request) { handleRequest(w, r, pgDrop) }
+func handleRotate(w http.ResponseWriter, r *http.Request) { handleRequest(w, r, pgRotate) }
+func handleRevoke(w http.ResponseWriter, r *http.Request) { handleRequest(w, r, pgRevoke) }
+func handleGrantRO(w http.ResponseWriter, r *http.Request) { handleRequest(w, r, pgGrantRO) }
+func handleRevokeRO(w http.ResponseWriter, r *http.Request) { handleRequest(w, r, pgRevokeRO) }
 
 var conf YAMLConf
 
@@ -209,6 +692,12 @@ func main() {
 
 	http.HandleFunc("/create", handleCreate)
 	http.HandleFunc("/drop", handleDrop)
+	http.HandleFunc("/rotate", handleRotate)
+	http.HandleFunc("/revoke", handleRevoke)
+	http.HandleFunc("/dump", handleDump)
+	http.HandleFunc("/grantro", handleGrantRO)
+	http.HandleFunc("/revokero", handleRevokeRO)
+	http.HandleFunc("/restore", handleRestore)
 	log.Fatal(http.ListenAndServe(conf.Addr, nil))
 }
 
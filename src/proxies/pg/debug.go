@@ -0,0 +1,55 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"log"
+	"errors"
+	"encoding/hex"
+)
+
+type rqShow struct {}
+var showAll bool
+
+func init() {
+	addModule("show", &rqShow{})
+}
+
+func (*rqShow)config(mc map[string]interface{}) error {
+	x, ok := mc["all"].(bool)
+	if !ok {
+		return errors.New("all must be bool")
+	}
+
+	showAll = x
+	log.Printf("Will show requests (all: %v)\n", showAll)
+	return nil
+}
+
+func (*rqShow)request(conid string, rq *pg_req) error {
+	rq.show(conid)
+	return nil
+}
+
+func (rq *pg_req)show(conid string) {
+	if rq.db != "" {
+		conid += "[" + rq.db + "]"
+	}
+
+	if rq.typ == 0 {
+		log.Printf("%s: startup %d\n", conid, rq.code)
+		return
+	}
+
+	if rq.query != "" {
+		log.Printf("%s: %c:%s\n", conid, rq.typ, rq.query)
+		return
+	}
+
+	if showAll && rq.typ != PG_MSG_PASSWORD {
+		log.Printf("%s: %c---\n%s---\n", conid, rq.typ, hex.Dump(rq.data))
+	}
+}
@@ -0,0 +1,28 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"log"
+)
+
+var pipeline []module
+
+func pipelineRun(conid string, rq *pg_req) error {
+	for _, n := range pipeline {
+		err := n.request(conid, rq)
+		if err != nil {
+			log.Printf("%s: notify error: %s\n", conid, err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pipelineAdd(n module) {
+	pipeline = append(pipeline, n)
+}
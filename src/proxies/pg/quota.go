@@ -0,0 +1,195 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"log"
+	"time"
+	"sync"
+	"errors"
+	"sync/atomic"
+	"database/sql"
+	_ "github.com/lib/pq"
+)
+
+var quotaCheckThresh uint32 = 4
+var unlockScanPeriod time.Duration = time.Minute
+var quotas sync.Map
+
+type cheqReq struct {
+	db	string
+	locked	bool
+}
+
+var cheq chan *cheqReq
+
+type dbQState struct {
+	check	uint32
+	locked	bool
+}
+
+func quotaLocked(db string) bool {
+	x, _ := quotas.LoadOrStore(db, &dbQState{})
+	qs := x.(*dbQState)
+	if qs.locked {
+		return true
+	}
+
+	if atomic.AddUint32(&qs.check, 1) % quotaCheckThresh == 0 {
+		cheq <-&cheqReq{db: db, locked: false}
+	}
+
+	return false
+}
+
+func quotaSetLocked(db string, val bool) {
+	x, ok := quotas.Load(db)
+	if ok {
+		qs := x.(*dbQState)
+		qs.locked = val
+	} else {
+		log.Printf("Q: cannot mark %s locked=%v\n", db, val)
+	}
+}
+
+/*
+ * This only saves the round-trip to the server, statements can hide
+ * writes in many ways (WITH, functions, ...). The lock is enforced by
+ * pgquotad on the server.
+ */
+var growOps = map[string]bool {
+	"INSERT":	true,
+	"UPDATE":	true,
+	"CREATE":	true,
+	"COPY":		true,
+}
+
+type quota struct {}
+
+func init() {
+	addModule("quota", &quota{})
+}
+
+func (*quota)config(mc map[string]interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error: %s\n", r)
+			err = errors.New("Error parsing config")
+		}
+	}()
+
+	if x, ok := mc["check_thresh"]; ok {
+		quotaCheckThresh = uint32(x.(int))
+		log.Printf("Set quota check thresh to %v\n", quotaCheckThresh)
+	}
+
+	if x, ok := mc["unlock_period"]; ok {
+		unlockScanPeriod, err = time.ParseDuration(x.(string))
+		if err != nil {
+			return err
+		}
+		log.Printf("Set unlock check period to %s\n", unlockScanPeriod.String())
+	}
+
+	if x, ok := mc["quotas"]; ok {
+		tblQuotas = x.(string)
+		log.Printf("Set quotas table to %s\n", tblQuotas)
+	}
+
+	if x, ok := mc["methods"]; ok {
+		for _, m := range x.([]interface{}) {
+			growOps[m.(string)] = true
+		}
+		log.Printf("Set grow ops to %v\n", growOps)
+	}
+
+	return nil
+}
+
+func reqCheckQuota(rq *pg_req) bool {
+	for _, st := range rq.statements() {
+		if _, ok := growOps[st]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (*quota)request(conid string, rq *pg_req) error {
+	if rq.db == "" || rq.query == "" {
+		return nil
+	}
+
+	chk := reqCheckQuota(rq)
+	if chk && quotaLocked(rq.db) {
+		log.Printf("%s: Q: quota exceeded for %s, stopping\n", conid, rq.db)
+		return errors.New("quota force abort")
+	}
+
+	return nil
+}
+
+var tblQuotas string = "quotas"
+
+func quotaCheckDB(rq *cheqReq) {
+	log.Printf("Q: Will check quota for %s (locked %v)\n", rq.db, rq.locked)
+
+	qdb, err := sql.Open("postgres", connstr)
+	if err == nil {
+		err = qdb.Ping()
+		defer qdb.Close()
+	}
+	if err != nil {
+		log.Printf("Can't connect to postgres (%s)", err.Error())
+		return
+	}
+
+	var lim, size uint64
+
+	err = qdb.QueryRow("SELECT size, pg_database_size(id) FROM " + tblQuotas + " WHERE id=$1", rq.db).Scan(&lim, &size)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			quotas.Delete(rq.db)
+		} else {
+			log.Printf("Can't get quota status for %s: %s", rq.db, err.Error())
+		}
+		return
+	}
+
+	log.Printf("%s: size %d/%d\n", rq.db, size, lim)
+
+	if lim != 0 && size > lim {
+		if !rq.locked {
+			quotaSetLocked(rq.db, true)
+		}
+	} else {
+		if rq.locked {
+			quotaSetLocked(rq.db, false)
+		}
+	}
+}
+
+func init() {
+	cheq = make(chan *cheqReq)
+	go func() {
+		for {
+			quotaCheckDB(<-cheq)
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(unlockScanPeriod)
+			quotas.Range(func(k, v interface{}) bool {
+				q := v.(*dbQState)
+				if q.locked {
+					cheq <-&cheqReq{db: k.(string), locked: true}
+				}
+				return true
+			})
+		}
+	}()
+}
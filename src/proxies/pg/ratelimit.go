@@ -0,0 +1,144 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+	"errors"
+	"database/sql"
+)
+
+type ratelimit struct {}
+
+func init() {
+	addModule("rate", &ratelimit{})
+}
+
+var tblRates string = "rates"
+var ratesCacheDuration time.Duration = 10 * time.Minute
+
+func (*ratelimit)config(cfg map[string]interface{}) error {
+	if x, ok := cfg["rates"]; ok {
+		switch y := x.(type) {
+		case string:
+			tblRates = y
+		default:
+			return errors.New("rates must be string")
+		}
+		log.Printf("Set rates table to %s\n", tblRates)
+	}
+
+	if x, ok := cfg["cache_duration"]; ok {
+		switch y := x.(type) {
+		case string:
+			var err error
+			ratesCacheDuration, err = time.ParseDuration(y)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("cache_duration must be string")
+		}
+		log.Printf("Set rates cache duration to %s\n", ratesCacheDuration.String())
+	}
+
+	return nil
+}
+
+/*
+ * Rates table looks like
+ *   CREATE TABLE rates (db varchar(64), req_size int, req_rate_psec int);
+ */
+type dbRates struct {
+	ReqSize		uint32
+	ReqRate		uint32
+
+	q		chan bool
+}
+
+var rates sync.Map
+
+func getDbRates(db string) *dbRates {
+	x, ok := rates.Load(db)
+	if ok {
+		return x.(*dbRates)
+	}
+
+	qdb, err := sql.Open("postgres", connstr)
+	if err != nil {
+		log.Printf("R: error connecting: %s\n", err.Error())
+		return nil
+	}
+
+	defer qdb.Close()
+
+	var r dbRates
+	err = qdb.QueryRow("SELECT req_size, req_rate_psec FROM " + tblRates + " WHERE db=$1", db).Scan(&r.ReqSize, &r.ReqRate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			r = dbRates{}
+			goto cache
+		}
+
+		log.Printf("ERROR: cannot get rates for %s: %s\n", db, err.Error())
+		return nil
+	}
+
+	if r.ReqRate != 0 {
+		r.q = make(chan bool)
+	}
+
+cache:
+	x, ok = rates.LoadOrStore(db, &r)
+	if !ok { /* stored */
+		if r.q != nil {
+			go func() {
+				delay := time.Second / time.Duration(r.ReqRate)
+				for {
+					goon := <-r.q
+					if !goon {
+						break
+					}
+					time.Sleep(delay)
+				}
+			}()
+
+			time.AfterFunc(ratesCacheDuration, func() {
+				rates.Delete(db)
+				if r.q != nil {
+					r.q <-false
+				}
+			})
+		}
+	}
+
+	return x.(*dbRates)
+}
+
+func (*ratelimit)request(conid string, rq *pg_req) error {
+	if rq.db == "" || rq.typ == 0 {
+		return nil
+	}
+
+	rates := getDbRates(rq.db)
+	if rates == nil {
+		return nil
+	}
+
+	if rates.ReqSize != 0 && uint32(rq.rlen) > rates.ReqSize {
+		log.Printf("%s: R: msg-size %d exceeded for %s, stopping\n", conid, rq.rlen, rq.db)
+		return errors.New("quota force abort")
+	}
+
+	if rates.ReqRate != 0 && rq.query != "" {
+		/* Chan blocks us until the reader is ready */
+		rates.q <-true
+	}
+
+	return nil
+}
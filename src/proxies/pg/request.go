@@ -0,0 +1,194 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"strings"
+	"encoding/binary"
+	"swifty/common/tcproxy"
+)
+
+const (
+	PG_PROTO_V3		= 196608
+	PG_CANCEL_REQUEST	= 80877102
+	PG_SSL_REQUEST		= 80877103
+	PG_GSSENC_REQUEST	= 80877104
+
+	PG_MSG_QUERY		= 'Q'
+	PG_MSG_PARSE		= 'P'
+	PG_MSG_BIND		= 'B'
+	PG_MSG_EXECUTE		= 'E'
+	PG_MSG_SYNC		= 'S'
+	PG_MSG_TERMINATE	= 'X'
+	PG_MSG_PASSWORD		= 'p'
+
+	/* TLS record type for handshake, see below */
+	TLS_HANDSHAKE		= 0x16
+)
+
+type pg_req struct {
+	rlen	int
+	typ	byte	/* 0 for startup-phase messages */
+	code	uint32	/* startup code */
+	data	[]byte
+
+	db	string
+	query	string
+}
+
+/*
+ * Startup-phase messages have no type byte, just the length and
+ * the code, the rest go with type byte, then length.
+ */
+func decode_pg_startup(data []byte) *pg_req {
+	if len(data) < 8 {
+		return nil
+	}
+
+	ln := int(binary.BigEndian.Uint32(data))
+	if ln < 8 || len(data) < ln {
+		return nil
+	}
+
+	return &pg_req{ rlen: ln, code: binary.BigEndian.Uint32(data[4:]), data: data[8:ln] }
+}
+
+func decode_pg_req(data []byte) *pg_req {
+	if len(data) < 5 {
+		return nil
+	}
+
+	ln := int(binary.BigEndian.Uint32(data[1:]))
+	if ln < 4 || len(data) < ln + 1 {
+		return nil
+	}
+
+	rq := &pg_req{ rlen: ln + 1, typ: data[0], data: data[5:ln+1] }
+
+	switch rq.typ {
+	case PG_MSG_QUERY:
+		rq.query, _ = read_cstring(rq.data)
+	case PG_MSG_PARSE:
+		_, nl := read_cstring(rq.data)
+		if nl > 0 {
+			rq.query, _ = read_cstring(rq.data[nl:])
+		}
+	}
+
+	return rq
+}
+
+func read_cstring(buf []byte) (string, int) {
+	for i := 0; i < len(buf); i++ {
+		if buf[i] == '\x00' {
+			return string(buf[:i]), i + 1
+		}
+	}
+
+	return "", -1
+}
+
+func startup_params(buf []byte) map[string]string {
+	ret := make(map[string]string)
+
+	for {
+		k, kl := read_cstring(buf)
+		if kl <= 1 {
+			break
+		}
+
+		v, vl := read_cstring(buf[kl:])
+		if vl < 0 {
+			break
+		}
+
+		ret[k] = v
+		buf = buf[kl+vl:]
+	}
+
+	return ret
+}
+
+/* Statements in the query, first words upper-cased */
+func (rq *pg_req)statements() []string {
+	var ret []string
+
+	for _, s := range strings.Split(rq.query, ";") {
+		f := strings.Fields(s)
+		if len(f) > 0 {
+			ret = append(ret, strings.ToUpper(f[0]))
+		}
+	}
+
+	return ret
+}
+
+type pgConData struct {
+	started	bool
+	raw	bool
+	db	string
+	rqnr	uint
+}
+
+func (*pgConsumer)Try(pc *tcproxy.Conn, data []byte) (int, error) {
+	var rq *pg_req
+
+	cd := pc.Data.(*pgConData)
+
+	if cd.raw {
+		return len(data), nil
+	}
+
+	if !cd.started {
+		if len(data) > 0 && data[0] == TLS_HANDSHAKE {
+			/*
+			 * Server agreed on SSL, we cannot see what's
+			 * going on from now on. Better configure the
+			 * target not to do this.
+			 */
+			cd.raw = true
+			return len(data), nil
+		}
+
+		rq = decode_pg_startup(data)
+		if rq == nil {
+			return 0, nil
+		}
+
+		if rq.code == PG_PROTO_V3 {
+			ps := startup_params(rq.data)
+			cd.db = ps["database"]
+			if cd.db == "" {
+				cd.db = ps["user"]
+			}
+			cd.started = true
+		}
+	} else {
+		rq = decode_pg_req(data)
+		if rq == nil {
+			return 0, nil
+		}
+	}
+
+	rq.db = cd.db
+	cd.rqnr++
+
+	err := pipelineRun(pc.Id, rq)
+	if err != nil {
+		return 0, err
+	}
+
+	return rq.rlen, nil
+}
+
+func (*pgConsumer)New(con *tcproxy.Conn) {
+	con.Data = &pgConData{}
+}
+
+func (*pgConsumer)Done(con *tcproxy.Conn) {
+}
+
+type pgConsumer struct { }
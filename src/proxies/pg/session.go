@@ -0,0 +1,39 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+var connstr string
+
+func configureSession(conf *Config) error {
+	if conf.Target.Addr == "" {
+		return errors.New("No target.address")
+	}
+	if conf.Target.DB == "" {
+		return errors.New("No target.db")
+	}
+	if conf.Target.User == "" {
+		return errors.New("No target.user")
+	}
+	if conf.Target.Pass == "" {
+		return errors.New("No target.password")
+	}
+
+	u := url.URL{
+		Scheme:		"postgres",
+		User:		url.UserPassword(conf.Target.User, conf.Target.Pass),
+		Host:		conf.Target.Addr,
+		Path:		"/" + conf.Target.DB,
+		RawQuery:	"sslmode=disable",
+	}
+
+	connstr = u.String()
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"code.cloudfoundry.org/bytefmt"
 	"gopkg.in/yaml.v2"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/csv"
 	"io/ioutil"
 	"net/http"
@@ -395,6 +396,9 @@ func show_mware_limits(mwl map[string]*swyapi.MwareLimits) {
 		if ml.Number != 0 {
 			fmt.Printf("    Number:            %d\n", ml.Number)
 		}
+		if ml.SizeMB != 0 {
+			fmt.Printf("    Size:              %s\n", formatBytes(ml.SizeMB<<20))
+		}
 	}
 }
 
@@ -656,6 +660,9 @@ func function_info(args []string, opts [16]string) {
 		fmt.Printf("Rate:        %d:%d\n", ifo.Size.Rate, ifo.Size.Burst)
 	}
 	fmt.Printf("Memory:      %dMi\n", ifo.Size.Memory)
+	if ifo.Size.Concurrency > 1 {
+		fmt.Printf("Concurrency: %d\n", ifo.Size.Concurrency)
+	}
 	fmt.Printf("Called:      %d\n", ifo.Stats[0].Called)
 	if ifo.Stats[0].Called != 0 {
 		lc, _ := time.Parse(time.RFC1123Z, ifo.Stats[0].LastCall)
@@ -663,6 +670,12 @@ func function_info(args []string, opts [16]string) {
 		since -= since % time.Second
 		fmt.Printf("Last run:    %s ago\n", since.String())
 		fmt.Printf("Time:        %d (avg %d) usec\n", ifo.Stats[0].Time, ifo.Stats[0].Time / ifo.Stats[0].Called)
+		if ifo.Stats[0].CPUTime != 0 {
+			fmt.Printf("CPU:         %d (avg %d) usec\n", ifo.Stats[0].CPUTime, ifo.Stats[0].CPUTime / ifo.Stats[0].Called)
+		}
+		if ifo.Stats[0].MaxRSS != 0 {
+			fmt.Printf("Max memory:  %s\n", formatBytes(ifo.Stats[0].MaxRSS << 10))
+		}
 		fmt.Printf("GBS:         %f\n", ifo.Stats[0].GBS)
 	}
 
@@ -689,7 +702,11 @@ func function_info(args []string, opts [16]string) {
 	if len(minf) != 0 {
 		fmt.Printf("Mware:\n")
 		for _, mi := range minf {
-			fmt.Printf("\t%20s %-10s(id:%s)\n", mi.Name, mi.Type, mi.Id)
+			name := mi.Name
+			if mi.Project != "" && mi.Project != curProj {
+				name = mi.Project + "/" + name
+			}
+			fmt.Printf("\t%20s %-10s(id:%s)\n", name, mi.Type, mi.Id)
 		}
 	}
 
@@ -803,6 +820,9 @@ func detect_language(path string) string {
 	swr := regexp.MustCompile("^func\\s+Main\\s*\\(.*->\\s*Encodable")
 	jsr := regexp.MustCompile("^exports.Main\\s*=\\s*function")
 	csr := regexp.MustCompile("static.*Response.*\\).*Main.*\\(.*Request")
+	jvr := regexp.MustCompile("static.*Main\\s*\\(\\s*Request.*,\\s*Response")
+	phr := regexp.MustCompile("^function\\s+Main\\s*\\(")
+	rsr := regexp.MustCompile("^pub\\s+fn\\s+Main\\s*\\(.*Request")
 
 	lines := strings.Split(string(cont), "\n")
 	for _, ln := range(lines) {
@@ -829,6 +849,18 @@ func detect_language(path string) string {
 		if csr.MatchString(ln) {
 			return check_ext(path, ".cs", "csharp")
 		}
+
+		if jvr.MatchString(ln) {
+			return check_ext(path, ".java", "java")
+		}
+
+		if phr.MatchString(ln) {
+			return check_ext(path, ".php", "php")
+		}
+
+		if rsr.MatchString(ln) {
+			return check_ext(path, ".rs", "rust")
+		}
 	}
 
 	return ""
@@ -940,6 +972,10 @@ func function_add(args []string, opts [16]string) {
 		req.Size.Rate, req.Size.Burst = parse_rate(opts[5])
 	}
 
+	if opts[9] != "" {
+		req.Size.Concurrency = parse_uint(opts[9], "concurrency")
+	}
+
 	if opts[6] != "" {
 		req.UserData = opts[6]
 	}
@@ -1012,7 +1048,12 @@ func function_update(args []string, opts [16]string) {
 	}
 
 	if opts[3] != "" {
-		mid, _ := swyclient.Mwares().Resolve(curProj, opts[3][1:])
+		/* Mware granted from another project is project/name */
+		mproj, mname := curProj, opts[3][1:]
+		if i := strings.Index(mname, "/"); i != -1 {
+			mproj, mname = mname[:i], mname[i+1:]
+		}
+		mid, _ := swyclient.Mwares().Resolve(mproj, mname)
 		if opts[3][0] == '+' {
 			swyclient.Add("functions/" + fid + "/middleware", http.StatusOK, mid, nil)
 		} else if opts[3][0] == '-' {
@@ -1054,8 +1095,9 @@ func function_update(args []string, opts [16]string) {
 		swyclient.Functions().Set(fid, "authctx", ac)
 	}
 
-	if opts[1] != "" || opts[2] != "" {
+	if opts[1] != "" || opts[2] != "" || opts[5] != "" {
 		sz := swyapi.FunctionSize{}
+		swyclient.Functions().Prop(fid, "size", &sz)
 
 		if opts[1] != "" {
 			x, err := strconv.ParseUint(opts[1], 10, 32)
@@ -1067,6 +1109,9 @@ func function_update(args []string, opts [16]string) {
 		if opts[2] != "" {
 			sz.Rate, sz.Burst = parse_rate(opts[2])
 		}
+		if opts[5] != "" {
+			sz.Concurrency = parse_uint(opts[5], "concurrency")
+		}
 
 		swyclient.Functions().Set(fid, "size", &sz)
 	}
@@ -1123,8 +1168,17 @@ func event_add(args []string, opts [16]string) {
 		e.WS = &swyapi.FunctionEventWebsock {
 			MwName: opts[0],
 		}
+		if opts[2] != "" {
+			e.WS.Events = strings.Split(opts[2], ",")
+		}
 	case "url":
 		e.URL = "auto"
+		if opts[3] != "" {
+			e.CORS = parse_cors(opts[3])
+		}
+		if opts[4] != "" {
+			e.Schema = parse_req_schema(opts[4])
+		}
 	}
 
 	var ei swyapi.FunctionEvent
@@ -1132,6 +1186,22 @@ func event_add(args []string, opts [16]string) {
 	fmt.Printf("Event %s created\n", ei.Id)
 }
 
+/* File with body: and/or args: JSON schemas, YAML or JSON */
+func parse_req_schema(fname string) *swyapi.RequestSchema {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		fatal(err)
+	}
+
+	var rs swyapi.RequestSchema
+	err = yaml.Unmarshal(data, &rs)
+	if err != nil {
+		fatal(err)
+	}
+
+	return &rs
+}
+
 func event_info(args []string, opts [16]string) {
 	var r bool
 	args[0], _ = swyclient.Functions().Resolve(curProj, args[0])
@@ -1189,8 +1259,9 @@ func function_code(args []string, opts [16]string) {
 	fmt.Printf("%s", data)
 }
 
+var logsFollow bool
+
 func function_logs(args []string, opts [16]string) {
-	var res []swyapi.LogEntry
 	args[0], _ = swyclient.Functions().Resolve(curProj, args[0])
 
 	fa := []string{}
@@ -1198,10 +1269,26 @@ func function_logs(args []string, opts [16]string) {
 		fa = append(fa, "last=" + opts[0])
 	}
 
-	swyclient.Get(url("functions/" + args[0] + "/logs", fa), http.StatusOK, &res)
+	cur := ""
+	for {
+		var res []swyapi.LogEntry
 
-	for _, le := range res {
-		fmt.Printf("%36s%12s: %s\n", le.Ts, le.Event, le.Text)
+		swyclient.Get(url("functions/" + args[0] + "/logs", fa), http.StatusOK, &res)
+
+		for _, le := range res {
+			fmt.Printf("%36s%12s: %s\n", le.Ts, le.Event, le.Text)
+			cur = le.Cursor
+		}
+
+		if !logsFollow {
+			break
+		}
+
+		/* Follow -- poll for what came after the last line seen */
+		time.Sleep(time.Second)
+		if cur != "" {
+			fa = []string{"after=" + cur}
+		}
 	}
 }
 
@@ -1244,17 +1331,59 @@ func mware_info(args []string, opts [16]string) {
 		fmt.Printf("Name:         %s\n", resp.Name)
 	}
 	fmt.Printf("Type:         %s\n", resp.Type)
+	if resp.External != "" {
+		fmt.Printf("External:     %s\n", resp.External)
+	}
 	if resp.DU != nil {
 		fmt.Printf("Disk usage:   %s\n", formatBytes(*resp.DU << 10))
 	}
 	if resp.URL != nil {
 		fmt.Printf("URL:          %s\n", *resp.URL)
 	}
+	if resp.Locked != "" {
+		fmt.Printf("Locked:       %s\n", resp.Locked)
+	}
+	if resp.JWT != nil {
+		fmt.Printf("JWT alg:      %s\n", resp.JWT.Alg)
+		switch {
+		case resp.JWT.JWKSURL != "":
+			fmt.Printf("JWKS URL:     %s\n", resp.JWT.JWKSURL)
+		case resp.JWT.JWKS != "":
+			fmt.Printf("JWKS:         inline\n")
+		case resp.JWT.PubKey != "":
+			fmt.Printf("Public key:   inline\n")
+		}
+		if resp.JWT.Iss != "" {
+			fmt.Printf("Issuer:       %s\n", resp.JWT.Iss)
+		}
+		if resp.JWT.Aud != "" {
+			fmt.Printf("Audience:     %s\n", resp.JWT.Aud)
+		}
+		if len(resp.JWT.Claims) != 0 {
+			fmt.Printf("Need claims:  %s\n", strings.Join(resp.JWT.Claims, ", "))
+		}
+	}
 	if resp.UserData != "" {
 		fmt.Printf("Data:         %s\n", resp.UserData)
 	}
 }
 
+func mware_logs(args []string, opts [16]string) {
+	var res []swyapi.LogEntry
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+
+	fa := []string{}
+	if opts[0] != "" {
+		fa = append(fa, "last=" + opts[0])
+	}
+
+	swyclient.Get(url("middleware/" + args[0] + "/logs", fa), http.StatusOK, &res)
+
+	for _, le := range res {
+		fmt.Printf("%36s%12s: %s\n", le.Ts, le.Event, le.Text)
+	}
+}
+
 func mware_add(args []string, opts [16]string) {
 	req := swyapi.MwareAdd {
 		Name: args[0],
@@ -1263,6 +1392,45 @@ func mware_add(args []string, opts [16]string) {
 		UserData: opts[0],
 	}
 
+	if opts[1] != "" {
+		req.External = &swyapi.MwareExternal {
+			Addr: opts[1],
+			User: opts[2],
+			Pass: opts[3],
+			DbName: opts[4],
+		}
+	}
+
+	if opts[5] != "" || opts[7] != "" || opts[8] != "" || opts[9] != "" {
+		req.JWT = &swyapi.MwareJWT {
+			Alg: opts[5],
+			Iss: opts[7],
+			Aud: opts[8],
+		}
+
+		if opts[9] != "" {
+			req.JWT.Claims = strings.Split(opts[9], ",")
+		}
+
+		switch {
+		case opts[6] == "":
+			;
+		case strings.HasPrefix(opts[6], "http://") || strings.HasPrefix(opts[6], "https://"):
+			req.JWT.JWKSURL = opts[6]
+		default:
+			key, err := ioutil.ReadFile(opts[6])
+			if err != nil {
+				fatal(fmt.Errorf("Can't read key: %s", err.Error()))
+			}
+
+			if strings.HasPrefix(strings.TrimSpace(string(key)), "{") {
+				req.JWT.JWKS = string(key)
+			} else {
+				req.JWT.PubKey = string(key)
+			}
+		}
+	}
+
 	var mi swyapi.MwareInfo
 	swyclient.Mwares().Add(&req, &mi)
 	fmt.Printf("Mware %s created\n", mi.Id)
@@ -1273,6 +1441,173 @@ func mware_del(args []string, opts [16]string) {
 	swyclient.Mwares().Del(args[0])
 }
 
+func mware_rotate(args []string, opts [16]string) {
+	var rq swyapi.MwareRotate
+	if opts[0] != "" {
+		t, err := strconv.Atoi(opts[0])
+		if err != nil || t < 0 {
+			fatal(fmt.Errorf("Bad grace value"))
+		}
+		rq.Grace = uint32(t)
+	}
+
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.Req1("POST", "middleware/" + args[0] + "/rotate", http.StatusOK, &rq, nil)
+}
+
+func mware_grant_list(args []string, opts [16]string) {
+	var gs []swyapi.MwareGrant
+
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.Get("middleware/" + args[0] + "/grants", http.StatusOK, &gs)
+	for _, g := range gs {
+		acc := "rw"
+		if g.ReadOnly {
+			acc = "ro"
+		}
+		fmt.Printf("%-20s%s\n", g.Project, acc)
+	}
+}
+
+func mware_grant_add(args []string, opts [16]string) {
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.Add("middleware/" + args[0] + "/grants", http.StatusOK,
+			&swyapi.MwareGrant{Project: args[1], ReadOnly: opts[0] != ""}, nil)
+}
+
+func mware_grant_del(args []string, opts [16]string) {
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.Del("middleware/" + args[0] + "/grants/" + args[1], http.StatusOK)
+}
+
+func mware_backup_list(args []string, opts [16]string) {
+	var bks []swyapi.MwareBackupInfo
+
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwBackups(args[0]).List([]string{}, &bks)
+	fmt.Printf("%-26s%-34s%-10s%-12s\n", "ID", "CREATED", "STATE", "SIZE")
+	for _, b := range bks {
+		auto := ""
+		if b.Auto {
+			auto = "auto"
+		}
+		fmt.Printf("%-26s%-34s%-10s%-12s%s\n", b.Id, b.Created, b.State, formatBytes(b.Size), auto)
+	}
+}
+
+func mware_backup_add(args []string, opts [16]string) {
+	var bi swyapi.MwareBackupInfo
+
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwBackups(args[0]).Add(&swyapi.MwareBackupAdd{Note: opts[0]}, &bi)
+	fmt.Printf("Backup %s started\n", bi.Id)
+}
+
+func mware_backup_del(args []string, opts [16]string) {
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwBackups(args[0]).Del(args[1])
+}
+
+func mware_key_list(args []string, opts [16]string) {
+	var ks []swyapi.AuthKeyInfo
+
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwKeys(args[0]).List([]string{}, &ks)
+	fmt.Printf("%-26s%-20s%-34s%s\n", "ID", "NAME", "EXPIRES", "SCOPES")
+	for _, k := range ks {
+		exp := k.Expires
+		if exp == "" {
+			exp = "never"
+		}
+		fmt.Printf("%-26s%-20s%-34s%s\n", k.Id, k.Name, exp, strings.Join(k.Scopes, ","))
+	}
+}
+
+func mware_key_add(args []string, opts [16]string) {
+	rq := swyapi.AuthKeyAdd{Name: args[1]}
+
+	if opts[0] != "" {
+		d, err := time.ParseDuration(opts[0])
+		if err != nil {
+			fatal(fmt.Errorf("Bad lifetime: %s", err.Error()))
+		}
+		rq.Lifetime = uint32(d.Seconds())
+	}
+
+	if opts[1] != "" {
+		rq.Scopes = strings.Split(opts[1], ",")
+	}
+
+	if opts[2] != "" {
+		rq.Rate, rq.Burst = parse_rate(opts[2])
+	}
+
+	var ki swyapi.AuthKeyInfo
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwKeys(args[0]).Add(&rq, &ki)
+	fmt.Printf("Key %s created, it's not shown again:\n%s\n", ki.Id, ki.Key)
+}
+
+func mware_key_del(args []string, opts [16]string) {
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwKeys(args[0]).Del(args[1])
+}
+
+func mware_conn_list(args []string, opts [16]string) {
+	var cs []swyapi.WsConnInfo
+
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwConns(args[0]).List([]string{}, &cs)
+	fmt.Printf("%-32s%-34s%s\n", "ID", "CONNECTED", "CHANNELS")
+	for _, c := range cs {
+		fmt.Printf("%-32s%-34s%s\n", c.Cid, c.Connected, strings.Join(c.Channels, ","))
+	}
+}
+
+func mware_conn_del(args []string, opts [16]string) {
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	swyclient.MwConns(args[0]).Del(args[1])
+}
+
+func mware_backup_restore(args []string, opts [16]string) {
+	var bi swyapi.MwareBackupInfo
+
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+	rq := swyapi.MwareRestore{Name: opts[0], Project: curProj}
+	swyclient.Req1("POST", "middleware/" + args[0] + "/backups/" + args[1] + "/restore", http.StatusOK, &rq, &bi)
+	fmt.Printf("Restoring into %s\n", bi.Restore.Target)
+}
+
+func mware_backup_sched(args []string, opts [16]string) {
+	args[0], _ = swyclient.Mwares().Resolve(curProj, args[0])
+
+	if opts[0] == "" && opts[1] == "" {
+		var bs swyapi.MwareBackupSched
+		swyclient.Mwares().Prop(args[0], "backups/schedule", &bs)
+		if bs.Tab == "" {
+			fmt.Printf("No scheduled backups\n")
+		} else {
+			fmt.Printf("Tab:          %s\n", bs.Tab)
+			fmt.Printf("Keep:         %d\n", bs.Keep)
+		}
+		return
+	}
+
+	bs := swyapi.MwareBackupSched{}
+	if opts[0] != "off" {
+		bs.Tab = opts[0]
+	}
+	if opts[1] != "" {
+		k, err := strconv.Atoi(opts[1])
+		if err != nil || k < 0 {
+			fatal(fmt.Errorf("Bad keep value"))
+		}
+		bs.Keep = uint32(k)
+	}
+
+	swyclient.Mwares().Set(args[0], "backups/schedule", &bs)
+}
+
 func auth_cfg(args []string, opts [16]string) {
 	switch args[0] {
 	case "get", "inf":
@@ -1380,17 +1715,40 @@ func parse_route_table(opt string) []*swyapi.RouterEntry {
 	res := []*swyapi.RouterEntry{}
 	ents := strings.Split(opt, ";")
 	for _, e := range ents {
-		ee := strings.SplitN(e, ":", 4)
-		res = append(res, &swyapi.RouterEntry {
+		ee := strings.SplitN(e, ":", 5)
+		re := &swyapi.RouterEntry {
 			Method:	ee[0],
 			Path:	ee[1],
 			Call:	ee[2],
 			Key:	ee[3],
-		})
+		}
+		if len(ee) > 4 && ee[4] != "" {
+			ttl, err := strconv.Atoi(ee[4])
+			if err != nil || ttl <= 0 {
+				fatal(fmt.Errorf("Bad cache TTL %s", ee[4]))
+			}
+			re.Cache = &swyapi.RouterCache{TTL: uint32(ttl)}
+		}
+		res = append(res, re)
 	}
 	return res
 }
 
+/* origin,origin,...[;method,method,...] */
+func parse_cors(opt string) *swyapi.CORSPolicy {
+	cp := &swyapi.CORSPolicy{}
+	if opt == "-" {
+		return cp
+	}
+
+	cs := strings.SplitN(opt, ";", 2)
+	cp.Origins = strings.Split(cs[0], ",")
+	if len(cs) > 1 {
+		cp.Methods = strings.Split(cs[1], ",")
+	}
+	return cp
+}
+
 func router_add(args []string, opts [16]string) {
 	ra := swyapi.RouterAdd {
 		Name: args[0],
@@ -1399,21 +1757,92 @@ func router_add(args []string, opts [16]string) {
 	if opts[0] != "" {
 		ra.Table = parse_route_table(opts[0])
 	}
+	if opts[1] != "" {
+		ra.CORS = parse_cors(opts[1])
+	}
+	if opts[2] != "" {
+		ra.OpenAPI = parse_openapi(opts[2])
+	}
 	var ri swyapi.RouterInfo
 	swyclient.Routers().Add(&ra, &ri)
 	fmt.Printf("Router %s created\n", ri.Id)
 }
 
+/* YAML or JSON, the latter is YAML too */
+func parse_openapi(fname string) *swyapi.OpenAPI {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		fatal(err)
+	}
+
+	var doc swyapi.OpenAPI
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		fatal(err)
+	}
+
+	return &doc
+}
+
+func router_openapi(args []string, opts [16]string) {
+	args[0], _ = swyclient.Routers().Resolve(curProj, args[0])
+	var doc swyapi.OpenAPI
+	swyclient.Routers().Prop(args[0], "openapi", &doc)
+	var out []byte
+	if opts[0] != "" {
+		out, _ = json.MarshalIndent(&doc, "", "  ")
+		out = append(out, '\n')
+	} else {
+		out, _ = yaml.Marshal(&doc)
+	}
+	os.Stdout.Write(out)
+}
+
 func router_info(args []string, opts [16]string) {
 	args[0], _ = swyclient.Routers().Resolve(curProj, args[0])
 	var ri swyapi.RouterInfo
 	swyclient.Routers().Get(args[0], &ri)
 	fmt.Printf("URL:      %s\n", ri.URL)
-	fmt.Printf("Table:    (%d ents)\n", ri.TLen)
+	if ri.CORS != nil {
+		fmt.Printf("CORS:     %s\n", strings.Join(ri.CORS.Origins, ","))
+	}
+	fmt.Printf("Table:    (%d ents, rev %d)\n", ri.TLen, ri.TRev)
 	var res []*swyapi.RouterEntry
 	swyclient.Routers().Prop(args[0], "table", &res)
 	for _, re := range res {
-		fmt.Printf("   %8s /%-32s -> %s\n", re.Method, re.Path, re.Call)
+		fmt.Printf("   %8s /%-32s -> %s", re.Method, re.Path, re.Call)
+		if re.Cache != nil {
+			fmt.Printf(" (cached %ds)", re.Cache.TTL)
+		}
+		if re.Transform != nil {
+			fmt.Printf(" (transformed)")
+		}
+		if re.Schema != nil {
+			fmt.Printf(" (validated)")
+		}
+		if re.Limit != nil {
+			fmt.Printf(" (limit %d", re.Limit.Rate)
+			if re.Limit.Period > 1 {
+				fmt.Printf("/%ds", re.Limit.Period)
+			} else {
+				fmt.Printf("/s")
+			}
+			if re.Limit.Key != "" {
+				fmt.Printf(" per %s", re.Limit.Key)
+			}
+			fmt.Printf(")")
+		}
+		fmt.Printf("\n")
+	}
+	if len(ri.Limits) != 0 {
+		fmt.Printf("Limits:\n")
+		for _, l := range ri.Limits {
+			fmt.Printf("   %8s /%-32s passed %d, limited %d", l.Method, l.Path, l.Passed, l.Limited)
+			if l.Keys != 0 {
+				fmt.Printf(", %d keys", l.Keys)
+			}
+			fmt.Printf("\n")
+		}
 	}
 }
 
@@ -1423,6 +1852,183 @@ func router_upd(args []string, opts [16]string) {
 		rt := parse_route_table
 		swyclient.Routers().Set(args[0], "table", rt)
 	}
+	if opts[1] != "" {
+		swyclient.Routers().Set(args[0], "cors", parse_cors(opts[1]))
+	}
+	if opts[2] != "" {
+		ua := []string{}
+		if opts[2] != "*" {
+			for _, p := range strings.Split(opts[2], ",") {
+				ua = append(ua, "path=" + p)
+			}
+		}
+		swyclient.Req1("DELETE", url("routers/" + args[0] + "/cache", ua), http.StatusOK, nil, nil)
+	}
+	if opts[3] != "" {
+		router_set_xform(args[0], opts[3])
+	}
+	if opts[4] != "" {
+		router_set_limit(args[0], opts[4])
+	}
+	if opts[5] != "" {
+		swyclient.Routers().Set(args[0], "openapi", parse_openapi(opts[5]))
+	}
+	if opts[6] != "" {
+		router_set_schema(args[0], opts[6])
+	}
+	if opts[7] != "" || opts[8] != "" {
+		router_edit(args[0], opts[7], opts[8], opts[9])
+	}
+	if opts[10] != "" {
+		rb := swyapi.RouterRollback{To: int(parse_uint(opts[10], "revision"))}
+		if opts[9] != "" {
+			rev := int(parse_uint(opts[9], "revision"))
+			rb.Rev = &rev
+		}
+		var tr swyapi.RouterTableRev
+		swyclient.Req1("POST", "routers/" + args[0] + "/rollback", http.StatusOK, &rb, &tr)
+		fmt.Printf("Table rolled back, rev %d (%d ents)\n", tr.Rev, tr.TLen)
+	}
+}
+
+/* M:path;M:path;... */
+func parse_entry_ids(opt string) []*swyapi.RouterEntryId {
+	res := []*swyapi.RouterEntryId{}
+	for _, e := range strings.Split(opt, ";") {
+		ee := strings.SplitN(e, ":", 2)
+		if len(ee) != 2 {
+			fatal(errors.New("Entry should be M:path"))
+		}
+		res = append(res, &swyapi.RouterEntryId{Method: ee[0], Path: ee[1]})
+	}
+	return res
+}
+
+func router_edit(rid, add, del, rev string) {
+	var ed swyapi.RouterTableEdit
+	if add != "" {
+		ed.Add = parse_route_table(add)
+	}
+	if del != "" {
+		ed.Delete = parse_entry_ids(del)
+	}
+	if rev != "" {
+		r := int(parse_uint(rev, "revision"))
+		ed.Rev = &r
+	}
+
+	var tr swyapi.RouterTableRev
+	swyclient.Req1("POST", "routers/" + rid + "/table", http.StatusOK, &ed, &tr)
+	fmt.Printf("Table updated, rev %d (%d ents)\n", tr.Rev, tr.TLen)
+}
+
+func router_history(args []string, opts [16]string) {
+	args[0], _ = swyclient.Routers().Resolve(curProj, args[0])
+	if opts[0] != "" {
+		var res []*swyapi.RouterEntry
+		swyclient.Routers().Prop(args[0], "table?rev=" + opts[0], &res)
+		for _, re := range res {
+			fmt.Printf("   %8s /%-32s -> %s\n", re.Method, re.Path, re.Call)
+		}
+		return
+	}
+
+	var hist []*swyapi.RouterTableRev
+	swyclient.Routers().Prop(args[0], "history", &hist)
+	fmt.Printf("%-6s%-36s%-8s%s\n", "REV", "CREATED", "ENTS", "OP")
+	for _, tr := range hist {
+		fmt.Printf("%-6d%-36s%-8d%s\n", tr.Rev, tr.Created, tr.TLen, tr.Op)
+	}
+}
+
+/* path:file.json, empty file drops the transform */
+func router_set_xform(rid, opt string) {
+	x := strings.SplitN(opt, ":", 2)
+	if len(x) != 2 {
+		fatal(errors.New("Transform should be path:file"))
+	}
+
+	var xf *swyapi.RouterTransform
+	if x[1] != "" {
+		data, err := ioutil.ReadFile(x[1])
+		if err != nil {
+			fatal(err)
+		}
+		xf = &swyapi.RouterTransform{}
+		err = json.Unmarshal(data, xf)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	router_upd_entry(rid, x[0], func(re *swyapi.RouterEntry) { re.Transform = xf })
+}
+
+/* path:file, empty file drops the schema */
+func router_set_schema(rid, opt string) {
+	x := strings.SplitN(opt, ":", 2)
+	if len(x) != 2 {
+		fatal(errors.New("Schema should be path:file"))
+	}
+
+	var rs *swyapi.RequestSchema
+	if x[1] != "" {
+		rs = parse_req_schema(x[1])
+	}
+
+	router_upd_entry(rid, x[0], func(re *swyapi.RouterEntry) { re.Schema = rs })
+}
+
+/* path:rate[/period][:burst[:key]], empty rate drops the limit */
+func router_set_limit(rid, opt string) {
+	x := strings.SplitN(opt, ":", 4)
+	if len(x) < 2 {
+		fatal(errors.New("Limit should be path:rate..."))
+	}
+
+	var rl *swyapi.RouterLimit
+	if x[1] != "" {
+		rl = &swyapi.RouterLimit{}
+		rp := strings.SplitN(x[1], "/", 2)
+		rl.Rate = parse_uint(rp[0], "rate")
+		if len(rp) > 1 {
+			rl.Period = parse_uint(rp[1], "period")
+		}
+		if len(x) > 2 && x[2] != "" {
+			rl.Burst = parse_uint(x[2], "burst")
+		}
+		if len(x) > 3 {
+			rl.Key = x[3]
+		}
+	}
+
+	router_upd_entry(rid, x[0], func(re *swyapi.RouterEntry) { re.Limit = rl })
+}
+
+func parse_uint(v, what string) uint {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		fatal(errors.New("Bad " + what + " value"))
+	}
+	return uint(n)
+}
+
+/* Edit one entry, the table revision makes concurrent updates fail */
+func router_upd_entry(rid, path string, upd func(*swyapi.RouterEntry)) {
+	var ri swyapi.RouterInfo
+	swyclient.Routers().Get(rid, &ri)
+	var res []*swyapi.RouterEntry
+	swyclient.Routers().Prop(rid, "table?rev=" + strconv.Itoa(ri.TRev), &res)
+	for _, re := range res {
+		if re.Path == path {
+			upd(re)
+			ed := swyapi.RouterTableEdit{Rev: &ri.TRev, Update: []*swyapi.RouterEntry{re}}
+			swyclient.Req1("POST", "routers/" + rid + "/table", http.StatusOK, &ed, nil)
+			return
+		}
+	}
+
+	fatal(errors.New("No such path in table"))
 }
 
 func router_del(args []string, opts [16]string) {
@@ -1430,6 +2036,129 @@ func router_del(args []string, opts [16]string) {
 	swyclient.Routers().Del(args[0])
 }
 
+func domain_list(args []string, opts [16]string) {
+	var ds []swyapi.DomainInfo
+	swyclient.Domains().List([]string{}, &ds)
+	fmt.Printf("%-26s%-12s%s\n", "ID", "STATE", "NAME")
+	for _, d := range ds {
+		fmt.Printf("%-26s%-12s%s\n", d.Id, d.State, d.Name)
+	}
+}
+
+/* prefix:rt:router;prefix:fn:function */
+func parse_domain_maps(opt string) []*swyapi.DomainMap {
+	res := []*swyapi.DomainMap{}
+	if opt == "-" {
+		return res
+	}
+
+	for _, e := range strings.Split(opt, ";") {
+		ee := strings.SplitN(e, ":", 3)
+		if len(ee) != 3 {
+			fatal(fmt.Errorf("Bad map %s, want prefix:rt|fn:name", e))
+		}
+
+		m := &swyapi.DomainMap{Prefix: ee[0]}
+		switch ee[1] {
+		case "rt":
+			m.Router = ee[2]
+		case "fn":
+			m.Function = ee[2]
+		default:
+			fatal(fmt.Errorf("Bad map target %s", ee[1]))
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func domain_add(args []string, opts [16]string) {
+	da := swyapi.DomainAdd {
+		Name: args[0],
+		Project: curProj,
+		Verify: opts[0],
+	}
+	if opts[1] != "" {
+		da.Maps = parse_domain_maps(opts[1])
+	}
+	var di swyapi.DomainInfo
+	swyclient.Domains().Add(&da, &di)
+	fmt.Printf("Domain %s created, verify it with\n", di.Id)
+	fmt.Printf("  %s\n  token %s\n", di.Challenge, di.Token)
+}
+
+func domain_info(args []string, opts [16]string) {
+	args[0], _ = swyclient.Domains().Resolve(curProj, args[0])
+	var di swyapi.DomainInfo
+	swyclient.Domains().Get(args[0], &di)
+	fmt.Printf("Name:     %s\n", di.Name)
+	fmt.Printf("State:    %s\n", di.State)
+	if di.Challenge != "" {
+		fmt.Printf("Verify:   %s\n", di.Challenge)
+		fmt.Printf("Token:    %s\n", di.Token)
+	}
+	if di.Cert != nil {
+		fmt.Printf("Cert:     %s, %s", di.Cert.Source, di.Cert.State)
+		if di.Cert.Expires != "" {
+			fmt.Printf(", expires %s", di.Cert.Expires)
+		}
+		if di.Cert.Error != "" {
+			fmt.Printf(" (%s)", di.Cert.Error)
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Printf("Maps:\n")
+	for _, m := range di.Maps {
+		if m.Router != "" {
+			fmt.Printf("   %-32s -> router %s\n", m.Prefix, m.Router)
+		} else {
+			fmt.Printf("   %-32s -> function %s\n", m.Prefix, m.Function)
+		}
+	}
+}
+
+func domain_verify(args []string, opts [16]string) {
+	args[0], _ = swyclient.Domains().Resolve(curProj, args[0])
+	var di swyapi.DomainInfo
+	swyclient.Req1("POST", "domains/" + args[0] + "/verify", http.StatusOK, nil, &di)
+	fmt.Printf("Domain %s is %s\n", di.Name, di.State)
+}
+
+func domain_upd(args []string, opts [16]string) {
+	args[0], _ = swyclient.Domains().Resolve(curProj, args[0])
+	if opts[0] != "" {
+		swyclient.Domains().Set(args[0], "maps", parse_domain_maps(opts[0]))
+	}
+
+	var dc *swyapi.DomainCert
+
+	switch {
+	case opts[1] == "acme":
+		dc = &swyapi.DomainCert{ACME: true}
+	case opts[1] == "-":
+		dc = &swyapi.DomainCert{}
+	case opts[1] != "":
+		cert, err := ioutil.ReadFile(opts[1])
+		if err != nil {
+			fatal(fmt.Errorf("Can't read cert: %s", err.Error()))
+		}
+		key, err := ioutil.ReadFile(opts[2])
+		if err != nil {
+			fatal(fmt.Errorf("Can't read key: %s", err.Error()))
+		}
+		dc = &swyapi.DomainCert{Cert: string(cert), Key: string(key)}
+	}
+
+	if dc != nil {
+		swyclient.Domains().Set(args[0], "cert", dc)
+	}
+}
+
+func domain_del(args []string, opts [16]string) {
+	args[0], _ = swyclient.Domains().Resolve(curProj, args[0])
+	swyclient.Domains().Del(args[0])
+}
+
 func repo_list(args []string, opts [16]string) {
 	var ris []*swyapi.RepoInfo
 	ua := []string{}
@@ -1925,6 +2654,21 @@ const (
 	CMD_MI string		= "mi"
 	CMD_MA string		= "ma"
 	CMD_MD string		= "md"
+	CMD_MROT string		= "mrot"
+	CMD_MLOG string		= "mlog"
+	CMD_MGL string		= "mgl"
+	CMD_MGA string		= "mga"
+	CMD_MGD string		= "mgd"
+	CMD_MBL string		= "mbl"
+	CMD_MBA string		= "mba"
+	CMD_MBD string		= "mbd"
+	CMD_MBR string		= "mbr"
+	CMD_MBS string		= "mbs"
+	CMD_MKL string		= "mkl"
+	CMD_MKA string		= "mka"
+	CMD_MKD string		= "mkd"
+	CMD_MCL string		= "mcl"
+	CMD_MCD string		= "mcd"
 
 	CMD_S3ACC string	= "s3acc"
 	CMD_AUTH string		= "auth"
@@ -1938,8 +2682,17 @@ const (
 	CMD_RTI string		= "rti"
 	CMD_RTA string		= "rta"
 	CMD_RTU string		= "rtu"
+	CMD_RTO string		= "rto"
+	CMD_RTH string		= "rth"
 	CMD_RTD string		= "rtd"
 
+	CMD_DOML string		= "doml"
+	CMD_DOMI string		= "domi"
+	CMD_DOMA string		= "doma"
+	CMD_DOMV string		= "domv"
+	CMD_DOMU string		= "domu"
+	CMD_DOMD string		= "domd"
+
 	CMD_RL string		= "rl"
 	CMD_RI string		= "ri"
 	CMD_RA string		= "ra"
@@ -2014,6 +2767,21 @@ var cmdOrder = []string {
 	CMD_MI,
 	CMD_MA,
 	CMD_MD,
+	CMD_MROT,
+	CMD_MLOG,
+	CMD_MGL,
+	CMD_MGA,
+	CMD_MGD,
+	CMD_MBL,
+	CMD_MBA,
+	CMD_MBD,
+	CMD_MBR,
+	CMD_MBS,
+	CMD_MKL,
+	CMD_MKA,
+	CMD_MKD,
+	CMD_MCL,
+	CMD_MCD,
 
 	CMD_S3ACC,
 	CMD_AUTH,
@@ -2027,8 +2795,17 @@ var cmdOrder = []string {
 	CMD_RTI,
 	CMD_RTA,
 	CMD_RTU,
+	CMD_RTO,
+	CMD_RTH,
 	CMD_RTD,
 
+	CMD_DOML,
+	CMD_DOMI,
+	CMD_DOMA,
+	CMD_DOMV,
+	CMD_DOMU,
+	CMD_DOMD,
+
 	CMD_RL,
 	CMD_RI,
 	CMD_RA,
@@ -2140,6 +2917,21 @@ var cmdMap = map[string]*cmdDesc {
 	CMD_MI:		&cmdDesc{ help: "Show mware info",	call: mware_info,	wp: true },
 	CMD_MA:		&cmdDesc{ help: "Add mware",		call: mware_add,	wp: true },
 	CMD_MD:		&cmdDesc{ help: "Del mware",		call: mware_del,	wp: true },
+	CMD_MROT:	&cmdDesc{ help: "Rotate mware creds",	call: mware_rotate,	wp: true },
+	CMD_MLOG:	&cmdDesc{ help: "Show mware logs",	call: mware_logs,	wp: true },
+	CMD_MGL:	&cmdDesc{ help: "List mware grants",	call: mware_grant_list,	wp: true },
+	CMD_MGA:	&cmdDesc{ help: "Grant mware to project",	call: mware_grant_add,	wp: true },
+	CMD_MGD:	&cmdDesc{ help: "Revoke mware grant",	call: mware_grant_del,	wp: true },
+	CMD_MBL:	&cmdDesc{ help: "List mware backups",	call: mware_backup_list,	wp: true },
+	CMD_MBA:	&cmdDesc{ help: "Backup mware",		call: mware_backup_add,	wp: true },
+	CMD_MBD:	&cmdDesc{ help: "Del mware backup",	call: mware_backup_del,	wp: true },
+	CMD_MBR:	&cmdDesc{ help: "Restore mware backup",	call: mware_backup_restore,	wp: true },
+	CMD_MBS:	&cmdDesc{ help: "Mware backups schedule",	call: mware_backup_sched,	wp: true },
+	CMD_MKL:	&cmdDesc{ help: "List API keys",	call: mware_key_list,	wp: true },
+	CMD_MKA:	&cmdDesc{ help: "Add API key",		call: mware_key_add,	wp: true },
+	CMD_MKD:	&cmdDesc{ help: "Revoke API key",	call: mware_key_del,	wp: true },
+	CMD_MCL:	&cmdDesc{ help: "List websocket connections",	call: mware_conn_list,	wp: true },
+	CMD_MCD:	&cmdDesc{ help: "Close websocket connection",	call: mware_conn_del,	wp: true },
 
 	CMD_DL:		&cmdDesc{ help: "List deployments",	call: deploy_list,	wp: true },
 	CMD_DI:		&cmdDesc{ help: "Show deploy info",	call: deploy_info,	wp: true },
@@ -2151,8 +2943,17 @@ var cmdMap = map[string]*cmdDesc {
 	CMD_RTI:	&cmdDesc{ help: "Show router info",	call: router_info,	wp: true },
 	CMD_RTA:	&cmdDesc{ help: "Add router",		call: router_add,	wp: true },
 	CMD_RTU:	&cmdDesc{ help: "Update router",	call: router_upd,	wp: true },
+	CMD_RTO:	&cmdDesc{ help: "Show router OpenAPI",	call: router_openapi,	wp: true },
+	CMD_RTH:	&cmdDesc{ help: "Show router table history",	call: router_history,	wp: true },
 	CMD_RTD:	&cmdDesc{ help: "Del router",		call: router_del,	wp: true },
 
+	CMD_DOML:	&cmdDesc{ help: "List domains",		call: domain_list,	wp: true },
+	CMD_DOMI:	&cmdDesc{ help: "Show domain info",	call: domain_info,	wp: true },
+	CMD_DOMA:	&cmdDesc{ help: "Add domain",		call: domain_add,	wp: true },
+	CMD_DOMV:	&cmdDesc{ help: "Verify domain",	call: domain_verify,	wp: true },
+	CMD_DOMU:	&cmdDesc{ help: "Update domain",	call: domain_upd,	wp: true },
+	CMD_DOMD:	&cmdDesc{ help: "Del domain",		call: domain_del,	wp: true },
+
 	CMD_RL:		&cmdDesc{ help: "List repositories",	call: repo_list		},
 	CMD_RI:		&cmdDesc{ help: "Show repo info",	call: repo_info		},
 	CMD_RA:		&cmdDesc{ help: "Add repo",		call: repo_add		},
@@ -2256,6 +3057,7 @@ func main() {
 	cmdMap[CMD_FA].opts.StringVar(&opts[6], "data", "", "Any text associated with fn")
 	cmdMap[CMD_FA].opts.StringVar(&opts[7], "env", "", "Colon-separated list of env vars")
 	cmdMap[CMD_FA].opts.StringVar(&opts[8], "auth", "", "ID of auth mware to verify the call")
+	cmdMap[CMD_FA].opts.StringVar(&opts[9], "conc", "", "Calls one pod runs at once")
 	setupCommonCmd(CMD_RUN, "NAME", "ARG=VAL,...")
 	cmdMap[CMD_RUN].opts.StringVar(&opts[0], "src", "", "Run a custom source in it")
 	cmdMap[CMD_RUN].opts.StringVar(&opts[1], "method", "", "Run method")
@@ -2263,6 +3065,7 @@ func main() {
 	cmdMap[CMD_FU].opts.StringVar(&opts[0], "src", "", "Source file")
 	cmdMap[CMD_FU].opts.StringVar(&opts[1], "tmo", "", "Timeout")
 	cmdMap[CMD_FU].opts.StringVar(&opts[2], "rl", "", "Rate (rate[:burst])")
+	cmdMap[CMD_FU].opts.StringVar(&opts[5], "conc", "", "Calls one pod runs at once")
 	cmdMap[CMD_FU].opts.StringVar(&opts[3], "mw", "", "Mware to use, +/- to add/remove")
 	cmdMap[CMD_FU].opts.StringVar(&opts[4], "data", "", "Associated text")
 	cmdMap[CMD_FU].opts.StringVar(&opts[7], "auth", "", "Auth context (- for off)")
@@ -2272,6 +3075,7 @@ func main() {
 	setupCommonCmd(CMD_FD, "NAME")
 	setupCommonCmd(CMD_FLOG, "NAME")
 	cmdMap[CMD_FLOG].opts.StringVar(&opts[0], "last", "", "Last N 'duration' period")
+	cmdMap[CMD_FLOG].opts.BoolVar(&logsFollow, "f", false, "Follow new lines")
 	setupCommonCmd(CMD_FCOD, "NAME")
 	setupCommonCmd(CMD_FON, "NAME")
 	setupCommonCmd(CMD_FOFF, "NAME")
@@ -2287,6 +3091,9 @@ func main() {
 	cmdMap[CMD_EA].opts.StringVar(&opts[0], "buck", "", "S3 bucket")
 	cmdMap[CMD_EA].opts.StringVar(&opts[1], "ops", "", "S3 ops")
 	cmdMap[CMD_EA].opts.StringVar(&opts[0], "wsid", "", "Websock mware id")
+	cmdMap[CMD_EA].opts.StringVar(&opts[2], "wsev", "", "Websock events (message,connect,disconnect)")
+	cmdMap[CMD_EA].opts.StringVar(&opts[3], "cors", "", "URL CORS origins[;methods]")
+	cmdMap[CMD_EA].opts.StringVar(&opts[4], "schema", "", "URL request schema file (body: and args: JSON schemas)")
 	setupCommonCmd(CMD_EI, "NAME", "ENAME")
 	setupCommonCmd(CMD_ED, "NAME", "ENAME")
 
@@ -2296,7 +3103,41 @@ func main() {
 	setupCommonCmd(CMD_MI, "NAME")
 	setupCommonCmd(CMD_MA, "NAME", "TYPE")
 	cmdMap[CMD_MA].opts.StringVar(&opts[0], "data", "", "Associated text")
+	cmdMap[CMD_MA].opts.StringVar(&opts[1], "ext", "", "Address of external mware")
+	cmdMap[CMD_MA].opts.StringVar(&opts[2], "user", "", "External mware user")
+	cmdMap[CMD_MA].opts.StringVar(&opts[3], "pass", "", "External mware password")
+	cmdMap[CMD_MA].opts.StringVar(&opts[4], "db", "", "External mware db name (vhost for rabbit)")
+	cmdMap[CMD_MA].opts.StringVar(&opts[5], "jwtalg", "", "Authjwt token alg (HS256, RS256, ES256)")
+	cmdMap[CMD_MA].opts.StringVar(&opts[6], "jwtkey", "", "Authjwt public key or JWKS file, or JWKS URL")
+	cmdMap[CMD_MA].opts.StringVar(&opts[7], "jwtiss", "", "Authjwt required issuer")
+	cmdMap[CMD_MA].opts.StringVar(&opts[8], "jwtaud", "", "Authjwt required audience")
+	cmdMap[CMD_MA].opts.StringVar(&opts[9], "jwtclaims", "", "Authjwt required claims (comma separated)")
 	setupCommonCmd(CMD_MD, "NAME")
+	setupCommonCmd(CMD_MROT, "NAME")
+	cmdMap[CMD_MROT].opts.StringVar(&opts[0], "grace", "", "Seconds to keep old creds valid")
+	setupCommonCmd(CMD_MLOG, "NAME")
+	cmdMap[CMD_MLOG].opts.StringVar(&opts[0], "last", "", "Last N 'duration' period")
+	setupCommonCmd(CMD_MGL, "NAME")
+	setupCommonCmd(CMD_MGA, "NAME", "PROJECT")
+	cmdMap[CMD_MGA].opts.StringVar(&opts[0], "ro", "", "Read-only access (any non-empty value)")
+	setupCommonCmd(CMD_MGD, "NAME", "PROJECT")
+	setupCommonCmd(CMD_MBL, "NAME")
+	setupCommonCmd(CMD_MBA, "NAME")
+	cmdMap[CMD_MBA].opts.StringVar(&opts[0], "note", "", "Backup note")
+	setupCommonCmd(CMD_MBD, "NAME", "BID")
+	setupCommonCmd(CMD_MBR, "NAME", "BID")
+	cmdMap[CMD_MBR].opts.StringVar(&opts[0], "to", "", "Restore into another (maybe new) mware")
+	setupCommonCmd(CMD_MBS, "NAME")
+	cmdMap[CMD_MBS].opts.StringVar(&opts[0], "tab", "", "Crontab, \"off\" to stop")
+	cmdMap[CMD_MBS].opts.StringVar(&opts[1], "keep", "", "Number of scheduled backups to keep")
+	setupCommonCmd(CMD_MKL, "NAME")
+	setupCommonCmd(CMD_MKA, "NAME", "KEYNAME")
+	cmdMap[CMD_MKA].opts.StringVar(&opts[0], "life", "", "Key lifetime (duration, e.g. 720h)")
+	cmdMap[CMD_MKA].opts.StringVar(&opts[1], "scopes", "", "Key scopes (comma separated)")
+	cmdMap[CMD_MKA].opts.StringVar(&opts[2], "rate", "", "Ratelimit (rate[:burst])")
+	setupCommonCmd(CMD_MKD, "NAME", "KID")
+	setupCommonCmd(CMD_MCL, "NAME")
+	setupCommonCmd(CMD_MCD, "NAME", "CID")
 
 	setupCommonCmd(CMD_S3ACC, "BUCKET")
 	cmdMap[CMD_S3ACC].opts.StringVar(&opts[0], "life", "60", "Lifetime (default 1 min)")
@@ -2314,11 +3155,39 @@ func main() {
 	setupCommonCmd(CMD_RTL)
 	setupCommonCmd(CMD_RTI, "NAME")
 	setupCommonCmd(CMD_RTA, "NAME")
-	cmdMap[CMD_RTA].opts.StringVar(&opts[0], "table", "", "Table entries [M:path:function:key];")
+	cmdMap[CMD_RTA].opts.StringVar(&opts[0], "table", "", "Table entries [M:path:function:key[:cache_ttl]];")
+	cmdMap[CMD_RTA].opts.StringVar(&opts[1], "cors", "", "CORS origins[;methods] (comma separated)")
+	cmdMap[CMD_RTA].opts.StringVar(&opts[2], "openapi", "", "OpenAPI 3 file (YAML or JSON) to make the table from")
 	setupCommonCmd(CMD_RTU, "NAME")
 	cmdMap[CMD_RTU].opts.StringVar(&opts[0], "table", "", "New table to set")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[1], "cors", "", "CORS origins[;methods], - to turn off")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[2], "flush", "", "Flush cached responses for paths (comma separated), * for all")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[3], "xform", "", "Set transform for path from JSON file (path:file, empty file to drop)")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[4], "limit", "", "Set rate limit for path (path:rate[/period][:burst[:ip|apikey|claim:name]], empty rate to drop)")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[5], "openapi", "", "Update table from OpenAPI 3 file (YAML or JSON)")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[6], "schema", "", "Set request schema for path (path:file, empty file to drop)")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[7], "add", "", "Add table entries [M:path:function:key[:cache_ttl]];")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[8], "del", "", "Delete table entries [M:path];")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[9], "rev", "", "Table revision the -add, -del and -rollback are made against")
+	cmdMap[CMD_RTU].opts.StringVar(&opts[10], "rollback", "", "Roll the table back to revision")
+	setupCommonCmd(CMD_RTO, "NAME")
+	cmdMap[CMD_RTO].opts.StringVar(&opts[0], "json", "", "Print JSON instead of YAML")
+	setupCommonCmd(CMD_RTH, "NAME")
+	cmdMap[CMD_RTH].opts.StringVar(&opts[0], "rev", "", "Show table at revision")
 	setupCommonCmd(CMD_RTD, "NAME")
 
+	setupCommonCmd(CMD_DOML)
+	setupCommonCmd(CMD_DOMI, "NAME")
+	setupCommonCmd(CMD_DOMA, "NAME")
+	cmdMap[CMD_DOMA].opts.StringVar(&opts[0], "verify", "", "Verification method (dns or http)")
+	cmdMap[CMD_DOMA].opts.StringVar(&opts[1], "map", "", "Maps prefix:rt|fn:name;")
+	setupCommonCmd(CMD_DOMV, "NAME")
+	setupCommonCmd(CMD_DOMU, "NAME")
+	cmdMap[CMD_DOMU].opts.StringVar(&opts[0], "map", "", "New maps to set, - to drop all")
+	cmdMap[CMD_DOMU].opts.StringVar(&opts[1], "cert", "", "Cert file, acme to get one, - to drop")
+	cmdMap[CMD_DOMU].opts.StringVar(&opts[2], "key", "", "Key file for the cert")
+	setupCommonCmd(CMD_DOMD, "NAME")
+
 	setupCommonCmd(CMD_RL)
 	cmdMap[CMD_RL].opts.StringVar(&opts[0], "acc", "", "Account ID")
 	cmdMap[CMD_RL].opts.StringVar(&opts[1], "at", "", "Attach status")
@@ -9,6 +9,7 @@ import (
 	"go.uber.org/zap"
 	"github.com/gorilla/mux"
 	"errors"
+	"encoding/json"
 	"strings"
 	"net/http"
 	"os/exec"
@@ -120,13 +121,42 @@ var ldescs = map[string]*LangDesc {
 		build:	true,
 		prep:	mkExecPath,
 	},
+	"java": &LangDesc {
+		build:	true,
+		prep:	mkExecPath,
+		info:	javaInfo,
+		packages: javaPackages,
+		install:  mvnInstall,
+		remove:   javaRemove,
+	},
+	"php": &LangDesc {
+		prep:	mkExecPath,
+		info:	phpInfo,
+		packages: composerPackages,
+		install:  composerInstall,
+		remove:   composerRemove,
+	},
+	"rust": &LangDesc {
+		build:	true,
+		prep:	mkExecRunner,
+		_runner:	"/rust/swycode/runner",
+		info:	rustInfo,
+		packages: cargoPackages,
+		install:  cargoInstall,
+		remove:   cargoRemove,
+	},
 }
 
+/*
+ * Pipes are non-blocking, but newer Go puts such files into poller
+ * and Read waits for data, so limit it to get what's there only
+ */
 func readLines(f *os.File) string {
 	var ret string
 
 	buf := make([]byte, 512, 512)
 	for {
+		f.SetReadDeadline(time.Now().Add(time.Millisecond))
 		n, _ := f.Read(buf)
 		if n == 0 {
 			return ret
@@ -152,9 +182,38 @@ func handleTry(lang string, tmous int64, w http.ResponseWriter, r *http.Request)
 	glock.Unlock()
 }
 
+/*
+ * Reply to /run is a stream of frames, headers go out with the first
+ * one, so errors up to that point are still reported with a code
+ */
+type runStream struct {
+	w	http.ResponseWriter
+	enc	*json.Encoder
+}
+
+func (rs *runStream)frame(f *swyapi.WdogRunFrame) error {
+	if rs.enc == nil {
+		rs.w.Header().Set("Content-Type", "application/x-ndjson")
+		rs.w.WriteHeader(http.StatusOK)
+		rs.enc = json.NewEncoder(rs.w)
+	}
+
+	err := rs.enc.Encode(f)
+	if fl, ok := rs.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+
+	return err
+}
+
+func (rs *runStream)line(l *swyapi.WdogLogLine) {
+	rs.frame(&swyapi.WdogRunFrame{Line: l})
+}
+
 func handleRun(runner *Runner, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	var result *swyapi.WdogFunctionRunResult
+	rs := &runStream{w: w}
 
 	code := http.StatusBadRequest
 	body, err := ioutil.ReadAll(r.Body)
@@ -165,7 +224,7 @@ func handleRun(runner *Runner, w http.ResponseWriter, r *http.Request) {
 	code = http.StatusInternalServerError
 	runner.lock.Lock()
 	if runner.ready {
-		result, err = doRun(runner, body)
+		result, err = doRun(runner, body, rs.line)
 		if err != nil || result.Code < 0 {
 			runner.restart(runner)
 		}
@@ -177,9 +236,9 @@ func handleRun(runner *Runner, w http.ResponseWriter, r *http.Request) {
 		goto out
 	}
 
-	err = xhttp.Respond(w, result)
+	err = rs.frame(&swyapi.WdogRunFrame{Res: result})
 	if err != nil {
-		goto out
+		log.Errorf("Can't send result: %s", err.Error())
 	}
 
 	return
@@ -189,6 +248,18 @@ out:
 	log.Errorf("%s", err.Error())
 }
 
+func handlePool(pool *RunnerPool, w http.ResponseWriter, r *http.Request) {
+	runner := pool.get()
+	if runner == nil {
+		http.Error(w, "No free runner", http.StatusInternalServerError)
+		log.Errorf("No free runner")
+		return
+	}
+
+	handleRun(runner, w, r)
+	pool.put(runner)
+}
+
 func listPackages(w http.ResponseWriter, ld *LangDesc, tenant string) {
 	var pks []string
 	var res []*swyapi.Package
@@ -405,17 +476,26 @@ func main() {
 			log.Fatal("SWD_POD_TOKEN not set")
 		}
 
+		conc := 1
+		concs := xh.SafeEnv("SWD_FN_CONC", "")
+		if concs != "" {
+			conc, err = strconv.Atoi(concs)
+			if err != nil || conc < 1 {
+				log.Fatal("Bad concurrency value")
+			}
+		}
+
 		crespDir := xh.SafeEnv("SWD_CRESPONDER", "")
 
 		tmous := int64((time.Duration(tmo) * time.Millisecond) / time.Microsecond)
-		runner, err := makeLocalRunner(lang, tmous, "")
+		pool, err := makeLocalPool(lang, tmous, conc)
 		if err != nil {
-			log.Fatal("Can't start runner")
+			log.Fatal("Can't start runners")
 		}
 
 		if crespDir != "" {
 			log.Debugf("Starting proxy responder @%s", crespDir)
-			err = startCResponder(runner, crespDir, podIP)
+			err = startCResponder(pool, crespDir, podIP)
 			if err != nil {
 				log.Fatal("Can't start cresponder: %s", err.Error())
 			}
@@ -423,7 +503,7 @@ func main() {
 
 		r.HandleFunc("/v1/run/" + podToken,
 				func(w http.ResponseWriter, r *http.Request) {
-					handleRun(runner, w, r)
+					handlePool(pool, w, r)
 				})
 		r.HandleFunc("/v1/run/" + podToken + "/{suff}",
 				func(w http.ResponseWriter, r *http.Request) {
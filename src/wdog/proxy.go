@@ -10,25 +10,62 @@ import (
 	"encoding/json"
 	"strings"
 	"net/http"
+	"errors"
 	"sync"
 	"syscall"
+	"time"
 	"net"
 	"os"
 
 	"swifty/common/xqueue"
 )
 
+/*
+ * The connection to the wdog is also used to ask for the runner
+ * usage counters. The answers are read by the watchdog goroutine.
+ */
 type proxyRunner struct {
 	wc	*net.UnixConn
 	rkey	string
+	conc	int
+	tmo	time.Duration
+	usg	chan *procUsage
+	dead	chan struct{}
+	noUsage	bool
+}
+
+/*
+ * Each wdog runner comes over its own connection, the pool grows up
+ * to the number of runners the wdog has, reported with the first one.
+ * The pool that ran out of runners is removed from prox_runners and
+ * is marked gone, so that those who picked it up before that go and
+ * make a new one.
+ */
+type proxyPool struct {
+	lock	sync.Mutex
+	wait	*sync.Cond
+	free	[]*Runner
+	nr	int
+	max	int
+	tmo	time.Duration
+	gone	bool
 }
 
 var prox_runners sync.Map
-var prox_lock sync.Mutex
+var errPoolGone = errors.New("Pool is gone")
+
+/* Until the wdog tells us the fn timeout */
+const proxyWaitDef = 60 * time.Second
 
 type runnerInfo struct {
+	Runners		int	`json:"runners,omitempty"`
+	Tmo		int64	`json:"tmo,omitempty"`		/* usec */
+	Usage		bool	`json:"usage,omitempty"`
 }
 
+/* The wdog answers right away, it just reads /proc */
+const proxyUsageTmo = time.Second
+
 func makeProxyRunner(dir, rkey string) (*Runner, error) {
 	var c *net.UnixConn
 	var rfds []int
@@ -84,7 +121,12 @@ func makeProxyRunner(dir, rkey string) (*Runner, error) {
 
 	/* FIXME -- up above we might have leaked the received FDs... */
 
-	pr = &proxyRunner{rkey: rkey, wc: c}
+	pr = &proxyRunner{rkey: rkey, wc: c, conc: rinf.Runners, tmo: time.Duration(rinf.Tmo) * time.Microsecond,
+			usg: make(chan *procUsage, 1), dead: make(chan struct{}), noUsage: !rinf.Usage}
+	if pr.noUsage {
+		log.Errorf("Runner %s doesn't report usage, calls' CPU and memory won't be accounted", rkey)
+	}
+
 	runner = &Runner{p: pr, restart: restartProxy, ready: true}
 	runner.fin = os.NewFile(uintptr(rfds[0]), "runner.stdout")
 	runner.fine = os.NewFile(uintptr(rfds[1]), "runner.stderr")
@@ -108,59 +150,248 @@ func restartProxy(runner *Runner) {
 	runner.fin.Close()
 	runner.fine.Close()
 	runner.p.wc.Close()
-	prox_runners.Delete(runner.p.rkey)
 
 	runner.p.wc = nil
 	runner.ready = false
 }
 
-func handleProxy(dir string, w http.ResponseWriter, req *http.Request) {
-	var runner *Runner
+func mkProxyPool() *proxyPool {
+	pp := &proxyPool{max: 1, tmo: proxyWaitDef}
+	pp.wait = sync.NewCond(&pp.lock)
+	return pp
+}
+
+func (pp *proxyPool)get(dir, rkey string) (*Runner, error) {
+	var deadline time.Time
+
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+
+	for {
+		if pp.gone {
+			return nil, errPoolGone
+		}
+
+		for len(pp.free) > 0 {
+			runner := pp.free[len(pp.free) - 1]
+			pp.free = pp.free[:len(pp.free) - 1]
+			if runner.ready {
+				return runner, nil
+			}
+
+			pp.nr--
+		}
+
+		if pp.nr < pp.max {
+			break
+		}
+
+		/* Calls that wait for a free runner longer than the timeout won't make it anyway */
+		if deadline.IsZero() {
+			deadline = time.Now().Add(pp.tmo)
+			t := time.AfterFunc(pp.tmo, func() {
+				pp.lock.Lock()
+				pp.wait.Broadcast()
+				pp.lock.Unlock()
+			})
+			defer t.Stop()
+		} else if !time.Now().Before(deadline) {
+			return nil, errors.New("No free runner")
+		}
+
+		pp.wait.Wait()
+	}
+
+	pp.nr++
+	log.Debugf("Proxifying %s (%d)", rkey, pp.nr)
+	pp.lock.Unlock()
+	runner, err := makeProxyRunner(dir, rkey)
+	pp.lock.Lock()
+
+	if err != nil {
+		pp.nr--
+		pp.wait.Signal()
+		return nil, err
+	}
+
+	if runner.p.conc > pp.max {
+		pp.max = runner.p.conc
+		pp.wait.Broadcast()
+	}
+
+	if runner.p.tmo != 0 {
+		pp.tmo = runner.p.tmo
+	}
+
+	go runner.p.watch(runner)
+
+	return runner, nil
+}
+
+/* Watchdog for wdog disappearing, also gets usage replies */
+func (pr *proxyRunner)watch(runner *Runner) {
+	wc := pr.wc
+	b := make([]byte, 1024)
+	for {
+		n, err := wc.Read(b)
+		if err != nil {
+			break
+		}
+
+		var u procUsage
+		if json.Unmarshal(b[:n], &u) == nil {
+			select {
+			case pr.usg <- &u:
+			default:
+			}
+		}
+	}
+
+	close(pr.dead)
+	runner.lock.Lock()
+	if pr.wc != nil {
+		restartProxy(runner)
+	}
+	runner.lock.Unlock()
+}
+
+func (pr *proxyRunner)usage() *procUsage {
+	if pr.noUsage {
+		return nil
+	}
+
+	/* Late answer to the previous request */
+	select {
+	case <-pr.usg:
+	default:
+	}
+
+	_, err := pr.wc.Write([]byte{'u'})
+	if err != nil {
+		log.Errorf("Can't ask %s for usage: %s", pr.rkey, err.Error())
+		return nil
+	}
+
+	select {
+	case u := <-pr.usg:
+		return u
+	case <-pr.dead:
+	case <-time.After(proxyUsageTmo):
+		log.Errorf("No usage from %s", pr.rkey)
+	}
+
+	return nil
+}
+
+func (pp *proxyPool)put(runner *Runner) {
+	pp.lock.Lock()
+	if runner.ready {
+		pp.free = append(pp.free, runner)
+	} else {
+		pp.nr--
+		if pp.nr == 0 && len(pp.free) == 0 {
+			pp.gone = true
+			prox_runners.Delete(runner.p.rkey)
+		}
+	}
+	pp.wait.Signal()
+	pp.lock.Unlock()
+}
 
+func handleProxy(dir string, w http.ResponseWriter, req *http.Request) {
 	v := mux.Vars(req)
 	podtok := v["podtok"]
 	podip := v["podip"]
 	rkey := podtok + "/" + podip
 
-	r, ok := prox_runners.Load(rkey)
-	if ok {
-		runner = r.(*Runner)
-	} else {
-		prox_lock.Lock()
-		r, ok := prox_runners.Load(rkey)
-		if ok {
-			runner = r.(*Runner)
-		} else {
-			var err error
-
-			log.Debugf("Proxifying %s", rkey)
-			runner, err = makeProxyRunner(dir, rkey)
-			if err != nil {
-				prox_lock.Unlock()
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	var pp *proxyPool
+	var runner *Runner
+	var err error
+
+	for {
+		p, ok := prox_runners.Load(rkey)
+		if !ok {
+			p, _ = prox_runners.LoadOrStore(rkey, mkProxyPool())
+		}
 
-			prox_runners.Store(rkey, runner)
-
-			/* Watchdog for wdog disappearing */
-			go func() {
-				b := make([]byte, 1)
-				runner.p.wc.Read(b)
-				runner.lock.Lock()
-				if runner.p.wc != nil {
-					restartProxy(runner)
-				}
-				runner.lock.Unlock()
-			}()
+		pp = p.(*proxyPool)
+		runner, err = pp.get(dir, rkey)
+		if err != errPoolGone {
+			break
 		}
-		prox_lock.Unlock()
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	handleRun(runner, w, req)
+	pp.put(runner)
+}
+
+/*
+ * Proxy gets a runner per connection, one being proxied is out of
+ * the pool till the proxy disconnects.
+ */
+func crespond(pool *RunnerPool, cln *net.UnixConn) {
+	var msg, cmsg []byte
+	var err error
+
+	runner := <-pool.free
+
+	log.Debugf("CResponder accepted conn")
+	runner.lock.Lock()
+	msg, err = json.Marshal(&runnerInfo{Runners: pool.size(), Tmo: int64(pool.tmo / time.Microsecond), Usage: true})
+	if err != nil {
+		goto skip
+	}
+
+	cmsg = syscall.UnixRights(int(runner.fin.Fd()), int(runner.fine.Fd()), runner.q.Fd())
+	_, _, err = cln.WriteMsgUnix(msg, cmsg, nil)
+	if err != nil {
+		goto skip
+	}
+
+	runner.ready = false
+	runner.lock.Unlock()
+
+	serveUsage(cln, runner.pid())
+	log.Debugf("Proxy disconnected, restarting runner")
+
+	runner.lock.Lock()
+	runner.ready = true
+	restartLocal(runner)
+
+skip:
+	runner.lock.Unlock()
+	pool.put(runner)
+	cln.Close()
 }
 
-func startCResponder(runner *Runner, dir, podip string) error {
+/* Proxy asks for usage counters around each call till it disconnects */
+func serveUsage(cln *net.UnixConn, pid int) {
+	b := make([]byte, 1)
+	for {
+		_, err := cln.Read(b)
+		if err != nil {
+			break
+		}
+
+		u := &procUsage{}
+		if pid != 0 {
+			u = procGetUsage(pid)
+		}
+
+		msg, _ := json.Marshal(u)
+		_, err = cln.Write(msg)
+		if err != nil {
+			break
+		}
+	}
+}
+
+func startCResponder(pool *RunnerPool, dir, podip string) error {
 	spath := dir + "/" + strings.Replace(podip, ".", "_", -1)
 	os.Remove(spath)
 	addr, err := net.ResolveUnixAddr("unixpacket", spath)
@@ -174,8 +405,6 @@ func startCResponder(runner *Runner, dir, podip string) error {
 	}
 
 	go func() {
-		var msg, cmsg []byte
-		b := make([]byte, 1)
 		for {
 			cln, err := sk.AcceptUnix()
 			if err != nil {
@@ -183,32 +412,7 @@ func startCResponder(runner *Runner, dir, podip string) error {
 				break
 			}
 
-			log.Debugf("CResponder accepted conn")
-			runner.lock.Lock()
-			msg, err = json.Marshal(&runnerInfo{})
-			if err != nil {
-				goto skip
-			}
-
-			cmsg = syscall.UnixRights(int(runner.fin.Fd()), int(runner.fine.Fd()), runner.q.Fd())
-			_, _, err = cln.WriteMsgUnix(msg, cmsg, nil)
-			if err != nil {
-				goto skip
-			}
-
-			runner.ready = false
-			runner.lock.Unlock()
-
-			cln.Read(b)
-			log.Debugf("Proxy disconnected, restarting runner")
-
-			runner.lock.Lock()
-			runner.ready = true
-			restartLocal(runner)
-
-		skip:
-			runner.lock.Unlock()
-			cln.Close()
+			go crespond(pool, cln)
 		}
 	}()
 
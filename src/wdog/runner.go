@@ -16,6 +16,7 @@ import (
 	"syscall"
 	"strconv"
 	"net/http"
+	"io/ioutil"
 	"io"
 
 	"swifty/apis"
@@ -34,9 +35,81 @@ type RunnerRes struct {
 	Then	json.RawMessage
 }
 
-func doRun(runner *Runner, body []byte) (*swyapi.WdogFunctionRunResult, error) {
+const logPollPeriod = 100 * time.Millisecond
+
+/*
+ * Pipes are non-blocking, so while the runner works we poll them and
+ * send out complete lines, the tail is flushed when the call is over
+ */
+type logPump struct {
+	f	*os.File
+	stream	string
+	part	string
+	out	func(*swyapi.WdogLogLine)
+}
+
+func (lp *logPump)poll(final bool) {
+	data := lp.part + readLines(lp.f)
+	ts := time.Now().UnixNano()
+
+	for {
+		i := strings.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+
+		lp.out(&swyapi.WdogLogLine{Ts: ts, Stream: lp.stream, Text: data[:i]})
+		data = data[i+1:]
+	}
+
+	if final && data != "" {
+		lp.out(&swyapi.WdogLogLine{Ts: ts, Stream: lp.stream, Text: data})
+		data = ""
+	}
+
+	lp.part = data
+}
+
+func startLogPumps(runner *Runner, out func(*swyapi.WdogLogLine)) func() {
+	pumps := []*logPump {
+		&logPump{f: runner.fin, stream: "stdout", out: out},
+		&logPump{f: runner.fine, stream: "stderr", out: out},
+	}
+
+	stop := make(chan bool)
+	done := make(chan bool)
+
+	go func() {
+		t := time.NewTicker(logPollPeriod)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				for _, lp := range pumps {
+					lp.poll(false)
+				}
+			case <-stop:
+				for _, lp := range pumps {
+					lp.poll(true)
+				}
+				done <- true
+				return
+			}
+		}
+	}()
+
+	return func() {
+		stop <- true
+		<-done
+	}
+}
+
+func doRun(runner *Runner, body []byte, lines func(*swyapi.WdogLogLine)) (*swyapi.WdogFunctionRunResult, error) {
 	var err error
 
+	u0 := runner.usage()
+
 	start := time.Now()
 	err = runner.q.SendBytes(body)
 	if err != nil {
@@ -45,16 +118,25 @@ func doRun(runner *Runner, body []byte) (*swyapi.WdogFunctionRunResult, error) {
 		return nil, fmt.Errorf("Can't send args: %s", err.Error())
 	}
 
+	stopPumps := startLogPumps(runner, lines)
+
 	var out RunnerRes
 	err = runner.q.Recv(&out)
 
+	stopPumps()
+
 	ret := &swyapi.WdogFunctionRunResult{
-		Stdout: readLines(runner.fin),
-		Stderr: readLines(runner.fine),
 		Time: uint(time.Since(start) / time.Microsecond),
 		Then: out.Then,
 	}
 
+	if u0 != nil {
+		if u := runner.usage(); u != nil && u.CPU >= u0.CPU {
+			ret.CPU = uint(u.CPU - u0.CPU)
+			ret.MaxRSS = u.MaxRSS
+		}
+	}
+
 	if err == nil {
 		if out.Res == 0 {
 			ret.Code = out.Status
@@ -171,6 +253,54 @@ func restartLocal(runner *Runner) {
 	startQnR(runner)
 }
 
+/*
+ * Local runners pool. Each runner process handles one call at a
+ * time, so the pool size is how many calls the pod runs at once.
+ */
+type RunnerPool struct {
+	free	chan *Runner
+	tmo	time.Duration
+}
+
+func makeLocalPool(lang string, tmous int64, n int) (*RunnerPool, error) {
+	pool := &RunnerPool {
+		free:	make(chan *Runner, n),
+		tmo:	time.Duration(tmous) * time.Microsecond,
+	}
+
+	for i := 0; i < n; i++ {
+		runner, err := makeLocalRunner(lang, tmous, "")
+		if err != nil {
+			return nil, err
+		}
+
+		pool.free <- runner
+	}
+
+	return pool, nil
+}
+
+func (pool *RunnerPool)size() int {
+	return cap(pool.free)
+}
+
+/* Calls that wait for a free runner longer than the timeout won't make it anyway */
+func (pool *RunnerPool)get() *Runner {
+	t := time.NewTimer(pool.tmo)
+	defer t.Stop()
+
+	select {
+	case runner := <-pool.free:
+		return runner
+	case <-t.C:
+		return nil
+	}
+}
+
+func (pool *RunnerPool)put(runner *Runner) {
+	pool.free <- runner
+}
+
 type Runner struct {
 	lock	sync.Mutex
 	q	*xqueue.Queue
@@ -183,6 +313,103 @@ type Runner struct {
 	p	*proxyRunner
 }
 
+func (runner *Runner)pid() int {
+	if runner.l == nil || runner.l.cmd == nil || runner.l.cmd.Process == nil {
+		return 0
+	}
+
+	return runner.l.cmd.Process.Pid
+}
+
+type procUsage struct {
+	CPU	uint64	`json:"cpu"`		/* usec */
+	MaxRSS	uint	`json:"maxrss"`		/* KB */
+}
+
+/*
+ * The peak RSS is reset after being read, so the next reading gets
+ * the peak since this one. Proxied runners live in another pod, so
+ * it's their wdog that reads the counters for us.
+ */
+func (runner *Runner)usage() *procUsage {
+	if runner.p != nil {
+		return runner.p.usage()
+	}
+
+	pid := runner.pid()
+	if pid == 0 {
+		return nil
+	}
+
+	return procGetUsage(pid)
+}
+
+func procGetUsage(pid int) *procUsage {
+	u := &procUsage{ CPU: uint64(procCPUTime(pid) / time.Microsecond), MaxRSS: procMaxRSS(pid) }
+	procResetMaxRSS(pid)
+	return u
+}
+
+/*
+ * Runner is exec-ed by swy-runner and the start script, so the
+ * pid is the language process. Times are summed over its threads.
+ */
+const procClkTck = 100
+
+func procCPUTime(pid int) time.Duration {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0
+	}
+
+	return procStatCPU(string(data))
+}
+
+func procStatCPU(s string) time.Duration {
+	/* comm may have spaces and parens, fields after it start with state */
+	f := strings.Fields(s[strings.LastIndexByte(s, ')') + 1:])
+	if len(f) < 13 {
+		return 0
+	}
+
+	ut, _ := strconv.ParseUint(f[11], 10, 64)
+	st, _ := strconv.ParseUint(f[12], 10, 64)
+
+	return time.Duration(ut + st) * time.Second / procClkTck
+}
+
+/* Writing 5 into clear_refs resets the VmHWM, i.e. the peak RSS */
+func procResetMaxRSS(pid int) {
+	ioutil.WriteFile("/proc/" + strconv.Itoa(pid) + "/clear_refs", []byte("5"), 0)
+}
+
+func procMaxRSS(pid int) uint {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0
+	}
+
+	return procStatusHWM(string(data))
+}
+
+func procStatusHWM(s string) uint {
+	for _, l := range strings.Split(s, "\n") {
+		if !strings.HasPrefix(l, "VmHWM:") {
+			continue
+		}
+
+		f := strings.Fields(l)
+		if len(f) < 2 {
+			break
+		}
+
+		kb, _ := strconv.ParseUint(f[1], 10, 64)
+		return uint(kb)
+	}
+
+	return 0
+}
+
 type localRunner struct {
 	cmd	*exec.Cmd
 	lang	*LangDesc
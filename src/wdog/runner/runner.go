@@ -19,6 +19,7 @@ type Request struct {
 	Claims		map[string]interface{}	`json:"claims,omitempty"` // JWT
 	Method		string			`json:"method,omitempty"`
 	Path		string			`json:"path,omitempty"`
+	Params		map[string]string	`json:"params,omitempty"`
 
 	B		*Body			`json:"-"`
 }
@@ -31,6 +32,7 @@ type Response struct {
 /* FIXME -- import from APIs */
 type Then struct {
 	Call		*ThenCall		`json:"call,omitempty"`
+	Invalidate	*ThenInvalidate		`json:"invalidate,omitempty"`
 }
 
 type ThenCall struct {
@@ -38,6 +40,11 @@ type ThenCall struct {
 	Args		map[string]string	`json:"args"`
 }
 
+type ThenInvalidate struct {
+	Router		string			`json:"router"`
+	Paths		[]string		`json:"paths,omitempty"`
+}
+
 /* FIXME -- share with wdog/runner.go */
 type RunnerRes struct {
 	Res	int
@@ -0,0 +1,119 @@
+//
+// © 2018 SwiftyCloud OÜ. All rights reserved.
+// Info: info@swifty.cloud
+//
+
+import java.io.FileDescriptor;
+import java.io.FileInputStream;
+import java.io.FileOutputStream;
+import java.io.ByteArrayOutputStream;
+import java.io.IOException;
+import java.lang.reflect.Field;
+import java.nio.charset.StandardCharsets;
+import java.util.Map;
+import com.google.gson.Gson;
+
+class Request {
+	public String event;
+	public Map<String, String> args;
+	public String content;
+	public String body;
+	public Map<String, Object> claims;
+	public String method;
+	public String path;
+	public Map<String, String> params;
+}
+
+class Response {
+	public int status;
+	// The "then" thing is here
+}
+
+class RunnerRes {
+	public int res;
+	public String ret;
+	public int status;
+}
+
+class FR
+{
+	static final int chunk = 1024;
+
+	/*
+	 * There's no way to wrap a raw descriptor into a stream, so
+	 * poke the FileDescriptor guts (--add-opens in runner-java.sh)
+	 */
+	static private FileDescriptor queueFd(int n) throws Exception
+	{
+		FileDescriptor fd = new FileDescriptor();
+		Field f = FileDescriptor.class.getDeclaredField("fd");
+		f.setAccessible(true);
+		f.setInt(fd, n);
+		return fd;
+	}
+
+	static private String recv(FileInputStream q) throws IOException
+	{
+		ByteArrayOutputStream msg = new ByteArrayOutputStream();
+		byte[] buf = new byte[chunk];
+
+		while (true) {
+			int l = q.read(buf, 0, chunk);
+			if (l < 0)
+				throw new IOException("Queue closed");
+
+			if (l < chunk) {
+				// Sender pads chunk-aligned messages with zero
+				if (l > 0 && buf[l - 1] == 0)
+					l--;
+				msg.write(buf, 0, l);
+				return new String(msg.toByteArray(), StandardCharsets.UTF_8);
+			}
+
+			msg.write(buf, 0, l);
+		}
+	}
+
+	static private void send(FileOutputStream q, String str) throws IOException
+	{
+		byte[] b = str.getBytes(StandardCharsets.UTF_8);
+		if (b.length % chunk == 0) {
+			byte[] x = new byte[b.length + 1];
+			System.arraycopy(b, 0, x, 0, b.length);
+			b = x;
+		}
+
+		for (int off = 0; off < b.length; off += chunk)
+			q.write(b, off, Math.min(chunk, b.length - off));
+	}
+
+	static public void main(String[] args) throws Exception
+	{
+		Gson gson = new Gson();
+		FileDescriptor fd = queueFd(3);
+		FileInputStream qi = new FileInputStream(fd);
+		FileOutputStream qo = new FileOutputStream(fd);
+
+		while (true) {
+			Request req = gson.fromJson(recv(qi), Request.class);
+			Response resp = new Response();
+			RunnerRes res = new RunnerRes();
+
+			try {
+				Object result = Function.Main(req, resp);
+				res.res = 0;
+				res.ret = gson.toJson(result);
+				res.status = resp.status;
+			} catch (Throwable e) {
+				System.out.println("Exception running FN:");
+				e.printStackTrace();
+				res.res = 1;
+				res.ret = "Exception";
+			}
+
+			System.out.flush();
+			System.err.flush();
+			send(qo, gson.toJson(res));
+		}
+	}
+}
@@ -0,0 +1,77 @@
+<?php
+//
+// © 2018 SwiftyCloud OÜ. All rights reserved.
+// Info: info@swifty.cloud
+//
+
+$swyres = null;
+
+// Tenant's composer packages are at /packages
+if (file_exists('/packages/vendor/autoload.php')) {
+	require '/packages/vendor/autoload.php';
+}
+
+try {
+	require '/function/' . $argv[1] . '.php';
+} catch (Throwable $e) {
+	echo $e, "\n";
+	$swyres = "Error loading script (" . $e->getMessage() . ")";
+}
+
+// Plain stream for the seqpacket socket, no buffering to keep
+// one read/write per packet
+$q = fopen('php://fd/3', 'r+');
+stream_set_read_buffer($q, 0);
+stream_set_write_buffer($q, 0);
+
+function recvmsg($q) {
+	$data = '';
+	while (true) {
+		$c = fread($q, 1024);
+		if ($c === false || $c === '') {
+			exit(1);
+		}
+		if (strlen($c) < 1024) {
+			return $data . rtrim($c, "\0");
+		}
+		$data .= $c;
+	}
+}
+
+function sendmsg($q, $msg) {
+	if (strlen($msg) % 1024 == 0) {
+		$msg .= "\0";
+	}
+	foreach (str_split($msg, 1024) as $c) {
+		fwrite($q, $c);
+	}
+}
+
+while (true) {
+	$req = json_decode(recvmsg($q));
+
+	if ($swyres === null) {
+		if (!isset($req->content)) {
+			$req->content = "text/plain";
+		}
+		if ($req->content == "application/json" && isset($req->body)) {
+			$req->b = json_decode($req->body);
+		}
+
+		try {
+			$ret = Main($req);
+			$res = array("res" => 0, "ret" => json_encode($ret[0]));
+			if (isset($ret[1]) && isset($ret[1]["status"])) {
+				$res["status"] = (int)$ret[1]["status"];
+			}
+		} catch (Throwable $e) {
+			echo "Exception running FN:\n", $e, "\n";
+			$res = array("res" => 1, "ret" => "Exception");
+		}
+	} else {
+		$res = array("res" => 2, "ret" => $swyres);
+	}
+
+	fflush(STDOUT);
+	sendmsg($q, json_encode($res));
+}
@@ -0,0 +1,125 @@
+//
+// © 2018 SwiftyCloud OÜ. All rights reserved.
+// Info: info@swifty.cloud
+//
+
+#![allow(non_snake_case)]
+
+use std::collections::HashMap;
+use std::fs::File;
+use std::io::{self, Read, Write};
+use std::os::unix::io::FromRawFd;
+use std::panic;
+use serde::{Serialize, Deserialize};
+use serde_json::Value;
+
+mod script;
+
+#[derive(Deserialize, Default, Debug)]
+#[serde(default)]
+pub struct Request {
+	pub event: String,
+	pub args: HashMap<String, String>,
+	pub content: String,
+	pub body: String,
+	pub claims: HashMap<String, Value>,
+	pub method: String,
+	pub path: String,
+	pub params: HashMap<String, String>,
+
+	#[serde(skip)]
+	pub b: Option<Value>,
+}
+
+#[derive(Default, Debug)]
+pub struct Response {
+	pub status: i32,
+	// The "then" thing is here
+}
+
+#[derive(Serialize)]
+struct RunnerRes {
+	res: i32,
+	ret: String,
+	status: i32,
+}
+
+const CHUNK: usize = 1024;
+
+fn recv(q: &mut File) -> io::Result<Vec<u8>> {
+	let mut msg = Vec::new();
+	let mut buf = [0u8; CHUNK];
+
+	loop {
+		let mut l = q.read(&mut buf)?;
+		if l == 0 {
+			return Err(io::Error::new(io::ErrorKind::UnexpectedEof, "queue closed"));
+		}
+
+		if l < CHUNK {
+			/* Sender pads chunk-aligned messages with zero */
+			if buf[l - 1] == 0 {
+				l -= 1;
+			}
+			msg.extend_from_slice(&buf[..l]);
+			return Ok(msg);
+		}
+
+		msg.extend_from_slice(&buf[..l]);
+	}
+}
+
+fn send(q: &mut File, mut msg: Vec<u8>) -> io::Result<()> {
+	if msg.len() % CHUNK == 0 {
+		msg.push(0);
+	}
+
+	for c in msg.chunks(CHUNK) {
+		q.write_all(c)?;
+	}
+
+	Ok(())
+}
+
+fn main() {
+	let mut q = unsafe { File::from_raw_fd(3) };
+
+	loop {
+		let data = match recv(&mut q) {
+			Ok(d) => d,
+			Err(e) => {
+				println!("Can't receive message: {}", e);
+				return;
+			}
+		};
+
+		let mut req: Request = match serde_json::from_slice(&data) {
+			Ok(r) => r,
+			Err(e) => {
+				println!("Can't parse request: {}", e);
+				return;
+			}
+		};
+
+		if req.content == "application/json" {
+			req.b = serde_json::from_str(&req.body).ok();
+		}
+
+		let res = match panic::catch_unwind(panic::AssertUnwindSafe(|| script::Main(req))) {
+			Ok((ret, resp)) => RunnerRes {
+				res: 0,
+				ret: serde_json::to_string(&ret).unwrap_or_default(),
+				status: resp.map_or(0, |r| r.status),
+			},
+			Err(_) => {
+				println!("Exception running FN");
+				RunnerRes { res: 1, ret: "Exception".to_string(), status: 0 }
+			}
+		};
+
+		io::stdout().flush().ok();
+		if send(&mut q, serde_json::to_vec(&res).unwrap()).is_err() {
+			return;
+		}
+	}
+}
@@ -18,6 +18,7 @@ struct Request: Codable {
 	var claims: [String:String]?
 	var request: String?
 	var path: String?
+	var params: [String:String]?
 }
 
 struct Result: Codable {
@@ -0,0 +1,95 @@
+/*
+ * © 2018 SwiftyCloud OÜ. All rights reserved.
+ * Info: info@swifty.cloud
+ */
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"net"
+	"os"
+)
+
+func TestProcStatCPU(t *testing.T) {
+	/* utime 150, stime 50 ticks */
+	stat := "42 (py thon) (x)) S 1 42 42 0 -1 4194560 100 0 0 0 150 50 0 0 20 0 1 0 100 1000 10"
+
+	if c := procStatCPU(stat); c != 2 * time.Second {
+		t.Errorf("CPU time is %s", c)
+	}
+
+	if c := procStatCPU("42 (x) S 1"); c != 0 {
+		t.Errorf("short stat gives %s", c)
+	}
+}
+
+func TestProcStatusHWM(t *testing.T) {
+	st := "Name:\tpython\nVmPeak:\t  20000 kB\nVmHWM:\t   12345 kB\nVmRSS:\t   10000 kB\n"
+
+	if kb := procStatusHWM(st); kb != 12345 {
+		t.Errorf("HWM is %d", kb)
+	}
+
+	if kb := procStatusHWM("Name:\tpython\n"); kb != 0 {
+		t.Errorf("missing HWM is %d", kb)
+	}
+}
+
+func TestProcUsageSelf(t *testing.T) {
+	u := procGetUsage(os.Getpid())
+	if u.MaxRSS == 0 {
+		t.Errorf("no peak RSS for self")
+	}
+}
+
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %s", err.Error())
+	}
+
+	var cs [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "sk")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("fileconn: %s", err.Error())
+		}
+		cs[i] = c.(*net.UnixConn)
+	}
+
+	return cs[0], cs[1]
+}
+
+func TestProxyUsage(t *testing.T) {
+	pc, wc := unixPair(t)
+	defer wc.Close()
+
+	go serveUsage(wc, os.Getpid())
+
+	pr := &proxyRunner{rkey: "test", wc: pc, usg: make(chan *procUsage, 1), dead: make(chan struct{})}
+	runner := &Runner{p: pr}
+	go pr.watch(runner)
+
+	u := pr.usage()
+	if u == nil || u.MaxRSS == 0 {
+		t.Fatalf("no usage from the proxied wdog: %v", u)
+	}
+
+	pr.noUsage = true
+	if pr.usage() != nil {
+		t.Errorf("usage from the wdog that doesn't report it")
+	}
+
+	/* No real runner to restart */
+	runner.lock.Lock()
+	pr.wc = nil
+	runner.lock.Unlock()
+
+	pc.Close()
+	<-pr.dead
+}
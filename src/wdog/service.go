@@ -10,6 +10,9 @@ import (
 	"strings"
 	"os/exec"
 	"path/filepath"
+	"io/ioutil"
+	"regexp"
+	"fmt"
 	"os"
 
 	"swifty/common"
@@ -228,3 +231,378 @@ func rubyInfo() (string, []string, error) {
 
 	return string(v), xh.GetLines(ps), nil
 }
+
+func javaInfo() (string, []string, error) {
+	/* Java prints version on stderr */
+	v, err := exec.Command("java", "-version").CombinedOutput()
+	if err != nil {
+		return "", nil, err
+	}
+
+	jars, err := filepath.Glob("/java/runner/*.jar")
+	if err != nil {
+		return "", nil, err
+	}
+
+	ps := []string{}
+	for _, j := range jars {
+		ps = append(ps, strings.TrimSuffix(filepath.Base(j), ".jar"))
+	}
+
+	return string(v), ps, nil
+}
+
+/*
+ * Each package lives in lib/$group/$artifact/$version with all the
+ * jars it needs, builder and runner put them all on classpath. The
+ * repo/ dir is the tenant's maven cache.
+ */
+func javaDir(tenant string) string {
+	return "/java-pkg/" + tenant + "/java"
+}
+
+var mvnPart = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+func mvnSplit(name string) ([]string, error) {
+	gav := strings.Split(name, ":")
+	if len(gav) != 3 || strings.Contains(name, "..") {
+		return nil, errors.New("Package should be group:artifact:version")
+	}
+
+	for _, p := range gav {
+		if !mvnPart.MatchString(p) {
+			return nil, errors.New("Bad package name")
+		}
+	}
+
+	return gav, nil
+}
+
+func javaPackages(tenant string) ([]string, error) {
+	stuff := []string{}
+
+	d := javaDir(tenant) + "/lib/"
+	vs, err := filepath.Glob(d + "*/*/*")
+	if err != nil {
+		return nil, errors.New("Error listing packages")
+	}
+
+	for _, v := range vs {
+		stuff = append(stuff, strings.Replace(strings.TrimPrefix(v, d), "/", ":", -1))
+	}
+
+	return stuff, nil
+}
+
+const mvnPom = `<project xmlns="http://maven.apache.org/POM/4.0.0">
+	<modelVersion>4.0.0</modelVersion>
+	<groupId>swifty</groupId>
+	<artifactId>package</artifactId>
+	<version>1</version>
+	<dependencies>
+		<dependency>
+			<groupId>%s</groupId>
+			<artifactId>%s</artifactId>
+			<version>%s</version>
+		</dependency>
+	</dependencies>
+</project>
+`
+
+func mvnInstall(tenant, name string) error {
+	gav, err := mvnSplit(name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir("", "mvn")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = ioutil.WriteFile(tmp + "/pom.xml", []byte(fmt.Sprintf(mvnPom, gav[0], gav[1], gav[2])), 0600)
+	if err != nil {
+		return err
+	}
+
+	d := javaDir(tenant)
+	cmd := exec.Command("mvn", "-q", "-B", "-f", tmp + "/pom.xml",
+			"-Dmaven.repo.local=" + d + "/repo",
+			"-DoutputDirectory=" + d + "/lib/" + strings.Join(gav, "/"),
+			"-DincludeScope=runtime",
+			"dependency:copy-dependencies")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Errorf("Can't install %s' package %s: %s", tenant, name, string(out))
+		return errors.New("Error installing pkg")
+	}
+
+	return nil
+}
+
+func javaRemove(tenant, name string) error {
+	gav, err := mvnSplit(name)
+	if err != nil {
+		return err
+	}
+
+	d := javaDir(tenant)
+	p := "lib/" + strings.Join(gav, "/")
+	_, err = os.Stat(d + "/" + p)
+	if err != nil {
+		return errors.New("Package not installed")
+	}
+
+	x, err := xh.DropDir(d, p)
+	if err != nil {
+		log.Errorf("Can't remove %s' package %s (%s): %s", tenant, name, x, err.Error())
+		return errors.New("Error removing pkg")
+	}
+
+	return nil
+}
+
+func phpInfo() (string, []string, error) {
+	v, err := exec.Command("php", "--version").Output()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ms, err := exec.Command("php", "-m").Output()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ps := []string{}
+	for _, m := range xh.GetLines(ms) {
+		if m != "" && !strings.HasPrefix(m, "[") {
+			ps = append(ps, m)
+		}
+	}
+
+	return string(v), ps, nil
+}
+
+func composerDir(tenant string) string {
+	return "/packages/" + tenant + "/php"
+}
+
+func composerName(name string) error {
+	if strings.HasPrefix(name, "-") || strings.ContainsAny(name, " \t") {
+		return errors.New("Bad package name")
+	}
+
+	return nil
+}
+
+func composerPackages(tenant string) ([]string, error) {
+	d := composerDir(tenant)
+	_, err := os.Stat(d + "/composer.json")
+	if err != nil {
+		return []string{}, nil
+	}
+
+	out, err := exec.Command("composer", "show", "--direct", "--name-only",
+			"--no-interaction", "--working-dir=" + d).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	ps := []string{}
+	for _, p := range xh.GetLines(out) {
+		if p != "" {
+			ps = append(ps, p)
+		}
+	}
+
+	return ps, nil
+}
+
+func composerInstall(tenant, name string) error {
+	err := composerName(name)
+	if err != nil {
+		return err
+	}
+
+	d := composerDir(tenant)
+	err = os.MkdirAll(d, 0755)
+	if err != nil {
+		return err
+	}
+
+	return exec.Command("composer", "require", "--no-interaction",
+			"--working-dir=" + d, name).Run()
+}
+
+func composerRemove(tenant, name string) error {
+	err := composerName(name)
+	if err != nil {
+		return err
+	}
+
+	return exec.Command("composer", "remove", "--no-interaction",
+			"--working-dir=" + composerDir(tenant), name).Run()
+}
+
+/*
+ * Rust crates are listed in tenant's deps file as Cargo.toml lines
+ * and are vendored next to it, builder makes the runner use them
+ * instead of the crates.io.
+ */
+const rustRunner = "/rust/runner/Cargo.toml.in"
+
+func cargoDir(tenant string) string {
+	return "/rust-pkg/" + tenant + "/rust"
+}
+
+var crateName = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+var crateVer = regexp.MustCompile("^[A-Za-z0-9.*^~=<>, +-]+$")
+
+func cargoDeps(fname string, all bool) ([]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	deps := []string{}
+	in := all
+	for _, l := range xh.GetLines(data) {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "[") {
+			in = (l == "[dependencies]")
+			continue
+		}
+
+		if in && l != "" {
+			deps = append(deps, l)
+		}
+	}
+
+	return deps, nil
+}
+
+func depName(dep string) string {
+	return strings.TrimSpace(strings.SplitN(dep, "=", 2)[0])
+}
+
+func rustInfo() (string, []string, error) {
+	v, err := exec.Command("rustc", "--version").Output()
+	if err != nil {
+		return "", nil, err
+	}
+
+	deps, err := cargoDeps(rustRunner, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ps := []string{}
+	for _, d := range deps {
+		ps = append(ps, depName(d))
+	}
+
+	return string(v), ps, nil
+}
+
+func cargoPackages(tenant string) ([]string, error) {
+	deps, err := cargoDeps(cargoDir(tenant) + "/deps", true)
+	if err != nil {
+		return nil, errors.New("Error listing packages")
+	}
+
+	ps := []string{}
+	for _, d := range deps {
+		v := strings.SplitN(d, "=", 2)
+		if len(v) != 2 {
+			continue
+		}
+		ps = append(ps, depName(d) + ":" + strings.Trim(strings.TrimSpace(v[1]), "\""))
+	}
+
+	return ps, nil
+}
+
+func cargoVendor(tenant string, deps []string) error {
+	d := cargoDir(tenant)
+
+	rdeps, err := ioutil.ReadFile(rustRunner)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(d + "/src", 0755)
+	if err != nil {
+		return err
+	}
+
+	ds := strings.Join(deps, "\n") + "\n"
+	err = ioutil.WriteFile(d + "/Cargo.toml", append(rdeps, []byte(ds)...), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(d + "/src/main.rs", []byte("fn main() {}\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(d + "/Cargo.lock")
+	out, err := exec.Command("cargo", "vendor", "--manifest-path", d + "/Cargo.toml", d + "/vendor").CombinedOutput()
+	if err != nil {
+		log.Errorf("Can't vendor %s' crates: %s", tenant, string(out))
+		return errors.New("Error vendoring crates")
+	}
+
+	return ioutil.WriteFile(d + "/deps", []byte(ds), 0644)
+}
+
+func cargoInstall(tenant, name string) error {
+	nv := strings.SplitN(name, ":", 2)
+	if len(nv) == 1 {
+		nv = append(nv, "*")
+	}
+
+	if !crateName.MatchString(nv[0]) || !crateVer.MatchString(nv[1]) {
+		return errors.New("Package should be crate[:version]")
+	}
+
+	deps, err := cargoDeps(cargoDir(tenant) + "/deps", true)
+	if err != nil {
+		return err
+	}
+
+	nd := []string{}
+	for _, d := range deps {
+		if depName(d) != nv[0] {
+			nd = append(nd, d)
+		}
+	}
+
+	return cargoVendor(tenant, append(nd, nv[0] + " = \"" + nv[1] + "\""))
+}
+
+func cargoRemove(tenant, name string) error {
+	name = strings.SplitN(name, ":", 2)[0]
+
+	deps, err := cargoDeps(cargoDir(tenant) + "/deps", true)
+	if err != nil {
+		return err
+	}
+
+	nd := []string{}
+	for _, d := range deps {
+		if depName(d) != name {
+			nd = append(nd, d)
+		}
+	}
+
+	if len(nd) == len(deps) {
+		return errors.New("Package not installed")
+	}
+
+	return cargoVendor(tenant, nd)
+}
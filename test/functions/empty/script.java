@@ -0,0 +1,12 @@
+import java.util.HashMap;
+import java.util.Map;
+
+class Function
+{
+	static public Object Main(Request req, Response resp)
+	{
+		Map<String, String> ret = new HashMap<>();
+		ret.put("msg", "Hello, world");
+		return ret;
+	}
+}
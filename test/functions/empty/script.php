@@ -0,0 +1,4 @@
+<?php
+function Main($req) {
+	return array("Hello, world", null);
+}
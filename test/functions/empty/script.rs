@@ -0,0 +1,6 @@
+use serde_json::{json, Value};
+use crate::{Request, Response};
+
+pub fn Main(_req: Request) -> (Value, Option<Response>) {
+	(json!("Hello, world"), None)
+}
@@ -0,0 +1,15 @@
+<?php
+function Main($req) {
+	echo "args:\n";
+	var_dump($req->args);
+	echo "content: ", $req->content, "\n";
+	if (isset($req->body)) {
+		echo "body: ", $req->body, "\n";
+	}
+	if (isset($req->b)) {
+		echo "b:\n";
+		var_dump($req->b);
+		return array(array("myname" => "hw:php:" . $req->b->name), array("status" => 201));
+	}
+	return array(array("myname" => "hw:php:" . $req->args->name), array("status" => 201));
+}
@@ -0,0 +1,4 @@
+<?php
+function Main($req) {
+	return array(array("message" => "hw:php:" . $req->args->name), null);
+}
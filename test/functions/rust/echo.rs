@@ -0,0 +1,13 @@
+use serde_json::{json, Value};
+use crate::{Request, Response};
+
+pub fn Main(req: Request) -> (Value, Option<Response>) {
+	println!("req: {:?}", req);
+
+	let name = match req.b {
+		Some(ref b) => b["name"].as_str().unwrap_or("").to_string(),
+		None => req.args.get("name").cloned().unwrap_or_default(),
+	};
+
+	(json!({ "myname": format!("hw:rust:{}", name) }), Some(Response { status: 201 }))
+}
@@ -0,0 +1,7 @@
+use serde_json::{json, Value};
+use crate::{Request, Response};
+
+pub fn Main(req: Request) -> (Value, Option<Response>) {
+	let name = req.args.get("name").cloned().unwrap_or_default();
+	(json!({ "message": format!("hw:rust:{}", name) }), None)
+}
@@ -97,6 +97,9 @@ var langs = map[string]*lDesc {
 	"ruby":   &lDesc{ echo_result: "\"Hello, world\"" },
 	"swift":  &lDesc{ echo_result: "{\"msg\":\"Hello, world\"}" },
 	"csharp": &lDesc{ echo_result: "{\"msg\":\"Hello, world!\"}" },
+	"java":   &lDesc{ echo_result: "{\"msg\":\"Hello, world\"}" },
+	"php":    &lDesc{ echo_result: "\"Hello, world\"" },
+	"rust":   &lDesc{ echo_result: "\"Hello, world\"" },
 }
 
 func runFunctions(cln *swyapi.Client, prj, lang string) {